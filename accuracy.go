@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AccuracyCheck struct {
+	Timestamp   time.Time `json:"timestamp"`
+	NodeName    string    `json:"node_name"`
+	KubeletCpu  int64     `json:"kubelet_cpu"`
+	MetricsCpu  int64     `json:"metrics_server_cpu"`
+	CpuError    float64   `json:"cpu_discrepancy"`
+	KubeletMem  int64     `json:"kubelet_memory"`
+	MetricsMem  int64     `json:"metrics_server_memory"`
+	MemoryError float64   `json:"memory_discrepancy"`
+	// SampleAge is how much older the metrics-server sample is than the
+	// kubelet reading, large values point at a stale metrics-server.
+	SampleAge float64 `json:"sample_age_seconds"`
+}
+
+// latestAccuracy keeps the last check of every node for the Prometheus
+// endpoint.
+var latestAccuracy = struct {
+	sync.Mutex
+	nodes map[string]AccuracyCheck
+}{nodes: make(map[string]AccuracyCheck)}
+
+// checkAccuracy compares the node usage the kubelet reports with the last
+// sample metrics-server delivered for the node. Both come from the same
+// cAdvisor data, so a large discrepancy means metrics-server is stale or
+// misconfigured rather than measuring differently.
+func checkAccuracy(nodeName string, summary *kubeletSummary) {
+	cpu, memory := summary.Node.CPU, summary.Node.Memory
+	if cpu == nil || cpu.UsageNanoCores == nil || memory == nil || memory.WorkingSetBytes == nil {
+		return
+	}
+
+	check := AccuracyCheck{
+		Timestamp:  time.Now(),
+		NodeName:   nodeName,
+		KubeletCpu: int64(*cpu.UsageNanoCores / 1e6),
+		KubeletMem: int64(*memory.WorkingSetBytes),
+	}
+	var timestamp time.Time
+	var sampleTime sql.NullTime
+	err := db.QueryRow(`
+        SELECT timestamp, sample_time, cpu_used, memory_usage
+        FROM metrics
+        WHERE node_name = ?
+          AND source = ?
+          AND cpu_used IS NOT NULL
+        ORDER BY timestamp DESC
+        LIMIT 1
+    `, nodeName, sourceMetricsServer).Scan(&timestamp, &sampleTime, &check.MetricsCpu, &check.MetricsMem)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		slog.Error("Error reading the last sample for the accuracy check", "node", nodeName, "error", err)
+		return
+	}
+	if sampleTime.Valid {
+		timestamp = sampleTime.Time
+	}
+	check.SampleAge = max(0, cpu.Time.Sub(timestamp).Seconds())
+	check.CpuError = discrepancy(check.MetricsCpu, check.KubeletCpu)
+	check.MemoryError = discrepancy(check.MetricsMem, check.KubeletMem)
+
+	if math.Abs(check.CpuError) > cfg.AccuracyThreshold || math.Abs(check.MemoryError) > cfg.AccuracyThreshold {
+		slog.Warn("metrics-server disagrees with the kubelet", "node", nodeName,
+			"cpu_discrepancy", check.CpuError, "memory_discrepancy", check.MemoryError, "sample_age", check.SampleAge)
+	}
+
+	latestAccuracy.Lock()
+	latestAccuracy.nodes[nodeName] = check
+	latestAccuracy.Unlock()
+
+	_, err = db.Exec(
+		`INSERT INTO accuracy_checks (
+            timestamp,
+            node_name,
+            kubelet_cpu,
+            metrics_server_cpu,
+            cpu_discrepancy,
+            kubelet_memory,
+            metrics_server_memory,
+            memory_discrepancy,
+            sample_age_seconds
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		check.Timestamp,
+		check.NodeName,
+		check.KubeletCpu,
+		check.MetricsCpu,
+		check.CpuError,
+		check.KubeletMem,
+		check.MetricsMem,
+		check.MemoryError,
+		check.SampleAge,
+	)
+	if err != nil {
+		slog.Error("Error inserting accuracy check", "node", nodeName, "error", err)
+	}
+}
+
+// discrepancy is how far the metrics-server value is off the kubelet
+// value in percent of the latter.
+func discrepancy(metricsServer, kubelet int64) float64 {
+	if kubelet == 0 {
+		return 0
+	}
+	return float64(metricsServer-kubelet) * 100 / float64(kubelet)
+}
+
+func writeAccuracyMetrics(p promWriter) {
+	latestAccuracy.Lock()
+	defer latestAccuracy.Unlock()
+
+	nodes := sortedKeys(latestAccuracy.nodes)
+	p.family("k8s_collector_accuracy_discrepancy_percent", "gauge", "Deviation of metrics-server from the kubelet in percent, by node and resource.")
+	for _, node := range nodes {
+		check := latestAccuracy.nodes[node]
+		p.sample("k8s_collector_accuracy_discrepancy_percent", check.CpuError, "node", node, "resource", "cpu")
+		p.sample("k8s_collector_accuracy_discrepancy_percent", check.MemoryError, "node", node, "resource", "memory")
+	}
+	p.family("k8s_collector_accuracy_sample_age_seconds", "gauge", "Age of the metrics-server sample compared with the kubelet reading.")
+	for _, node := range nodes {
+		p.sample("k8s_collector_accuracy_sample_age_seconds", latestAccuracy.nodes[node].SampleAge, "node", node)
+	}
+}
+
+// getAccuracyChecks returns the cross-checks of all nodes, or of ?node=,
+// newest first.
+func getAccuracyChecks(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            node_name,
+            kubelet_cpu,
+            metrics_server_cpu,
+            cpu_discrepancy,
+            kubelet_memory,
+            metrics_server_memory,
+            memory_discrepancy,
+            sample_age_seconds
+        FROM accuracy_checks
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	if v := c.Query("node"); v != "" {
+		query += " AND node_name = ?"
+		args = append(args, v)
+	}
+	query += " ORDER BY timestamp DESC, node_name"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	checks := []AccuracyCheck{}
+	for rows.Next() {
+		var a AccuracyCheck
+		err := rows.Scan(
+			&a.Timestamp,
+			&a.NodeName,
+			&a.KubeletCpu,
+			&a.MetricsCpu,
+			&a.CpuError,
+			&a.KubeletMem,
+			&a.MetricsMem,
+			&a.MemoryError,
+			&a.SampleAge,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		checks = append(checks, a)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, checks)
+}
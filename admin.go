@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	rpprof "runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxProfileSeconds = 300
+
+// serveAdmin runs the profiling endpoints on their own listener so they
+// are never reachable through the public API port. Every request needs
+// the admin token as a bearer token. The server stops when ctx is done.
+func serveAdmin(ctx context.Context, addr, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("POST /profiles/cpu", captureCPUProfile)
+	mux.HandleFunc("POST /profiles/heap", captureHeapProfile)
+	mux.HandleFunc("GET /profiles/{name}", downloadProfile)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           requireToken(token, mux),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	slog.Info("Admin endpoints listening", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Admin server stopped", "error", err)
+	}
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasBearerToken reports whether r carries token in its Authorization
+// header. The comparison takes the same time wherever the tokens differ.
+func hasBearerToken(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// captureCPUProfile records a CPU profile for ?seconds (default 30) into
+// the profile directory and returns its name, so it can be fetched later
+// even if the connection that started it is gone.
+func captureCPUProfile(w http.ResponseWriter, r *http.Request) {
+	seconds := 30
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxProfileSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", maxProfileSeconds), http.StatusBadRequest)
+			return
+		}
+		seconds = n
+	}
+
+	name, f, err := createProfile("cpu")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if err := rpprof.StartCPUProfile(f); err != nil {
+		os.Remove(f.Name())
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	time.Sleep(time.Duration(seconds) * time.Second)
+	rpprof.StopCPUProfile()
+
+	fmt.Fprintln(w, name)
+}
+
+func captureHeapProfile(w http.ResponseWriter, r *http.Request) {
+	name, f, err := createProfile("heap")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if err := rpprof.Lookup("heap").WriteTo(f, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, name)
+}
+
+func createProfile(kind string) (string, *os.File, error) {
+	if err := os.MkdirAll(cfg.ProfileDir, 0o700); err != nil {
+		return "", nil, err
+	}
+	name := fmt.Sprintf("%s-%s.pprof", kind, time.Now().UTC().Format("20060102T150405Z"))
+	f, err := os.Create(filepath.Join(cfg.ProfileDir, name))
+	return name, f, err
+}
+
+func downloadProfile(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".pprof") {
+		http.Error(w, "invalid profile name", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, filepath.Join(cfg.ProfileDir, name))
+}
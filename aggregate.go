@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// zoneLabels are the node labels holding the zone, the GA label first.
+var zoneLabels = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+// AggregateGroup is the pod usage of one group, summed over its pods per
+// tick and then averaged and maxed over the ticks the group has samples in.
+type AggregateGroup struct {
+	Group     string  `json:"group"`
+	Samples   int     `json:"samples"`
+	AvgPods   float64 `json:"avg_pods"`
+	AvgCpu    float64 `json:"avg_cpu"`
+	MaxCpu    int64   `json:"max_cpu"`
+	AvgMemory float64 `json:"avg_memory"`
+	MaxMemory int64   `json:"max_memory"`
+}
+
+// aggregateTick is the usage of one group at one tick.
+type aggregateTick struct {
+	pods   int
+	cpu    int64
+	memory int64
+}
+
+// getAggregate pivots the pod metrics by group_by, one of namespace, node,
+// zone or label:<key>, so clients don't have to join the pod and node
+// endpoints themselves. zone is the topology zone of the pod's node and
+// label:<key> a label of the pod. Both are looked up in the Kubernetes API
+// when the query runs, so pods and nodes gone since, or without the label,
+// fall in the group "".
+func getAggregate(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	groupBy := c.DefaultQuery("group_by", "namespace")
+	labelKey, byLabel := strings.CutPrefix(groupBy, "label:")
+	var columns []string
+	switch {
+	case groupBy == "namespace":
+		columns = []string{"namespace"}
+	case groupBy == "node", groupBy == "zone":
+		columns = []string{"node_name"}
+	case byLabel && labelKey != "":
+		columns = []string{"namespace", "pod_name"}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_by must be namespace, node, zone or label:<key>"})
+		return
+	}
+	if (groupBy == "zone" || byLabel) && clientset == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "group_by=" + groupBy + " needs the Kubernetes API"})
+		return
+	}
+
+	query := `
+        SELECT timestamp, ` + strings.Join(columns, ", ") + `, COUNT(*), SUM(cpu_usage), SUM(memory_usage)
+        FROM pod_metrics
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	for param, column := range map[string]string{"namespace": "namespace", "node": "node_name"} {
+		if v := c.Query(param); v != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	query, args = scopeNamespaces(c, query, args)
+	query += " GROUP BY timestamp, " + strings.Join(columns, ", ")
+
+	var groupOf func(keys []string) string
+	switch {
+	case groupBy == "zone":
+		zones, err := nodeZones(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		groupOf = func(keys []string) string { return zones[keys[0]] }
+	case byLabel:
+		labels, err := podLabels(c, labelKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		groupOf = func(keys []string) string { return labels[keys[0]+"/"+keys[1]] }
+	default:
+		groupOf = func(keys []string) string { return keys[0] }
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	ticks := make(map[string]map[int64]*aggregateTick)
+	keys := make([]string, len(columns))
+	for rows.Next() {
+		var timestamp time.Time
+		var pods int
+		var cpu, memory int64
+		dest := []any{&timestamp}
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		if err := rows.Scan(append(dest, &pods, &cpu, &memory)...); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		group := groupOf(keys)
+		if ticks[group] == nil {
+			ticks[group] = make(map[int64]*aggregateTick)
+		}
+		t := ticks[group][timestamp.UnixNano()]
+		if t == nil {
+			t = &aggregateTick{}
+			ticks[group][timestamp.UnixNano()] = t
+		}
+		t.pods += pods
+		t.cpu += cpu
+		t.memory += memory
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	groups := []AggregateGroup{}
+	for group, groupTicks := range ticks {
+		g := AggregateGroup{Group: group, Samples: len(groupTicks)}
+		var pods, cpu, memory float64
+		for _, t := range groupTicks {
+			pods += float64(t.pods)
+			cpu += float64(t.cpu)
+			memory += float64(t.memory)
+			g.MaxCpu = max(g.MaxCpu, t.cpu)
+			g.MaxMemory = max(g.MaxMemory, t.memory)
+		}
+		n := float64(len(groupTicks))
+		g.AvgPods = pods / n
+		g.AvgCpu = cpu / n
+		g.AvgMemory = memory / n
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Group < groups[j].Group })
+
+	respond(c, http.StatusOK, groups)
+}
+
+// nodeZones maps the nodes to their zone.
+func nodeZones(c *gin.Context) (map[string]string, error) {
+	nodes, err := clientset.CoreV1().Nodes().List(c.Request.Context(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	zones := make(map[string]string, len(nodes.Items))
+	for _, node := range nodes.Items {
+		for _, label := range zoneLabels {
+			if v := node.Labels[label]; v != "" {
+				zones[node.Name] = v
+				break
+			}
+		}
+	}
+	return zones, nil
+}
+
+// podLabels maps namespace/name of the pods to their label key, limited to
+// the namespace of the request if it names one.
+func podLabels(c *gin.Context, key string) (map[string]string, error) {
+	pods, err := clientset.CoreV1().Pods(c.Query("namespace")).List(c.Request.Context(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, len(pods.Items))
+	for _, pod := range pods.Items {
+		if v, ok := pod.Labels[key]; ok {
+			labels[pod.Namespace+"/"+pod.Name] = v
+		}
+	}
+	return labels, nil
+}
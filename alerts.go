@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Alert rules watch the cluster on every alert-interval and benchmark
+// assertions check every run when it stops. Both are read from the JSON
+// file named by alert-rules, e.g.
+//
+//	{
+//	  "alerts": [
+//	    {"name": "cluster-cpu-saturated", "metric": "cluster_cpu_usage", "above": 90, "for": "5m", "severity": "critical", "issue": true},
+//	    {"name": "collection-down", "metric": "collection_age", "above": 120, "severity": "critical"}
+//	  ],
+//	  "benchmarks": [
+//	    {"name": "checkout-budget", "select": "label.workload == \"checkout\"", "max": {"avg_cpu": 60}, "fail_on_outlier": true, "issue": true}
+//	  ]
+//	}
+//
+// With "issue" set, a firing rule or a failed assertion opens an issue in
+// the issue-tracker. Rules with the severity "critical" also page through
+// PagerDuty or Opsgenie.
+
+const (
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertMetrics are what alert rules can watch: the cluster CPU and memory
+// usage in percent of allocatable, and the seconds since the last
+// successful collection.
+var alertMetrics = map[string]func(latest []MetricsData, age time.Duration) (float64, bool){
+	"cluster_cpu_usage": func(latest []MetricsData, _ time.Duration) (float64, bool) {
+		if len(latest) == 0 {
+			return 0, false
+		}
+		return latest[0].ClusterCpuUsage, true
+	},
+	"cluster_memory_usage": func(latest []MetricsData, _ time.Duration) (float64, bool) {
+		if len(latest) == 0 {
+			return 0, false
+		}
+		return latest[0].ClusterMemoryUsagePercent, true
+	},
+	"collection_age": func(_ []MetricsData, age time.Duration) (float64, bool) {
+		return age.Seconds(), true
+	},
+}
+
+// assertionMetrics are the run statistics a benchmark assertion can bound.
+var assertionMetrics = map[string]func(*RunStats) float64{
+	"avg_cpu":    func(s *RunStats) float64 { return s.AvgCpu },
+	"max_cpu":    func(s *RunStats) float64 { return s.MaxCpu },
+	"avg_memory": func(s *RunStats) float64 { return s.AvgMemory },
+	"max_memory": func(s *RunStats) float64 { return float64(s.MaxMemory) },
+}
+
+// AlertRule fires when Metric stays above Above for For.
+type AlertRule struct {
+	Name     string  `json:"name"`
+	Metric   string  `json:"metric"`
+	Above    float64 `json:"above"`
+	For      string  `json:"for,omitempty"`
+	Severity string  `json:"severity,omitempty"`
+	// Issue opens an issue in the issue-tracker when the rule fires.
+	Issue bool `json:"issue,omitempty"`
+
+	hold time.Duration
+}
+
+// BenchmarkAssertion bounds the cluster statistics of the runs Select
+// matches, and with FailOnOutlier fails runs far outside their prior runs.
+type BenchmarkAssertion struct {
+	Name          string             `json:"name"`
+	Select        string             `json:"select,omitempty"`
+	Max           map[string]float64 `json:"max,omitempty"`
+	FailOnOutlier bool               `json:"fail_on_outlier,omitempty"`
+	Issue         bool               `json:"issue,omitempty"`
+
+	sel runSelector
+}
+
+type alertConfig struct {
+	Alerts     []AlertRule          `json:"alerts"`
+	Benchmarks []BenchmarkAssertion `json:"benchmarks"`
+}
+
+var alertRules alertConfig
+
+// loadAlertRules reads and checks the alert-rules file.
+func loadAlertRules(path string) (alertConfig, error) {
+	var rules alertConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, err
+	}
+	names := make(map[string]bool)
+	for i := range rules.Alerts {
+		rule := &rules.Alerts[i]
+		if rule.Name == "" || names[rule.Name] {
+			return rules, errors.New("every alert rule needs a unique name")
+		}
+		names[rule.Name] = true
+		if _, ok := alertMetrics[rule.Metric]; !ok {
+			return rules, fmt.Errorf("alert rule %s: metric must be cluster_cpu_usage, cluster_memory_usage or collection_age", rule.Name)
+		}
+		if rule.For != "" {
+			if rule.hold, err = time.ParseDuration(rule.For); err != nil || rule.hold < 0 {
+				return rules, fmt.Errorf("alert rule %s: invalid for %q", rule.Name, rule.For)
+			}
+		}
+	}
+	for i := range rules.Benchmarks {
+		assertion := &rules.Benchmarks[i]
+		if assertion.Name == "" {
+			return rules, errors.New("every benchmark assertion needs a name")
+		}
+		if assertion.sel, err = parseRunSelector(assertion.Select); err != nil {
+			return rules, fmt.Errorf("benchmark assertion %s: invalid select: %w", assertion.Name, err)
+		}
+		for metric := range assertion.Max {
+			if _, ok := assertionMetrics[metric]; !ok {
+				return rules, fmt.Errorf("benchmark assertion %s: max %s must be avg_cpu, max_cpu, avg_memory or max_memory", assertion.Name, metric)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Alert is the state of an alert rule. Rules that are neither pending nor
+// firing have no alert.
+type Alert struct {
+	Rule     string    `json:"rule"`
+	Metric   string    `json:"metric"`
+	Severity string    `json:"severity,omitempty"`
+	Above    float64   `json:"above"`
+	Value    float64   `json:"value"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`
+	Issue    string    `json:"issue,omitempty"`
+}
+
+var (
+	alertsMu sync.Mutex
+	alerts   = make(map[string]*Alert)
+)
+
+// loadFiringAlerts restores the alerts that were firing when the
+// collector stopped, so a restart doesn't notify about them again.
+func loadFiringAlerts() error {
+	rows, err := db.Query("SELECT rule, value, since, issue FROM alerts")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a := &Alert{State: alertFiring}
+		if err := rows.Scan(&a.Rule, &a.Value, &a.Since, &a.Issue); err != nil {
+			return err
+		}
+		for _, rule := range alertRules.Alerts {
+			if rule.Name == a.Rule {
+				a.Metric, a.Severity, a.Above = rule.Metric, rule.Severity, rule.Above
+				alerts[a.Rule] = a
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// evaluateAlerts checks the alert rules on every interval until ctx is
+// done.
+func evaluateAlerts(ctx context.Context, interval time.Duration) {
+	if err := loadFiringAlerts(); err != nil {
+		slog.Error("Error loading firing alerts", "error", err)
+	}
+	started := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		latest, err := store.LatestSamples()
+		if err != nil {
+			slog.Error("Error evaluating alert rules", "error", err)
+			continue
+		}
+		last := started
+		if t := lastCollection.Load(); t != 0 {
+			last = time.Unix(0, t)
+		}
+		now := time.Now()
+		for _, rule := range alertRules.Alerts {
+			value, ok := alertMetrics[rule.Metric](latest, now.Sub(last))
+			if ok {
+				evaluateRule(ctx, rule, value, now)
+			}
+		}
+	}
+}
+
+// evaluateRule moves the alert of a rule through pending, firing and
+// resolved and notifies on the transitions to firing and resolved.
+func evaluateRule(ctx context.Context, rule AlertRule, value float64, now time.Time) {
+	alertsMu.Lock()
+	a := alerts[rule.Name]
+	breached := value > rule.Above
+	switch {
+	case breached && a == nil:
+		a = &Alert{Rule: rule.Name, Metric: rule.Metric, Severity: rule.Severity, Above: rule.Above, State: alertPending, Since: now}
+		alerts[rule.Name] = a
+	case !breached && a != nil:
+		delete(alerts, rule.Name)
+	}
+	if a == nil {
+		alertsMu.Unlock()
+		return
+	}
+	a.Value = value
+	fire := breached && a.State == alertPending && now.Sub(a.Since) >= rule.hold
+	resolve := !breached && a.State == alertFiring
+	if fire {
+		a.State = alertFiring
+		a.Since = now
+	}
+	if resolve {
+		a.State = alertResolved
+		a.Since = now
+	}
+	alert := *a
+	alertsMu.Unlock()
+
+	switch {
+	case fire:
+		slog.Warn("Alert firing", "rule", rule.Name, "metric", rule.Metric, "value", value, "above", rule.Above)
+		if rule.Issue && cfg.IssueTracker != "" {
+			issue, err := fileAlertIssue(ctx, alert)
+			if err != nil {
+				slog.Error("Error opening issue", "rule", rule.Name, "error", err)
+			}
+			alert.Issue = issue
+			alertsMu.Lock()
+			if a := alerts[rule.Name]; a != nil {
+				a.Issue = issue
+			}
+			alertsMu.Unlock()
+		}
+		routeAlert(ctx, alert)
+		_, err := db.Exec("INSERT INTO alerts (rule, value, since, issue) VALUES (?, ?, ?, ?)", alert.Rule, alert.Value, alert.Since, alert.Issue)
+		if err != nil {
+			slog.Error("Error storing alert", "rule", rule.Name, "error", err)
+		}
+	case resolve:
+		slog.Info("Alert resolved", "rule", rule.Name, "metric", rule.Metric, "value", value)
+		routeAlert(ctx, alert)
+		if _, err := db.Exec("DELETE FROM alerts WHERE rule = ?", rule.Name); err != nil {
+			slog.Error("Error removing alert", "rule", rule.Name, "error", err)
+		}
+	}
+}
+
+// getAlerts returns the pending and firing alerts.
+func getAlerts(c *gin.Context) {
+	alertsMu.Lock()
+	list := []Alert{}
+	for _, a := range alerts {
+		list = append(list, *a)
+	}
+	alertsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Rule < list[j].Rule })
+	respond(c, http.StatusOK, list)
+}
+
+// checkBenchmarkAssertions checks a finished run against the assertions
+// whose selector matches it, reading the run and its prior runs from one
+// snapshot.
+func checkBenchmarkAssertions(run BenchmarkRun) {
+	view, release, err := snapshotView(context.Background())
+	if err != nil {
+		slog.Error("Error checking benchmark assertions", "benchmark", run.Name, "error", err)
+		return
+	}
+	defer release()
+
+	var samples []MetricsData
+	var loaded bool
+	for _, assertion := range alertRules.Benchmarks {
+		if !assertion.sel(&run) {
+			continue
+		}
+		if !loaded {
+			var err error
+			if samples, err = benchmarkSamples(view, run); err != nil {
+				slog.Error("Error checking benchmark assertions", "benchmark", run.Name, "error", err)
+				return
+			}
+			loaded = true
+		}
+		failures, outliers, err := assertBenchmark(view, assertion, run, samples)
+		if err != nil {
+			slog.Error("Error checking benchmark assertions", "benchmark", run.Name, "assertion", assertion.Name, "error", err)
+			continue
+		}
+		if len(failures) == 0 {
+			continue
+		}
+		slog.Warn("Benchmark failed its assertions", "benchmark", run.Name, "assertion", assertion.Name, "failures", failures)
+		if assertion.Issue && cfg.IssueTracker != "" {
+			if _, err := fileBenchmarkIssue(context.Background(), run, samples, assertion.Name, failures, outliers); err != nil {
+				slog.Error("Error opening issue", "benchmark", run.Name, "assertion", assertion.Name, "error", err)
+			}
+		}
+	}
+}
+
+// assertBenchmark returns why a run fails an assertion, if it does.
+func assertBenchmark(view readView, assertion BenchmarkAssertion, run BenchmarkRun, samples []MetricsData) ([]string, []RunOutlier, error) {
+	var failures []string
+	cluster := summarizeRun(run.Name, samples).cluster
+	if cluster == nil && len(assertion.Max) > 0 {
+		failures = append(failures, "the run has no samples")
+	}
+	if cluster != nil {
+		metrics := make([]string, 0, len(assertion.Max))
+		for metric := range assertion.Max {
+			metrics = append(metrics, metric)
+		}
+		sort.Strings(metrics)
+		for _, metric := range metrics {
+			if value := assertionMetrics[metric](cluster); value > assertion.Max[metric] {
+				failures = append(failures, fmt.Sprintf("%s is %.2f, above the maximum of %.2f", metric, value, assertion.Max[metric]))
+			}
+		}
+	}
+	var outliers []RunOutlier
+	if assertion.FailOnOutlier {
+		var err error
+		if outliers, err = checkPriorRuns(view, run, samples); err != nil {
+			return nil, nil, err
+		}
+		for _, o := range outliers {
+			failures = append(failures, fmt.Sprintf("%s is %.2f, %.1f standard deviations from the mean of %d prior runs", o.Metric, o.Value, o.ZScore, o.History))
+		}
+	}
+	return failures, outliers, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// reviewCacheTTL is how long the outcome of a TokenReview and
+// SubjectAccessReview is reused, so a polling dashboard doesn't cost two
+// API requests per query.
+const reviewCacheTTL = time.Minute
+
+// maxCachedReviews bounds the cache against callers with many tokens.
+const maxCachedReviews = 10000
+
+type accessReview struct {
+	authenticated bool
+	allowed       bool
+	expires       time.Time
+}
+
+var reviewCache = struct {
+	sync.Mutex
+	entries map[string]accessReview
+}{entries: make(map[string]accessReview)}
+
+// reviewAccess authenticates a ServiceAccount or user token with a
+// TokenReview and asks the API server with a SubjectAccessReview whether
+// its owner may use verb on the non-resource URL path. Access is granted
+// with RBAC rules like nonResourceURLs: ["/metrics", "/metrics/*"].
+func reviewAccess(ctx context.Context, token, path, verb string) (authenticated, allowed bool, err error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:]) + " " + verb + " " + path
+
+	reviewCache.Lock()
+	cached, ok := reviewCache.entries[key]
+	reviewCache.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.authenticated, cached.allowed, nil
+	}
+
+	review := accessReview{expires: time.Now().Add(reviewCacheTTL)}
+	tokenReview, err := clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, false, err
+	}
+	if review.authenticated = tokenReview.Status.Authenticated; review.authenticated {
+		user := tokenReview.Status.User
+		extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+		for k, v := range user.Extra {
+			extra[k] = authorizationv1.ExtraValue(v)
+		}
+		accessReview, err := clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:   user.Username,
+				UID:    user.UID,
+				Groups: user.Groups,
+				Extra:  extra,
+				NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+					Path: path,
+					Verb: verb,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return false, false, err
+		}
+		review.allowed = accessReview.Status.Allowed
+	}
+
+	reviewCache.Lock()
+	if len(reviewCache.entries) >= maxCachedReviews {
+		reviewCache.entries = make(map[string]accessReview)
+	}
+	reviewCache.entries[key] = review
+	reviewCache.Unlock()
+	return review.authenticated, review.allowed, nil
+}
+
+// rbacVerb maps an HTTP method to the verb RBAC uses for non-resource URLs.
+func rbacVerb(method string) string {
+	if method == http.MethodHead {
+		return "get"
+	}
+	return strings.ToLower(method)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When the collector was down, metrics-server has nothing of the gap left
+// to collect once it is back, and a benchmark timeline spanning it would
+// have a hole. With backfill-prometheus-url set, startup fills the gap
+// since the last collected tick with one coarse sample per node and
+// backfill-step from the Prometheus that scraped the cluster meanwhile.
+// The samples have source prometheus-backfill, so they can be told apart
+// from and filtered out of the collected ones.
+//
+// The CPU query must return the cores and the memory query the bytes in
+// use of every node, labelled with the node name in "node". The capacity
+// and allocatable of a node are taken from its last collected sample,
+// nodes that joined during the gap are left out.
+//
+// Backfilled samples are stored on a grid of backfill-step, so filling the
+// same gap again, after a crash before the first tick, stores nothing twice.
+
+const (
+	sourceBackfill = "prometheus-backfill"
+
+	// backfillPoints bounds the points of one range query below the
+	// 11000 Prometheus allows per series.
+	backfillPoints = 10000
+)
+
+// backfillGap is the period to backfill and the last collected sample of
+// every node before it.
+type backfillGap struct {
+	from, to time.Time
+	nodes    map[string]MetricsData
+}
+
+// findBackfillGap returns the gap between the last collected tick and now,
+// at most backfill-max-gap of it, or false if there is none. It must run
+// before collection starts.
+func findBackfillGap(now time.Time) (backfillGap, bool) {
+	latest, err := store.LatestSamples()
+	if err != nil {
+		slog.Error("Error finding the collection gap to backfill", "error", err)
+		return backfillGap{}, false
+	}
+	if len(latest) == 0 {
+		return backfillGap{}, false
+	}
+	gap := backfillGap{
+		from:  latest[0].Timestamp.Truncate(cfg.BackfillStep).Add(cfg.BackfillStep),
+		to:    now,
+		nodes: make(map[string]MetricsData),
+	}
+	if earliest := now.Add(-cfg.BackfillMaxGap).Truncate(cfg.BackfillStep); gap.from.Before(earliest) {
+		gap.from = earliest
+	}
+	// A gap of a tick or two is a restart, not downtime
+	if gap.to.Sub(gap.from) < 2*cfg.CollectInterval {
+		return backfillGap{}, false
+	}
+	for _, m := range latest {
+		gap.nodes[m.NodeName] = m
+	}
+	return gap, true
+}
+
+// backfill stores the samples of the gap, one range query at a time.
+func backfill(ctx context.Context, gap backfillGap) {
+	slog.Info("Backfilling the collection gap from Prometheus", "from", gap.from, "to", gap.to)
+	client := &http.Client{Timeout: time.Minute}
+	var stored int
+	chunk := backfillPoints * cfg.BackfillStep
+	for from := gap.from; from.Before(gap.to); from = from.Add(chunk) {
+		to := from.Add(chunk - cfg.BackfillStep)
+		if to.After(gap.to) {
+			to = gap.to
+		}
+		samples, err := backfillSamples(ctx, client, gap.nodes, from, to)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error backfilling from Prometheus", "from", from, "to", to, "error", err)
+			}
+			return
+		}
+		if err := store.InsertSamples(samples); err != nil {
+			slog.Error("Error storing backfilled samples", "error", err)
+			return
+		}
+		stored += len(samples)
+	}
+	slog.Info("Backfilled the collection gap", "samples", stored)
+}
+
+// backfillSamples queries the usage of every node between from and to and
+// turns it into samples like the collected ones.
+func backfillSamples(ctx context.Context, client *http.Client, nodes map[string]MetricsData, from, to time.Time) ([]MetricsData, error) {
+	cpu, err := queryPrometheusRange(ctx, client, cfg.BackfillCPUQuery, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("CPU query: %w", err)
+	}
+	memory, err := queryPrometheusRange(ctx, client, cfg.BackfillMemoryQuery, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("memory query: %w", err)
+	}
+
+	var samples []MetricsData
+	for t := from; !t.After(to); t = t.Add(cfg.BackfillStep) {
+		key := t.Unix()
+		var tick []MetricsData
+		var clusterTotalCPU, clusterAllocatableCPU, clusterUsedCPU int64
+		var clusterTotalMemory, clusterAllocatableMemory, clusterUsedMemory int64
+		for name, last := range nodes {
+			cores, okCPU := cpu[name][key]
+			bytes, okMemory := memory[name][key]
+			if !okCPU || !okMemory {
+				continue
+			}
+			used := int64(cores * 1000)
+			usedMemory := int64(bytes)
+			clusterTotalCPU += last.NodeTotalCpu
+			clusterAllocatableCPU += last.NodeAllocatableCpu
+			clusterUsedCPU += used
+			clusterTotalMemory += last.NodeTotalMemory
+			clusterAllocatableMemory += last.NodeAllocatableMemory
+			clusterUsedMemory += usedMemory
+			tick = append(tick, MetricsData{
+				Timestamp:             t.Local(),
+				SampleTime:            t.Local(),
+				Window:                cfg.BackfillStep.Seconds(),
+				NodeName:              name,
+				NodeGroup:             last.NodeGroup,
+				CpuUsage:              percentOf(used, last.NodeAllocatableCpu),
+				MemoryUsage:           usedMemory,
+				Source:                sourceBackfill,
+				CpuUsed:               used,
+				NodeTotalCpu:          last.NodeTotalCpu,
+				NodeAllocatableCpu:    last.NodeAllocatableCpu,
+				MemoryUsagePercent:    percentOf(usedMemory, last.NodeAllocatableMemory),
+				NodeTotalMemory:       last.NodeTotalMemory,
+				NodeAllocatableMemory: last.NodeAllocatableMemory,
+			})
+		}
+		for i := range tick {
+			tick[i].ClusterCpuUsage = percentOf(clusterUsedCPU, clusterAllocatableCPU)
+			tick[i].ClusterTotalCpu = clusterTotalCPU
+			tick[i].ClusterUsedCpu = clusterUsedCPU
+			tick[i].ClusterAllocatableCpu = clusterAllocatableCPU
+			tick[i].ClusterMemoryUsagePercent = percentOf(clusterUsedMemory, clusterAllocatableMemory)
+			tick[i].ClusterMemoryUsage = clusterUsedMemory
+			tick[i].ClusterTotalMemory = clusterTotalMemory
+			tick[i].ClusterAllocatableMemory = clusterAllocatableMemory
+			tick[i].Headroom = headroom(clusterAllocatableCPU-clusterUsedCPU, clusterAllocatableMemory-clusterUsedMemory)
+		}
+		samples = append(samples, tick...)
+	}
+	return samples, nil
+}
+
+// queryPrometheusRange evaluates query from from to to every backfill-step
+// and returns the values by node and Unix time.
+func queryPrometheusRange(ctx context.Context, client *http.Client, query string, from, to time.Time) (map[string]map[int64]float64, error) {
+	params := url.Values{
+		"query": {query},
+		"start": {strconv.FormatInt(from.Unix(), 10)},
+		"end":   {strconv.FormatInt(to.Unix(), 10)},
+		"step":  {strconv.FormatFloat(cfg.BackfillStep.Seconds(), 'f', -1, 64)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(cfg.BackfillPrometheusURL, "/")+"/api/v1/query_range?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BackfillPrometheusToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.BackfillPrometheusToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Values [][2]any          `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response, %s: %w", resp.Status, err)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("%s: %s", resp.Status, result.Error)
+	}
+
+	values := make(map[string]map[int64]float64)
+	for _, series := range result.Data.Result {
+		node := series.Metric["node"]
+		if node == "" {
+			continue
+		}
+		if values[node] == nil {
+			values[node] = make(map[int64]float64)
+		}
+		for _, point := range series.Values {
+			at, ok := point[0].(float64)
+			text, isText := point[1].(string)
+			if !ok || !isText {
+				return nil, fmt.Errorf("invalid point %v of node %s", point, node)
+			}
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q of node %s", text, node)
+			}
+			if math.IsNaN(value) {
+				continue
+			}
+			values[node][int64(at)] = value
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BenchmarkRun struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Start       time.Time         `json:"start"`
+	End         *time.Time        `json:"end,omitempty"`
+	Samples     int64             `json:"samples,omitempty"`
+	// CollectorVersion is the build of the collector that recorded the run.
+	CollectorVersion string `json:"collector_version,omitempty"`
+}
+
+var errRunNotFound = errors.New("benchmark run not found")
+
+// benchmarkMu serializes starting and stopping runs so two requests can't
+// both open one.
+var benchmarkMu sync.Mutex
+
+const benchmarkRunColumns = `
+            id,
+            name,
+            description,
+            labels,
+            start_time,
+            end_time,
+            COALESCE(collector_version, '')`
+
+func scanBenchmarkRun(row interface{ Scan(...any) error }) (*BenchmarkRun, error) {
+	var run BenchmarkRun
+	var labels string
+	var end sql.NullTime
+	err := row.Scan(&run.ID, &run.Name, &run.Description, &labels, &run.Start, &end, &run.CollectorVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errRunNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(labels), &run.Labels); err != nil {
+		return nil, err
+	}
+	if end.Valid {
+		run.End = &end.Time
+	}
+	return &run, nil
+}
+
+func loadBenchmarkRun(q rowQuerier, name string) (*BenchmarkRun, error) {
+	return scanBenchmarkRun(q.QueryRow(`
+        SELECT`+benchmarkRunColumns+`
+        FROM benchmark_runs
+        WHERE name = ?
+    `, name))
+}
+
+// runningBenchmark returns the run that has not been stopped yet, if any.
+// It is kept in the database so a restart doesn't lose an open run.
+func runningBenchmark() (*BenchmarkRun, error) {
+	run, err := scanBenchmarkRun(db.QueryRow(`
+        SELECT` + benchmarkRunColumns + `
+        FROM benchmark_runs
+        WHERE end_time IS NULL
+    `))
+	if errors.Is(err, errRunNotFound) {
+		return nil, nil
+	}
+	return run, err
+}
+
+// startBenchmark opens a named benchmark run. Samples are assigned to the
+// run when it is stopped, so a run covers whatever was collected in
+// between.
+func startBenchmark(c *gin.Context) {
+	var run BenchmarkRun
+	if err := c.ShouldBindJSON(&run); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if run.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	benchmarkMu.Lock()
+	defer benchmarkMu.Unlock()
+
+	running, err := runningBenchmark()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if running != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "benchmark " + running.Name + " is already running"})
+		return
+	}
+	if _, err := loadBenchmarkRun(db, run.Name); !errors.Is(err, errRunNotFound) {
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "a benchmark named " + run.Name + " already exists"})
+		return
+	}
+
+	labels, _ := json.Marshal(run.Labels)
+	run.Start = time.Now()
+	run.CollectorVersion = versionString()
+	err = db.QueryRow(
+		`INSERT INTO benchmark_runs (
+            name,
+            description,
+            labels,
+            start_time,
+            collector_version
+        ) VALUES (?, ?, ?, ?, ?)
+        RETURNING id`,
+		run.Name,
+		run.Description,
+		string(labels),
+		run.Start,
+		run.CollectorVersion,
+	).Scan(&run.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusCreated, run)
+}
+
+// stopBenchmark closes the running benchmark and assigns every sample
+// collected during it to the run. With smtp-addr set, the summary of the
+// run is emailed to the report-recipients.
+func stopBenchmark(c *gin.Context) {
+	benchmarkMu.Lock()
+	defer benchmarkMu.Unlock()
+
+	run, err := runningBenchmark()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if run == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "no benchmark is running"})
+		return
+	}
+
+	end := time.Now()
+	run.End = &end
+	run.Samples, err = store.MarkBenchmark(run.ID, run.Start, end)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = db.Exec("UPDATE benchmark_runs SET end_time = ? WHERE id = ?", end, run.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if cfg.SMTPAddr != "" {
+		go mailBenchmark(*run)
+	}
+	if cfg.SheetsSpreadsheet != "" {
+		queueSheetRun(*run)
+	}
+	if len(alertRules.Benchmarks) > 0 {
+		go checkBenchmarkAssertions(*run)
+	}
+
+	respond(c, http.StatusOK, run)
+}
+
+// listBenchmarkRuns returns the runs the selector matches, oldest first.
+func listBenchmarkRuns(q rowQuerier, sel runSelector) ([]BenchmarkRun, error) {
+	rows, err := q.Query(`
+        SELECT` + benchmarkRunColumns + `
+        FROM benchmark_runs
+        ORDER BY start_time
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []BenchmarkRun{}
+	for rows.Next() {
+		run, err := scanBenchmarkRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		if sel(run) {
+			runs = append(runs, *run)
+		}
+	}
+	return runs, rows.Err()
+}
+
+// getBenchmarkRuns lists the runs, or with ?select= the ones the run
+// selector matches.
+func getBenchmarkRuns(c *gin.Context) {
+	sel, err := parseRunSelector(c.Query("select"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid select: " + err.Error()})
+		return
+	}
+	runs, err := listBenchmarkRuns(db, sel)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, runs)
+}
+
+// BenchmarkRunDetail is a run with the metrics it is an outlier in
+// compared with its prior runs, once it finished.
+type BenchmarkRunDetail struct {
+	BenchmarkRun
+	Outliers []RunOutlier `json:"outliers,omitempty"`
+}
+
+// getBenchmarkRun returns a run. A finished one is checked against its
+// prior runs with the same labels, read from the same snapshot.
+func getBenchmarkRun(c *gin.Context) {
+	view, release, err := snapshotView(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	run, err := loadBenchmarkRun(view.q, c.Param("name"))
+	if errors.Is(err, errRunNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	detail := BenchmarkRunDetail{BenchmarkRun: *run}
+	if run.End != nil {
+		samples, err := benchmarkSamples(view, *run)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if detail.Outliers, err = checkPriorRuns(view, *run, samples); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	respond(c, http.StatusOK, detail)
+}
+
+// getBenchmarkMetrics returns the samples assigned to a run, oldest first.
+// The run and its samples are read from one snapshot, so a run that just
+// finished doesn't come without them.
+func getBenchmarkMetrics(c *gin.Context) {
+	view, release, err := snapshotView(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	run, err := loadBenchmarkRun(view.q, c.Param("name"))
+	if errors.Is(err, errRunNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if run.End == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "benchmark " + run.Name + " is still running"})
+		return
+	}
+
+	samples, err := view.store.QuerySamples(SampleQuery{
+		From:      run.Start,
+		To:        *run.End,
+		Node:      c.Query("node"),
+		Basis:     "allocatable",
+		RunID:     run.ID,
+		Ascending: true,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, samples)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A run selector picks benchmark runs by their name, description,
+// collector version and labels, e.g.
+//
+//	label.workload == "checkout" && commit ~= "v2.*"
+//
+// Fields are name, description, collector_version and label.<key>; any
+// other bare name is a label too, so commit is label.commit. A label a run
+// doesn't have is the empty string. The operators are == and != and the
+// regular expression matches ~= and !~, which must match the whole value.
+// Conditions combine with &&, || and !, && binding tighter than ||, and
+// group with parentheses. Values are double-quoted Go strings.
+
+// runSelector reports whether a run matches a parsed selector.
+type runSelector func(run *BenchmarkRun) bool
+
+type selectorToken struct {
+	kind  string // "ident", "string", an operator or "" at the end
+	value string
+	pos   int
+}
+
+// parseRunSelector compiles a selector. An empty one matches every run.
+func parseRunSelector(expr string) (runSelector, error) {
+	if strings.TrimSpace(expr) == "" {
+		return func(*BenchmarkRun) bool { return true }, nil
+	}
+	tokens, err := lexSelector(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{tokens: tokens}
+	sel, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "" {
+		return nil, fmt.Errorf("unexpected %q at %d", t.value, t.pos)
+	}
+	return sel, nil
+}
+
+var selectorOperators = []string{"&&", "||", "==", "!=", "~=", "!~", "!", "(", ")"}
+
+func lexSelector(expr string) ([]selectorToken, error) {
+	var tokens []selectorToken
+	for i := 0; i < len(expr); {
+		r := rune(expr[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			value, err := strconv.Unquote(expr[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d", i)
+			}
+			tokens = append(tokens, selectorToken{"string", value, i})
+			i = end + 1
+		case r == '_' || unicode.IsLetter(r):
+			end := i
+			for end < len(expr) && isSelectorIdent(rune(expr[end])) {
+				end++
+			}
+			tokens = append(tokens, selectorToken{"ident", expr[i:end], i})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range selectorOperators {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", r, i)
+			}
+			tokens = append(tokens, selectorToken{op, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, selectorToken{pos: len(expr)}), nil
+}
+
+// isSelectorIdent allows the characters of label keys such as
+// app.kubernetes.io/name.
+func isSelectorIdent(r rune) bool {
+	return r == '_' || r == '.' || r == '-' || r == '/' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+type selectorParser struct {
+	tokens []selectorToken
+	next   int
+}
+
+func (p *selectorParser) peek() selectorToken {
+	return p.tokens[p.next]
+}
+
+func (p *selectorParser) take() selectorToken {
+	t := p.tokens[p.next]
+	if t.kind != "" {
+		p.next++
+	}
+	return t
+}
+
+func (p *selectorParser) or() (runSelector, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "||" {
+		p.take()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(run *BenchmarkRun) bool { return l(run) || right(run) }
+	}
+	return left, nil
+}
+
+func (p *selectorParser) and() (runSelector, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "&&" {
+		p.take()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(run *BenchmarkRun) bool { return l(run) && right(run) }
+	}
+	return left, nil
+}
+
+func (p *selectorParser) unary() (runSelector, error) {
+	switch t := p.take(); t.kind {
+	case "!":
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(run *BenchmarkRun) bool { return !operand(run) }, nil
+	case "(":
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.take(); closing.kind != ")" {
+			return nil, fmt.Errorf("expected ) at %d", closing.pos)
+		}
+		return inner, nil
+	case "ident":
+		return p.condition(t)
+	case "":
+		return nil, fmt.Errorf("unexpected end of selector")
+	default:
+		return nil, fmt.Errorf("unexpected %q at %d", t.value, t.pos)
+	}
+}
+
+func (p *selectorParser) condition(field selectorToken) (runSelector, error) {
+	get := selectorField(field.value)
+	op := p.take()
+	if op.kind != "==" && op.kind != "!=" && op.kind != "~=" && op.kind != "!~" {
+		return nil, fmt.Errorf("expected ==, !=, ~= or !~ after %s at %d", field.value, op.pos)
+	}
+	value := p.take()
+	if value.kind != "string" {
+		return nil, fmt.Errorf("expected a quoted value at %d", value.pos)
+	}
+
+	switch op.kind {
+	case "==":
+		return func(run *BenchmarkRun) bool { return get(run) == value.value }, nil
+	case "!=":
+		return func(run *BenchmarkRun) bool { return get(run) != value.value }, nil
+	}
+	if _, err := regexp.Compile(value.value); err != nil {
+		return nil, fmt.Errorf("invalid regular expression at %d: %w", value.pos, err)
+	}
+	re := regexp.MustCompile("^(?:" + value.value + ")$")
+	if op.kind == "!~" {
+		return func(run *BenchmarkRun) bool { return !re.MatchString(get(run)) }, nil
+	}
+	return func(run *BenchmarkRun) bool { return re.MatchString(get(run)) }, nil
+}
+
+func selectorField(name string) func(run *BenchmarkRun) string {
+	switch name {
+	case "name":
+		return func(run *BenchmarkRun) string { return run.Name }
+	case "description":
+		return func(run *BenchmarkRun) string { return run.Description }
+	case "collector_version":
+		return func(run *BenchmarkRun) string { return run.CollectorVersion }
+	}
+	key := strings.TrimPrefix(name, "label.")
+	return func(run *BenchmarkRun) string { return run.Labels[key] }
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLexSelector(t *testing.T) {
+	tests := []struct {
+		expr   string
+		tokens []selectorToken
+		err    string
+	}{
+		{
+			expr: `label.app.kubernetes.io/name == "web"`,
+			tokens: []selectorToken{
+				{"ident", "label.app.kubernetes.io/name", 0},
+				{"==", "==", 29},
+				{"string", "web", 32},
+			},
+		},
+		{
+			expr:   `name=="a \"quoted\" \\ value"`,
+			tokens: []selectorToken{{"ident", "name", 0}, {"==", "==", 4}, {"string", `a "quoted" \ value`, 6}},
+		},
+		{
+			expr:   `x == "tab\there"`,
+			tokens: []selectorToken{{"ident", "x", 0}, {"==", "==", 2}, {"string", "tab\there", 5}},
+		},
+		{
+			expr:   `"a && b"`,
+			tokens: []selectorToken{{"string", "a && b", 0}},
+		},
+		{
+			expr: `!(a!~"x")||b!="y"`,
+			tokens: []selectorToken{
+				{"!", "!", 0}, {"(", "(", 1}, {"ident", "a", 2}, {"!~", "!~", 3}, {"string", "x", 5},
+				{")", ")", 8}, {"||", "||", 9}, {"ident", "b", 11}, {"!=", "!=", 12}, {"string", "y", 14},
+			},
+		},
+		{expr: `name == "open`, err: "unterminated string at 8"},
+		{expr: `name == "ends in a backslash\"`, err: "unterminated string at 8"},
+		{expr: `name == "bad \q"`, err: "invalid string at 8"},
+		{expr: `name = "x"`, err: `unexpected '=' at 5`},
+		{expr: `name == 'x'`, err: `unexpected '\'' at 8`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			tokens, err := lexSelector(tt.expr)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append(tt.tokens, selectorToken{pos: len(tt.expr)})
+			if len(tokens) != len(want) {
+				t.Fatalf("got %v, want %v", tokens, want)
+			}
+			for i := range want {
+				if tokens[i] != want[i] {
+					t.Errorf("token %d is %v, want %v", i, tokens[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseRunSelector(t *testing.T) {
+	runs := map[string]*BenchmarkRun{
+		"checkout-v2": {Name: "checkout-v2", Labels: map[string]string{"workload": "checkout", "commit": "v2.1"}},
+		"checkout-v1": {Name: "checkout-v1", Labels: map[string]string{"workload": "checkout", "commit": "v1.9"}},
+		"search":      {Name: "search", Description: "a && b", Labels: map[string]string{"workload": "search"}},
+		"unlabeled":   {Name: "unlabeled", CollectorVersion: "1.4.0"},
+	}
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{``, []string{"checkout-v1", "checkout-v2", "search", "unlabeled"}},
+		{`label.workload == "checkout" && commit ~= "v2.*"`, []string{"checkout-v2"}},
+		{`name == "search"`, []string{"search"}},
+		{`description == "a && b"`, []string{"search"}},
+		{`collector_version == "1.4.0"`, []string{"unlabeled"}},
+		// A missing label is the empty string
+		{`workload == ""`, []string{"unlabeled"}},
+		{`workload != "checkout"`, []string{"search", "unlabeled"}},
+		// && binds tighter than ||
+		{`name == "search" || workload == "checkout" && commit == "v1.9"`, []string{"checkout-v1", "search"}},
+		{`workload == "checkout" && commit == "v1.9" || name == "search"`, []string{"checkout-v1", "search"}},
+		{`(name == "search" || workload == "checkout") && commit == "v1.9"`, []string{"checkout-v1"}},
+		{`!name == "search" && workload ~= ".+"`, []string{"checkout-v1", "checkout-v2"}},
+		{`!(name == "search" || workload == "checkout")`, []string{"unlabeled"}},
+		{`!!(name == "search")`, []string{"search"}},
+		// Regular expressions match the whole value
+		{`name ~= "check"`, nil},
+		{`name ~= "check.*|search"`, []string{"checkout-v1", "checkout-v2", "search"}},
+		{`name !~ "checkout-v."`, []string{"search", "unlabeled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			sel, err := parseRunSelector(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, name := range []string{"checkout-v1", "checkout-v2", "search", "unlabeled"} {
+				if sel(runs[name]) {
+					got = append(got, name)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("matched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRunSelectorErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{`name`, "expected ==, !=, ~= or !~ after name at 4"},
+		{`name == checkout`, "expected a quoted value at 8"},
+		{`name == "a" &&`, "unexpected end of selector"},
+		{`name == "a" name == "b"`, `unexpected "name" at 12`},
+		{`(name == "a"`, "expected ) at 12"},
+		{`name == "a")`, `unexpected ")" at 11`},
+		{`&& name == "a"`, `unexpected "&&" at 0`},
+		{`"checkout"`, `unexpected "checkout" at 0`},
+		{`name ~= "("`, "invalid regular expression at 8"},
+		{`name == "open`, "unterminated string at 8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseRunSelector(tt.expr)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The BigQuery sink runs a load job of newline delimited JSON per batch,
+// which unlike streaming inserts is free and deduplicated by the job ID.
+// The tables are created on the first load with the schema detected from
+// the rows. The service account of bigquery-credentials needs the
+// BigQuery Job User role in the project and Data Editor on the dataset.
+
+const (
+	bigQueryScope     = "https://www.googleapis.com/auth/bigquery"
+	bigQueryAPI       = "https://bigquery.googleapis.com/bigquery/v2/projects/"
+	bigQueryUploadAPI = "https://bigquery.googleapis.com/upload/bigquery/v2/projects/"
+)
+
+var bigQueryAccount *serviceAccount
+
+type bigQuerySink struct{}
+
+func (bigQuerySink) destination() string { return "bigquery" }
+
+// bigQueryJob is the part of a job resource the sink reads.
+type bigQueryJob struct {
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	Status struct {
+		State       string `json:"state"`
+		ErrorResult *struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errorResult"`
+	} `json:"status"`
+}
+
+// load starts a load job with the batch ID as its job ID and waits for it
+// to finish. A job with that ID that exists already is waited for instead.
+func (bigQuerySink) load(ctx context.Context, table, id string, rows any) error {
+	project, dataset, _ := strings.Cut(cfg.BigQueryDataset, ".")
+	client := &http.Client{Timeout: 5 * time.Minute}
+	token, err := bigQueryAccount.accessToken(ctx, client, bigQueryScope)
+	if err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(map[string]any{
+		"jobReference": map[string]string{"projectId": project, "jobId": id},
+		"configuration": map[string]any{
+			"load": map[string]any{
+				"destinationTable": map[string]string{
+					"projectId": project,
+					"datasetId": dataset,
+					"tableId":   table,
+				},
+				"sourceFormat":      "NEWLINE_DELIMITED_JSON",
+				"writeDisposition":  "WRITE_APPEND",
+				"createDisposition": "CREATE_IF_NEEDED",
+				"autodetect":        true,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	part.Write(config)
+	part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return err
+	}
+	encoder := newNDJSONEncoder(part)
+	v := reflect.ValueOf(rows)
+	for i := range v.Len() {
+		if err := encoder.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, bigQueryUploadAPI+url.PathEscape(project)+"/jobs?uploadType=multipart", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/related; boundary="+w.Boundary())
+	var job bigQueryJob
+	status, err := bigQueryRequest(client, req, token, &job)
+	switch {
+	case status == http.StatusConflict:
+		// Started before, possibly by a run that crashed before saving
+		// the mark
+		job.JobReference.JobID = id
+	case err != nil:
+		return err
+	}
+
+	for job.Status.State != "DONE" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(warehousePoll):
+		}
+		endpoint := bigQueryAPI + url.PathEscape(project) + "/jobs/" + url.PathEscape(id)
+		if job.JobReference.Location != "" {
+			endpoint += "?location=" + url.QueryEscape(job.JobReference.Location)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := bigQueryRequest(client, req, token, &job); err != nil {
+			return err
+		}
+	}
+	if e := job.Status.ErrorResult; e != nil {
+		return fmt.Errorf("load job %s failed: %s: %s", id, e.Reason, e.Message)
+	}
+	return nil
+}
+
+// bigQueryRequest sends req with the access token and decodes the job it
+// returns into v. It returns the status code along with any error.
+func bigQueryRequest(client *http.Client, req *http.Request, token string, v any) (int, error) {
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var result struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, fmt.Errorf("BigQuery rejected the request: %s %s", resp.Status, result.Error.Message)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"runtime"
+	"runtime/debug"
+)
+
+// applyMemoryLimit sets the soft memory limit of the runtime, so on a
+// small node the garbage collector runs more often instead of the
+// collector growing until it is OOM killed.
+func applyMemoryLimit() {
+	if cfg.MemoryLimit > 0 {
+		debug.SetMemoryLimit(cfg.MemoryLimit)
+		slog.Info("Memory limit set", "bytes", cfg.MemoryLimit)
+	}
+}
+
+// writeBudgetMetrics exposes the memory use of the collector itself next
+// to the budgets it is held to.
+func writeBudgetMetrics(p promWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		limit = 0
+	}
+
+	p.family("k8s_collector_heap_bytes", "gauge", "Bytes of allocated heap objects of the collector.")
+	p.sample("k8s_collector_heap_bytes", float64(mem.HeapAlloc))
+	p.family("k8s_collector_memory_limit_bytes", "gauge", "Soft memory limit of the collector, 0 if unlimited.")
+	p.sample("k8s_collector_memory_limit_bytes", float64(limit))
+	p.family("k8s_collector_stream_queued_samples", "gauge", "Samples waiting in the queues of streaming clients.")
+	p.sample("k8s_collector_stream_queued_samples", float64(updates.queuedSamples()))
+	p.family("k8s_collector_stream_queue_budget_samples", "gauge", "Samples that may be queued for all streaming clients together.")
+	p.sample("k8s_collector_stream_queue_budget_samples", float64(cfg.StreamQueueBudget))
+	p.family("k8s_collector_stream_evictions_total", "counter", "Streaming clients disconnected for falling behind.")
+	p.sample("k8s_collector_stream_evictions_total", float64(updates.evictions.Load()))
+}
+
+// writeDatabaseMetrics exposes the connection pool statistics, which show
+// whether the pool sizes fit the load.
+func writeDatabaseMetrics(p promWriter) {
+	pools := db.stats()
+	p.family("k8s_collector_db_open_connections", "gauge", "Open connections of the database pool.")
+	for _, pool := range pools {
+		p.sample("k8s_collector_db_open_connections", float64(pool.OpenConnections), "pool", pool.name)
+	}
+	p.family("k8s_collector_db_in_use_connections", "gauge", "Connections of the database pool in use.")
+	for _, pool := range pools {
+		p.sample("k8s_collector_db_in_use_connections", float64(pool.InUse), "pool", pool.name)
+	}
+	p.family("k8s_collector_db_idle_connections", "gauge", "Idle connections of the database pool.")
+	for _, pool := range pools {
+		p.sample("k8s_collector_db_idle_connections", float64(pool.Idle), "pool", pool.name)
+	}
+	p.family("k8s_collector_db_max_open_connections", "gauge", "Connection limit of the database pool, 0 if unlimited.")
+	for _, pool := range pools {
+		p.sample("k8s_collector_db_max_open_connections", float64(pool.MaxOpenConnections), "pool", pool.name)
+	}
+	p.family("k8s_collector_db_wait_count_total", "counter", "Queries that waited for a free connection.")
+	for _, pool := range pools {
+		p.sample("k8s_collector_db_wait_count_total", float64(pool.WaitCount), "pool", pool.name)
+	}
+	p.family("k8s_collector_db_wait_duration_seconds_total", "counter", "Time queries spent waiting for a free connection.")
+	for _, pool := range pools {
+		p.sample("k8s_collector_db_wait_duration_seconds_total", pool.WaitDuration.Seconds(), "pool", pool.name)
+	}
+}
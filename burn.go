@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// burnSlice is the period the CPU burner splits into busy and idle time.
+const burnSlice = 100 * time.Millisecond
+
+// runBurner consumes a fixed amount of CPU and memory for a while. It is
+// what the calibration Job runs, started as "metrics burn".
+func runBurner(args []string) {
+	flags := flag.NewFlagSet("burn", flag.ExitOnError)
+	cpu := flags.Int64("cpu", 500, "CPU to consume in millicores")
+	memory := flags.Int64("memory", 256<<20, "memory to hold in bytes")
+	duration := flags.Duration("duration", 3*time.Minute, "how long to keep consuming")
+	flags.Parse(args)
+
+	slog.Info("Burning", "cpu_millicores", *cpu, "memory_bytes", *memory, "duration", *duration)
+
+	// Touch every page so the memory counts towards the working set
+	ballast := make([]byte, *memory)
+	for i := 0; i < len(ballast); i += os.Getpagesize() {
+		ballast[i] = 1
+	}
+
+	deadline := time.Now().Add(*duration)
+	workers := int((*cpu + 999) / 1000)
+	runtime.GOMAXPROCS(max(workers, 1))
+	busy := time.Duration(*cpu) * burnSlice / time.Duration(1000*max(workers, 1))
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				for time.Since(start) < busy {
+				}
+				time.Sleep(burnSlice - busy)
+			}
+		}()
+	}
+	wg.Wait()
+	if workers == 0 {
+		time.Sleep(time.Until(deadline))
+	}
+	runtime.KeepAlive(ballast)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+)
+
+// cadvisorSample is one line of the kubelet's cAdvisor Prometheus endpoint.
+type cadvisorSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// fetchCadvisorMetrics reads the cAdvisor metrics of a node's kubelet
+// through the API server proxy and returns the samples whose name is in
+// names. Parsing is limited to what cAdvisor emits: one sample per line,
+// optionally followed by a timestamp.
+func fetchCadvisorMetrics(ctx context.Context, nodeName string, names map[string]bool) ([]cadvisorSample, error) {
+	body, err := clientset.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		Name(nodeName).
+		SubResource("proxy").
+		Suffix("metrics/cadvisor").
+		DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []cadvisorSample
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		name, rest, _ := strings.Cut(line, "{")
+		if !names[name] {
+			continue
+		}
+
+		labels, rest, ok := parseLabels(rest)
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+
+		samples = append(samples, cadvisorSample{Name: name, Labels: labels, Value: value})
+	}
+	return samples, scanner.Err()
+}
+
+// parseLabels parses `a="x",b="y"}` and returns the labels and whatever
+// follows the closing brace.
+func parseLabels(s string) (map[string]string, string, bool) {
+	labels := make(map[string]string)
+	for {
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], true
+		}
+
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok || !strings.HasPrefix(rest, `"`) {
+			return nil, "", false
+		}
+
+		// Find the closing quote, skipping escaped characters
+		var value strings.Builder
+		i := 1
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] == '\\' && i+1 < len(rest) {
+				i++
+			}
+			value.WriteByte(rest[i])
+		}
+		if i >= len(rest) {
+			return nil, "", false
+		}
+
+		labels[key] = value.String()
+		s = strings.TrimPrefix(rest[i+1:], ",")
+	}
+}
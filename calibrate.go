@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+// calibrationWarmup is left out of the comparison, metrics-server needs
+// a full window of the burner running before its averages settle.
+const calibrationWarmup = time.Minute
+
+// calibrationMemoryOverhead is added to the memory limit of the burner
+// for the Go runtime, so it isn't OOM killed holding its ballast.
+const calibrationMemoryOverhead = 64 << 20
+
+const (
+	calibrationRunning = "running"
+	calibrationDone    = "done"
+	calibrationFailed  = "failed"
+)
+
+type Calibration struct {
+	ID       int64     `json:"id"`
+	Node     string    `json:"node,omitempty"`
+	Job      string    `json:"job"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	// CpuTarget and MemoryTarget are what the burner consumes, the
+	// measured values the averages of the stored pod samples after the
+	// warm-up. Memory includes a few MiB of runtime overhead.
+	CpuTarget      int64   `json:"cpu_target"`
+	MemoryTarget   int64   `json:"memory_target"`
+	Samples        int     `json:"samples"`
+	CpuMeasured    float64 `json:"cpu_measured"`
+	MemoryMeasured float64 `json:"memory_measured"`
+	// Errors are the deviation of the measured from the target value in
+	// percent of the target.
+	CpuError    float64 `json:"cpu_error"`
+	MemoryError float64 `json:"memory_error"`
+}
+
+// calibrations are kept in memory only, they are meant to be read right
+// after they finish.
+var calibrations = struct {
+	sync.Mutex
+	next int64
+	runs map[int64]*Calibration
+}{runs: make(map[int64]*Calibration)}
+
+type calibrationRequest struct {
+	Node         string `json:"node"`
+	CpuTarget    int64  `json:"cpu_target"`
+	MemoryTarget int64  `json:"memory_target"`
+	Duration     string `json:"duration"`
+}
+
+// postCalibrate deploys a Job that burns a known amount of CPU and memory
+// and, once it finished, compares what the collector stored for its pod
+// with it. The response is the running calibration, GET /calibrate/:id
+// has the result.
+func postCalibrate(c *gin.Context) {
+	if !cfg.CollectPods {
+		c.JSON(http.StatusConflict, gin.H{"error": "calibration needs collect-pods"})
+		return
+	}
+
+	req := calibrationRequest{CpuTarget: 500, MemoryTarget: 256 << 20, Duration: "3m"}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration < 2*calibrationWarmup {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration must be at least %v", 2*calibrationWarmup)})
+		return
+	}
+	if req.CpuTarget <= 0 || req.MemoryTarget <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cpu_target and memory_target must be positive"})
+		return
+	}
+
+	namespace, err := ownNamespace()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot find the collector's namespace: " + err.Error()})
+		return
+	}
+
+	calibrations.Lock()
+	calibrations.next++
+	run := &Calibration{
+		ID:           calibrations.next,
+		Node:         req.Node,
+		Status:       calibrationRunning,
+		Start:        time.Now(),
+		Duration:     duration.Seconds(),
+		CpuTarget:    req.CpuTarget,
+		MemoryTarget: req.MemoryTarget,
+	}
+	run.Job = fmt.Sprintf("metrics-calibration-%d-%d", run.Start.Unix(), run.ID)
+	calibrations.runs[run.ID] = run
+	calibrations.Unlock()
+
+	job := calibrationJob(run, duration)
+	if _, err := clientset.BatchV1().Jobs(namespace).Create(c.Request.Context(), job, metav1.CreateOptions{}); err != nil {
+		calibrations.Lock()
+		delete(calibrations.runs, run.ID)
+		calibrations.Unlock()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result := *run
+	go finishCalibration(run, namespace, duration)
+
+	respond(c, http.StatusAccepted, result)
+}
+
+// calibrationJob runs the collector image in burn mode with requests
+// matching the targets, so the scheduler reserves what it will use.
+func calibrationJob(run *Calibration, duration time.Duration) *batchv1.Job {
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    *resource.NewMilliQuantity(run.CpuTarget, resource.DecimalSI),
+			corev1.ResourceMemory: *resource.NewQuantity(run.MemoryTarget, resource.BinarySI),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceMemory: *resource.NewQuantity(run.MemoryTarget+calibrationMemoryOverhead, resource.BinarySI),
+		},
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   run.Job,
+			Labels: map[string]string{"app": "metrics-calibration"},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            ptr.To[int32](0),
+			ActiveDeadlineSeconds:   ptr.To(int64((duration + 5*time.Minute).Seconds())),
+			TTLSecondsAfterFinished: ptr.To[int32](300),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "metrics-calibration"}},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					NodeName:      run.Node,
+					Containers: []corev1.Container{{
+						Name:  "burner",
+						Image: cfg.CalibrationImage,
+						Command: []string{
+							"/app/metrics", "burn",
+							"--cpu", strconv.FormatInt(run.CpuTarget, 10),
+							"--memory", strconv.FormatInt(run.MemoryTarget, 10),
+							"--duration", duration.String(),
+						},
+						Resources: resources,
+						SecurityContext: &corev1.SecurityContext{
+							RunAsNonRoot:             ptr.To(true),
+							AllowPrivilegeEscalation: ptr.To(false),
+							ReadOnlyRootFilesystem:   ptr.To(true),
+							Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+							SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// finishCalibration waits for the burner to run its course and compares
+// the pod samples stored after the warm-up with the targets.
+func finishCalibration(run *Calibration, namespace string, duration time.Duration) {
+	// Scheduling and pulling the image delay the start, the samples are
+	// looked up by pod so the delay doesn't skew the result
+	time.Sleep(duration + 2*cfg.CollectInterval)
+
+	var samples int
+	var cpu, memory float64
+	var first time.Time
+	rows, err := db.Query(`
+        SELECT timestamp, cpu_usage, memory_usage
+        FROM pod_metrics
+        WHERE namespace = ?
+          AND pod_name LIKE ?
+          AND timestamp >= ?
+        ORDER BY timestamp
+    `, namespace, run.Job+"-%", run.Start)
+	if err == nil {
+		for rows.Next() {
+			var timestamp time.Time
+			var podCPU, podMemory int64
+			if err = rows.Scan(&timestamp, &podCPU, &podMemory); err != nil {
+				break
+			}
+			if first.IsZero() {
+				first = timestamp
+			}
+			if timestamp.Sub(first) < calibrationWarmup {
+				continue
+			}
+			samples++
+			cpu += float64(podCPU)
+			memory += float64(podMemory)
+		}
+		rows.Close()
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+
+	calibrations.Lock()
+	defer calibrations.Unlock()
+	switch {
+	case err != nil:
+		run.Status = calibrationFailed
+		run.Error = err.Error()
+	case samples == 0:
+		run.Status = calibrationFailed
+		run.Error = "no samples of the burner pod after the warm-up, check the Job " + run.Job
+	default:
+		run.Status = calibrationDone
+		run.Samples = samples
+		run.CpuMeasured = cpu / float64(samples)
+		run.MemoryMeasured = memory / float64(samples)
+		run.CpuError = (run.CpuMeasured - float64(run.CpuTarget)) * 100 / float64(run.CpuTarget)
+		run.MemoryError = (run.MemoryMeasured - float64(run.MemoryTarget)) * 100 / float64(run.MemoryTarget)
+	}
+	slog.Info("Calibration finished", "job", run.Job, "status", run.Status, "samples", samples,
+		"cpu_error", math.Round(run.CpuError*10)/10, "memory_error", math.Round(run.MemoryError*10)/10)
+
+	propagation := metav1.DeletePropagationBackground
+	err = clientset.BatchV1().Jobs(namespace).Delete(context.Background(), run.Job, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil {
+		slog.Error("Error deleting calibration job", "job", run.Job, "error", err)
+	}
+}
+
+func getCalibration(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid calibration id"})
+		return
+	}
+
+	calibrations.Lock()
+	run, ok := calibrations.runs[id]
+	var result Calibration
+	if ok {
+		result = *run
+	}
+	calibrations.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "calibration not found"})
+		return
+	}
+	respond(c, http.StatusOK, result)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Capabilities struct {
+	Collectors []string `json:"collectors"`
+	Exporters  []string `json:"exporters"`
+	Features   []string `json:"features"`
+	// ExternalURL is where the collector is reachable from outside the
+	// cluster, if known.
+	ExternalURL string `json:"external_url,omitempty"`
+}
+
+// currentCapabilities reports what this instance has enabled so clients
+// can adapt instead of assuming a default deployment.
+func currentCapabilities() Capabilities {
+	caps := Capabilities{
+		Collectors:  []string{"node"},
+		Exporters:   []string{},
+		ExternalURL: externalURL,
+		Features: []string{
+			"aggregate",
+			"benchmark",
+			"benchmark-bundle",
+			"benchmark-compare",
+			"benchmark-intervals",
+			"benchmark-outliers",
+			"benchmark-select",
+			"calibration",
+			"checksums",
+			"config",
+			"content-negotiation",
+			"cursor",
+			"disk-io",
+			"disruptions",
+			"drain-impact",
+			"experiments",
+			"export",
+			"filesystem",
+			"fragmentation",
+			"governance",
+			"health",
+			"incremental-export",
+			"latest-samples",
+			"image-pulls",
+			"ingest-stats",
+			"node-events",
+			"pod-network",
+			"prometheus",
+			"quotas",
+			"report-summary",
+			"reprocess",
+			"reset",
+			"schema",
+			"simulate",
+			"startup-latency",
+			"sse",
+			"status",
+			"stream",
+			"subscriptions",
+			"targets",
+			"tiles",
+			"version",
+		},
+	}
+
+	if cfg.CollectPods {
+		caps.Collectors = append(caps.Collectors, "pod")
+		caps.Features = append(caps.Features, "leaks")
+	}
+	if cfg.KubeletStatsInterval > 0 {
+		caps.Collectors = append(caps.Collectors, "kubelet")
+		caps.Features = append(caps.Features, "accuracy-checks")
+	}
+
+	if cfg.EventPollInterval > 0 {
+		caps.Collectors = append(caps.Collectors, "events")
+	}
+
+	if cfg.QuotaInterval > 0 {
+		caps.Collectors = append(caps.Collectors, "quota")
+	}
+
+	if cfg.ReplicateFrom != "" {
+		caps.Features = append(caps.Features, "standby")
+	}
+
+	if cfg.BackfillPrometheusURL != "" {
+		caps.Features = append(caps.Features, "backfill")
+	}
+
+	if cfg.CollectorPlugins != "" {
+		caps.Collectors = append(caps.Collectors, "plugin")
+	}
+
+	if cfg.DerivedMetrics != "" {
+		caps.Features = append(caps.Features, "derived-metrics")
+	}
+
+	if cfg.AlertRules != "" {
+		caps.Features = append(caps.Features, "alerts")
+	}
+
+	if cfg.RecordingRules != "" {
+		caps.Features = append(caps.Features, "recording-rules")
+	}
+
+	if cfg.IssueTracker != "" {
+		caps.Exporters = append(caps.Exporters, cfg.IssueTracker)
+	}
+
+	if cfg.PagerDutyRoutingKey != "" {
+		caps.Exporters = append(caps.Exporters, "pagerduty")
+	}
+
+	if cfg.OpsgenieAPIKey != "" {
+		caps.Exporters = append(caps.Exporters, "opsgenie")
+	}
+
+	if cfg.APIToken != "" || cfg.KubernetesAuth {
+		caps.Features = append(caps.Features, "auth")
+	}
+
+	if cfg.AdminAddr != "" {
+		caps.Features = append(caps.Features, "profiling")
+	}
+
+	if cfg.TenantTokens != "" {
+		caps.Features = append(caps.Features, "tenants")
+	}
+
+	if cfg.ShareSecret != "" {
+		caps.Features = append(caps.Features, "share-links")
+	}
+
+	if cfg.ExportSigningKey != "" {
+		caps.Features = append(caps.Features, "signing")
+	}
+
+	if cfg.RollupInterval > 0 {
+		caps.Features = append(caps.Features, "rollups")
+	}
+
+	if cfg.ReportSchedule != "" {
+		caps.Features = append(caps.Features, "reports")
+	}
+
+	if cfg.Retention > 0 {
+		caps.Features = append(caps.Features, "retention")
+	}
+
+	if cfg.HeartbeatURL != "" {
+		caps.Exporters = append(caps.Exporters, "heartbeat")
+	}
+
+	if cfg.SMTPAddr != "" {
+		caps.Exporters = append(caps.Exporters, "email")
+	}
+
+	if cfg.ExporterPlugins != "" {
+		caps.Exporters = append(caps.Exporters, "plugin")
+	}
+
+	if cfg.SheetsSpreadsheet != "" {
+		caps.Exporters = append(caps.Exporters, "google-sheets")
+	}
+
+	if cfg.BigQueryDataset != "" {
+		caps.Exporters = append(caps.Exporters, "bigquery")
+	}
+
+	if cfg.SnowflakeAccount != "" {
+		caps.Exporters = append(caps.Exporters, "snowflake")
+	}
+
+	if fleetCache != nil {
+		caps.Exporters = append(caps.Exporters, "fleet-cache")
+	}
+
+	return caps
+}
+
+func getCapabilities(c *gin.Context) {
+	respond(c, http.StatusOK, currentCapabilities())
+}
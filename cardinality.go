@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	cardinalityDrop = "drop"
+	cardinalityHash = "hash"
+
+	// cardinalityHashBuckets bounds the values excess values are hashed to.
+	cardinalityHashBuckets = 64
+)
+
+// cardinalityGuard bounds the distinct values stored per label within a
+// window, so a workload creating pods with unique names can't grow the
+// pod tables without limit. Values beyond the limit are dropped or hashed
+// into a fixed set of overflow values.
+type cardinalityGuard struct {
+	mu       sync.Mutex
+	limit    int
+	action   string
+	window   time.Duration
+	started  time.Time
+	seen     map[string]map[string]struct{}
+	overflow map[string]float64
+	// warned holds the labels that reached the limit in the current window
+	warned map[string]bool
+}
+
+var cardinality *cardinalityGuard
+
+func newCardinalityGuard(limit int, action string, window time.Duration) *cardinalityGuard {
+	return &cardinalityGuard{
+		limit:    limit,
+		action:   action,
+		window:   window,
+		started:  time.Now(),
+		seen:     make(map[string]map[string]struct{}),
+		overflow: make(map[string]float64),
+		warned:   make(map[string]bool),
+	}
+}
+
+// admit returns the value to store for a label, or false if the row is to
+// be dropped.
+func (g *cardinalityGuard) admit(label, value string) (string, bool) {
+	if g == nil {
+		return value, true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if time.Since(g.started) > g.window {
+		g.seen = make(map[string]map[string]struct{})
+		g.warned = make(map[string]bool)
+		g.started = time.Now()
+	}
+	values := g.seen[label]
+	if values == nil {
+		values = make(map[string]struct{})
+		g.seen[label] = values
+	}
+	if _, ok := values[value]; ok {
+		return value, true
+	}
+	if len(values) < g.limit {
+		values[value] = struct{}{}
+		return value, true
+	}
+
+	if !g.warned[label] {
+		g.warned[label] = true
+		slog.Warn("Cardinality limit reached", "label", label, "limit", g.limit, "window", g.window, "action", g.action)
+	}
+	g.overflow[label]++
+	if g.action == cardinalityDrop {
+		return "", false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("overflow-%02x", h.Sum32()%cardinalityHashBuckets), true
+}
+
+// admitPod applies the namespace and pod name limits to a pod and returns
+// the namespace and name to store, or false if its rows are to be dropped.
+// Every writer of per-pod rows goes through it.
+func (g *cardinalityGuard) admitPod(namespace, name string) (string, string, bool) {
+	namespace, ok := g.admit("namespace", namespace)
+	if !ok {
+		return "", "", false
+	}
+	podName, ok := g.admit("pod_name", namespace+"/"+name)
+	if !ok {
+		return "", "", false
+	}
+	if podName == namespace+"/"+name {
+		podName = name
+	}
+	return namespace, podName, true
+}
+
+func (g *cardinalityGuard) write(p promWriter) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p.family("k8s_collector_label_values", "gauge", "Distinct values of a label stored in the current cardinality window.")
+	for _, label := range sortedKeys(g.seen) {
+		p.sample("k8s_collector_label_values", float64(len(g.seen[label])), "label", label)
+	}
+	p.family("k8s_collector_label_overflow_total", "counter", "Values of a label over the cardinality limit that were dropped or hashed.")
+	for _, label := range sortedKeys(g.overflow) {
+		p.sample("k8s_collector_label_overflow_total", g.overflow[label], "label", label)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RunStats struct {
+	Samples   int     `json:"samples"`
+	AvgCpu    float64 `json:"avg_cpu"`
+	MaxCpu    float64 `json:"max_cpu"`
+	AvgMemory float64 `json:"avg_memory"`
+	MaxMemory int64   `json:"max_memory"`
+}
+
+type StatsDelta struct {
+	AvgCpu    float64 `json:"avg_cpu"`
+	MaxCpu    float64 `json:"max_cpu"`
+	AvgMemory float64 `json:"avg_memory"`
+	MaxMemory int64   `json:"max_memory"`
+}
+
+type StatsComparison struct {
+	NodeName  string      `json:"node_name,omitempty"`
+	Base      *RunStats   `json:"base"`
+	Candidate *RunStats   `json:"candidate"`
+	Delta     *StatsDelta `json:"delta,omitempty"`
+}
+
+type BenchmarkComparison struct {
+	// Base and Candidate are run names or run selectors.
+	Base      string `json:"base"`
+	Candidate string `json:"candidate"`
+	// BaseRuns and CandidateRuns list the runs a selector matched.
+	BaseRuns      []string          `json:"base_runs,omitempty"`
+	CandidateRuns []string          `json:"candidate_runs,omitempty"`
+	Cluster       StatsComparison   `json:"cluster"`
+	Nodes         []StatsComparison `json:"nodes"`
+	// Outliers are the base runs that look like noise next to the other
+	// base runs and the candidate runs that do next to their prior runs.
+	Outliers []RunOutlier `json:"outliers"`
+	// Intervals are the confidence intervals of the cluster deltas, with
+	// Warnings where there are too few runs to trust them.
+	Intervals []DeltaInterval `json:"intervals"`
+	Warnings  []string        `json:"warnings,omitempty"`
+}
+
+type statsAccumulator struct {
+	count     int
+	cpuSum    float64
+	cpuMax    float64
+	memorySum float64
+	memoryMax int64
+}
+
+func (a *statsAccumulator) add(cpu float64, memory int64) {
+	if a.count == 0 || cpu > a.cpuMax {
+		a.cpuMax = cpu
+	}
+	if a.count == 0 || memory > a.memoryMax {
+		a.memoryMax = memory
+	}
+	a.cpuSum += cpu
+	a.memorySum += float64(memory)
+	a.count++
+}
+
+func (a *statsAccumulator) stats() *RunStats {
+	if a == nil || a.count == 0 {
+		return nil
+	}
+	return &RunStats{
+		Samples:   a.count,
+		AvgCpu:    a.cpuSum / float64(a.count),
+		MaxCpu:    a.cpuMax,
+		AvgMemory: a.memorySum / float64(a.count),
+		MaxMemory: a.memoryMax,
+	}
+}
+
+// runStats aggregates the samples of one run per node and for the whole
+// cluster. Cluster memory is the sum over the nodes of each tick.
+func runStats(samples []MetricsData) (map[string]*statsAccumulator, *statsAccumulator) {
+	nodes := make(map[string]*statsAccumulator)
+	type tick struct {
+		cpu    float64
+		memory int64
+	}
+	ticks := make(map[time.Time]*tick)
+	var order []time.Time
+
+	for _, m := range samples {
+		if nodes[m.NodeName] == nil {
+			nodes[m.NodeName] = &statsAccumulator{}
+		}
+		nodes[m.NodeName].add(m.CpuUsage, m.MemoryUsage)
+
+		t := ticks[m.Timestamp]
+		if t == nil {
+			t = &tick{cpu: m.ClusterCpuUsage}
+			ticks[m.Timestamp] = t
+			order = append(order, m.Timestamp)
+		}
+		t.memory += m.MemoryUsage
+	}
+
+	cluster := &statsAccumulator{}
+	for _, timestamp := range order {
+		cluster.add(ticks[timestamp].cpu, ticks[timestamp].memory)
+	}
+	return nodes, cluster
+}
+
+func compareStats(nodeName string, base, candidate *statsAccumulator) StatsComparison {
+	comparison := StatsComparison{
+		NodeName:  nodeName,
+		Base:      base.stats(),
+		Candidate: candidate.stats(),
+	}
+	if comparison.Base != nil && comparison.Candidate != nil {
+		comparison.Delta = &StatsDelta{
+			AvgCpu:    comparison.Candidate.AvgCpu - comparison.Base.AvgCpu,
+			MaxCpu:    comparison.Candidate.MaxCpu - comparison.Base.MaxCpu,
+			AvgMemory: comparison.Candidate.AvgMemory - comparison.Base.AvgMemory,
+			MaxMemory: comparison.Candidate.MaxMemory - comparison.Base.MaxMemory,
+		}
+	}
+	return comparison
+}
+
+var errRunRunning = errors.New("benchmark run is still running")
+
+func benchmarkSamples(view readView, run BenchmarkRun) ([]MetricsData, error) {
+	if run.End == nil {
+		return nil, errRunRunning
+	}
+	return view.store.QuerySamples(SampleQuery{
+		From:  run.Start,
+		To:    *run.End,
+		Basis: "allocatable",
+		RunID: run.ID,
+	})
+}
+
+// comparisonRuns resolves one side of a comparison, the run named by
+// ?<side>= or the finished runs ?<side>_select= matches. On failure it
+// responds and returns false.
+func comparisonRuns(c *gin.Context, view readView, side string) (string, []BenchmarkRun, bool) {
+	name, expr := c.Query(side), c.Query(side+"_select")
+	if (name == "") == (expr == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "one of " + side + " and " + side + "_select is required"})
+		return "", nil, false
+	}
+
+	if name != "" {
+		run, err := loadBenchmarkRun(view.q, name)
+		if errors.Is(err, errRunNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "benchmark run " + name + " not found"})
+			return "", nil, false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return "", nil, false
+		}
+		if run.End == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "benchmark " + name + " is still running"})
+			return "", nil, false
+		}
+		return name, []BenchmarkRun{*run}, true
+	}
+
+	sel, err := parseRunSelector(expr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + side + "_select: " + err.Error()})
+		return "", nil, false
+	}
+	runs, err := listBenchmarkRuns(view.q, func(run *BenchmarkRun) bool { return run.End != nil && sel(run) })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", nil, false
+	}
+	if len(runs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no finished benchmark run matches " + side + "_select"})
+		return "", nil, false
+	}
+	return expr, runs, true
+}
+
+// getBenchmarkComparison returns the CPU and memory averages and maxima of
+// two runs per node and for the cluster, with the candidate minus base
+// delta. Nodes that only took part in one run have no delta. Either side
+// can be a run selector instead of a run name, the samples of the runs it
+// matches are then pooled. Base runs far off the other base runs and
+// candidate runs far off their prior runs are listed as outliers, so a
+// single candidate run is checked too. With several runs per side the cluster deltas come with
+// confidence intervals. Runs and samples are read from one snapshot.
+func getBenchmarkComparison(c *gin.Context) {
+	view, release, err := snapshotView(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	baseName, baseRuns, ok := comparisonRuns(c, view, "base")
+	if !ok {
+		return
+	}
+	candidateName, candidateRuns, ok := comparisonRuns(c, view, "candidate")
+	if !ok {
+		return
+	}
+
+	var stats [2]struct {
+		nodes   map[string]*statsAccumulator
+		cluster *statsAccumulator
+		runs    []runSummary
+	}
+	var candidateOutliers []RunOutlier
+	for i, runs := range [][]BenchmarkRun{baseRuns, candidateRuns} {
+		var samples []MetricsData
+		for _, run := range runs {
+			runSamples, err := benchmarkSamples(view, run)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			stats[i].runs = append(stats[i].runs, summarizeRun(run.Name, runSamples))
+			samples = append(samples, runSamples...)
+			if i == 1 {
+				outliers, err := checkPriorRuns(view, run, runSamples)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				candidateOutliers = append(candidateOutliers, outliers...)
+			}
+		}
+		stats[i].nodes, stats[i].cluster = runStats(samples)
+	}
+	base, candidate := stats[0], stats[1]
+
+	response := BenchmarkComparison{
+		Base:      baseName,
+		Candidate: candidateName,
+		Cluster:   compareStats("", base.cluster, candidate.cluster),
+		Nodes:     []StatsComparison{},
+		Outliers:  append(detectOutliers(base.runs), candidateOutliers...),
+	}
+	response.Intervals, response.Warnings = deltaIntervals(base.runs, candidate.runs)
+	if c.Query("base_select") != "" {
+		response.BaseRuns = runNames(baseRuns)
+	}
+	if c.Query("candidate_select") != "" {
+		response.CandidateRuns = runNames(candidateRuns)
+	}
+	for nodeName := range base.nodes {
+		response.Nodes = append(response.Nodes, compareStats(nodeName, base.nodes[nodeName], candidate.nodes[nodeName]))
+	}
+	for nodeName := range candidate.nodes {
+		if base.nodes[nodeName] == nil {
+			response.Nodes = append(response.Nodes, compareStats(nodeName, nil, candidate.nodes[nodeName]))
+		}
+	}
+	sort.Slice(response.Nodes, func(i, j int) bool {
+		return response.Nodes[i].NodeName < response.Nodes[j].NodeName
+	})
+
+	respond(c, http.StatusOK, response)
+}
+
+func runNames(runs []BenchmarkRun) []string {
+	names := make([]string, len(runs))
+	for i, run := range runs {
+		names[i] = run.Name
+	}
+	return names
+}
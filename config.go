@@ -0,0 +1,623 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// minCollectInterval keeps a misconfigured interval from turning the
+// collector into a busy loop against the API server.
+const minCollectInterval = 100 * time.Millisecond
+
+type Config struct {
+	Kubeconfig        string
+	CollectInterval   time.Duration
+	ListenAddr        string
+	AddressFamily     string
+	HeartbeatURL      string
+	HeartbeatInterval time.Duration
+	StaleAfter        time.Duration
+	MinNodes          int
+	StartupTimeout    time.Duration
+	MaxBodyBytes      int64
+	MaxHeaderBytes    int
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+	DBDriver          string
+	DBDSN             string
+	DBBusyTimeout     time.Duration
+	Retention         time.Duration
+	RetentionInterval time.Duration
+	RollupInterval    time.Duration
+	StreamBuffer      int
+	StreamQueueBudget int
+	StreamOrigins     string
+	MemoryLimit       int64
+	AdminAddr         string
+	AdminToken        string
+	ProfileDir        string
+	ExternalURL       string
+	ReportSchedule    string
+	ReportWebhookURL  string
+	SMTPAddr          string
+	SMTPUsername      string
+	SMTPPassword      string
+	SMTPFrom          string
+	ReportRecipients  string
+	RouteName         string
+
+	InstallMetricsServer bool
+
+	ReportWebhookTemplate string
+	ReportWebhookType     string
+	ReportMailTemplate    string
+	BenchmarkMailTemplate string
+	ReportTimezone        string
+	ReportLocale          string
+
+	// MaxConcurrentQueries only applies to SQLite.
+	MaxConcurrentQueries int
+
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	CardinalityLimit  int
+	CardinalityAction string
+	CardinalityWindow time.Duration
+
+	HeadroomPodCPU    int64
+	HeadroomPodMemory int64
+
+	NodeGroupLabel     string
+	UtilizationTargets string
+	CalibrationImage   string
+	AccuracyThreshold  float64
+	LeakThreshold      int64
+
+	LogLevel  string
+	LogFormat string
+
+	// APIToken and KubernetesAuth protect the mutating endpoints, and with
+	// APITokenReads every query as well.
+	APIToken       string
+	APITokenReads  bool
+	KubernetesAuth bool
+	// ShareSecret signs the share links of POST /share.
+	ShareSecret string
+	// TenantTokens names a file of tokens limited to some namespaces.
+	TenantTokens string
+
+	CollectPods          bool
+	KubeletStatsInterval time.Duration
+	EventPollInterval    time.Duration
+	QuotaInterval        time.Duration
+
+	ExportSigningKey string
+
+	CollectorPlugins string
+	ExporterPlugins  string
+	PluginInterval   time.Duration
+	DerivedMetrics   string
+
+	SheetsSpreadsheet string
+	SheetsRange       string
+	SheetsCredentials string
+
+	WarehouseInterval   time.Duration
+	BigQueryDataset     string
+	BigQueryCredentials string
+	SnowflakeAccount    string
+	SnowflakeUser       string
+	SnowflakePrivateKey string
+	SnowflakeSchema     string
+	SnowflakeWarehouse  string
+
+	AlertRules    string
+	AlertInterval time.Duration
+
+	RecordingRules    string
+	RecordingInterval time.Duration
+
+	IssueTracker      string
+	IssueTrackerURL   string
+	IssueTrackerToken string
+	IssueTemplate     string
+	JiraProject       string
+	JiraIssueType     string
+
+	PagerDutyRoutingKey string
+	OpsgenieAPIKey      string
+	PageTemplate        string
+
+	// ReplicateFrom makes the instance a standby of the collector at that
+	// URL.
+	ReplicateFrom       string
+	ReplicationToken    string
+	ReplicationInterval time.Duration
+	TakeoverAfter       time.Duration
+
+	BackfillPrometheusURL   string
+	BackfillPrometheusToken string
+	BackfillCPUQuery        string
+	BackfillMemoryQuery     string
+	BackfillStep            time.Duration
+	BackfillMaxGap          time.Duration
+
+	// FleetCollectors makes the instance an aggregator of the collectors
+	// at those URLs.
+	FleetCollectors string
+	FleetToken      string
+	FleetTimeout    time.Duration
+	// RedisURL is the fleet cache collectors publish their latest state to
+	// under FleetCluster, and an aggregator reads it from.
+	RedisURL     string
+	FleetCluster string
+}
+
+var cfg Config
+
+// loadConfig parses the command line flags. Every flag falls back to an
+// environment variable so the collector can be configured from a manifest
+// without overriding the container command.
+func loadConfig() {
+	flag.StringVar(&cfg.Kubeconfig, "kubeconfig", "", "path to a kubeconfig file (defaults to in-cluster config, then $KUBECONFIG or ~/.kube/config)")
+	flag.DurationVar(&cfg.CollectInterval, "interval", envDuration("COLLECT_INTERVAL", time.Second), "interval between metrics collections")
+	flag.StringVar(&cfg.ListenAddr, "listen-addr", envString("LISTEN_ADDR", ":8089"), "address the HTTP API listens on, e.g. :8089, [::1]:8089 or unix:/run/metrics.sock")
+	flag.StringVar(&cfg.AddressFamily, "address-family", envString("ADDRESS_FAMILY", "any"), "address family for the listener: any, ipv4 or ipv6")
+	flag.StringVar(&cfg.HeartbeatURL, "heartbeat-url", os.Getenv("HEARTBEAT_URL"), "URL pinged while collection is healthy (disabled if empty)")
+	flag.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", envDuration("HEARTBEAT_INTERVAL", time.Minute), "interval between heartbeat pings")
+	flag.DurationVar(&cfg.StaleAfter, "stale-after", envDuration("STALE_AFTER", time.Minute), "time without a successful collection after which /healthz and /readyz fail")
+	flag.IntVar(&cfg.MinNodes, "min-nodes", envInt("MIN_NODES", 1), "nodes that must report metrics before collection starts")
+	flag.DurationVar(&cfg.StartupTimeout, "startup-timeout", envDuration("STARTUP_TIMEOUT", 5*time.Minute), "how long to wait for the cluster before collecting anyway")
+	flag.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", int64(envInt("MAX_BODY_BYTES", 1<<20)), "maximum request body size in bytes")
+	flag.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", envInt("MAX_HEADER_BYTES", 64<<10), "maximum size of request headers in bytes")
+	flag.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", envDuration("READ_HEADER_TIMEOUT", 10*time.Second), "time allowed to read request headers")
+	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", envDuration("READ_TIMEOUT", time.Minute), "time allowed to read a whole request including the body")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", envDuration("IDLE_TIMEOUT", 2*time.Minute), "how long idle keep-alive connections are kept open")
+	flag.StringVar(&cfg.DBDriver, "db-driver", envString("DB_DRIVER", driverSQLite), "storage backend: sqlite3 or postgres")
+	flag.StringVar(&cfg.DBDSN, "db-dsn", os.Getenv("DB_DSN"), "database file for sqlite3 (default ./metrics.db) or connection string for postgres")
+	flag.DurationVar(&cfg.DBBusyTimeout, "db-busy-timeout", envDuration("DB_BUSY_TIMEOUT", 5*time.Second), "how long a sqlite3 query waits for a lock held by another connection")
+	flag.IntVar(&cfg.DBMaxOpenConns, "db-max-open-conns", envInt("DB_MAX_OPEN_CONNS", 0), "open connections of the database pool, for sqlite3 the read pool (0 is unlimited)")
+	flag.IntVar(&cfg.DBMaxIdleConns, "db-max-idle-conns", envInt("DB_MAX_IDLE_CONNS", 2), "idle connections the database pool keeps open")
+	flag.DurationVar(&cfg.DBConnMaxLifetime, "db-conn-max-lifetime", envDuration("DB_CONN_MAX_LIFETIME", 0), "time after which a database connection is reopened, e.g. to follow a PostgreSQL failover (0 keeps them)")
+	flag.IntVar(&cfg.MaxConcurrentQueries, "max-concurrent-queries", envInt("MAX_CONCURRENT_QUERIES", 8), "GET requests served at once on sqlite3 before answering 429 (0 disables)")
+	flag.DurationVar(&cfg.Retention, "retention", envDuration("RETENTION", 0), "how long collected rows are kept, e.g. 72h (0 keeps them forever)")
+	flag.DurationVar(&cfg.RetentionInterval, "retention-interval", envDuration("RETENTION_INTERVAL", time.Hour), "interval between deleting rows older than the retention period")
+	flag.DurationVar(&cfg.RollupInterval, "rollup-interval", envDuration("ROLLUP_INTERVAL", time.Minute), "interval for aggregating samples into the 1m, 5m and 1h rollups (0 disables)")
+	flag.IntVar(&cfg.StreamBuffer, "stream-buffer", envInt("STREAM_BUFFER", 16), "collection ticks queued per streaming client before it is disconnected")
+	flag.IntVar(&cfg.StreamQueueBudget, "stream-queue-budget", envInt("STREAM_QUEUE_BUDGET", 100000), "samples queued for all streaming clients together before the slowest is disconnected")
+	flag.StringVar(&cfg.StreamOrigins, "stream-origins", os.Getenv("STREAM_ORIGINS"), "comma separated origins, e.g. https://dashboard.example.com, allowed to open the WebSocket stream besides the collector's own host")
+	flag.Int64Var(&cfg.MemoryLimit, "memory-limit", int64(envInt("MEMORY_LIMIT", 0)), "soft limit in bytes for the memory of the collector, the garbage collector works harder near it (0 keeps GOMEMLIMIT)")
+	flag.StringVar(&cfg.AdminAddr, "admin-addr", os.Getenv("ADMIN_ADDR"), "address for the pprof and profile capture endpoints (disabled if empty)")
+	flag.StringVar(&cfg.APIToken, "api-token", os.Getenv("API_TOKEN"), "bearer token required by POST and DELETE requests to the API (disabled if empty)")
+	flag.BoolVar(&cfg.APITokenReads, "api-token-reads", envBool("API_TOKEN_READS", false), "require api-token or kubernetes-auth for GET requests as well")
+	flag.BoolVar(&cfg.KubernetesAuth, "kubernetes-auth", envBool("KUBERNETES_AUTH", false), "accept Kubernetes tokens as bearer tokens, authorized by RBAC rules on non-resource URLs")
+	flag.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token required by the admin endpoints")
+	flag.StringVar(&cfg.ProfileDir, "profile-dir", envString("PROFILE_DIR", os.TempDir()), "directory captured profiles are written to")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", envDuration("SHUTDOWN_TIMEOUT", 10*time.Second), "time allowed for requests and collection to finish on shutdown")
+	flag.StringVar(&cfg.ExternalURL, "external-url", os.Getenv("EXTERNAL_URL"), "URL the collector is reachable at from outside the cluster, used in links")
+	flag.StringVar(&cfg.ReportSchedule, "report-schedule", os.Getenv("REPORT_SCHEDULE"), "create utilization reports daily or weekly (disabled if empty)")
+	flag.StringVar(&cfg.ReportWebhookURL, "report-webhook-url", os.Getenv("REPORT_WEBHOOK_URL"), "URL each new report is posted to as Markdown (disabled if empty)")
+	flag.StringVar(&cfg.ReportWebhookTemplate, "report-webhook-template", os.Getenv("REPORT_WEBHOOK_TEMPLATE"), "Go text/template file rendering the report-webhook-url body from the report, e.g. a Slack message (built-in Markdown if empty)")
+	flag.StringVar(&cfg.ReportWebhookType, "report-webhook-content-type", envString("REPORT_WEBHOOK_CONTENT_TYPE", "text/markdown; charset=utf-8"), "Content-Type of the report-webhook-url body, application/json for Slack")
+	flag.StringVar(&cfg.SMTPAddr, "smtp-addr", os.Getenv("SMTP_ADDR"), "host:port of the SMTP server new reports and finished benchmarks are emailed through (disabled if empty)")
+	flag.StringVar(&cfg.SMTPUsername, "smtp-username", os.Getenv("SMTP_USERNAME"), "username for SMTP authentication (none if empty)")
+	flag.StringVar(&cfg.SMTPPassword, "smtp-password", os.Getenv("SMTP_PASSWORD"), "password for SMTP authentication")
+	flag.StringVar(&cfg.SMTPFrom, "smtp-from", os.Getenv("SMTP_FROM"), "sender address of report emails")
+	flag.StringVar(&cfg.ReportRecipients, "report-recipients", os.Getenv("REPORT_RECIPIENTS"), "comma separated addresses report emails are sent to")
+	flag.StringVar(&cfg.ReportMailTemplate, "report-mail-template", os.Getenv("REPORT_MAIL_TEMPLATE"), "Go html/template file rendering report emails, with an optional \"subject\" template (built-in if empty)")
+	flag.StringVar(&cfg.BenchmarkMailTemplate, "benchmark-mail-template", os.Getenv("BENCHMARK_MAIL_TEMPLATE"), "Go html/template file rendering the emails of finished benchmarks, with an optional \"subject\" template (built-in if empty)")
+	flag.StringVar(&cfg.ReportTimezone, "report-timezone", os.Getenv("REPORT_TIMEZONE"), "IANA time zone, e.g. Europe/Berlin, that report periods and the dates and times in reports and emails follow (the collector's zone if empty)")
+	flag.StringVar(&cfg.ReportLocale, "report-locale", envString("REPORT_LOCALE", "en"), "BCP 47 language tag, e.g. de-DE, that numbers in reports and emails are formatted for")
+	flag.StringVar(&cfg.RouteName, "route-name", os.Getenv("ROUTE_NAME"), "OpenShift Route in the collector's namespace to take the external URL from")
+	flag.BoolVar(&cfg.InstallMetricsServer, "install-metrics-server", envBool("INSTALL_METRICS_SERVER", false), "install metrics-server on k3s, minikube or kind clusters that lack the metrics API (needs permission to create it)")
+	flag.IntVar(&cfg.CardinalityLimit, "cardinality-limit", envInt("CARDINALITY_LIMIT", 0), "distinct namespaces and pods stored per cardinality window before excess values are dropped or hashed (0 disables)")
+	flag.StringVar(&cfg.CardinalityAction, "cardinality-action", envString("CARDINALITY_ACTION", cardinalityDrop), "what happens to values over the cardinality limit: drop or hash")
+	flag.DurationVar(&cfg.CardinalityWindow, "cardinality-window", envDuration("CARDINALITY_WINDOW", time.Hour), "interval after which the counted label values are forgotten")
+	flag.Int64Var(&cfg.HeadroomPodCPU, "headroom-pod-cpu", int64(envInt("HEADROOM_POD_CPU", 100)), "CPU in millicores of the standard pod the headroom is counted in")
+	flag.Int64Var(&cfg.HeadroomPodMemory, "headroom-pod-memory", int64(envInt("HEADROOM_POD_MEMORY", 256<<20)), "memory in bytes of the standard pod the headroom is counted in")
+	flag.StringVar(&cfg.LogLevel, "log-level", envString("LOG_LEVEL", "info"), "minimum level of log messages: debug, info, warn or error")
+	flag.StringVar(&cfg.LogFormat, "log-format", envString("LOG_FORMAT", logText), "log output: text or json for Loki and ELK")
+	flag.StringVar(&cfg.NodeGroupLabel, "node-group-label", os.Getenv("NODE_GROUP_LABEL"), "node label that names the node group (defaults to the EKS, GKE, AKS or Karpenter pool label)")
+	flag.StringVar(&cfg.UtilizationTargets, "utilization-targets", os.Getenv("UTILIZATION_TARGETS"), "target utilization bands per node group, e.g. default:cpu=50-80,gpu:memory=30-70 with * for any group")
+	flag.StringVar(&cfg.CalibrationImage, "calibration-image", envString("CALIBRATION_IMAGE", "ghcr.io/romankudravcev/k8s-metrics-collector:latest"), "image of the burner Job deployed by POST /calibrate, the collector image itself")
+	flag.Float64Var(&cfg.AccuracyThreshold, "accuracy-threshold", envFloat("ACCURACY_THRESHOLD", 20), "discrepancy in percent between metrics-server and the kubelet that is logged as a warning")
+	flag.Int64Var(&cfg.LeakThreshold, "leak-threshold", int64(envInt("LEAK_THRESHOLD", 10<<20)), "memory growth in bytes per hour above which a pod growing almost monotonically is reported as a suspected leak")
+	flag.BoolVar(&cfg.CollectPods, "collect-pods", envBool("COLLECT_PODS", true), "collect per-pod usage from the metrics API")
+	flag.DurationVar(&cfg.KubeletStatsInterval, "kubelet-stats-interval", envDuration("KUBELET_STATS_INTERVAL", 15*time.Second), "interval for scraping kubelet stats summaries (0 disables)")
+	flag.DurationVar(&cfg.EventPollInterval, "event-poll-interval", envDuration("EVENT_POLL_INTERVAL", 30*time.Second), "interval for polling image pull, eviction and preemption events (0 disables)")
+	flag.DurationVar(&cfg.QuotaInterval, "quota-interval", envDuration("QUOTA_INTERVAL", 30*time.Second), "interval for recording resource quota usage (0 disables)")
+	flag.StringVar(&cfg.TenantTokens, "tenant-tokens", os.Getenv("TENANT_TOKENS"), "JSON file mapping tokens to the namespaces whose pod data they may read, e.g. {\"<token>\": [\"team-a\"]}; node and cluster data stays limited to api-token (needs api-token-reads)")
+	flag.StringVar(&cfg.ShareSecret, "share-secret", os.Getenv("SHARE_SECRET"), "secret that signs the read-only share links of POST /share, changing it revokes every link (sharing is disabled if empty)")
+	flag.StringVar(&cfg.ExportSigningKey, "export-signing-key", os.Getenv("EXPORT_SIGNING_KEY"), "Ed25519 private key in PKCS #8 PEM that benchmark bundles are signed with (unsigned if empty)")
+	flag.StringVar(&cfg.CollectorPlugins, "collector-plugins", os.Getenv("COLLECTOR_PLUGINS"), "comma separated executables run every plugin-interval that print samples as JSON lines, stored in plugin_metrics")
+	flag.StringVar(&cfg.ExporterPlugins, "exporter-plugins", os.Getenv("EXPORTER_PLUGINS"), "comma separated executables kept running that read every collected node sample as a JSON line on stdin")
+	flag.StringVar(&cfg.DerivedMetrics, "derived-metric-scripts", os.Getenv("DERIVED_METRIC_SCRIPTS"), "comma separated executables run on every collection tick with its node samples as JSON lines on stdin, that print derived samples stored in plugin_metrics")
+	flag.DurationVar(&cfg.PluginInterval, "plugin-interval", envDuration("PLUGIN_INTERVAL", time.Minute), "interval between runs of the collector plugins, which also bounds how long a run may take")
+	flag.StringVar(&cfg.SheetsSpreadsheet, "sheets-spreadsheet", os.Getenv("SHEETS_SPREADSHEET"), "ID of a Google Sheet every finished benchmark run is appended to as a row (disabled if empty)")
+	flag.StringVar(&cfg.SheetsRange, "sheets-range", envString("SHEETS_RANGE", "Benchmarks"), "A1 range of the table in sheets-spreadsheet the rows are appended to, e.g. a sheet name")
+	flag.StringVar(&cfg.SheetsCredentials, "sheets-credentials", os.Getenv("SHEETS_CREDENTIALS"), "service account key file, in JSON, with edit access to sheets-spreadsheet")
+	flag.DurationVar(&cfg.WarehouseInterval, "warehouse-interval", envDuration("WAREHOUSE_INTERVAL", 15*time.Minute), "interval between loads of new samples and finished benchmark runs into BigQuery or Snowflake")
+	flag.StringVar(&cfg.BigQueryDataset, "bigquery-dataset", os.Getenv("BIGQUERY_DATASET"), "project.dataset samples and benchmark runs are loaded into (disabled if empty)")
+	flag.StringVar(&cfg.BigQueryCredentials, "bigquery-credentials", os.Getenv("BIGQUERY_CREDENTIALS"), "service account key file, in JSON, that runs the BigQuery load jobs")
+	flag.StringVar(&cfg.SnowflakeAccount, "snowflake-account", os.Getenv("SNOWFLAKE_ACCOUNT"), "account identifier, e.g. myorg-myaccount, of the Snowflake samples and benchmark runs are inserted into (disabled if empty)")
+	flag.StringVar(&cfg.SnowflakeUser, "snowflake-user", os.Getenv("SNOWFLAKE_USER"), "Snowflake user the rows are inserted as")
+	flag.StringVar(&cfg.SnowflakePrivateKey, "snowflake-private-key", os.Getenv("SNOWFLAKE_PRIVATE_KEY"), "unencrypted RSA private key in PKCS #8 PEM of snowflake-user")
+	flag.StringVar(&cfg.SnowflakeSchema, "snowflake-schema", os.Getenv("SNOWFLAKE_SCHEMA"), "database.schema holding the samples and benchmark_runs tables")
+	flag.StringVar(&cfg.SnowflakeWarehouse, "snowflake-warehouse", os.Getenv("SNOWFLAKE_WAREHOUSE"), "Snowflake warehouse the inserts run on")
+	flag.StringVar(&cfg.AlertRules, "alert-rules", os.Getenv("ALERT_RULES"), "JSON file of alert rules on the cluster utilization and collection, and assertions on finished benchmark runs (disabled if empty)")
+	flag.DurationVar(&cfg.AlertInterval, "alert-interval", envDuration("ALERT_INTERVAL", 30*time.Second), "interval between evaluations of the alert rules")
+	flag.StringVar(&cfg.RecordingRules, "recording-rules", os.Getenv("RECORDING_RULES"), "JSON file of recording rules whose expressions over the stored series are stored as series of their own (disabled if empty)")
+	flag.DurationVar(&cfg.RecordingInterval, "recording-interval", envDuration("RECORDING_INTERVAL", time.Minute), "interval between evaluations of the recording rules")
+	flag.StringVar(&cfg.IssueTracker, "issue-tracker", os.Getenv("ISSUE_TRACKER"), "github or jira, where alert rules and benchmark assertions with \"issue\" set open issues (disabled if empty)")
+	flag.StringVar(&cfg.IssueTrackerURL, "issue-tracker-url", os.Getenv("ISSUE_TRACKER_URL"), "API URL of the repository, e.g. https://api.github.com/repos/<owner>/<repo>, or base URL of the Jira issues are opened in")
+	flag.StringVar(&cfg.IssueTrackerToken, "issue-tracker-token", os.Getenv("ISSUE_TRACKER_TOKEN"), "GitHub token, or Jira user:api-token or personal access token, issues are opened with")
+	flag.StringVar(&cfg.IssueTemplate, "issue-template", os.Getenv("ISSUE_TEMPLATE"), "Go text/template file rendering the issue body, which must define a \"title\" template (built-in Markdown if empty)")
+	flag.StringVar(&cfg.JiraProject, "jira-project", os.Getenv("JIRA_PROJECT"), "key of the Jira project issues are opened in")
+	flag.StringVar(&cfg.JiraIssueType, "jira-issue-type", envString("JIRA_ISSUE_TYPE", "Bug"), "type of the Jira issues opened")
+	flag.StringVar(&cfg.PagerDutyRoutingKey, "pagerduty-routing-key", os.Getenv("PAGERDUTY_ROUTING_KEY"), "Events API v2 integration key critical alert rules trigger and resolve PagerDuty incidents with (disabled if empty)")
+	flag.StringVar(&cfg.OpsgenieAPIKey, "opsgenie-api-key", os.Getenv("OPSGENIE_API_KEY"), "API key critical alert rules create and close Opsgenie alerts with (disabled if empty)")
+	flag.StringVar(&cfg.PageTemplate, "page-template", os.Getenv("PAGE_TEMPLATE"), "Go text/template file rendering the summary of PagerDuty and Opsgenie pages from the alert (built-in if empty)")
+	flag.StringVar(&cfg.ReplicateFrom, "replicate-from", os.Getenv("REPLICATE_FROM"), "URL of a primary collector to replicate samples from as a standby, which only collects itself once the primary is down (disabled if empty)")
+	flag.StringVar(&cfg.ReplicationToken, "replication-token", os.Getenv("REPLICATION_TOKEN"), "bearer token sent to the primary when it requires one for reads")
+	flag.DurationVar(&cfg.ReplicationInterval, "replication-interval", envDuration("REPLICATION_INTERVAL", 10*time.Second), "interval between pulls from the primary and checks of its health")
+	flag.DurationVar(&cfg.TakeoverAfter, "takeover-after", envDuration("TAKEOVER_AFTER", time.Minute), "how long the primary must fail its health check before the standby takes over collection (0 never takes over)")
+	flag.StringVar(&cfg.BackfillPrometheusURL, "backfill-prometheus-url", os.Getenv("BACKFILL_PROMETHEUS_URL"), "URL of a Prometheus the gap since the last collected sample is backfilled from on startup (disabled if empty)")
+	flag.StringVar(&cfg.BackfillPrometheusToken, "backfill-prometheus-token", os.Getenv("BACKFILL_PROMETHEUS_TOKEN"), "bearer token sent to backfill-prometheus-url")
+	flag.StringVar(&cfg.BackfillCPUQuery, "backfill-cpu-query", envString("BACKFILL_CPU_QUERY", `sum by (node) (rate(container_cpu_usage_seconds_total{container!="",pod!=""}[5m]))`), "PromQL query of the CPU cores every node uses, labelled with the node name in \"node\"")
+	flag.StringVar(&cfg.BackfillMemoryQuery, "backfill-memory-query", envString("BACKFILL_MEMORY_QUERY", `sum by (node) (container_memory_working_set_bytes{container!="",pod!=""})`), "PromQL query of the memory bytes every node uses, labelled with the node name in \"node\"")
+	flag.DurationVar(&cfg.BackfillStep, "backfill-step", envDuration("BACKFILL_STEP", time.Minute), "interval between backfilled samples")
+	flag.DurationVar(&cfg.BackfillMaxGap, "backfill-max-gap", envDuration("BACKFILL_MAX_GAP", 24*time.Hour), "how far back a gap is backfilled at most")
+	flag.StringVar(&cfg.FleetCollectors, "fleet-collectors", os.Getenv("FLEET_COLLECTORS"), "comma separated name=url pairs, e.g. prod=https://metrics.prod.example.com, of the collectors to serve a merged API for as a fleet aggregator instead of collecting (disabled if empty)")
+	flag.StringVar(&cfg.FleetToken, "fleet-token", os.Getenv("FLEET_TOKEN"), "bearer token sent to the fleet collectors when they require one for reads")
+	flag.DurationVar(&cfg.FleetTimeout, "fleet-timeout", envDuration("FLEET_TIMEOUT", 10*time.Second), "how long the aggregator waits for a fleet collector before leaving its cluster out")
+	flag.StringVar(&cfg.RedisURL, "redis-url", os.Getenv("REDIS_URL"), "redis:// or rediss:// URL of the fleet cache the latest state is published to, or read from by a fleet aggregator (disabled if empty)")
+	flag.StringVar(&cfg.FleetCluster, "fleet-cluster", os.Getenv("FLEET_CLUSTER"), "name the collector publishes its state under in the fleet cache, as listed in the aggregator's fleet-collectors")
+
+	flag.Parse()
+
+	if cfg.CollectInterval < minCollectInterval {
+		log.Fatalf("interval must be at least %v", minCollectInterval)
+	}
+	if _, ok := listenNetworks[cfg.AddressFamily]; !ok {
+		log.Fatalf("Invalid address-family %q, expected any, ipv4 or ipv6", cfg.AddressFamily)
+	}
+	if cfg.DBDriver != driverSQLite && cfg.DBDriver != driverPostgres {
+		log.Fatalf("Invalid db-driver %q, expected sqlite3 or postgres", cfg.DBDriver)
+	}
+	if cfg.DBDriver == driverPostgres && cfg.DBDSN == "" {
+		log.Fatal("db-dsn is required for the postgres driver")
+	}
+	if cfg.DBBusyTimeout < 0 {
+		log.Fatal("db-busy-timeout must not be negative")
+	}
+	if cfg.DBMaxOpenConns < 0 || cfg.DBMaxIdleConns < 0 || cfg.DBConnMaxLifetime < 0 {
+		log.Fatal("db-max-open-conns, db-max-idle-conns and db-conn-max-lifetime must not be negative")
+	}
+	if cfg.MaxConcurrentQueries < 0 {
+		log.Fatal("max-concurrent-queries must not be negative")
+	}
+	if cfg.Retention < 0 || cfg.RetentionInterval <= 0 {
+		log.Fatal("retention must not be negative and retention-interval must be positive")
+	}
+	if cfg.RollupInterval < 0 {
+		log.Fatal("rollup-interval must not be negative")
+	}
+	if cfg.ReportSchedule != "" && cfg.ReportSchedule != reportDaily && cfg.ReportSchedule != reportWeekly {
+		log.Fatalf("Invalid report-schedule %q, expected daily or weekly", cfg.ReportSchedule)
+	}
+	if cfg.SMTPAddr != "" && (cfg.SMTPFrom == "" || cfg.ReportRecipients == "") {
+		log.Fatal("smtp-from and report-recipients are required when smtp-addr is set")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		log.Fatal("shutdown-timeout must be positive")
+	}
+	if cfg.StaleAfter <= cfg.CollectInterval {
+		log.Fatal("stale-after must be longer than interval")
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		log.Fatal("heartbeat-interval must be positive")
+	}
+	if cfg.MinNodes < 0 {
+		log.Fatal("min-nodes must not be negative")
+	}
+	if cfg.KubeletStatsInterval < 0 || cfg.EventPollInterval < 0 || cfg.QuotaInterval < 0 {
+		log.Fatal("kubelet-stats-interval, event-poll-interval and quota-interval must not be negative")
+	}
+	if cfg.ReplicationInterval <= 0 || cfg.TakeoverAfter < 0 {
+		log.Fatal("replication-interval must be positive and takeover-after must not be negative")
+	}
+	if cfg.BackfillPrometheusURL != "" {
+		if u, err := url.Parse(cfg.BackfillPrometheusURL); err != nil || u.Host == "" {
+			log.Fatalf("Invalid backfill-prometheus-url %q, expected the URL of a Prometheus", cfg.BackfillPrometheusURL)
+		}
+		if cfg.BackfillStep < time.Second || cfg.BackfillStep%time.Second != 0 || cfg.BackfillMaxGap <= 0 {
+			log.Fatal("backfill-step must be whole seconds and backfill-max-gap positive")
+		}
+	}
+	if cfg.FleetCollectors != "" {
+		collectors, err := parseFleetCollectors(cfg.FleetCollectors)
+		if err != nil {
+			log.Fatalf("Invalid fleet-collectors: %v", err)
+		}
+		if cfg.KubernetesAuth || cfg.TenantTokens != "" || cfg.ReplicateFrom != "" {
+			log.Fatal("kubernetes-auth, tenant-tokens and replicate-from can't be combined with fleet-collectors")
+		}
+		if cfg.FleetTimeout <= 0 {
+			log.Fatal("fleet-timeout must be positive")
+		}
+		fleetCollectors = collectors
+	}
+	if cfg.RedisURL != "" {
+		client, err := newRedisClient(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("Invalid redis-url: %v", err)
+		}
+		if cfg.FleetCollectors == "" && cfg.FleetCluster == "" {
+			log.Fatal("fleet-cluster is required when redis-url is set")
+		}
+		fleetCache = client
+	}
+	if cfg.ReplicateFrom != "" {
+		if u, err := url.Parse(cfg.ReplicateFrom); err != nil || u.Host == "" {
+			log.Fatalf("Invalid replicate-from %q, expected the URL of a collector", cfg.ReplicateFrom)
+		}
+	}
+	if cfg.ExportSigningKey != "" {
+		key, err := loadSigningKey(cfg.ExportSigningKey)
+		if err != nil {
+			log.Fatalf("Invalid export-signing-key: %v", err)
+		}
+		exportSigningKey = key
+	}
+	if cfg.PluginInterval <= 0 {
+		log.Fatal("plugin-interval must be positive")
+	}
+	for _, path := range pluginPaths(cfg.CollectorPlugins + "," + cfg.ExporterPlugins + "," + cfg.DerivedMetrics) {
+		if _, err := exec.LookPath(path); err != nil {
+			log.Fatalf("Invalid plugin: %v", err)
+		}
+	}
+	if cfg.SheetsSpreadsheet != "" {
+		account, err := loadServiceAccount(cfg.SheetsCredentials)
+		if err != nil {
+			log.Fatalf("Invalid sheets-credentials: %v", err)
+		}
+		sheetsAccount = account
+	}
+	if cfg.WarehouseInterval <= 0 {
+		log.Fatal("warehouse-interval must be positive")
+	}
+	if cfg.BigQueryDataset != "" {
+		if project, dataset, ok := strings.Cut(cfg.BigQueryDataset, "."); !ok || project == "" || dataset == "" {
+			log.Fatalf("Invalid bigquery-dataset %q, expected project.dataset", cfg.BigQueryDataset)
+		}
+		account, err := loadServiceAccount(cfg.BigQueryCredentials)
+		if err != nil {
+			log.Fatalf("Invalid bigquery-credentials: %v", err)
+		}
+		bigQueryAccount = account
+	}
+	if cfg.SnowflakeAccount != "" {
+		if database, schema, ok := strings.Cut(cfg.SnowflakeSchema, "."); !ok || database == "" || schema == "" {
+			log.Fatalf("Invalid snowflake-schema %q, expected database.schema", cfg.SnowflakeSchema)
+		}
+		if cfg.SnowflakeUser == "" || cfg.SnowflakeWarehouse == "" {
+			log.Fatal("snowflake-user and snowflake-warehouse are required when snowflake-account is set")
+		}
+		key, err := loadSnowflakeKey(cfg.SnowflakePrivateKey)
+		if err != nil {
+			log.Fatalf("Invalid snowflake-private-key: %v", err)
+		}
+		snowflakeKey = key
+	}
+	if cfg.AlertInterval <= 0 {
+		log.Fatal("alert-interval must be positive")
+	}
+	if cfg.AlertRules != "" {
+		rules, err := loadAlertRules(cfg.AlertRules)
+		if err != nil {
+			log.Fatalf("Invalid alert-rules: %v", err)
+		}
+		alertRules = rules
+	}
+	if cfg.RecordingInterval <= 0 {
+		log.Fatal("recording-interval must be positive")
+	}
+	if cfg.RecordingRules != "" {
+		rules, err := loadRecordingRules(cfg.RecordingRules)
+		if err != nil {
+			log.Fatalf("Invalid recording-rules: %v", err)
+		}
+		recordingRules = rules
+	}
+	switch cfg.IssueTracker {
+	case "":
+	case issueTrackerGitHub, issueTrackerJira:
+		if cfg.IssueTrackerURL == "" || cfg.IssueTrackerToken == "" {
+			log.Fatal("issue-tracker-url and issue-tracker-token are required when issue-tracker is set")
+		}
+		if cfg.IssueTracker == issueTrackerJira && cfg.JiraProject == "" {
+			log.Fatal("jira-project is required for the jira issue-tracker")
+		}
+	default:
+		log.Fatalf("Invalid issue-tracker %q, expected github or jira", cfg.IssueTracker)
+	}
+	if err := loadReportLocale(); err != nil {
+		log.Fatalf("Invalid report-timezone or report-locale: %v", err)
+	}
+	if err := loadNotificationTemplates(); err != nil {
+		log.Fatalf("Invalid notification template: %v", err)
+	}
+	targets, err := parseUtilizationTargets(cfg.UtilizationTargets)
+	if err != nil {
+		log.Fatalf("Invalid utilization-targets: %v", err)
+	}
+	utilizationTargets = targets
+	if cfg.APITokenReads && cfg.APIToken == "" && !cfg.KubernetesAuth {
+		log.Fatal("api-token or kubernetes-auth is required when api-token-reads is set")
+	}
+	if cfg.TenantTokens != "" {
+		if !cfg.APITokenReads {
+			log.Fatal("api-token-reads is required when tenant-tokens is set")
+		}
+		t, err := loadTenants(cfg.TenantTokens)
+		if err != nil {
+			log.Fatalf("Invalid tenant-tokens: %v", err)
+		}
+		tenants = t
+	}
+	if cfg.AdminAddr != "" && cfg.AdminToken == "" {
+		log.Fatal("admin-token is required when admin-addr is set")
+	}
+	if cfg.StreamBuffer <= 0 || cfg.StreamQueueBudget <= 0 {
+		log.Fatal("stream-buffer and stream-queue-budget must be positive")
+	}
+	if cfg.MemoryLimit < 0 {
+		log.Fatal("memory-limit must not be negative")
+	}
+	if err := logLevel.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		log.Fatalf("Invalid log-level %q, expected debug, info, warn or error", cfg.LogLevel)
+	}
+	if cfg.LogFormat != logText && cfg.LogFormat != logJSON {
+		log.Fatalf("Invalid log-format %q, expected text or json", cfg.LogFormat)
+	}
+	if cfg.CardinalityLimit < 0 || cfg.CardinalityWindow <= 0 {
+		log.Fatal("cardinality-limit must not be negative and cardinality-window must be positive")
+	}
+	if cfg.CardinalityAction != cardinalityDrop && cfg.CardinalityAction != cardinalityHash {
+		log.Fatalf("Invalid cardinality-action %q, expected drop or hash", cfg.CardinalityAction)
+	}
+	if cfg.HeadroomPodCPU <= 0 || cfg.HeadroomPodMemory <= 0 {
+		log.Fatal("headroom-pod-cpu and headroom-pod-memory must be positive")
+	}
+	if cfg.MaxBodyBytes <= 0 || cfg.MaxHeaderBytes <= 0 {
+		log.Fatal("max-body-bytes and max-header-bytes must be positive")
+	}
+	if cfg.LeakThreshold <= 0 {
+		log.Fatal("leak-threshold must be positive")
+	}
+}
+
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return d
+}
+
+func envBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return b
+}
+
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return n
+}
+
+func envFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return f
+}
+
+const redacted = "REDACTED"
+
+// dsnPassword matches the password of a key=value postgres connection string.
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// effectiveConfig returns the value of every flag after the environment
+// fallbacks were applied, keyed by flag name, with secrets redacted.
+func effectiveConfig() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+		case "admin-token", "api-token", "smtp-password", "replication-token", "share-secret", "issue-tracker-token", "pagerduty-routing-key", "opsgenie-api-key", "backfill-prometheus-token", "fleet-token":
+			if value != "" {
+				value = redacted
+			}
+		case "db-dsn", "redis-url":
+			value = redactURL(value)
+		case "heartbeat-url", "report-webhook-url":
+			value = redactEndpoint(value)
+		}
+		values[f.Name] = value
+	})
+	return values
+}
+
+// redactURL hides the password in a URL or postgres connection string.
+func redactURL(value string) string {
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		return u.String()
+	}
+	return dsnPassword.ReplaceAllString(value, "${1}"+redacted)
+}
+
+// redactEndpoint keeps only the scheme and host of a URL. Webhook and
+// heartbeat services carry their secret in the path or query, like the
+// check UUID of healthchecks.io or the token of a Slack hook.
+func redactEndpoint(value string) string {
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
+
+func getConfig(c *gin.Context) {
+	respond(c, http.StatusOK, effectiveConfig())
+}
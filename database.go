@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	driverSQLite   = "sqlite3"
+	driverPostgres = "postgres"
+)
+
+// database wraps the connection pool so every query can be written once in
+// SQLite syntax and run against either backend. For PostgreSQL the ?
+// placeholders are rewritten to $n and the column types of schema
+// statements are mapped to their PostgreSQL equivalents.
+//
+// SQLite allows only one writer at a time, so writes go through a separate
+// pool with a single connection and only reads use the shared pool. With
+// WAL journaling those reads don't wait for the writer.
+type database struct {
+	*sql.DB
+	writer *sql.DB
+	driver string
+}
+
+func openDatabase(driver, dsn string, busyTimeout time.Duration) (*database, error) {
+	if driver != driverSQLite {
+		conn, err := openPool(driver, dsn)
+		if err != nil {
+			return nil, err
+		}
+		return &database{DB: conn, writer: conn, driver: driver}, nil
+	}
+
+	if dsn == "" {
+		dsn = "./metrics.db"
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	dsn += fmt.Sprintf("%s_journal_mode=WAL&_busy_timeout=%d", separator, busyTimeout.Milliseconds())
+
+	// Write transactions take the lock up front so two of them can't both
+	// start reading and then fail to upgrade
+	writer, err := openPool(driver, dsn+"&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	writer.SetMaxOpenConns(1)
+
+	reader, err := openPool(driver, dsn)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	return &database{DB: reader, writer: writer, driver: driver}, nil
+}
+
+func openPool(driver, dsn string) (*sql.DB, error) {
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *database) Exec(query string, args ...any) (sql.Result, error) {
+	return d.writer.Exec(d.rebind(d.schema(query)), args...)
+}
+
+func (d *database) Query(query string, args ...any) (*sql.Rows, error) {
+	return d.pool(query).Query(d.rebind(query), args...)
+}
+
+func (d *database) QueryRow(query string, args ...any) *sql.Row {
+	return d.pool(query).QueryRow(d.rebind(query), args...)
+}
+
+// pool picks the writer for statements that modify data, like an INSERT
+// with RETURNING.
+func (d *database) pool(query string) *sql.DB {
+	statement := strings.ToUpper(strings.TrimSpace(query))
+	if strings.HasPrefix(statement, "SELECT") || strings.HasPrefix(statement, "WITH") {
+		return d.DB
+	}
+	return d.writer
+}
+
+// setPoolLimits sizes the shared pool. The SQLite writer always keeps its
+// single connection.
+func (d *database) setPoolLimits(maxOpen, maxIdle int, maxLifetime time.Duration) {
+	d.DB.SetMaxOpenConns(maxOpen)
+	d.DB.SetMaxIdleConns(maxIdle)
+	d.DB.SetConnMaxLifetime(maxLifetime)
+}
+
+type poolStats struct {
+	name string
+	sql.DBStats
+}
+
+// stats returns the statistics of each pool, read and write on SQLite and
+// shared on PostgreSQL.
+func (d *database) stats() []poolStats {
+	if d.writer == d.DB {
+		return []poolStats{{"shared", d.DB.Stats()}}
+	}
+	return []poolStats{{"read", d.DB.Stats()}, {"write", d.writer.Stats()}}
+}
+
+func (d *database) Close() error {
+	err := d.DB.Close()
+	if d.writer != d.DB {
+		if werr := d.writer.Close(); err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+func (d *database) Begin() (*transaction, error) {
+	tx, err := d.writer.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{Tx: tx, d: d}, nil
+}
+
+// snapshot starts a read-only transaction on the read pool, so several
+// queries, or one that streams for long, see the same state of the data
+// while the collector keeps writing. SQLite keeps the state of the first
+// read for the rest of the transaction. PostgreSQL needs REPEATABLE READ
+// for that, under its default READ COMMITTED every statement sees what
+// was committed before it started.
+func (d *database) snapshot(ctx context.Context) (*transaction, error) {
+	opts := &sql.TxOptions{ReadOnly: true}
+	if d.driver == driverPostgres {
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+	tx, err := d.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{Tx: tx, d: d}, nil
+}
+
+// rowQuerier is implemented by database and transaction, so reads can run
+// on a snapshot or not.
+type rowQuerier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// transaction rewrites placeholders the same way as database.
+type transaction struct {
+	*sql.Tx
+	d *database
+}
+
+func (t *transaction) Exec(query string, args ...any) (sql.Result, error) {
+	return t.Tx.Exec(t.d.rebind(query), args...)
+}
+
+func (t *transaction) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.Query(t.d.rebind(query), args...)
+}
+
+func (t *transaction) QueryRow(query string, args ...any) *sql.Row {
+	return t.Tx.QueryRow(t.d.rebind(query), args...)
+}
+
+func (t *transaction) Prepare(query string) (*sql.Stmt, error) {
+	return t.Tx.Prepare(t.d.rebind(query))
+}
+
+// rebind rewrites ? placeholders outside string literals to $1, $2, ...
+func (d *database) rebind(query string) string {
+	if d.driver != driverPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// postgresTypes maps the SQLite column types used in the schema. INTEGER
+// becomes BIGINT because byte counts don't fit in 32 bits.
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"INTEGER", "BIGINT",
+	"DATETIME", "TIMESTAMPTZ",
+	"REAL", "DOUBLE PRECISION",
+)
+
+// schema translates CREATE and ALTER TABLE statements for PostgreSQL.
+func (d *database) schema(query string) string {
+	if d.driver != driverPostgres {
+		return query
+	}
+	statement := strings.TrimSpace(query)
+	if !strings.HasPrefix(statement, "CREATE TABLE") && !strings.HasPrefix(statement, "ALTER TABLE") {
+		return query
+	}
+	return postgresTypes.Replace(query)
+}
+
+// epochSeconds returns an expression for the unix time of a DATETIME
+// column in whole seconds.
+func (d *database) epochSeconds(column string) string {
+	if d.driver == driverPostgres {
+		return "CAST(floor(extract(epoch FROM " + column + ")) AS BIGINT)"
+	}
+	return "CAST(strftime('%s', " + column + ") AS INTEGER)"
+}
+
+// bucketStart returns an expression truncating a DATETIME column to a
+// multiple of size since the epoch, like time.Truncate. On SQLite the
+// result is formatted the way go-sqlite3 writes local times, with their
+// offset, so it compares and scans like the times stored from Go.
+func (d *database) bucketStart(column string, size time.Duration) string {
+	seconds := int64(size / time.Second)
+	bucket := fmt.Sprintf("(%s / %d * %d)", d.epochSeconds(column), seconds, seconds)
+	if d.driver == driverPostgres {
+		return "to_timestamp(" + bucket + ")"
+	}
+	offset := fmt.Sprintf("CAST(round((julianday(%[1]s, 'unixepoch', 'localtime') - julianday(%[1]s, 'unixepoch')) * 1440) AS INTEGER)", bucket)
+	return fmt.Sprintf(
+		"strftime('%%Y-%%m-%%d %%H:%%M:%%S', %[1]s, 'unixepoch', 'localtime') || CASE WHEN %[2]s < 0 THEN '-' ELSE '+' END || printf('%%02d:%%02d', abs(%[2]s) / 60, abs(%[2]s) %% 60)",
+		bucket, offset,
+	)
+}
+
+// columnsQuery lists the column names of a table.
+func (d *database) columnsQuery() string {
+	if d.driver == driverPostgres {
+		return "SELECT column_name FROM information_schema.columns WHERE table_name = ?"
+	}
+	return "SELECT name FROM pragma_table_info(?)"
+}
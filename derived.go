@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+)
+
+// Derived metric scripts compute metrics of their own from what the
+// collector measured, e.g. an efficiency formula that combines the
+// cluster CPU and memory with the request rate the script reads from the
+// application. They run on every collection tick with the node samples of
+// the tick on stdin, one MetricsData per line as exporter plugins read
+// them, and print PluginSample lines like collector plugins. What they
+// print is stored in plugin_metrics under the script's name with the
+// timestamp of the tick, so it lines up with the samples it came from.
+//
+// A script gets one collection interval to finish. Ticks that arrive while
+// the scripts are still busy with an earlier one are skipped.
+
+// runDerivedMetrics runs the scripts on every tick until ctx is done.
+func runDerivedMetrics(ctx context.Context, paths []string) {
+	for ctx.Err() == nil {
+		sub := updates.subscribe(nil)
+		stop := context.AfterFunc(ctx, func() { updates.unsubscribe(sub) })
+		for {
+			samples, ok := updates.receive(sub)
+			if !ok {
+				break
+			}
+			deriveMetrics(ctx, paths, samples)
+		}
+		stop()
+		updates.unsubscribe(sub)
+		if updates.wasEvicted(sub) {
+			slog.Warn("Derived metric scripts fell behind, skipped ticks")
+		}
+	}
+}
+
+// deriveMetrics runs every script on the samples of one tick.
+func deriveMetrics(ctx context.Context, paths []string, samples []MetricsData) {
+	if len(samples) == 0 {
+		return
+	}
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	for _, m := range samples {
+		if err := encoder.Encode(m); err != nil {
+			slog.Error("Error encoding samples for derived metric scripts", "error", err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.CollectInterval)
+	defer cancel()
+	done := make(chan struct{}, len(paths))
+	for _, path := range paths {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			err := collectFromPlugin(ctx, path, bytes.NewReader(input.Bytes()), samples[0].Timestamp)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("Error running derived metric script", "script", filepath.Base(path), "error", err)
+			}
+		}()
+	}
+	for range paths {
+		<-done
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		slog.Warn("Derived metric scripts took longer than the collection interval", "interval", cfg.CollectInterval)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// diskIOMetrics are the cAdvisor counters summed for a node. The root
+// cgroup (id="/") covers every process on the node.
+var diskIOMetrics = map[string]bool{
+	"container_fs_reads_bytes_total":  true,
+	"container_fs_writes_bytes_total": true,
+	"container_fs_reads_total":        true,
+	"container_fs_writes_total":       true,
+}
+
+var (
+	// diskPartition matches partitions of sd, vd, xvd, hd, NVMe and MMC
+	// disks.
+	diskPartition = regexp.MustCompile(`^((nvme\d+n\d+|mmcblk\d+)p\d+|(sd|vd|xvd|hd)[a-z]+\d+)$`)
+	// stackedDevice matches device mapper, software RAID and loop devices,
+	// whose I/O also shows up on the disks below them.
+	stackedDevice = regexp.MustCompile(`^(dm-\d+|md\d+|loop\d+|mapper/.+)$`)
+)
+
+// wholeDisk reports whether a cAdvisor device label names a physical disk
+// rather than a partition or a device stacked on other disks.
+func wholeDisk(device string) bool {
+	name := strings.TrimPrefix(device, "/dev/")
+	return name != "" && !diskPartition.MatchString(name) && !stackedDevice.MatchString(name)
+}
+
+type NodeDiskIOSample struct {
+	Timestamp  time.Time `json:"timestamp"`
+	ReadBytes  int64     `json:"read_bytes"`
+	WriteBytes int64     `json:"write_bytes"`
+	Reads      int64     `json:"reads"`
+	Writes     int64     `json:"writes"`
+	ReadRate   float64   `json:"read_rate"`
+	WriteRate  float64   `json:"write_rate"`
+	ReadIops   float64   `json:"read_iops"`
+	WriteIops  float64   `json:"write_iops"`
+}
+
+// storeNodeDiskIO records the cumulative disk counters of a node's root
+// cgroup across its whole disks. Partitions, LVM and RAID devices are left
+// out since their I/O is already counted on the disks, and a device listed
+// twice counts once.
+func storeNodeDiskIO(ctx context.Context, nodeName string) {
+	samples, err := fetchCadvisorMetrics(ctx, nodeName, diskIOMetrics)
+	if err != nil {
+		slog.Error("Error fetching cAdvisor metrics", "node", nodeName, "error", err)
+		apiErrors.add("cadvisor", 1)
+		return
+	}
+
+	devices := make(map[[2]string]float64)
+	for _, s := range samples {
+		if s.Labels["id"] == "/" && wholeDisk(s.Labels["device"]) {
+			devices[[2]string{s.Name, s.Labels["device"]}] = s.Value
+		}
+	}
+	totals := make(map[string]float64)
+	for key, value := range devices {
+		totals[key[0]] += value
+	}
+	if len(totals) == 0 {
+		return
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO node_disk_io (
+            timestamp,
+            node_name,
+            read_bytes,
+            write_bytes,
+            reads,
+            writes
+        ) VALUES (?, ?, ?, ?, ?, ?)`,
+		time.Now(),
+		nodeName,
+		int64(totals["container_fs_reads_bytes_total"]),
+		int64(totals["container_fs_writes_bytes_total"]),
+		int64(totals["container_fs_reads_total"]),
+		int64(totals["container_fs_writes_total"]),
+	)
+	if err != nil {
+		slog.Error("Error inserting disk I/O stats", "node", nodeName, "error", err)
+	}
+}
+
+// getNodeDiskIO returns a node's disk counters together with throughput in
+// bytes per second and operations per second since the previous sample.
+func getNodeDiskIO(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT
+            timestamp,
+            read_bytes,
+            write_bytes,
+            reads,
+            writes
+        FROM node_disk_io
+        WHERE node_name = ?
+          AND timestamp BETWEEN ? AND ?
+        ORDER BY timestamp
+    `, c.Param("node"), from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	samples := []NodeDiskIOSample{}
+	for rows.Next() {
+		var s NodeDiskIOSample
+		if err := rows.Scan(&s.Timestamp, &s.ReadBytes, &s.WriteBytes, &s.Reads, &s.Writes); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(samples) > 0 {
+			prev := samples[len(samples)-1]
+			seconds := s.Timestamp.Sub(prev.Timestamp).Seconds()
+			if seconds > 0 {
+				s.ReadRate = counterRate(prev.ReadBytes, s.ReadBytes, seconds)
+				s.WriteRate = counterRate(prev.WriteBytes, s.WriteBytes, seconds)
+				s.ReadIops = counterRate(prev.Reads, s.Reads, seconds)
+				s.WriteIops = counterRate(prev.Writes, s.Writes, seconds)
+			}
+		}
+		samples = append(samples, s)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, samples)
+}
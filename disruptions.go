@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// disruptionReasons are the event reasons for pods removed to free
+// capacity: node-pressure evictions by the kubelet, taint based evictions
+// and scheduler preemption.
+var disruptionReasons = []string{"Evicted", "TaintManagerEviction", "Preempted"}
+
+type PodDisruption struct {
+	Timestamp time.Time `json:"timestamp"`
+	Namespace string    `json:"namespace"`
+	PodName   string    `json:"pod_name"`
+	NodeName  string    `json:"node_name"`
+	Workload  string    `json:"workload"`
+	Reason    string    `json:"reason"`
+	Message   string    `json:"message"`
+}
+
+type DisruptionReport struct {
+	Disruptions []PodDisruption `json:"disruptions"`
+	Counts      map[string]int  `json:"counts"`
+	Workloads   map[string]int  `json:"workloads"`
+}
+
+// collectDisruptions stores the disruption events the API server still
+// has. Events stored by an earlier poll are skipped before their workload
+// is looked up.
+func collectDisruptions(ctx context.Context, podLister corelisters.PodLister) {
+	for _, reason := range disruptionReasons {
+		events, err := clientset.CoreV1().Events("").List(ctx, metav1.ListOptions{
+			FieldSelector: fields.Set{"involvedObject.kind": "Pod", "reason": reason}.String(),
+		})
+		if err != nil {
+			slog.Error("Error listing events", "reason", reason, "error", err)
+			apiErrors.add("events", 1)
+			continue
+		}
+		stored, err := storedDisruptions(reason, events.Items)
+		if err != nil {
+			slog.Error("Error looking up stored pod disruptions", "reason", reason, "error", err)
+			continue
+		}
+
+		for _, event := range events.Items {
+			if stored[string(event.UID)] {
+				continue
+			}
+			namespace, podName, ok := cardinality.admitPod(event.InvolvedObject.Namespace, event.InvolvedObject.Name)
+			if !ok {
+				continue
+			}
+			_, err = db.Exec(
+				`INSERT INTO pod_disruptions (
+                    event_uid,
+                    timestamp,
+                    namespace,
+                    pod_name,
+                    node_name,
+                    workload,
+                    reason,
+                    message
+                ) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+                ON CONFLICT (event_uid) DO NOTHING`,
+				string(event.UID),
+				eventTime(&event).Local(),
+				namespace,
+				podName,
+				event.Source.Host,
+				podWorkload(podLister, event.InvolvedObject.Namespace, event.InvolvedObject.Name),
+				reason,
+				event.Message,
+			)
+			if err != nil {
+				slog.Error("Error inserting pod disruption", "error", err)
+			}
+		}
+	}
+}
+
+// storedDisruptions returns the UIDs of the events that are already
+// stored, out of those since the oldest listed event.
+func storedDisruptions(reason string, events []corev1.Event) (map[string]bool, error) {
+	stored := make(map[string]bool)
+	if len(events) == 0 {
+		return stored, nil
+	}
+	oldest := eventTime(&events[0])
+	for i := range events {
+		if t := eventTime(&events[i]); t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	rows, err := db.Query(
+		"SELECT event_uid FROM pod_disruptions WHERE reason = ? AND timestamp >= ?",
+		reason,
+		oldest.Local(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		stored[uid] = true
+	}
+	return stored, rows.Err()
+}
+
+// podWorkload returns the controller owning a pod as kind/name. Preempted
+// pods are usually deleted by the time the event is seen, in which case
+// the workload is unknown.
+func podWorkload(podLister corelisters.PodLister, namespace, name string) string {
+	pod, err := podLister.Pods(namespace).Get(name)
+	if err != nil {
+		return ""
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return ""
+	}
+	return owner.Kind + "/" + owner.Name
+}
+
+// getDisruptions lists the evictions and preemptions in a time range with
+// counts per reason and per affected workload.
+func getDisruptions(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            namespace,
+            pod_name,
+            node_name,
+            workload,
+            reason,
+            message
+        FROM pod_disruptions
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	for param, column := range map[string]string{"namespace": "namespace", "node": "node_name", "reason": "reason"} {
+		if v := c.Query(param); v != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	query, args = scopeNamespaces(c, query, args)
+	query += " ORDER BY timestamp"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	report := DisruptionReport{
+		Disruptions: []PodDisruption{},
+		Counts:      make(map[string]int),
+		Workloads:   make(map[string]int),
+	}
+	for rows.Next() {
+		var d PodDisruption
+		err := rows.Scan(
+			&d.Timestamp,
+			&d.Namespace,
+			&d.PodName,
+			&d.NodeName,
+			&d.Workload,
+			&d.Reason,
+			&d.Message,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		report.Counts[d.Reason]++
+		if d.Workload != "" {
+			report.Workloads[d.Namespace+"/"+d.Workload]++
+		}
+		report.Disruptions = append(report.Disruptions, d)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, report)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	distroK3s      = "k3s"
+	distroMinikube = "minikube"
+	distroKind     = "kind"
+	distroGeneric  = "kubernetes"
+
+	metricsServerImage = "registry.k8s.io/metrics-server/metrics-server:v0.7.2"
+)
+
+// detectDistribution recognises the lightweight distributions used for
+// development from what they put on their nodes.
+func detectDistribution(nodes []corev1.Node) string {
+	for _, node := range nodes {
+		switch {
+		case strings.Contains(node.Status.NodeInfo.KubeletVersion, "+k3s"):
+			return distroK3s
+		case node.Labels["minikube.k8s.io/name"] != "":
+			return distroMinikube
+		case strings.HasPrefix(node.Spec.ProviderID, "kind://"):
+			return distroKind
+		}
+	}
+	return distroGeneric
+}
+
+// prepareDistribution adapts the collector to the cluster it runs on and
+// returns the number of nodes to wait for. Dev clusters are usually a
+// single node, so waiting for more nodes than exist would only delay
+// collection until the startup timeout. kind ships without metrics-server,
+// which is installed when install-metrics-server is set.
+func prepareDistribution(ctx context.Context, config *rest.Config, minNodes int) int {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		slog.Error("Error listing nodes to detect the distribution", "error", err)
+		return minNodes
+	}
+	distribution := detectDistribution(nodes.Items)
+	slog.Info("Detected distribution", "distribution", distribution, "nodes", len(nodes.Items))
+
+	statusMu.Lock()
+	status.Distribution = distribution
+	statusMu.Unlock()
+
+	if distribution != distroGeneric && minNodes > len(nodes.Items) {
+		slog.Info("Lowering min-nodes", "from", minNodes, "to", len(nodes.Items), "distribution", distribution)
+		minNodes = len(nodes.Items)
+	}
+
+	if !cfg.InstallMetricsServer {
+		return minNodes
+	}
+	if _, err := clientset.Discovery().ServerResourcesForGroupVersion("metrics.k8s.io/v1beta1"); err == nil {
+		return minNodes
+	}
+	if distribution == distroGeneric {
+		slog.Warn("Metrics API missing, not installing metrics-server on a cluster that is not a known dev distribution")
+		return minNodes
+	}
+	if err := installMetricsServer(ctx, config); err != nil {
+		slog.Error("Error installing metrics-server", "error", err)
+	}
+	return minNodes
+}
+
+// installMetricsServer creates the objects of the upstream metrics-server
+// manifest in kube-system. Dev cluster kubelets serve self-signed
+// certificates, so it runs with --kubelet-insecure-tls. The collector's
+// service account needs to be allowed to create all of these, which the
+// bundled deployment.yml deliberately does not grant.
+func installMetricsServer(ctx context.Context, config *rest.Config) error {
+	const namespace = "kube-system"
+	const name = "metrics-server"
+	labels := map[string]string{"k8s-app": name}
+	meta := metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels}
+
+	slog.Info("Metrics API missing, installing metrics-server", "image", metricsServerImage)
+
+	create := func(kind string, err error) error {
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("creating %s: %w", kind, err)
+		}
+		return nil
+	}
+
+	_, err := clientset.CoreV1().ServiceAccounts(namespace).Create(ctx, &corev1.ServiceAccount{ObjectMeta: meta}, metav1.CreateOptions{})
+	if err := create("service account", err); err != nil {
+		return err
+	}
+
+	_, err = clientset.RbacV1().ClusterRoles().Create(ctx, &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "system:" + name, Labels: labels},
+		Rules: []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"nodes/metrics"}, Verbs: []string{"get"}},
+			{APIGroups: []string{""}, Resources: []string{"pods", "nodes"}, Verbs: []string{"get", "list", "watch"}},
+		},
+	}, metav1.CreateOptions{})
+	if err := create("cluster role", err); err != nil {
+		return err
+	}
+
+	subjects := []rbacv1.Subject{{Kind: "ServiceAccount", Name: name, Namespace: namespace}}
+	for _, binding := range []struct{ name, role string }{
+		{"system:" + name, "system:" + name},
+		{name + ":system:auth-delegator", "system:auth-delegator"},
+	} {
+		_, err = clientset.RbacV1().ClusterRoleBindings().Create(ctx, &rbacv1.ClusterRoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: binding.name, Labels: labels},
+			RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: binding.role},
+			Subjects:   subjects,
+		}, metav1.CreateOptions{})
+		if err := create("cluster role binding", err); err != nil {
+			return err
+		}
+	}
+
+	_, err = clientset.RbacV1().RoleBindings(namespace).Create(ctx, &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name + "-auth-reader", Namespace: namespace, Labels: labels},
+		RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "Role", Name: "extension-apiserver-authentication-reader"},
+		Subjects:   subjects,
+	}, metav1.CreateOptions{})
+	if err := create("role binding", err); err != nil {
+		return err
+	}
+
+	_, err = clientset.CoreV1().Services(namespace).Create(ctx, &corev1.Service{
+		ObjectMeta: meta,
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports: []corev1.ServicePort{{
+				Name:       "https",
+				Port:       443,
+				TargetPort: intstr.FromString("https"),
+			}},
+		},
+	}, metav1.CreateOptions{})
+	if err := create("service", err); err != nil {
+		return err
+	}
+
+	nonRoot := true
+	_, err = clientset.AppsV1().Deployments(namespace).Create(ctx, &appsv1.Deployment{
+		ObjectMeta: meta,
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: name,
+					PriorityClassName:  "system-cluster-critical",
+					Containers: []corev1.Container{{
+						Name:  name,
+						Image: metricsServerImage,
+						Args: []string{
+							"--cert-dir=/tmp",
+							"--secure-port=10250",
+							"--kubelet-preferred-address-types=InternalIP,ExternalIP,Hostname",
+							"--kubelet-use-node-status-port",
+							"--kubelet-insecure-tls",
+							"--metric-resolution=15s",
+						},
+						Ports: []corev1.ContainerPort{{Name: "https", ContainerPort: 10250}},
+						SecurityContext: &corev1.SecurityContext{
+							RunAsNonRoot:           &nonRoot,
+							ReadOnlyRootFilesystem: &nonRoot,
+						},
+						VolumeMounts: []corev1.VolumeMount{{Name: "tmp-dir", MountPath: "/tmp"}},
+					}},
+					Volumes: []corev1.Volume{{
+						Name:         "tmp-dir",
+						VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+					}},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err := create("deployment", err); err != nil {
+		return err
+	}
+
+	// APIService has no typed client in client-go
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	apiService := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "apiregistration.k8s.io/v1",
+		"kind":       "APIService",
+		"metadata": map[string]any{
+			"name":   "v1beta1.metrics.k8s.io",
+			"labels": map[string]any{"k8s-app": name},
+		},
+		"spec": map[string]any{
+			"group":                 "metrics.k8s.io",
+			"version":               "v1beta1",
+			"groupPriorityMinimum":  int64(100),
+			"versionPriority":       int64(100),
+			"insecureSkipTLSVerify": true,
+			"service": map[string]any{
+				"name":      name,
+				"namespace": namespace,
+			},
+		},
+	}}
+	resource := schema.GroupVersionResource{Group: "apiregistration.k8s.io", Version: "v1", Resource: "apiservices"}
+	_, err = dynamicClient.Resource(resource).Create(ctx, apiService, metav1.CreateOptions{})
+	return create("api service", err)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type DrainPlacement struct {
+	Namespace   string `json:"namespace"`
+	PodName     string `json:"pod_name"`
+	TargetNode  string `json:"target_node"`
+	CpuRequest  int64  `json:"cpu_request"`
+	CpuUsage    int64  `json:"cpu_usage"`
+	MemoryUsage int64  `json:"memory_usage"`
+}
+
+type DrainNodeImpact struct {
+	NodeName             string  `json:"node_name"`
+	CpuUsage             float64 `json:"cpu_usage"`
+	ProjectedCpuUsage    float64 `json:"projected_cpu_usage"`
+	MemoryUsage          int64   `json:"memory_usage"`
+	ProjectedMemoryUsage int64   `json:"projected_memory_usage"`
+	PodsReceived         int     `json:"pods_received"`
+}
+
+type DrainImpact struct {
+	NodeName                 string            `json:"node_name"`
+	Placements               []DrainPlacement  `json:"placements"`
+	Unschedulable            []DrainPlacement  `json:"unschedulable"`
+	Nodes                    []DrainNodeImpact `json:"nodes"`
+	ClusterCpuUsage          float64           `json:"cluster_cpu_usage"`
+	ProjectedClusterCpuUsage float64           `json:"projected_cluster_cpu_usage"`
+}
+
+// drainCandidate tracks the state of a node that may receive evicted pods.
+type drainCandidate struct {
+	impact      DrainNodeImpact
+	totalCPU    int64
+	usedCPU     int64
+	freeCPU     int64
+	freeMemory  int64
+	schedulable bool
+}
+
+// getDrainImpact estimates what happens if the given node is drained: every
+// pod that would be evicted is placed on the remaining node with the lowest
+// resulting CPU usage that still fits its requests. Taints, affinity and
+// topology constraints are ignored, so the result is an estimate only.
+func getDrainImpact(c *gin.Context) {
+	nodeName := c.Query("node")
+	if nodeName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "node query parameter is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	nodeMetrics, err := metricsClient.MetricsV1beta1().NodeMetricses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	podMetrics, err := metricsClient.MetricsV1beta1().PodMetricses("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	nodeUsage := make(map[string]corev1.ResourceList)
+	for _, m := range nodeMetrics.Items {
+		nodeUsage[m.Name] = m.Usage
+	}
+
+	// Pod usage is keyed by namespace/name and summed over containers
+	type podUsage struct{ cpu, memory int64 }
+	usageByPod := make(map[string]podUsage)
+	for _, m := range podMetrics.Items {
+		var u podUsage
+		for _, container := range m.Containers {
+			u.cpu += container.Usage.Cpu().MilliValue()
+			u.memory += container.Usage.Memory().Value()
+		}
+		usageByPod[m.Namespace+"/"+m.Name] = u
+	}
+
+	found := false
+	candidates := make(map[string]*drainCandidate)
+	var clusterTotalCPU, clusterUsedCPU int64
+	for _, node := range nodes.Items {
+		usage := nodeUsage[node.Name]
+		totalCPU := node.Status.Allocatable.Cpu().MilliValue()
+		usedCPU := usage.Cpu().MilliValue()
+		clusterTotalCPU += totalCPU
+		clusterUsedCPU += usedCPU
+
+		if node.Name == nodeName {
+			found = true
+			continue
+		}
+
+		candidates[node.Name] = &drainCandidate{
+			impact: DrainNodeImpact{
+				NodeName:             node.Name,
+				CpuUsage:             percentOf(usedCPU, totalCPU),
+				ProjectedCpuUsage:    percentOf(usedCPU, totalCPU),
+				MemoryUsage:          usage.Memory().Value(),
+				ProjectedMemoryUsage: usage.Memory().Value(),
+			},
+			totalCPU:    totalCPU,
+			usedCPU:     usedCPU,
+			freeCPU:     node.Status.Allocatable.Cpu().MilliValue(),
+			freeMemory:  node.Status.Allocatable.Memory().Value(),
+			schedulable: !node.Spec.Unschedulable && nodeReady(&node),
+		}
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found: " + nodeName})
+		return
+	}
+
+	// Subtract the requests of pods already running on each candidate and
+	// collect the pods that would be evicted from the drained node
+	var evicted []DrainPlacement
+	evictedMemory := make(map[string]int64)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+
+		cpuRequest, memoryRequest := podRequests(&pod)
+		if candidate, ok := candidates[pod.Spec.NodeName]; ok {
+			candidate.freeCPU -= cpuRequest
+			candidate.freeMemory -= memoryRequest
+			continue
+		}
+
+		if pod.Spec.NodeName != nodeName || !podEvictable(&pod) {
+			continue
+		}
+
+		usage := usageByPod[pod.Namespace+"/"+pod.Name]
+		placement := DrainPlacement{
+			Namespace:   pod.Namespace,
+			PodName:     pod.Name,
+			CpuRequest:  cpuRequest,
+			CpuUsage:    usage.cpu,
+			MemoryUsage: usage.memory,
+		}
+		evictedMemory[placement.Namespace+"/"+placement.PodName] = memoryRequest
+		evicted = append(evicted, placement)
+	}
+
+	// Place the largest pods first so they get the best chance to fit
+	sort.Slice(evicted, func(i, j int) bool {
+		return evicted[i].CpuRequest > evicted[j].CpuRequest
+	})
+
+	result := DrainImpact{
+		NodeName:        nodeName,
+		Placements:      []DrainPlacement{},
+		Unschedulable:   []DrainPlacement{},
+		ClusterCpuUsage: percentOf(clusterUsedCPU, clusterTotalCPU),
+	}
+
+	for _, placement := range evicted {
+		memoryRequest := evictedMemory[placement.Namespace+"/"+placement.PodName]
+
+		var best *drainCandidate
+		var bestUsage float64
+		for _, candidate := range candidates {
+			if !candidate.schedulable || candidate.freeCPU < placement.CpuRequest || candidate.freeMemory < memoryRequest {
+				continue
+			}
+			projected := percentOf(candidate.usedCPU+placement.CpuUsage, candidate.totalCPU)
+			if best == nil || projected < bestUsage {
+				best = candidate
+				bestUsage = projected
+			}
+		}
+
+		if best == nil {
+			result.Unschedulable = append(result.Unschedulable, placement)
+			continue
+		}
+
+		best.freeCPU -= placement.CpuRequest
+		best.freeMemory -= memoryRequest
+		best.usedCPU += placement.CpuUsage
+		best.impact.ProjectedCpuUsage = bestUsage
+		best.impact.ProjectedMemoryUsage += placement.MemoryUsage
+		best.impact.PodsReceived++
+
+		placement.TargetNode = best.impact.NodeName
+		result.Placements = append(result.Placements, placement)
+	}
+
+	// Usage moves with the pods, so the cluster keeps its used CPU but loses
+	// the drained node's capacity
+	var remainingCPU, remainingUsedCPU int64
+	for _, candidate := range candidates {
+		remainingCPU += candidate.totalCPU
+		remainingUsedCPU += candidate.usedCPU
+		result.Nodes = append(result.Nodes, candidate.impact)
+	}
+	result.ProjectedClusterCpuUsage = percentOf(remainingUsedCPU, remainingCPU)
+
+	sort.Slice(result.Nodes, func(i, j int) bool {
+		return result.Nodes[i].NodeName < result.Nodes[j].NodeName
+	})
+
+	respond(c, http.StatusOK, result)
+}
+
+// podRequests returns the effective CPU (millicores) and memory (bytes)
+// requests of a pod, taking init containers into account the same way the
+// scheduler does.
+func podRequests(pod *corev1.Pod) (int64, int64) {
+	var cpu, memory int64
+	for _, container := range pod.Spec.Containers {
+		cpu += container.Resources.Requests.Cpu().MilliValue()
+		memory += container.Resources.Requests.Memory().Value()
+	}
+	for _, container := range pod.Spec.InitContainers {
+		cpu = max(cpu, container.Resources.Requests.Cpu().MilliValue())
+		memory = max(memory, container.Resources.Requests.Memory().Value())
+	}
+	return cpu, memory
+}
+
+// podEvictable reports whether a drain would move the pod elsewhere.
+// DaemonSet pods and static (mirror) pods stay bound to their node.
+func podEvictable(pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+		return false
+	}
+	for _, owner := range pod.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return false
+		}
+	}
+	return true
+}
+
+func nodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func percentOf(used, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(used) / float64(total) * 100
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	mimeNDJSON  = "application/x-ndjson"
+	mimeCSV     = "text/csv"
+	mimeMsgpack = "application/msgpack"
+	mimeCBOR    = "application/cbor"
+)
+
+// responseFormats lists the formats every data endpoint can produce, in
+// order of preference when the client accepts several.
+var responseFormats = []string{
+	gin.MIMEJSON,
+	mimeNDJSON,
+	mimeCSV,
+	mimeMsgpack,
+	mimeCBOR,
+}
+
+// respond writes data in the format negotiated from the Accept header,
+// defaulting to JSON. NDJSON and CSV write one line per element and need
+// data to be a slice; CSV additionally needs the elements to be structs,
+// whose json tags become the column names.
+func respond(c *gin.Context, status int, data any) {
+	switch c.NegotiateFormat(responseFormats...) {
+	case mimeNDJSON:
+		respondNDJSON(c, status, data)
+	case mimeCSV:
+		respondCSV(c, status, data)
+	case mimeMsgpack:
+		respondMsgpack(c, status, data)
+	case mimeCBOR:
+		respondCBOR(c, status, data)
+	case gin.MIMEJSON:
+		c.JSON(status, data)
+	default:
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": "supported formats: " + strings.Join(responseFormats, ", ")})
+	}
+}
+
+func respondNDJSON(c *gin.Context, status int, data any) {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Slice {
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": "this endpoint does not return a list, use JSON"})
+		return
+	}
+
+	c.Header("Content-Type", mimeNDJSON)
+	c.Status(status)
+	encoder := newNDJSONEncoder(c.Writer)
+	for i := 0; i < v.Len(); i++ {
+		if err := encoder.encode(v.Index(i)); err != nil {
+			return
+		}
+	}
+}
+
+func respondCSV(c *gin.Context, status int, data any) {
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct {
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": "this endpoint does not return rows, use JSON"})
+		return
+	}
+
+	c.Header("Content-Type", mimeCSV)
+	c.Status(status)
+	encoder := newCSVEncoder(c.Writer, v.Type().Elem())
+	for i := 0; i < v.Len(); i++ {
+		if err := encoder.encode(v.Index(i)); err != nil {
+			return
+		}
+	}
+	encoder.flush()
+}
+
+// rowEncoder writes a list one element at a time, so it can be sent while
+// it is still being read.
+type rowEncoder interface {
+	encode(row reflect.Value) error
+	flush() error
+}
+
+// csvEncoder writes the header on creation and one record per row.
+type csvEncoder struct {
+	w       *csv.Writer
+	columns []csvColumn
+	record  []string
+}
+
+func newCSVEncoder(w io.Writer, elem reflect.Type) *csvEncoder {
+	e := &csvEncoder{w: csv.NewWriter(w), columns: csvColumns(elem)}
+	e.record = make([]string, len(e.columns))
+	for i, column := range e.columns {
+		e.record[i] = column.name
+	}
+	e.w.Write(e.record)
+	return e
+}
+
+func (e *csvEncoder) encode(row reflect.Value) error {
+	for i, column := range e.columns {
+		e.record[i] = csvValue(row.Field(column.index))
+	}
+	e.w.Write(e.record)
+	return e.w.Error()
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonEncoder writes one JSON document per line.
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer) *ndjsonEncoder {
+	return &ndjsonEncoder{encoder: json.NewEncoder(w)}
+}
+
+func (e *ndjsonEncoder) encode(row reflect.Value) error {
+	return e.encoder.Encode(row.Interface())
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return nil
+}
+
+// streamFormats lists the formats respondStream can write row by row, in
+// order of preference.
+var streamFormats = []string{
+	mimeCSV,
+	mimeNDJSON,
+}
+
+// streamFlushRows is how many rows respondStream writes between flushes,
+// so the client receives them while they are being read from the
+// database.
+const streamFlushRows = 1000
+
+// respondStream writes the rows each emits in the format negotiated from
+// streamFormats, flushing as it goes instead of collecting them first.
+// With a filename the response is an attachment named after it and the
+// format. A complete response ends with its checksum in checksumTrailer.
+// It returns the number of rows written; once the first row is
+// out, errors can only truncate the response.
+func respondStream[T any](c *gin.Context, status int, filename string, each func(emit func(T) error) error) (int, error) {
+	format := c.NegotiateFormat(streamFormats...)
+	if format == "" {
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": "supported formats: " + strings.Join(streamFormats, ", ")})
+		return 0, nil
+	}
+
+	checksum := newChecksumWriter(c)
+	w := bufio.NewWriter(checksum)
+	var encoder rowEncoder
+	var extension string
+	switch format {
+	case mimeCSV:
+		encoder, extension = newCSVEncoder(w, reflect.TypeFor[T]()), ".csv"
+	case mimeNDJSON:
+		encoder, extension = newNDJSONEncoder(w), ".ndjson"
+	}
+	c.Header("Content-Type", format)
+	if filename != "" {
+		c.Header("Content-Disposition", `attachment; filename="`+filename+extension+`"`)
+	}
+	c.Status(status)
+
+	rows := 0
+	err := each(func(row T) error {
+		if err := encoder.encode(reflect.ValueOf(row)); err != nil {
+			return err
+		}
+		if rows++; rows%streamFlushRows == 0 {
+			if err := encoder.flush(); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if flushErr := encoder.flush(); err == nil {
+		err = flushErr
+	}
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if err == nil {
+		checksum.setTrailer(c)
+	}
+	return rows, err
+}
+
+func respondMsgpack(c *gin.Context, status int, data any) {
+	body, err := marshalMsgpack(data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(status, mimeMsgpack, body)
+}
+
+// marshalMsgpack encodes with the json field names so every format uses
+// the same keys.
+func marshalMsgpack(data any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cborMode encodes times as RFC 3339 strings like the JSON output instead
+// of the default whole unix seconds. Field names come from the json tags.
+var cborMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+func respondCBOR(c *gin.Context, status int, data any) {
+	body, err := cborMode.Marshal(data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(status, mimeCBOR, body)
+}
+
+type csvColumn struct {
+	name  string
+	index int
+}
+
+// csvColumns returns the exported fields of a struct named after their
+// json tags.
+func csvColumns(t reflect.Type) []csvColumn {
+	var columns []csvColumn
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		columns = append(columns, csvColumn{name: name, index: i})
+	}
+	return columns
+}
+
+func csvValue(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case int, int64:
+		return fmt.Sprint(value)
+	default:
+		// Nested values (lists, maps) are embedded as JSON
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+}
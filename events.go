@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// pollEvents collects everything derived from Kubernetes events. Events
+// are only kept by the API server for about an hour, so they are polled
+// and persisted rather than looked up when a report is requested.
+func pollEvents(ctx context.Context, interval time.Duration, podLister corelisters.PodLister) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		collectImagePulls(ctx)
+		collectDisruptions(ctx, podLister)
+	}
+}
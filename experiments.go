@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// An experiment compares two arms, namespaces or deployments, that run
+// side by side over the same window, e.g. the same service on two
+// runtimes with traffic split between them. Its report pairs the pod
+// usage of both arms tick by tick, so load that changes over the window
+// affects both arms alike and drops out of the deltas.
+
+type ExperimentArm struct {
+	Namespace string `json:"namespace"`
+	// Deployment limits the arm to the pods of one deployment, matched by
+	// the <deployment>-<replicaset hash>-<pod hash> names it gives them.
+	Deployment string `json:"deployment,omitempty"`
+}
+
+func (a ExperimentArm) String() string {
+	if a.Deployment == "" {
+		return a.Namespace
+	}
+	return a.Namespace + "/" + a.Deployment
+}
+
+type Experiment struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	A           ExperimentArm `json:"a"`
+	B           ExperimentArm `json:"b"`
+	Start       time.Time     `json:"start"`
+	// End is unset while the experiment runs, its report then ends now.
+	End       *time.Time `json:"end,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ArmUsage is the pod usage of one arm over the window. CPU is in
+// millicores and memory in bytes, summed over the arm's pods.
+type ArmUsage struct {
+	Arm          string  `json:"arm"`
+	Samples      int     `json:"samples"`
+	AvgPods      float64 `json:"avg_pods"`
+	AvgCpu       float64 `json:"avg_cpu"`
+	MaxCpu       int64   `json:"max_cpu"`
+	AvgMemory    float64 `json:"avg_memory"`
+	MaxMemory    int64   `json:"max_memory"`
+	CpuPerPod    float64 `json:"cpu_per_pod"`
+	MemoryPerPod float64 `json:"memory_per_pod"`
+	// CpuRequestUtilization and MemoryRequestUtilization are the averages
+	// over the requests of the arm's pods running now, unset when none
+	// are.
+	CpuRequestUtilization    *float64 `json:"cpu_request_utilization,omitempty"`
+	MemoryRequestUtilization *float64 `json:"memory_request_utilization,omitempty"`
+}
+
+// PairedDelta is the mean B minus A difference of a metric over the ticks
+// both arms have samples for, with its 95% confidence interval. Relative
+// is the delta as a fraction of A. Consecutive ticks are not independent,
+// so the interval is on the narrow side for short windows.
+type PairedDelta struct {
+	Metric      string  `json:"metric"`
+	Pairs       int     `json:"pairs"`
+	Delta       float64 `json:"delta"`
+	Low         float64 `json:"low"`
+	High        float64 `json:"high"`
+	Relative    float64 `json:"relative"`
+	Significant bool    `json:"significant"`
+}
+
+type ExperimentReport struct {
+	Experiment Experiment    `json:"experiment"`
+	From       time.Time     `json:"from"`
+	To         time.Time     `json:"to"`
+	A          ArmUsage      `json:"a"`
+	B          ArmUsage      `json:"b"`
+	Deltas     []PairedDelta `json:"deltas"`
+	Warnings   []string      `json:"warnings,omitempty"`
+}
+
+var errExperimentNotFound = errors.New("experiment not found")
+
+const experimentColumns = `
+            name,
+            description,
+            a_namespace,
+            a_deployment,
+            b_namespace,
+            b_deployment,
+            start_time,
+            end_time,
+            created_at`
+
+func scanExperiment(row interface{ Scan(...any) error }) (*Experiment, error) {
+	var e Experiment
+	var end sql.NullTime
+	err := row.Scan(&e.Name, &e.Description, &e.A.Namespace, &e.A.Deployment, &e.B.Namespace, &e.B.Deployment, &e.Start, &end, &e.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errExperimentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if end.Valid {
+		e.End = &end.Time
+	}
+	return &e, nil
+}
+
+func loadExperiment(name string) (*Experiment, error) {
+	return scanExperiment(db.QueryRow(`
+        SELECT`+experimentColumns+`
+        FROM experiments
+        WHERE name = ?
+    `, name))
+}
+
+// createExperiment defines an experiment. start defaults to now and end
+// may be left out for an experiment that is still running.
+func createExperiment(c *gin.Context) {
+	var req struct {
+		Name        string        `json:"name"`
+		Description string        `json:"description"`
+		A           ExperimentArm `json:"a"`
+		B           ExperimentArm `json:"b"`
+		Start       string        `json:"start"`
+		End         string        `json:"end"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	if req.A.Namespace == "" || req.B.Namespace == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a and b need a namespace"})
+		return
+	}
+	if req.A == req.B {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a and b must differ"})
+		return
+	}
+
+	e := Experiment{
+		Name:        req.Name,
+		Description: req.Description,
+		A:           req.A,
+		B:           req.B,
+		Start:       time.Now(),
+		CreatedAt:   time.Now(),
+	}
+	if req.Start != "" {
+		start, err := parseTime(req.Start)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start: " + err.Error()})
+			return
+		}
+		e.Start = start
+	}
+	if req.End != "" {
+		end, err := parseTime(req.End)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end: " + err.Error()})
+			return
+		}
+		if !end.After(e.Start) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "end must be after start"})
+			return
+		}
+		e.End = &end
+	}
+
+	result, err := db.Exec(
+		`INSERT INTO experiments (
+            name,
+            description,
+            a_namespace,
+            a_deployment,
+            b_namespace,
+            b_deployment,
+            start_time,
+            end_time,
+            created_at
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (name) DO NOTHING`,
+		e.Name,
+		e.Description,
+		e.A.Namespace,
+		e.A.Deployment,
+		e.B.Namespace,
+		e.B.Deployment,
+		e.Start,
+		e.End,
+		e.CreatedAt,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "an experiment named " + e.Name + " already exists"})
+		return
+	}
+
+	respond(c, http.StatusCreated, e)
+}
+
+func getExperiments(c *gin.Context) {
+	rows, err := db.Query(`
+        SELECT` + experimentColumns + `
+        FROM experiments
+        ORDER BY start_time
+    `)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	experiments := []Experiment{}
+	for rows.Next() {
+		e, err := scanExperiment(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		experiments = append(experiments, *e)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, experiments)
+}
+
+func getExperiment(c *gin.Context) {
+	e, err := loadExperiment(c.Param("name"))
+	if errors.Is(err, errExperimentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, e)
+}
+
+func deleteExperiment(c *gin.Context) {
+	result, err := db.Exec("DELETE FROM experiments WHERE name = ?", c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": errExperimentNotFound.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// armTick is the usage of an arm's pods at one collection.
+type armTick struct {
+	pods   int
+	cpu    int64
+	memory int64
+}
+
+// armTicks returns the usage of an arm per collection, keyed by the unix
+// nanoseconds of its timestamp.
+func armTicks(q rowQuerier, arm ExperimentArm, from, to time.Time) (map[int64]*armTick, error) {
+	query := `
+        SELECT
+            timestamp,
+            pod_name,
+            cpu_usage,
+            memory_usage
+        FROM pod_metrics
+        WHERE timestamp BETWEEN ? AND ?
+          AND namespace = ?`
+	args := []any{from, to, arm.Namespace}
+	var pods *regexp.Regexp
+	if arm.Deployment != "" {
+		// Names are DNS labels, so they hold no LIKE wildcards
+		query += " AND pod_name LIKE ?"
+		args = append(args, arm.Deployment+"-%")
+		pods = deploymentPods(arm.Deployment)
+	}
+
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ticks := make(map[int64]*armTick)
+	for rows.Next() {
+		var timestamp time.Time
+		var podName string
+		var cpu, memory int64
+		if err := rows.Scan(&timestamp, &podName, &cpu, &memory); err != nil {
+			return nil, err
+		}
+		if pods != nil && !pods.MatchString(podName) {
+			continue
+		}
+		t := ticks[timestamp.UnixNano()]
+		if t == nil {
+			t = &armTick{}
+			ticks[timestamp.UnixNano()] = t
+		}
+		t.pods++
+		t.cpu += cpu
+		t.memory += memory
+	}
+	return ticks, rows.Err()
+}
+
+// deploymentPods matches the names of the pods of a deployment, which
+// its ReplicaSets name <deployment>-<hash> and their pods
+// <replicaset>-<hash>.
+func deploymentPods(deployment string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(deployment) + "-[a-z0-9]{1,10}-[a-z0-9]{5}$")
+}
+
+func armUsage(arm ExperimentArm, ticks map[int64]*armTick) ArmUsage {
+	usage := ArmUsage{Arm: arm.String(), Samples: len(ticks)}
+	if len(ticks) == 0 {
+		return usage
+	}
+	var pods, cpu, memory float64
+	for _, t := range ticks {
+		pods += float64(t.pods)
+		cpu += float64(t.cpu)
+		memory += float64(t.memory)
+		usage.MaxCpu = max(usage.MaxCpu, t.cpu)
+		usage.MaxMemory = max(usage.MaxMemory, t.memory)
+	}
+	n := float64(len(ticks))
+	usage.AvgPods = pods / n
+	usage.AvgCpu = cpu / n
+	usage.AvgMemory = memory / n
+	usage.CpuPerPod = cpu / pods
+	usage.MemoryPerPod = memory / pods
+	return usage
+}
+
+// addRequestUtilization sets the request utilization of an arm from the
+// requests of its pods running now. Without the Kubernetes API it is left
+// out.
+func addRequestUtilization(c *gin.Context, arm ExperimentArm, usage *ArmUsage) {
+	if clientset == nil || usage.Samples == 0 {
+		return
+	}
+	pods, err := clientset.CoreV1().Pods(arm.Namespace).List(c.Request.Context(), metav1.ListOptions{})
+	if err != nil {
+		slog.Warn("Error listing experiment pods", "arm", arm.String(), "error", err)
+		return
+	}
+	var match *regexp.Regexp
+	if arm.Deployment != "" {
+		match = deploymentPods(arm.Deployment)
+	}
+	var running int
+	var cpu, memory int64
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || (match != nil && !match.MatchString(pod.Name)) {
+			continue
+		}
+		podCPU, podMemory := podRequests(&pod)
+		cpu += podCPU
+		memory += podMemory
+		running++
+	}
+	if running == 0 {
+		return
+	}
+	// Requests per pod times the average pod count, so scaling during the
+	// window is accounted for
+	if cpu > 0 {
+		v := usage.AvgCpu / (float64(cpu) / float64(running) * usage.AvgPods)
+		usage.CpuRequestUtilization = &v
+	}
+	if memory > 0 {
+		v := usage.AvgMemory / (float64(memory) / float64(running) * usage.AvgPods)
+		usage.MemoryRequestUtilization = &v
+	}
+}
+
+var pairedMetrics = []struct {
+	name  string
+	value func(*armTick) float64
+}{
+	{"cpu", func(t *armTick) float64 { return float64(t.cpu) }},
+	{"memory", func(t *armTick) float64 { return float64(t.memory) }},
+	{"cpu_per_pod", func(t *armTick) float64 { return float64(t.cpu) / float64(t.pods) }},
+	{"memory_per_pod", func(t *armTick) float64 { return float64(t.memory) / float64(t.pods) }},
+}
+
+// pairedDeltas compares the arms over the ticks both have samples for.
+func pairedDeltas(a, b map[int64]*armTick) []PairedDelta {
+	var pairs [][2]*armTick
+	for timestamp, tickA := range a {
+		if tickB, ok := b[timestamp]; ok {
+			pairs = append(pairs, [2]*armTick{tickA, tickB})
+		}
+	}
+
+	deltas := []PairedDelta{}
+	if len(pairs) < 2 {
+		return deltas
+	}
+	for _, metric := range pairedMetrics {
+		differences := make([]float64, len(pairs))
+		var sumA float64
+		for i, pair := range pairs {
+			differences[i] = metric.value(pair[1]) - metric.value(pair[0])
+			sumA += metric.value(pair[0])
+		}
+		mean, stddev := meanStdDev(differences)
+		margin := criticalT(float64(len(pairs)-1)) * stddev / math.Sqrt(float64(len(pairs)))
+		delta := PairedDelta{
+			Metric:      metric.name,
+			Pairs:       len(pairs),
+			Delta:       mean,
+			Low:         mean - margin,
+			High:        mean + margin,
+			Significant: mean-margin > 0 || mean+margin < 0,
+		}
+		if sumA != 0 {
+			delta.Relative = mean / (sumA / float64(len(pairs)))
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas
+}
+
+// getExperimentReport returns the paired comparison of the arms of an
+// experiment, rendered as Markdown or HTML with ?format=markdown or
+// ?format=html.
+func getExperimentReport(c *gin.Context) {
+	e, err := loadExperiment(c.Param("name"))
+	if errors.Is(err, errExperimentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := ExperimentReport{Experiment: *e, From: e.Start, To: time.Now()}
+	if e.End != nil {
+		report.To = *e.End
+	}
+	// Both arms are read from one snapshot, a tick collected in between
+	// would only have samples of one arm
+	view, release, err := snapshotView(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+	ticksA, err := armTicks(view.q, e.A, report.From, report.To)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ticksB, err := armTicks(view.q, e.B, report.From, report.To)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	report.A, report.B = armUsage(e.A, ticksA), armUsage(e.B, ticksB)
+	addRequestUtilization(c, e.A, &report.A)
+	addRequestUtilization(c, e.B, &report.B)
+	report.Deltas = pairedDeltas(ticksA, ticksB)
+
+	for _, usage := range []ArmUsage{report.A, report.B} {
+		if usage.Samples == 0 {
+			report.Warnings = append(report.Warnings, "no pod samples of "+usage.Arm+" in the window")
+		}
+	}
+	if report.A.Samples > 0 && report.B.Samples > 0 && len(report.Deltas) == 0 {
+		report.Warnings = append(report.Warnings, "the arms have fewer than 2 collections in common, there is nothing to pair")
+	} else if len(report.Deltas) > 0 && report.Deltas[0].Pairs < min(report.A.Samples, report.B.Samples) {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("only %d collections have samples of both arms", report.Deltas[0].Pairs))
+	}
+
+	var body bytes.Buffer
+	switch c.Query("format") {
+	case "":
+		respond(c, http.StatusOK, report)
+		return
+	case "markdown":
+		err = experimentMarkdown.Execute(&body, report)
+		c.Header("Content-Type", "text/markdown; charset=utf-8")
+	case "html":
+		err = experimentHTML.Execute(&body, report)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be markdown or html"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Writer.Write(body.Bytes())
+}
+
+var experimentMarkdown = template.Must(template.New("experiment").Funcs(reportFuncs).Parse(
+	`# Experiment {{.Experiment.Name}}
+{{with .Experiment.Description}}
+{{.}}
+{{end}}
+A: {{.A.Arm}}, B: {{.B.Arm}}, {{datetime .From}} to {{datetime .To}}.
+
+| | A | B |
+|---|---|---|
+| Collections | {{.A.Samples}} | {{.B.Samples}} |
+| Average pods | {{decimal .A.AvgPods}} | {{decimal .B.AvgPods}} |
+| Average CPU | {{millicores .A.AvgCpu}} | {{millicores .B.AvgCpu}} |
+| Peak CPU | {{millicores .A.MaxCpu}} | {{millicores .B.MaxCpu}} |
+| Average memory | {{mib .A.AvgMemory}} | {{mib .B.AvgMemory}} |
+| Peak memory | {{mib .A.MaxMemory}} | {{mib .B.MaxMemory}} |
+| CPU per pod | {{millicores .A.CpuPerPod}} | {{millicores .B.CpuPerPod}} |
+| Memory per pod | {{mib .A.MemoryPerPod}} | {{mib .B.MemoryPerPod}} |
+| CPU of requests | {{with .A.CpuRequestUtilization}}{{share .}}{{end}} | {{with .B.CpuRequestUtilization}}{{share .}}{{end}} |
+| Memory of requests | {{with .A.MemoryRequestUtilization}}{{share .}}{{end}} | {{with .B.MemoryRequestUtilization}}{{share .}}{{end}} |
+{{with .Deltas}}
+## B minus A
+
+| | Delta | 95% interval | Relative | |
+|---|---|---|---|---|
+{{range .}}| {{.Metric}} | {{if eq .Metric "cpu" "cpu_per_pod"}}{{millicores .Delta}} | {{millicores .Low}} to {{millicores .High}}{{else}}{{mib .Delta}} | {{mib .Low}} to {{mib .High}}{{end}} | {{share .Relative}} | {{if .Significant}}significant{{else}}within noise{{end}} |
+{{end}}{{end}}{{range .Warnings}}
+Warning: {{.}}
+{{end}}`))
+
+var experimentHTML = htmltemplate.Must(htmltemplate.New("experiment").Funcs(reportFuncs).Parse(
+	`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Experiment {{.Experiment.Name}}</title></head>
+<body>
+<h1>Experiment {{.Experiment.Name}}</h1>
+{{with .Experiment.Description}}<p>{{.}}</p>{{end}}
+<p>A: {{.A.Arm}}, B: {{.B.Arm}}, {{datetime .From}} to {{datetime .To}}.</p>
+<table>
+<tr><th></th><th>A</th><th>B</th></tr>
+<tr><td>Collections</td><td>{{.A.Samples}}</td><td>{{.B.Samples}}</td></tr>
+<tr><td>Average pods</td><td>{{decimal .A.AvgPods}}</td><td>{{decimal .B.AvgPods}}</td></tr>
+<tr><td>Average CPU</td><td>{{millicores .A.AvgCpu}}</td><td>{{millicores .B.AvgCpu}}</td></tr>
+<tr><td>Peak CPU</td><td>{{millicores .A.MaxCpu}}</td><td>{{millicores .B.MaxCpu}}</td></tr>
+<tr><td>Average memory</td><td>{{mib .A.AvgMemory}}</td><td>{{mib .B.AvgMemory}}</td></tr>
+<tr><td>Peak memory</td><td>{{mib .A.MaxMemory}}</td><td>{{mib .B.MaxMemory}}</td></tr>
+<tr><td>CPU per pod</td><td>{{millicores .A.CpuPerPod}}</td><td>{{millicores .B.CpuPerPod}}</td></tr>
+<tr><td>Memory per pod</td><td>{{mib .A.MemoryPerPod}}</td><td>{{mib .B.MemoryPerPod}}</td></tr>
+<tr><td>CPU of requests</td><td>{{with .A.CpuRequestUtilization}}{{share .}}{{end}}</td><td>{{with .B.CpuRequestUtilization}}{{share .}}{{end}}</td></tr>
+<tr><td>Memory of requests</td><td>{{with .A.MemoryRequestUtilization}}{{share .}}{{end}}</td><td>{{with .B.MemoryRequestUtilization}}{{share .}}{{end}}</td></tr>
+</table>
+{{with .Deltas}}<h2>B minus A</h2>
+<table>
+<tr><th></th><th>Delta</th><th>95% interval</th><th>Relative</th><th></th></tr>
+{{range .}}<tr><td>{{.Metric}}</td>{{if eq .Metric "cpu" "cpu_per_pod"}}<td>{{millicores .Delta}}</td><td>{{millicores .Low}} to {{millicores .High}}</td>{{else}}<td>{{mib .Delta}}</td><td>{{mib .Low}} to {{mib .High}}</td>{{end}}<td>{{share .Relative}}</td><td>{{if .Significant}}significant{{else}}within noise{{end}}</td></tr>
+{{end}}</table>
+{{end}}{{range .Warnings}}<p><strong>Warning:</strong> {{.}}</p>
+{{end}}</body>
+</html>
+`))
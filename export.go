@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getMetricsExport streams every node sample matching the filters of
+// /metrics through respondStream, as a CSV attachment unless the Accept
+// header asks for NDJSON. Unlike /metrics it isn't paged, the rows go
+// straight from the database to the client, so the export of a large
+// table doesn't have to fit into memory. With ?destination= only the
+// samples stored after the mark of that destination are shipped, for
+// periodic sync jobs into a data warehouse. The export doesn't move the
+// mark, the job acks the sequence number of the lastSeqTrailer once it
+// stored the samples, so an export it lost is shipped again. The export
+// reads one snapshot however long the client takes to receive it, so
+// samples stored or pruned meanwhile don't show up halfway.
+func getMetricsExport(c *gin.Context) {
+	basis := c.DefaultQuery("basis", "allocatable")
+	if basis != "allocatable" && basis != "capacity" && basis != "requests" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "basis must be allocatable, capacity or requests"})
+		return
+	}
+	if c.Query("step") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "step is not supported by the export, request /metrics?step= instead"})
+		return
+	}
+
+	// An incremental export ships what was stored after the mark of the
+	// destination, in the order it was stored. Filters would leave samples
+	// out that the next export doesn't ship either.
+	destination := c.Query("destination")
+	if destination != "" && (c.Query("node") != "" || c.Query("from") != "" || c.Query("to") != "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "destination can't be combined with node, from or to"})
+		return
+	}
+
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	q := SampleQuery{
+		From:      from,
+		To:        to,
+		Node:      c.Query("node"),
+		Basis:     basis,
+		Ascending: true,
+	}
+	if destination != "" {
+		mark, err := exportMark(destination)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		q.BySeq = true
+		q.AfterSeq = mark
+		c.Writer.Header().Add("Trailer", lastSeqTrailer)
+	}
+
+	view, release, err := snapshotView(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	last := q.AfterSeq
+	rows, err := respondStream(c, http.StatusOK, "metrics", func(emit func(MetricsData) error) error {
+		return view.store.EachSample(q, func(m MetricsData) error {
+			last = max(last, m.Seq)
+			return emit(m)
+		})
+	})
+	if err != nil {
+		// The status is already sent, the client sees a truncated export
+		slog.Error("Error exporting metrics", "rows", rows, "error", err)
+		return
+	}
+	if destination != "" {
+		c.Writer.Header().Set(lastSeqTrailer, strconv.FormatInt(last, 10))
+	}
+}
+
+// lastSeqTrailer tells an incremental export the sequence number of its
+// last sample, the one to ack. It is missing when the export failed.
+const lastSeqTrailer = "X-Last-Seq"
+
+// ExportAck is the sequence number of the last sample a destination
+// stored.
+type ExportAck struct {
+	Seq int64 `json:"seq"`
+}
+
+// ackExport moves the mark of a destination to the sequence number its
+// sync job acks, so the next export starts after it.
+func ackExport(c *gin.Context) {
+	var ack ExportAck
+	if err := c.ShouldBindJSON(&ack); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var stored sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(id) FROM metrics").Scan(&stored); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if ack.Seq <= 0 || ack.Seq > stored.Int64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "seq must be the sequence number of a stored sample"})
+		return
+	}
+	destination := c.Param("destination")
+	if err := saveExportMark(destination, ack.Seq); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	mark := ExportMark{Destination: destination}
+	err := db.QueryRow("SELECT last_seq, updated_at FROM export_marks WHERE destination = ?", destination).Scan(&mark.LastSeq, &mark.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, mark)
+}
+
+// ExportMark is the high-water mark of an export destination, the
+// sequence number of the last sample shipped to it.
+type ExportMark struct {
+	Destination string    `json:"destination"`
+	LastSeq     int64     `json:"last_seq"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// exportMark returns the mark of a destination, 0 for a new one so its
+// first export ships everything.
+func exportMark(destination string) (int64, error) {
+	var seq int64
+	err := db.QueryRow("SELECT last_seq FROM export_marks WHERE destination = ?", destination).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// saveExportMark advances the mark of a destination. It never moves back,
+// so a late ack of an earlier export can't undo a later one.
+func saveExportMark(destination string, seq int64) error {
+	_, err := db.Exec(`
+        INSERT INTO export_marks (destination, last_seq, updated_at)
+        VALUES (?, ?, ?)
+        ON CONFLICT (destination) DO UPDATE
+        SET last_seq = CASE WHEN excluded.last_seq > export_marks.last_seq THEN excluded.last_seq ELSE export_marks.last_seq END,
+            updated_at = excluded.updated_at
+    `, destination, seq, time.Now())
+	return err
+}
+
+// getExportMarks lists the destinations of incremental exports.
+func getExportMarks(c *gin.Context) {
+	rows, err := db.Query(`
+        SELECT destination, last_seq, updated_at
+        FROM export_marks
+        ORDER BY destination
+    `)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	marks := []ExportMark{}
+	for rows.Next() {
+		var m ExportMark
+		if err := rows.Scan(&m.Destination, &m.LastSeq, &m.UpdatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		marks = append(marks, m)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, marks)
+}
+
+// deleteExportMark forgets a destination, so its next export ships
+// everything again.
+func deleteExportMark(c *gin.Context) {
+	result, err := db.Exec("DELETE FROM export_marks WHERE destination = ?", c.Param("destination"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "export destination not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type ContainerFilesystemSample struct {
+	Timestamp     time.Time `json:"timestamp"`
+	ContainerName string    `json:"container_name"`
+	NodeName      string    `json:"node_name"`
+	RootfsBytes   int64     `json:"rootfs_bytes"`
+	LogsBytes     int64     `json:"logs_bytes"`
+}
+
+type NodeImagesSample struct {
+	Timestamp       time.Time `json:"timestamp"`
+	ImageCount      int       `json:"image_count"`
+	ImagesBytes     int64     `json:"images_bytes"`
+	ImageFsUsed     int64     `json:"image_fs_used"`
+	ImageFsCapacity int64     `json:"image_fs_capacity"`
+}
+
+// storeContainerFilesystems records the writable layer and log usage of
+// every container in a kubelet summary.
+func storeContainerFilesystems(nodeName string, summary *kubeletSummary) {
+	now := time.Now()
+	for _, pod := range summary.Pods {
+		namespace, podName, ok := cardinality.admitPod(pod.PodRef.Namespace, pod.PodRef.Name)
+		if !ok {
+			continue
+		}
+		for _, container := range pod.Containers {
+			if container.Rootfs == nil && container.Logs == nil {
+				continue
+			}
+
+			_, err := db.Exec(
+				`INSERT INTO container_filesystem (
+                    timestamp,
+                    namespace,
+                    pod_name,
+                    container_name,
+                    node_name,
+                    rootfs_bytes,
+                    logs_bytes
+                ) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				now,
+				namespace,
+				podName,
+				container.Name,
+				nodeName,
+				fsUsedBytes(container.Rootfs),
+				fsUsedBytes(container.Logs),
+			)
+			if err != nil {
+				slog.Error("Error inserting container filesystem stats", "node", nodeName, "error", err)
+			}
+		}
+	}
+}
+
+// storeNodeImages records the images pulled onto a node as reported in its
+// status, plus the image filesystem usage from the kubelet summary.
+func storeNodeImages(node *corev1.Node, summary *kubeletSummary) {
+	var imagesBytes int64
+	for _, image := range node.Status.Images {
+		imagesBytes += image.SizeBytes
+	}
+
+	var imageFs *kubeletFsStats
+	if summary.Node.Runtime != nil {
+		imageFs = summary.Node.Runtime.ImageFs
+	}
+	var capacity int64
+	if imageFs != nil && imageFs.CapacityBytes != nil {
+		capacity = int64(*imageFs.CapacityBytes)
+	}
+
+	_, err := db.Exec(
+		`INSERT INTO node_images (
+            timestamp,
+            node_name,
+            image_count,
+            images_bytes,
+            image_fs_used,
+            image_fs_capacity
+        ) VALUES (?, ?, ?, ?, ?, ?)`,
+		time.Now(),
+		node.Name,
+		len(node.Status.Images),
+		imagesBytes,
+		fsUsedBytes(imageFs),
+		capacity,
+	)
+	if err != nil {
+		slog.Error("Error inserting node image stats", "node", node.Name, "error", err)
+	}
+}
+
+func fsUsedBytes(fs *kubeletFsStats) int64 {
+	if fs == nil || fs.UsedBytes == nil {
+		return 0
+	}
+	return int64(*fs.UsedBytes)
+}
+
+func getPodFilesystem(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT
+            timestamp,
+            container_name,
+            node_name,
+            rootfs_bytes,
+            logs_bytes
+        FROM container_filesystem
+        WHERE namespace = ?
+          AND pod_name = ?
+          AND timestamp BETWEEN ? AND ?
+        ORDER BY timestamp, container_name
+    `, c.Param("namespace"), c.Param("name"), from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	samples := []ContainerFilesystemSample{}
+	for rows.Next() {
+		var s ContainerFilesystemSample
+		if err := rows.Scan(&s.Timestamp, &s.ContainerName, &s.NodeName, &s.RootfsBytes, &s.LogsBytes); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		samples = append(samples, s)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, samples)
+}
+
+func getNodeImages(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT
+            timestamp,
+            image_count,
+            images_bytes,
+            image_fs_used,
+            image_fs_capacity
+        FROM node_images
+        WHERE node_name = ?
+          AND timestamp BETWEEN ? AND ?
+        ORDER BY timestamp
+    `, c.Param("node"), from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	samples := []NodeImagesSample{}
+	for rows.Next() {
+		var s NodeImagesSample
+		if err := rows.Scan(&s.Timestamp, &s.ImageCount, &s.ImagesBytes, &s.ImageFsUsed, &s.ImageFsCapacity); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		samples = append(samples, s)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, samples)
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Aggregator mode, set with fleet-collectors, runs the binary in front of
+// the collectors of several clusters instead of collecting itself. Like a
+// standby reads from its primary, it reads from them over their API, but
+// at query time instead of copying their samples, and serves one API for
+// the fleet: the list endpoints return the items of every cluster tagged
+// with its name, /fleet/utilization and /fleet/report add the clusters up,
+// and /fleet/clusters/<name>/... passes any other read through to one
+// cluster. A cluster that doesn't answer is left out and named in the
+// X-Fleet-Unavailable header, so it can't take the fleet view down.
+
+const fleetUnavailableHeader = "X-Fleet-Unavailable"
+
+// fleetLists are the list endpoints the aggregator merges. Limits and
+// cursors apply per cluster, after_seq only makes sense with ?cluster=.
+var fleetLists = []string{
+	"/metrics",
+	"/metrics/latest",
+	"/metrics/aggregate",
+	"/metrics/recorded",
+	"/metrics/pods",
+	"/metrics/quotas",
+	"/metrics/node-events",
+	"/benchmarks",
+	"/experiments",
+	"/alerts",
+	"/reports",
+}
+
+// fleetCollector is a collector the aggregator reads from.
+type fleetCollector struct {
+	name string
+	url  string
+}
+
+var (
+	fleetCollectors []fleetCollector
+	fleetClient     *http.Client
+)
+
+// parseFleetCollectors parses the comma separated name=url pairs of
+// fleet-collectors. The names tag the items of every cluster.
+func parseFleetCollectors(value string) ([]fleetCollector, error) {
+	var collectors []fleetCollector
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rawURL, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q is not name=url", entry)
+		}
+		if slices.ContainsFunc(collectors, func(f fleetCollector) bool { return f.name == name }) {
+			return nil, fmt.Errorf("cluster %q is listed twice", name)
+		}
+		u, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL for cluster %q, expected the URL of a collector", name)
+		}
+		collectors = append(collectors, fleetCollector{name: name, url: strings.TrimSuffix(u.String(), "/")})
+	}
+	if len(collectors) == 0 {
+		return nil, errors.New("no collectors listed")
+	}
+	return collectors, nil
+}
+
+// request sends a GET for path, which may carry a query, to the collector
+// with the fleet-token.
+func (f fleetCollector) request(ctx context.Context, path, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if cfg.FleetToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.FleetToken)
+	}
+	return fleetClient.Do(req)
+}
+
+// get requests path from the collector and decodes the JSON response into
+// v unless it is nil. Numbers are kept as they were sent, so items passed
+// through as maps don't lose the precision of large integers.
+func (f fleetCollector) get(ctx context.Context, path string, v any) error {
+	resp, err := f.request(ctx, path, gin.MIMEJSON)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// clusterResult is the response of one cluster to a fan-out.
+type clusterResult[T any] struct {
+	cluster string
+	value   T
+}
+
+// fanOut requests path from every collector at once, or only from the one
+// of the cluster query parameter, and returns the responses in the order
+// of fleet-collectors. Clusters that failed are logged and named in the
+// X-Fleet-Unavailable header. It answers the request itself and returns
+// false if the cluster is unknown or no cluster answered.
+func fanOut[T any](c *gin.Context, path string) ([]clusterResult[T], bool) {
+	collectors, ok := selectedCollectors(c)
+	if !ok {
+		return nil, false
+	}
+
+	values := make([]T, len(collectors))
+	errs := make([]error, len(collectors))
+	var wg sync.WaitGroup
+	for i, f := range collectors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f.get(c.Request.Context(), path, &values[i])
+		}()
+	}
+	wg.Wait()
+
+	var results []clusterResult[T]
+	var unavailable []string
+	for i, f := range collectors {
+		if errs[i] != nil {
+			slog.Warn("Cluster unavailable", "cluster", f.name, "path", path, "error", errs[i])
+			unavailable = append(unavailable, f.name)
+			continue
+		}
+		results = append(results, clusterResult[T]{cluster: f.name, value: values[i]})
+	}
+	if len(unavailable) > 0 {
+		c.Header(fleetUnavailableHeader, strings.Join(unavailable, ","))
+	}
+	if len(results) == 0 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "no cluster answered: " + strings.Join(unavailable, ", ")})
+		return nil, false
+	}
+	return results, true
+}
+
+// selectedCollectors returns the collector of the cluster query parameter
+// if set, every collector otherwise. It answers 404 for an unknown cluster.
+func selectedCollectors(c *gin.Context) ([]fleetCollector, bool) {
+	name := c.Query("cluster")
+	if name == "" {
+		return fleetCollectors, true
+	}
+	i := slices.IndexFunc(fleetCollectors, func(f fleetCollector) bool { return f.name == name })
+	if i < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown cluster " + name})
+		return nil, false
+	}
+	return fleetCollectors[i : i+1], true
+}
+
+// forwardedPath is the path of the request with its query minus the
+// aggregator's own cluster parameter.
+func forwardedPath(c *gin.Context, path string) string {
+	query := c.Request.URL.Query()
+	query.Del("cluster")
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
+
+// getFleetList serves a list endpoint with the items of every cluster,
+// cluster by cluster, each with the cluster's name in "cluster".
+func getFleetList(c *gin.Context) {
+	results, ok := fanOut[[]map[string]any](c, forwardedPath(c, c.FullPath()))
+	if !ok {
+		return
+	}
+	items := []map[string]any{}
+	for _, r := range results {
+		for _, item := range r.value {
+			item["cluster"] = r.cluster
+			items = append(items, item)
+		}
+	}
+	respond(c, http.StatusOK, items)
+}
+
+// FleetCluster is the state of one collector of the fleet.
+type FleetCluster struct {
+	Name    string         `json:"name"`
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Version map[string]any `json:"version,omitempty"`
+}
+
+// getFleetClusters checks the liveness probe of every collector.
+func getFleetClusters(c *gin.Context) {
+	clusters := make([]FleetCluster, len(fleetCollectors))
+	var wg sync.WaitGroup
+	for i, f := range fleetCollectors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cluster := FleetCluster{Name: f.name, Status: "ok"}
+			if err := f.get(c.Request.Context(), "/healthz", nil); err != nil {
+				cluster.Status = "failing"
+				cluster.Error = err.Error()
+			} else if err := f.get(c.Request.Context(), "/version", &cluster.Version); err != nil {
+				cluster.Error = err.Error()
+			}
+			clusters[i] = cluster
+		}()
+	}
+	wg.Wait()
+	respond(c, http.StatusOK, clusters)
+}
+
+// proxyToCluster passes a read through to the collector of one cluster,
+// for the endpoints the aggregator doesn't merge.
+func proxyToCluster(c *gin.Context) {
+	i := slices.IndexFunc(fleetCollectors, func(f fleetCollector) bool { return f.name == c.Param("cluster") })
+	if i < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown cluster " + c.Param("cluster")})
+		return
+	}
+	path := c.Param("path")
+	if c.Request.URL.RawQuery != "" {
+		path += "?" + c.Request.URL.RawQuery
+	}
+	resp, err := fleetCollectors[i].request(c.Request.Context(), path, c.GetHeader("Accept"))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range []string{"Content-Type", "Content-Disposition", "X-Next-Seq", "X-Next-Offset"} {
+		if v := resp.Header.Get(header); v != "" {
+			c.Header(header, v)
+		}
+	}
+	c.Status(resp.StatusCode)
+	io.Copy(c.Writer, resp.Body)
+}
+
+// ClusterUtilization is the utilization of a cluster, or of the fleet, at
+// its latest collection tick. CPU is in millicores, memory in bytes and
+// the percentages are relative to allocatable.
+type ClusterUtilization struct {
+	Cluster           string    `json:"cluster,omitempty"`
+	Timestamp         time.Time `json:"timestamp"`
+	Nodes             int       `json:"nodes"`
+	UsedCpu           int64     `json:"used_cpu"`
+	AllocatableCpu    int64     `json:"allocatable_cpu"`
+	CpuUsage          float64   `json:"cpu_usage"`
+	UsedMemory        int64     `json:"used_memory"`
+	AllocatableMemory int64     `json:"allocatable_memory"`
+	MemoryUsage       float64   `json:"memory_usage"`
+	Headroom          int64     `json:"headroom"`
+}
+
+// FleetUtilization adds up the latest utilization of the clusters. The
+// percentages of the fleet are weighted by the size of each cluster and
+// its timestamp is that of the cluster it heard from longest ago.
+type FleetUtilization struct {
+	Fleet    ClusterUtilization   `json:"fleet"`
+	Clusters []ClusterUtilization `json:"clusters"`
+}
+
+// utilizationOf returns the utilization of a cluster from the samples of
+// its latest tick, false if it has none yet.
+func utilizationOf(cluster string, samples []MetricsData) (ClusterUtilization, bool) {
+	if len(samples) == 0 {
+		return ClusterUtilization{}, false
+	}
+	// Cluster values repeat on every node row of a tick
+	m := samples[0]
+	return ClusterUtilization{
+		Cluster:           cluster,
+		Timestamp:         m.Timestamp,
+		Nodes:             len(samples),
+		UsedCpu:           m.ClusterUsedCpu,
+		AllocatableCpu:    m.ClusterAllocatableCpu,
+		CpuUsage:          m.ClusterCpuUsage,
+		UsedMemory:        m.ClusterMemoryUsage,
+		AllocatableMemory: m.ClusterAllocatableMemory,
+		MemoryUsage:       m.ClusterMemoryUsagePercent,
+		Headroom:          m.Headroom,
+	}, true
+}
+
+// sumUtilization adds up the utilization of the clusters.
+func sumUtilization(clusters []ClusterUtilization) FleetUtilization {
+	fleet := FleetUtilization{Clusters: clusters}
+	for _, u := range clusters {
+		if fleet.Fleet.Timestamp.IsZero() || u.Timestamp.Before(fleet.Fleet.Timestamp) {
+			fleet.Fleet.Timestamp = u.Timestamp
+		}
+		fleet.Fleet.Nodes += u.Nodes
+		fleet.Fleet.UsedCpu += u.UsedCpu
+		fleet.Fleet.AllocatableCpu += u.AllocatableCpu
+		fleet.Fleet.UsedMemory += u.UsedMemory
+		fleet.Fleet.AllocatableMemory += u.AllocatableMemory
+		fleet.Fleet.Headroom += u.Headroom
+	}
+	if fleet.Fleet.AllocatableCpu > 0 {
+		fleet.Fleet.CpuUsage = float64(fleet.Fleet.UsedCpu) * 100 / float64(fleet.Fleet.AllocatableCpu)
+	}
+	if fleet.Fleet.AllocatableMemory > 0 {
+		fleet.Fleet.MemoryUsage = float64(fleet.Fleet.UsedMemory) * 100 / float64(fleet.Fleet.AllocatableMemory)
+	}
+	return fleet
+}
+
+// getFleetUtilization returns the latest utilization of every cluster and
+// of the fleet. Clusters that haven't collected yet are left out.
+func getFleetUtilization(c *gin.Context) {
+	if fleetCache != nil {
+		getCachedFleetUtilization(c)
+		return
+	}
+	fanOutUtilization(c)
+}
+
+// fanOutUtilization adds up the latest ticks of the clusters.
+func fanOutUtilization(c *gin.Context) {
+	results, ok := fanOut[[]MetricsData](c, "/metrics/latest")
+	if !ok {
+		return
+	}
+	clusters := []ClusterUtilization{}
+	for _, r := range results {
+		if u, ok := utilizationOf(r.cluster, r.value); ok {
+			clusters = append(clusters, u)
+		}
+	}
+	respond(c, http.StatusOK, sumUtilization(clusters))
+}
+
+// FleetReport summarizes the utilization of the fleet over a period from
+// the summaries of its clusters.
+type FleetReport struct {
+	From     time.Time            `json:"from"`
+	To       time.Time            `json:"to"`
+	Fleet    ClusterSummary       `json:"fleet"`
+	Clusters []FleetClusterReport `json:"clusters"`
+}
+
+type FleetClusterReport struct {
+	Cluster string         `json:"cluster"`
+	Summary ClusterSummary `json:"summary"`
+	Nodes   []NodeSummary  `json:"nodes"`
+}
+
+// combineSummaries adds up the summaries of the clusters. The averages are
+// weighted by the collection ticks of each cluster, not by its size, since
+// the summaries carry percentages only. The minimum headroom is the sum of
+// the minimums, a lower bound of what the fleet could place at its
+// busiest.
+func combineSummaries(summaries []ClusterSummary) ClusterSummary {
+	var fleet ClusterSummary
+	for _, s := range summaries {
+		if s.Samples == 0 {
+			continue
+		}
+		weight := float64(s.Samples)
+		fleet.Samples += s.Samples
+		fleet.AvgCpu += s.AvgCpu * weight
+		fleet.AvgMemory += s.AvgMemory * weight
+		fleet.AvgCpuRequests += s.AvgCpuRequests * weight
+		fleet.MaxCpu = max(fleet.MaxCpu, s.MaxCpu)
+		fleet.MaxMemory = max(fleet.MaxMemory, s.MaxMemory)
+		fleet.MinHeadroom += s.MinHeadroom
+	}
+	if fleet.Samples > 0 {
+		fleet.AvgCpu /= float64(fleet.Samples)
+		fleet.AvgMemory /= float64(fleet.Samples)
+		fleet.AvgCpuRequests /= float64(fleet.Samples)
+	}
+	return fleet
+}
+
+// getFleetReport summarizes the period between from and to, the last day
+// by default, across the clusters.
+func getFleetReport(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 24*time.Hour)
+	if !ok {
+		return
+	}
+	query := url.Values{"from": {from.Format(time.RFC3339Nano)}, "to": {to.Format(time.RFC3339Nano)}}
+	results, ok := fanOut[Report](c, "/reports/summary?"+query.Encode())
+	if !ok {
+		return
+	}
+	report := FleetReport{From: from, To: to, Clusters: []FleetClusterReport{}}
+	var summaries []ClusterSummary
+	for _, r := range results {
+		report.Clusters = append(report.Clusters, FleetClusterReport{
+			Cluster: r.cluster,
+			Summary: r.value.Cluster,
+			Nodes:   r.value.Nodes,
+		})
+		summaries = append(summaries, r.value.Cluster)
+	}
+	report.Fleet = combineSummaries(summaries)
+	respond(c, http.StatusOK, report)
+}
+
+// getFleetHealthz passes as long as the aggregator runs. Unreachable
+// clusters show in /fleet/clusters, a restart wouldn't bring them back.
+func getFleetHealthz(c *gin.Context) {
+	respondHealth(c, map[string]string{})
+}
+
+func getFleetCapabilities(c *gin.Context) {
+	caps := Capabilities{
+		Collectors: []string{},
+		Exporters:  []string{},
+		Features:   []string{"fleet", "health", "version"},
+	}
+	if fleetCache != nil {
+		caps.Features = append(caps.Features, "fleet-cache")
+	}
+	respond(c, http.StatusOK, caps)
+}
+
+// runAggregator serves the fleet API until SIGINT or SIGTERM. It needs no
+// cluster or database of its own.
+func runAggregator() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	fleetClient = &http.Client{Timeout: cfg.FleetTimeout}
+	slog.Info("Running as a fleet aggregator", "clusters", len(fleetCollectors), "cache", fleetCache != nil)
+
+	router := gin.Default()
+	router.Use(observeRequests())
+	router.Use(limitRequestBody(cfg.MaxBodyBytes))
+	router.GET("/healthz", getFleetHealthz)
+	router.GET("/readyz", getFleetHealthz)
+	if cfg.APIToken != "" {
+		router.Use(requireAuth(cfg.APIToken, false, cfg.APITokenReads))
+	}
+	for _, path := range fleetLists {
+		router.GET(path, getFleetList)
+	}
+	router.GET("/fleet/clusters", getFleetClusters)
+	router.GET("/fleet/clusters/:cluster/*path", proxyToCluster)
+	router.GET("/fleet/utilization", getFleetUtilization)
+	router.GET("/fleet/report", getFleetReport)
+	router.GET("/capabilities", getFleetCapabilities)
+	router.GET("/config", requireAuth(cfg.APIToken, false, true), getConfig)
+	router.GET("/version", getVersion)
+
+	listener, err := listen(cfg.AddressFamily, cfg.ListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Listening", "addr", listener.Addr().String())
+
+	server := &http.Server{
+		Handler:           router,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down HTTP server", "error", err)
+	}
+}
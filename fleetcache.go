@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With redis-url set, collectors publish the utilization of their latest
+// tick to Redis under their fleet-cluster name, and a fleet aggregator
+// answers /fleet/utilization from there with one MGET instead of asking
+// every cluster. The entries expire after stale-after, so a cluster that
+// stopped collecting drops out like one that doesn't answer. While Redis
+// is unreachable the aggregator asks the clusters.
+
+const fleetCacheKeyPrefix = "k8s-metrics-collector:fleet:"
+
+var fleetCache *redisClient
+
+func fleetCacheKey(cluster string) string {
+	return fleetCacheKeyPrefix + cluster
+}
+
+// publishFleetState publishes every tick until ctx is done.
+func publishFleetState(ctx context.Context) {
+	ttl := strconv.FormatInt(cfg.StaleAfter.Milliseconds(), 10)
+	for ctx.Err() == nil {
+		sub := updates.subscribe(nil)
+		stop := context.AfterFunc(ctx, func() { updates.unsubscribe(sub) })
+		for {
+			samples, ok := updates.receive(sub)
+			if !ok {
+				break
+			}
+			u, ok := utilizationOf(cfg.FleetCluster, samples)
+			if !ok {
+				continue
+			}
+			value, err := json.Marshal(u)
+			if err != nil {
+				slog.Error("Error encoding the fleet state", "error", err)
+				continue
+			}
+			if _, err := fleetCache.do(ctx, "SET", fleetCacheKey(cfg.FleetCluster), string(value), "PX", ttl); err != nil && ctx.Err() == nil {
+				slog.Error("Error publishing to the fleet cache", "error", err)
+			}
+		}
+		stop()
+		updates.unsubscribe(sub)
+		if updates.wasEvicted(sub) {
+			slog.Warn("Fleet cache fell behind, skipped ticks")
+		}
+	}
+}
+
+// cachedUtilization reads the utilization of the collectors from the
+// fleet cache. Clusters without an entry are named in the
+// X-Fleet-Unavailable header.
+func cachedUtilization(c *gin.Context, collectors []fleetCollector) ([]ClusterUtilization, error) {
+	command := []string{"MGET"}
+	for _, f := range collectors {
+		command = append(command, fleetCacheKey(f.name))
+	}
+	reply, err := fleetCache.do(c.Request.Context(), command...)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]any)
+
+	clusters := []ClusterUtilization{}
+	var unavailable []string
+	for i, f := range collectors {
+		var u ClusterUtilization
+		value, ok := "", false
+		if i < len(values) {
+			value, ok = values[i].(string)
+		}
+		if !ok || json.Unmarshal([]byte(value), &u) != nil {
+			unavailable = append(unavailable, f.name)
+			continue
+		}
+		u.Cluster = f.name
+		clusters = append(clusters, u)
+	}
+	if len(unavailable) > 0 {
+		c.Header(fleetUnavailableHeader, strings.Join(unavailable, ","))
+	}
+	return clusters, nil
+}
+
+// getCachedFleetUtilization answers /fleet/utilization from the fleet
+// cache, or from the clusters if it fails.
+func getCachedFleetUtilization(c *gin.Context) {
+	collectors, ok := selectedCollectors(c)
+	if !ok {
+		return
+	}
+	clusters, err := cachedUtilization(c, collectors)
+	if err != nil {
+		slog.Error("Error reading the fleet cache, asking the clusters", "error", err)
+		fanOutUtilization(c)
+		return
+	}
+	respond(c, http.StatusOK, sumUtilization(clusters))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FragmentationTick is the capacity left unrequested at one collection
+// tick, counted in standard pods as sized by headroom-pod-cpu and
+// headroom-pod-memory.
+type FragmentationTick struct {
+	Timestamp time.Time `json:"timestamp"`
+	Nodes     int       `json:"nodes"`
+	// FreeCpu and FreeMemory are allocatable minus requested, summed over
+	// the nodes.
+	FreeCpu    int64 `json:"free_cpu"`
+	FreeMemory int64 `json:"free_memory"`
+	// SchedulablePods fit by request on the nodes as they are,
+	// PooledPods would fit if the free capacity were on a single node.
+	SchedulablePods int64 `json:"schedulable_pods"`
+	PooledPods      int64 `json:"pooled_pods"`
+	// StrandedPods is the difference, the pods lost to fragmentation.
+	StrandedPods int64 `json:"stranded_pods"`
+	// StrandedCpu and StrandedMemory are the free capacity no standard pod
+	// fits into.
+	StrandedCpu    int64 `json:"stranded_cpu"`
+	StrandedMemory int64 `json:"stranded_memory"`
+}
+
+type FragmentationResponse struct {
+	From      time.Time           `json:"from"`
+	To        time.Time           `json:"to"`
+	PodCpu    int64               `json:"pod_cpu"`
+	PodMemory int64               `json:"pod_memory"`
+	Ticks     []FragmentationTick `json:"ticks"`
+	// AvgStrandedPods and MaxStrandedPods summarize the ticks.
+	AvgStrandedPods float64 `json:"avg_stranded_pods"`
+	MaxStrandedPods int64   `json:"max_stranded_pods"`
+}
+
+// getFragmentation reports how much capacity is stranded by bin-packing
+// over time: free capacity by request that is spread over the nodes in
+// pieces too small for a standard pod. Unlike the headroom, which is
+// based on usage, this is what the scheduler sees. ?node_group= limits it
+// to one node group. Samples recorded before memory requests were stored
+// are left out.
+func getFragmentation(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, time.Hour)
+	if !ok {
+		return
+	}
+
+	ticks, err := store.FreeCapacity(from, to, c.Query("node_group"), cfg.HeadroomPodCPU, cfg.HeadroomPodMemory)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := FragmentationResponse{
+		From:      from,
+		To:        to,
+		PodCpu:    cfg.HeadroomPodCPU,
+		PodMemory: cfg.HeadroomPodMemory,
+		Ticks:     []FragmentationTick{},
+	}
+	var strandedSum int64
+	for _, t := range ticks {
+		t.PooledPods = min(t.FreeCpu/cfg.HeadroomPodCPU, t.FreeMemory/cfg.HeadroomPodMemory)
+		t.StrandedPods = t.PooledPods - t.SchedulablePods
+		t.StrandedCpu = t.FreeCpu - t.SchedulablePods*cfg.HeadroomPodCPU
+		t.StrandedMemory = t.FreeMemory - t.SchedulablePods*cfg.HeadroomPodMemory
+		strandedSum += t.StrandedPods
+		response.MaxStrandedPods = max(response.MaxStrandedPods, t.StrandedPods)
+		response.Ticks = append(response.Ticks, t)
+	}
+	if len(response.Ticks) > 0 {
+		response.AvgStrandedPods = float64(strandedSum) / float64(len(response.Ticks))
+	}
+
+	respond(c, http.StatusOK, response)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// limitRangerAnnotation is set by the LimitRanger admission plugin when it
+// filled in requests or limits from a LimitRange default.
+const limitRangerAnnotation = "kubernetes.io/limit-ranger"
+
+type UnboundedContainer struct {
+	Namespace     string   `json:"namespace"`
+	Workload      string   `json:"workload"`
+	ContainerName string   `json:"container_name"`
+	Pods          int      `json:"pods"`
+	Missing       []string `json:"missing"`
+	Defaulted     string   `json:"defaulted,omitempty"`
+}
+
+type NamespaceDefaults struct {
+	Namespace      string            `json:"namespace"`
+	LimitRange     string            `json:"limit_range"`
+	DefaultRequest map[string]string `json:"default_request"`
+	DefaultLimit   map[string]string `json:"default_limit"`
+}
+
+type GovernanceReport struct {
+	Unbounded []UnboundedContainer `json:"unbounded"`
+	Defaulted []UnboundedContainer `json:"defaulted"`
+	Defaults  []NamespaceDefaults  `json:"defaults"`
+}
+
+// getGovernance lists workloads whose containers run without CPU or memory
+// requests and limits, which make utilization figures misleading: usage
+// without requests doesn't show up in bin-packing and usage without limits
+// can grow into other workloads' headroom. Containers that only have
+// values because a LimitRange filled in defaults are listed separately,
+// together with the defaults of each namespace.
+func getGovernance(c *gin.Context) {
+	ctx := c.Request.Context()
+	namespace := c.Query("namespace")
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	limitRanges, err := clientset.CoreV1().LimitRanges(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := GovernanceReport{
+		Unbounded: []UnboundedContainer{},
+		Defaulted: []UnboundedContainer{},
+		Defaults:  []NamespaceDefaults{},
+	}
+
+	// Replicas of the same workload are reported once
+	unbounded := make(map[string]*UnboundedContainer)
+	defaulted := make(map[string]*UnboundedContainer)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+
+		workload := pod.Name
+		if owner := metav1.GetControllerOf(&pod); owner != nil {
+			workload = owner.Kind + "/" + owner.Name
+		}
+
+		for _, container := range pod.Spec.Containers {
+			key := pod.Namespace + "/" + workload + "/" + container.Name
+
+			if missing := missingResources(container.Resources); len(missing) > 0 {
+				if entry, ok := unbounded[key]; ok {
+					entry.Pods++
+					continue
+				}
+				unbounded[key] = &UnboundedContainer{
+					Namespace:     pod.Namespace,
+					Workload:      workload,
+					ContainerName: container.Name,
+					Pods:          1,
+					Missing:       missing,
+				}
+				continue
+			}
+
+			if message, ok := pod.Annotations[limitRangerAnnotation]; ok {
+				if entry, ok := defaulted[key]; ok {
+					entry.Pods++
+					continue
+				}
+				defaulted[key] = &UnboundedContainer{
+					Namespace:     pod.Namespace,
+					Workload:      workload,
+					ContainerName: container.Name,
+					Pods:          1,
+					Missing:       []string{},
+					Defaulted:     message,
+				}
+			}
+		}
+	}
+
+	for _, entry := range unbounded {
+		report.Unbounded = append(report.Unbounded, *entry)
+	}
+	for _, entry := range defaulted {
+		report.Defaulted = append(report.Defaulted, *entry)
+	}
+	sortContainers(report.Unbounded)
+	sortContainers(report.Defaulted)
+
+	for _, limitRange := range limitRanges.Items {
+		for _, item := range limitRange.Spec.Limits {
+			if item.Type != corev1.LimitTypeContainer {
+				continue
+			}
+			report.Defaults = append(report.Defaults, NamespaceDefaults{
+				Namespace:      limitRange.Namespace,
+				LimitRange:     limitRange.Name,
+				DefaultRequest: resourceStrings(item.DefaultRequest),
+				DefaultLimit:   resourceStrings(item.Default),
+			})
+		}
+	}
+
+	respond(c, http.StatusOK, report)
+}
+
+// missingResources lists the CPU and memory requests and limits a
+// container doesn't set.
+func missingResources(resources corev1.ResourceRequirements) []string {
+	var missing []string
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if _, ok := resources.Requests[name]; !ok {
+			missing = append(missing, "requests."+string(name))
+		}
+		if _, ok := resources.Limits[name]; !ok {
+			missing = append(missing, "limits."+string(name))
+		}
+	}
+	return missing
+}
+
+func resourceStrings(list corev1.ResourceList) map[string]string {
+	values := make(map[string]string, len(list))
+	for name, quantity := range list {
+		values[string(name)] = quantity.String()
+	}
+	return values
+}
+
+func sortContainers(containers []UnboundedContainer) {
+	sort.Slice(containers, func(i, j int) bool {
+		a, b := containers[i], containers[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Workload != b.Workload {
+			return a.Workload < b.Workload
+		}
+		return a.ContainerName < b.ContainerName
+	})
+}
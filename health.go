@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const healthPingTimeout = 2 * time.Second
+
+type HealthCheck struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// checkDatabase pings every pool of the database.
+func checkDatabase(ctx context.Context) string {
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+	err := db.DB.PingContext(ctx)
+	if err == nil {
+		err = db.writer.PingContext(ctx)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// checkCollection reports a problem if the last collection tick is older
+// than stale-after. Checks return "" when they pass.
+func checkCollection(requireStarted bool) string {
+	last := lastCollection.Load()
+	if last == 0 {
+		if requireStarted {
+			statusMu.Lock()
+			defer statusMu.Unlock()
+			return "not collecting yet: " + status.State
+		}
+		return ""
+	}
+	if age := time.Since(time.Unix(0, last)); age > cfg.StaleAfter {
+		return "last collection " + age.Truncate(time.Second).String() + " ago"
+	}
+	return ""
+}
+
+func respondHealth(c *gin.Context, checks map[string]string) {
+	health := HealthCheck{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for name, result := range checks {
+		if result == "" {
+			checks[name] = "ok"
+			continue
+		}
+		health.Status = "failing"
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, health)
+}
+
+// getHealthz is the liveness probe. It fails when the database stopped
+// answering or collection stalled after it had started, both of which a
+// restart can fix. Waiting for the cluster at startup is not a failure.
+func getHealthz(c *gin.Context) {
+	respondHealth(c, map[string]string{
+		"collection": checkCollection(false),
+		"database":   checkDatabase(c.Request.Context()),
+	})
+}
+
+// getReadyz is the readiness probe. On top of liveness it requires that
+// collection is running, so no traffic reaches an instance that would
+// only serve stale data.
+func getReadyz(c *gin.Context) {
+	respondHealth(c, map[string]string{
+		"collection": checkCollection(true),
+		"database":   checkDatabase(c.Request.Context()),
+	})
+}
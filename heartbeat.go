@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// lastCollection holds the unix nano timestamp of the last collection tick
+// that successfully listed node metrics.
+var lastCollection atomic.Int64
+
+// sendHeartbeats pings the configured URL on every interval as long as the
+// collector has recorded data recently. When collection stalls the pings
+// stop, which lets an external dead man's switch raise the alarm.
+func sendHeartbeats(ctx context.Context, url string, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Allow for a missed tick when collecting less often than pinging
+		last := time.Unix(0, lastCollection.Load())
+		if time.Since(last) > max(interval, 2*cfg.CollectInterval) {
+			slog.Warn("Skipping heartbeat", "last_collection", last)
+			continue
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			slog.Error("Error sending heartbeat", "error", err)
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			slog.Error("Error sending heartbeat", "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("Heartbeat rejected", "status", resp.Status)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hub fans the samples of every collection tick out to the streaming
+// clients. Node samples go to every subscriber, pod samples only to those
+// of a subscription with a namespace filter. Publishing never blocks: each subscriber has a bounded queue and
+// a subscriber whose queue is full is evicted, so one stuck connection
+// can't hold up the collection loop. On top of that the samples queued for
+// all subscribers together are capped by the stream queue budget.
+type hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	// queued counts the samples waiting in all subscriber queues.
+	queued    int
+	evictions atomic.Int64
+}
+
+type subscriber struct {
+	// updates is closed when the subscriber is evicted or unsubscribed.
+	updates  chan hubUpdate
+	throttle *subscriptionThrottle
+	queued   int
+	evicted  bool
+}
+
+// hubUpdate carries either the node or the pod samples of a tick.
+type hubUpdate struct {
+	nodes []MetricsData
+	pods  []PodMetricsData
+}
+
+func (u hubUpdate) len() int {
+	return len(u.nodes) + len(u.pods)
+}
+
+var updates = &hub{subscribers: make(map[*subscriber]struct{})}
+
+// subscribe registers a client. sub may be nil to receive every sample.
+func (h *hub) subscribe(sub *Subscription) *subscriber {
+	s := &subscriber{updates: make(chan hubUpdate, cfg.StreamBuffer)}
+	if sub != nil {
+		s.throttle = newSubscriptionThrottle(sub)
+	}
+
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[s]; ok {
+		h.remove(s)
+	}
+}
+
+// receive waits for the next node samples of a subscriber without a
+// namespace filter. ok is false once the subscriber was evicted or
+// unsubscribed.
+func (h *hub) receive(s *subscriber) ([]MetricsData, bool) {
+	update, ok := h.receiveUpdate(s)
+	return update.nodes, ok
+}
+
+// receiveUpdate waits for the next node or pod samples of a subscriber.
+func (h *hub) receiveUpdate(s *subscriber) (hubUpdate, bool) {
+	update, ok := <-s.updates
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Updates left in the queue of an evicted subscriber are not delivered
+	if _, subscribed := h.subscribers[s]; !subscribed {
+		return hubUpdate{}, false
+	}
+	s.queued -= update.len()
+	h.queued -= update.len()
+	return update, ok
+}
+
+// wasEvicted reports whether the updates channel was closed because the
+// subscriber fell behind.
+func (h *hub) wasEvicted(s *subscriber) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return s.evicted
+}
+
+// queuedSamples returns the samples waiting in all subscriber queues.
+func (h *hub) queuedSamples() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.queued
+}
+
+func (h *hub) publish(samples []MetricsData) {
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		h.deliver(s, hubUpdate{nodes: s.filter(samples, now)})
+	}
+}
+
+// publishPods sends the pod samples of a tick to the subscribers with a
+// namespace filter.
+func (h *hub) publishPods(pods []PodMetricsData) {
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers {
+		if s.throttle != nil && len(s.throttle.sub.Namespaces) > 0 {
+			h.deliver(s, hubUpdate{pods: s.filterPods(pods, now)})
+		}
+	}
+}
+
+func (h *hub) deliver(s *subscriber, update hubUpdate) {
+	if update.len() == 0 {
+		return
+	}
+
+	// Make room by dropping whoever is furthest behind, which is
+	// normally the subscriber that is stuck
+	for h.queued+update.len() > cfg.StreamQueueBudget && h.queued > 0 {
+		h.evict(h.slowest(), "stream queue budget exceeded")
+	}
+	if s.evicted {
+		return
+	}
+
+	select {
+	case s.updates <- update:
+		s.queued += update.len()
+		h.queued += update.len()
+	default:
+		h.evict(s, "queue full")
+	}
+}
+
+func (h *hub) slowest() *subscriber {
+	var slowest *subscriber
+	for s := range h.subscribers {
+		if slowest == nil || s.queued > slowest.queued {
+			slowest = s
+		}
+	}
+	return slowest
+}
+
+func (h *hub) evict(s *subscriber, reason string) {
+	slog.Warn("Evicting stream subscriber", "queued_samples", s.queued, "reason", reason)
+	s.evicted = true
+	h.evictions.Add(1)
+	h.remove(s)
+}
+
+// remove drops a subscriber and the samples still queued for it.
+func (h *hub) remove(s *subscriber) {
+	delete(h.subscribers, s)
+	h.queued -= s.queued
+	s.queued = 0
+	close(s.updates)
+}
+
+func (s *subscriber) filter(samples []MetricsData, now time.Time) []MetricsData {
+	if s.throttle == nil {
+		return samples
+	}
+	var filtered []MetricsData
+	for _, m := range samples {
+		if s.throttle.sub.matches(m.NodeName) && s.throttle.admit(m.NodeName, m.CpuUsage, now) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+func (s *subscriber) filterPods(pods []PodMetricsData, now time.Time) []PodMetricsData {
+	var filtered []PodMetricsData
+	for _, p := range pods {
+		if s.throttle.sub.matchesPod(p) && s.throttle.admit(p.Namespace+"/"+p.PodName, podCPUPercent(p), now) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// pulledMessage matches the kubelet's Pulled event, e.g.
+// Successfully pulled image "nginx:1.27" in 2.1s (3.4s including waiting). Image size: 72099410 bytes.
+// The waiting time and image size are only reported by newer kubelets.
+var pulledMessage = regexp.MustCompile(`^Successfully pulled image "([^"]+)" in ([0-9][0-9.a-zµ]*)(?: \(([0-9][0-9.a-zµ]*) including waiting\))?(?:\. Image size: ([0-9]+) bytes)?`)
+
+type ImagePull struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Namespace    string    `json:"namespace"`
+	PodName      string    `json:"pod_name"`
+	NodeName     string    `json:"node_name"`
+	Image        string    `json:"image"`
+	Duration     float64   `json:"duration"`
+	WaitDuration float64   `json:"wait_duration"`
+	SizeBytes    int64     `json:"size_bytes"`
+	Bandwidth    float64   `json:"bandwidth"`
+}
+
+type ImagePullSummary struct {
+	Pulls         []ImagePull `json:"pulls"`
+	Count         int         `json:"count"`
+	TotalBytes    int64       `json:"total_bytes"`
+	TotalDuration float64     `json:"total_duration"`
+	Bandwidth     float64     `json:"bandwidth"`
+}
+
+// collectImagePulls stores the pull duration and image size reported in
+// Pulled events. Events are keyed by UID so seeing the same event on the
+// next poll is harmless.
+func collectImagePulls(ctx context.Context) {
+	events, err := clientset.CoreV1().Events("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.Set{"involvedObject.kind": "Pod", "reason": "Pulled"}.String(),
+	})
+	if err != nil {
+		slog.Error("Error listing image pull events", "error", err)
+		apiErrors.add("events", 1)
+		return
+	}
+
+	for _, event := range events.Items {
+		match := pulledMessage.FindStringSubmatch(event.Message)
+		if match == nil {
+			// "already present on machine", nothing was pulled
+			continue
+		}
+
+		duration, err := time.ParseDuration(match[2])
+		if err != nil {
+			continue
+		}
+		var wait time.Duration
+		if match[3] != "" {
+			wait, _ = time.ParseDuration(match[3])
+		}
+		var size int64
+		if match[4] != "" {
+			size, _ = strconv.ParseInt(match[4], 10, 64)
+		}
+		namespace, podName, ok := cardinality.admitPod(event.InvolvedObject.Namespace, event.InvolvedObject.Name)
+		if !ok {
+			continue
+		}
+
+		_, err = db.Exec(
+			`INSERT INTO image_pulls (
+                event_uid,
+                timestamp,
+                namespace,
+                pod_name,
+                node_name,
+                image,
+                duration,
+                wait_duration,
+                size_bytes
+            ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (event_uid) DO NOTHING`,
+			string(event.UID),
+			eventTime(&event).Local(),
+			namespace,
+			podName,
+			event.Source.Host,
+			match[1],
+			duration.Seconds(),
+			wait.Seconds(),
+			size,
+		)
+		if err != nil {
+			slog.Error("Error inserting image pull", "error", err)
+		}
+	}
+}
+
+// getImagePulls lists the recorded image pulls with the effective registry
+// bandwidth of each pull and of all pulls together. Pulls without a
+// reported size don't count towards the bandwidth.
+func getImagePulls(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            namespace,
+            pod_name,
+            node_name,
+            image,
+            duration,
+            wait_duration,
+            size_bytes
+        FROM image_pulls
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	for param, column := range map[string]string{"namespace": "namespace", "node": "node_name", "image": "image"} {
+		if v := c.Query(param); v != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	query, args = scopeNamespaces(c, query, args)
+	query += " ORDER BY timestamp"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	summary := ImagePullSummary{Pulls: []ImagePull{}}
+	var sizedDuration float64
+	for rows.Next() {
+		var p ImagePull
+		err := rows.Scan(
+			&p.Timestamp,
+			&p.Namespace,
+			&p.PodName,
+			&p.NodeName,
+			&p.Image,
+			&p.Duration,
+			&p.WaitDuration,
+			&p.SizeBytes,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if p.SizeBytes > 0 && p.Duration > 0 {
+			p.Bandwidth = float64(p.SizeBytes) / p.Duration
+			summary.TotalBytes += p.SizeBytes
+			sizedDuration += p.Duration
+		}
+		summary.TotalDuration += p.Duration
+		summary.Pulls = append(summary.Pulls, p)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	summary.Count = len(summary.Pulls)
+	if sizedDuration > 0 {
+		summary.Bandwidth = float64(summary.TotalBytes) / sizedDuration
+	}
+
+	respond(c, http.StatusOK, summary)
+}
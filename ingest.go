@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ingestRateWindow is how far back the ingest rates look.
+const ingestRateWindow = time.Minute
+
+// ingestSnapshot holds the sample and row totals after a collection tick.
+type ingestSnapshot struct {
+	at      time.Time
+	samples float64
+	rows    float64
+}
+
+// ingestTracker keeps the snapshots of the last rate window, the rates are
+// the difference between the oldest one and the current totals.
+type ingestTracker struct {
+	mu        sync.Mutex
+	snapshots []ingestSnapshot
+	nodes     atomic.Int64
+	pods      atomic.Int64
+}
+
+var ingest ingestTracker
+
+func (t *ingestTracker) record(now time.Time, nodes int) {
+	t.nodes.Store(int64(nodes))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.snapshots = append(t.snapshots, ingestSnapshot{at: now, samples: samplesCollected.total(), rows: rowsInserted.total()})
+	expired := 0
+	for expired < len(t.snapshots)-1 && now.Sub(t.snapshots[expired].at) > ingestRateWindow {
+		expired++
+	}
+	t.snapshots = t.snapshots[expired:]
+}
+
+// rates returns samples and rows per second over the rate window, 0 before
+// the first collection tick.
+func (t *ingestTracker) rates() (float64, float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.snapshots) == 0 {
+		return 0, 0
+	}
+	oldest := t.snapshots[0]
+	elapsed := time.Since(oldest.at).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return (samplesCollected.total() - oldest.samples) / elapsed, (rowsInserted.total() - oldest.rows) / elapsed
+}
+
+type IngestBacklog struct {
+	// StreamQueuedSamples wait to be sent to streaming clients.
+	StreamQueuedSamples int `json:"stream_queued_samples"`
+	// WriteConnectionsInUse is 1 while the SQLite writer is busy, on
+	// PostgreSQL it counts every connection in use.
+	WriteConnectionsInUse int `json:"write_connections_in_use"`
+	// CollectionLag is how much longer than the interval the last
+	// collection tick is ago.
+	CollectionLag float64 `json:"collection_lag_seconds"`
+}
+
+type IngestStats struct {
+	SamplesPerSecond float64       `json:"samples_per_second"`
+	RowsPerSecond    float64       `json:"rows_per_second"`
+	ActiveNodes      int64         `json:"active_nodes"`
+	ActivePods       int64         `json:"active_pods"`
+	Window           float64       `json:"window_seconds"`
+	Backlog          IngestBacklog `json:"backlog"`
+}
+
+// getIngestStats reports how much the collector takes in and writes, so it
+// can be sized before pointing it at a bigger cluster.
+func getIngestStats(c *gin.Context) {
+	samples, rows := ingest.rates()
+	stats := IngestStats{
+		SamplesPerSecond: samples,
+		RowsPerSecond:    rows,
+		ActiveNodes:      ingest.nodes.Load(),
+		ActivePods:       ingest.pods.Load(),
+		Window:           ingestRateWindow.Seconds(),
+		Backlog: IngestBacklog{
+			StreamQueuedSamples: updates.queuedSamples(),
+		},
+	}
+	for _, pool := range db.stats() {
+		if pool.name != "read" {
+			stats.Backlog.WriteConnectionsInUse += pool.InUse
+		}
+	}
+	if last := lastCollection.Load(); last != 0 {
+		stats.Backlog.CollectionLag = max(0, (time.Since(time.Unix(0, last)) - cfg.CollectInterval).Seconds())
+	}
+
+	respond(c, http.StatusOK, stats)
+}
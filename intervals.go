@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// deltaConfidence is the confidence level of the delta intervals.
+const deltaConfidence = 0.95
+
+// studentT975 are the 97.5% quantiles of Student's t distribution for 1
+// to 30 degrees of freedom, the two-sided 95% critical values.
+var studentT975 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// criticalT returns the two-sided 95% critical value for df degrees of
+// freedom, rounded down to stay on the conservative side.
+func criticalT(df float64) float64 {
+	switch n := int(df); {
+	case n < 1:
+		return math.NaN()
+	case n <= len(studentT975):
+		return studentT975[n-1]
+	case n <= 40:
+		return 2.021
+	case n <= 60:
+		return 2.000
+	case n <= 120:
+		return 1.980
+	default:
+		return 1.960
+	}
+}
+
+// DeltaInterval is the 95% confidence interval of the candidate minus base
+// delta of a cluster average, with every run counting once. Delta is the
+// difference of the run means, so unlike the pooled cluster delta a long
+// run doesn't outweigh short ones.
+type DeltaInterval struct {
+	Metric     string  `json:"metric"`
+	Delta      float64 `json:"delta"`
+	Low        float64 `json:"low"`
+	High       float64 `json:"high"`
+	Confidence float64 `json:"confidence"`
+	// Significant is whether the interval excludes zero.
+	Significant bool `json:"significant"`
+	// MinRuns is about how many runs per side it takes for the interval
+	// to exclude zero with the observed variance, if more than there are.
+	MinRuns int `json:"min_runs,omitempty"`
+}
+
+// deltaIntervals returns Welch's t intervals for the deltas between the
+// runs of base and candidate, and warnings where the run counts are too
+// low to tell the delta from noise. A side needs at least two runs with
+// samples for an interval.
+func deltaIntervals(base, candidate []runSummary) ([]DeltaInterval, []string) {
+	intervals := []DeltaInterval{}
+	var warnings []string
+	baseValues, candidateValues := runValues(base), runValues(candidate)
+	for _, side := range []struct {
+		name string
+		runs int
+	}{{"base", len(baseValues[0])}, {"candidate", len(candidateValues[0])}} {
+		if side.runs < 2 {
+			warnings = append(warnings, fmt.Sprintf("%s has %d run(s) with samples, at least 2 per side are needed for confidence intervals", side.name, side.runs))
+		}
+	}
+	if len(warnings) > 0 {
+		return intervals, warnings
+	}
+
+	for i, metric := range runMetrics {
+		b, c := baseValues[i], candidateValues[i]
+		nb, nc := float64(len(b)), float64(len(c))
+		meanB, sdB := meanStdDev(b)
+		meanC, sdC := meanStdDev(c)
+		varB, varC := sdB*sdB/nb, sdC*sdC/nc
+		delta := meanC - meanB
+
+		interval := DeltaInterval{
+			Metric:     metric.name,
+			Delta:      delta,
+			Low:        delta,
+			High:       delta,
+			Confidence: deltaConfidence,
+		}
+		if se := math.Sqrt(varB + varC); se > 0 {
+			// Welch-Satterthwaite degrees of freedom
+			df := (varB + varC) * (varB + varC) / (varB*varB/(nb-1) + varC*varC/(nc-1))
+			margin := criticalT(df) * se
+			interval.Low, interval.High = delta-margin, delta+margin
+		}
+		interval.Significant = interval.Low > 0 || interval.High < 0
+
+		if !interval.Significant && delta != 0 {
+			// Equal run counts n give a margin of about
+			// 1.96 * sqrt((sdB² + sdC²) / n)
+			n := int(math.Ceil(1.96 * 1.96 * (sdB*sdB + sdC*sdC) / (delta * delta)))
+			if n > min(len(b), len(c)) {
+				interval.MinRuns = n
+				warnings = append(warnings, fmt.Sprintf("the %s delta is within the noise of %d base and %d candidate runs, about %d runs per side are needed to tell a delta of this size apart", metric.name, len(b), len(c), interval.MinRuns))
+			}
+		}
+		intervals = append(intervals, interval)
+	}
+	return intervals, warnings
+}
+
+// runValues returns the values of every run metric of the runs with
+// samples, in the order of runMetrics.
+func runValues(runs []runSummary) [][]float64 {
+	values := make([][]float64, len(runMetrics))
+	for _, run := range runs {
+		if run.cluster == nil {
+			continue
+		}
+		for i, metric := range runMetrics {
+			values[i] = append(values[i], metric.value(run.cluster))
+		}
+	}
+	return values
+}
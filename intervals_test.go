@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestCriticalT(t *testing.T) {
+	tests := []struct {
+		df   float64
+		want float64
+	}{
+		{-1, math.NaN()},
+		{0, math.NaN()},
+		{0.9, math.NaN()},
+		{1, 12.706},
+		// Fractional Welch degrees of freedom round down
+		{1.99, 12.706},
+		{2, 4.303},
+		{30, 2.042},
+		{30.5, 2.042},
+		{31, 2.021},
+		{40, 2.021},
+		{41, 2.000},
+		{60, 2.000},
+		{61, 1.980},
+		{120, 1.980},
+		{121, 1.960},
+		{1e6, 1.960},
+	}
+	for _, tt := range tests {
+		got := criticalT(tt.df)
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("criticalT(%v) = %v, want %v", tt.df, got, tt.want)
+		}
+	}
+}
+
+// summaryOf returns a run whose cluster averages are cpu and memory, or a
+// run without samples if stats is false.
+func summaryOf(cpu, memory float64, stats bool) runSummary {
+	if !stats {
+		return runSummary{name: "empty"}
+	}
+	return runSummary{name: "run", cluster: &RunStats{Samples: 1, AvgCpu: cpu, AvgMemory: memory}}
+}
+
+func TestDeltaIntervals(t *testing.T) {
+	type want struct {
+		delta, low, high float64
+		significant      bool
+		minRuns          int
+	}
+	tests := []struct {
+		name      string
+		base      []runSummary
+		candidate []runSummary
+		want      []want // avg_cpu, avg_memory
+		warnings  []string
+	}{
+		{
+			name:      "no runs",
+			base:      nil,
+			candidate: nil,
+			warnings:  []string{"base has 0 run(s)", "candidate has 0 run(s)"},
+		},
+		{
+			name:      "one run per side",
+			base:      []runSummary{summaryOf(10, 20, true)},
+			candidate: []runSummary{summaryOf(30, 20, true)},
+			warnings:  []string{"base has 1 run(s)", "candidate has 1 run(s)"},
+		},
+		{
+			name:      "runs without samples don't count",
+			base:      []runSummary{summaryOf(10, 20, true), summaryOf(0, 0, false)},
+			candidate: []runSummary{summaryOf(30, 20, true), summaryOf(31, 20, true)},
+			warnings:  []string{"base has 1 run(s)"},
+		},
+		{
+			name:      "zero variance",
+			base:      []runSummary{summaryOf(10, 20, true), summaryOf(10, 20, true)},
+			candidate: []runSummary{summaryOf(12.5, 20, true), summaryOf(12.5, 20, true)},
+			want: []want{
+				{delta: 2.5, low: 2.5, high: 2.5, significant: true},
+				{delta: 0, low: 0, high: 0},
+			},
+		},
+		{
+			name:      "equal variance",
+			base:      []runSummary{summaryOf(10, 20, true), summaryOf(12, 20, true)},
+			candidate: []runSummary{summaryOf(20, 20, true), summaryOf(22, 20, true)},
+			// sd 1.414 per side, se 1.414, df 2
+			want: []want{
+				{delta: 10, low: 10 - 4.303*math.Sqrt2, high: 10 + 4.303*math.Sqrt2, significant: true},
+				{delta: 0, low: 0, high: 0},
+			},
+		},
+		{
+			name:      "delta within the noise",
+			base:      []runSummary{summaryOf(10, 20, true), summaryOf(20, 20, true)},
+			candidate: []runSummary{summaryOf(12, 20, true), summaryOf(22, 20, true)},
+			// 1.96² * (50 + 50) / 2² = 96.04 runs per side
+			want: []want{
+				{delta: 2, low: 2 - 4.303*math.Sqrt(50), high: 2 + 4.303*math.Sqrt(50), minRuns: 97},
+				{delta: 0, low: 0, high: 0},
+			},
+			warnings: []string{"the avg_cpu delta is within the noise of 2 base and 2 candidate runs, about 97 runs"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			intervals, warnings := deltaIntervals(tt.base, tt.candidate)
+			if len(intervals) != len(tt.want) {
+				t.Fatalf("got %d intervals, want %d", len(intervals), len(tt.want))
+			}
+			for i, w := range tt.want {
+				got := intervals[i]
+				if got.Metric != runMetrics[i].name || got.Confidence != deltaConfidence {
+					t.Errorf("interval %d is %s at %v", i, got.Metric, got.Confidence)
+				}
+				if math.Abs(got.Delta-w.delta) > 1e-9 || math.Abs(got.Low-w.low) > 1e-9 || math.Abs(got.High-w.high) > 1e-9 {
+					t.Errorf("%s is %v [%v, %v], want %v [%v, %v]", got.Metric, got.Delta, got.Low, got.High, w.delta, w.low, w.high)
+				}
+				if got.Significant != w.significant || got.MinRuns != w.minRuns {
+					t.Errorf("%s is significant %v with min runs %d, want %v with %d", got.Metric, got.Significant, got.MinRuns, w.significant, w.minRuns)
+				}
+			}
+			if len(warnings) != len(tt.warnings) {
+				t.Fatalf("got warnings %q, want %q", warnings, tt.warnings)
+			}
+			for i, prefix := range tt.warnings {
+				if !strings.HasPrefix(warnings[i], prefix) {
+					t.Errorf("warning %q, want %q", warnings[i], prefix)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Issues are opened in GitHub or Jira for firing alert rules and failed
+// benchmark assertions that have "issue" set, so regressions are tracked
+// without someone triaging the logs. The report of the last day or the
+// samples of the run go along, as a Jira attachment or, since GitHub
+// issues have none, folded into the issue body.
+
+const (
+	issueTrackerGitHub = "github"
+	issueTrackerJira   = "jira"
+
+	// issueReportWindow is the period of the report attached to alert
+	// issues.
+	issueReportWindow = 24 * time.Hour
+	// maxGitHubAttachment keeps the issue body below GitHub's limit of
+	// 65536 characters.
+	maxGitHubAttachment = 60000
+)
+
+// IssueData is what the issue template renders, the alert or the run
+// with the assertion it failed.
+type IssueData struct {
+	Alert     *Alert
+	Run       *BenchmarkRun
+	Cluster   *RunStats
+	Assertion string
+	Failures  []string
+	Outliers  []RunOutlier
+}
+
+var issueMarkdown = template.Must(template.New("issue").Funcs(reportFuncs).Parse(
+	`{{define "title"}}{{if .Alert}}Alert {{.Alert.Rule}} firing{{else}}Benchmark {{.Run.Name}} failed {{.Assertion}}{{end}}{{end}}
+{{- if .Alert}}The alert rule **{{.Alert.Rule}}** fired at {{datetime .Alert.Since}}: {{.Alert.Metric}} is {{decimal .Alert.Value}}, above {{decimal .Alert.Above}}.
+
+The utilization report of the last day is attached.
+{{else}}Benchmark **{{.Run.Name}}**, {{datetime .Run.Start}} to {{datetime .Run.End}}, failed the assertion **{{.Assertion}}**:
+
+{{range .Failures}}- {{.}}
+{{end}}{{with .Cluster}}
+| | Average | Peak |
+|---|---|---|
+| Cluster CPU | {{percent .AvgCpu}} | {{percent .MaxCpu}} |
+| Cluster memory | {{mib .AvgMemory}} | {{mib .MaxMemory}} |
+{{end}}
+The samples of the run are attached as CSV.
+{{end}}`))
+
+// issueAttachment is a file that goes along with an issue.
+type issueAttachment struct {
+	filename string
+	data     []byte
+}
+
+// renderIssue renders the title and body of an issue with issueTemplate,
+// the title from its "title" template.
+func renderIssue(data IssueData) (string, string, error) {
+	var buf bytes.Buffer
+	if err := issueTemplate.ExecuteTemplate(&buf, "title", data); err != nil {
+		return "", "", err
+	}
+	title := strings.Join(strings.Fields(buf.String()), " ")
+	buf.Reset()
+	if err := issueTemplate.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	return title, buf.String(), nil
+}
+
+// fileAlertIssue opens an issue for a firing alert with the report of the
+// last day attached and returns its URL.
+func fileAlertIssue(ctx context.Context, alert Alert) (string, error) {
+	title, body, err := renderIssue(IssueData{Alert: &alert})
+	if err != nil {
+		return "", err
+	}
+	to := time.Now()
+	report := &Report{Period: "last day", From: to.Add(-issueReportWindow), To: to}
+	if _, err := summarizeReport(report); err != nil {
+		return "", err
+	}
+	report.Link = reportLink(report)
+	var markdown bytes.Buffer
+	if err := reportMarkdown.Execute(&markdown, report); err != nil {
+		return "", err
+	}
+	return createIssue(ctx, title, body, issueAttachment{"report.md", markdown.Bytes()})
+}
+
+// fileBenchmarkIssue opens an issue for a run that failed an assertion
+// with its samples attached and returns its URL.
+func fileBenchmarkIssue(ctx context.Context, run BenchmarkRun, samples []MetricsData, assertion string, failures []string, outliers []RunOutlier) (string, error) {
+	title, body, err := renderIssue(IssueData{
+		Run:       &run,
+		Cluster:   summarizeRun(run.Name, samples).cluster,
+		Assertion: assertion,
+		Failures:  failures,
+		Outliers:  outliers,
+	})
+	if err != nil {
+		return "", err
+	}
+	var csv bytes.Buffer
+	encoder := newCSVEncoder(&csv, reflect.TypeOf(MetricsData{}))
+	for _, m := range samples {
+		encoder.encode(reflect.ValueOf(m))
+	}
+	encoder.flush()
+	return createIssue(ctx, title, body, issueAttachment{run.Name + ".csv", csv.Bytes()})
+}
+
+// createIssue opens an issue in the issue-tracker and returns its URL.
+func createIssue(ctx context.Context, title, body string, attachment issueAttachment) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if cfg.IssueTracker == issueTrackerJira {
+		return createJiraIssue(ctx, title, body, attachment)
+	}
+	return createGitHubIssue(ctx, title, body, attachment)
+}
+
+// createGitHubIssue opens an issue in the repository issue-tracker-url
+// points at, e.g. https://api.github.com/repos/<owner>/<repo>.
+func createGitHubIssue(ctx context.Context, title, body string, attachment issueAttachment) (string, error) {
+	data := attachment.data
+	if len(data) > maxGitHubAttachment {
+		data = data[:maxGitHubAttachment]
+	}
+	body += "\n<details><summary>" + attachment.filename + "</summary>\n\n````\n" + string(data) + "\n````\n</details>\n"
+	payload, err := json.Marshal(map[string]string{"title": title, "body": body})
+	if err != nil {
+		return "", err
+	}
+	var issue struct {
+		HTMLURL string `json:"html_url"`
+	}
+	err = issueRequest(ctx, strings.TrimSuffix(cfg.IssueTrackerURL, "/")+"/issues", "application/json", bytes.NewReader(payload), &issue)
+	return issue.HTMLURL, err
+}
+
+// createJiraIssue opens an issue in the jira-project of the Jira at
+// issue-tracker-url and attaches the file to it.
+func createJiraIssue(ctx context.Context, title, body string, attachment issueAttachment) (string, error) {
+	base := strings.TrimSuffix(cfg.IssueTrackerURL, "/")
+	payload, err := json.Marshal(map[string]any{
+		"fields": map[string]any{
+			"project":     map[string]string{"key": cfg.JiraProject},
+			"issuetype":   map[string]string{"name": cfg.JiraIssueType},
+			"summary":     title,
+			"description": body,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	var issue struct {
+		Key string `json:"key"`
+	}
+	if err := issueRequest(ctx, base+"/rest/api/2/issue", "application/json", bytes.NewReader(payload), &issue); err != nil {
+		return "", err
+	}
+	link := base + "/browse/" + issue.Key
+
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	part, err := w.CreateFormFile("file", attachment.filename)
+	if err != nil {
+		return link, err
+	}
+	if _, err := part.Write(attachment.data); err != nil {
+		return link, err
+	}
+	if err := w.Close(); err != nil {
+		return link, err
+	}
+	err = issueRequest(ctx, base+"/rest/api/2/issue/"+issue.Key+"/attachments", w.FormDataContentType(), &form, nil)
+	return link, err
+}
+
+// issueRequest posts to the issue tracker and decodes the response into
+// v unless it is nil. A Jira token of the form user:token is sent with
+// basic authentication, anything else as a bearer token.
+func issueRequest(ctx context.Context, url, contentType string, body io.Reader, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+	if user, token, ok := strings.Cut(cfg.IssueTrackerToken, ":"); ok && cfg.IssueTracker == issueTrackerJira {
+		req.SetBasicAuth(user, token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+cfg.IssueTrackerToken)
+	}
+	// Jira refuses attachments without it as a CSRF guard
+	req.Header.Set("X-Atlassian-Token", "no-check")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("issue tracker rejected the request: %s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.New("invalid response from the issue tracker: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// kubeletSummary mirrors the parts of the kubelet /stats/summary response
+// (k8s.io/kubelet/pkg/apis/stats/v1alpha1) the collector uses.
+type kubeletSummary struct {
+	Node kubeletNodeStats  `json:"node"`
+	Pods []kubeletPodStats `json:"pods"`
+}
+
+type kubeletNodeStats struct {
+	NodeName         string                  `json:"nodeName"`
+	CPU              *kubeletCPUStats        `json:"cpu,omitempty"`
+	Memory           *kubeletMemoryStats     `json:"memory,omitempty"`
+	SystemContainers []kubeletContainerStats `json:"systemContainers,omitempty"`
+	Runtime          *kubeletRuntimeStats    `json:"runtime,omitempty"`
+}
+
+type kubeletCPUStats struct {
+	Time           metav1.Time `json:"time"`
+	UsageNanoCores *uint64     `json:"usageNanoCores,omitempty"`
+}
+
+type kubeletMemoryStats struct {
+	Time            metav1.Time `json:"time"`
+	WorkingSetBytes *uint64     `json:"workingSetBytes,omitempty"`
+}
+
+type kubeletRuntimeStats struct {
+	ImageFs *kubeletFsStats `json:"imageFs,omitempty"`
+}
+
+type kubeletPodStats struct {
+	PodRef     kubeletPodReference     `json:"podRef"`
+	Containers []kubeletContainerStats `json:"containers"`
+	Network    *kubeletNetwork         `json:"network,omitempty"`
+}
+
+type kubeletContainerStats struct {
+	Name      string          `json:"name"`
+	StartTime metav1.Time     `json:"startTime"`
+	Rootfs    *kubeletFsStats `json:"rootfs,omitempty"`
+	Logs      *kubeletFsStats `json:"logs,omitempty"`
+}
+
+type kubeletFsStats struct {
+	Time          metav1.Time `json:"time"`
+	CapacityBytes *uint64     `json:"capacityBytes,omitempty"`
+	UsedBytes     *uint64     `json:"usedBytes,omitempty"`
+}
+
+type kubeletPodReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type kubeletNetwork struct {
+	Time    metav1.Time `json:"time"`
+	RxBytes *uint64     `json:"rxBytes,omitempty"`
+	TxBytes *uint64     `json:"txBytes,omitempty"`
+}
+
+// fetchKubeletSummary reads the stats summary of a node's kubelet through
+// the API server proxy, which needs get on nodes/proxy.
+func fetchKubeletSummary(ctx context.Context, nodeName string) (*kubeletSummary, error) {
+	body, err := clientset.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		Name(nodeName).
+		SubResource("proxy").
+		Suffix("stats/summary").
+		DoRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var summary kubeletSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// collectKubeletStats polls every node's kubelet summary and cAdvisor
+// metrics on its own, slower interval since both are far more expensive
+// than the metrics API.
+func collectKubeletStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			slog.Error("Error listing nodes for kubelet stats", "error", err)
+			apiErrors.add("nodes", 1)
+			continue
+		}
+
+		for _, node := range nodes.Items {
+			summary, err := fetchKubeletSummary(ctx, node.Name)
+			if err != nil {
+				slog.Error("Error fetching kubelet summary", "node", node.Name, "error", err)
+				apiErrors.add("kubelet_summary", 1)
+				continue
+			}
+
+			detectNodeRestarts(&node, summary)
+			checkAccuracy(node.Name, summary)
+			storePodNetwork(node.Name, summary)
+			storeContainerFilesystems(node.Name, summary)
+			storeNodeImages(&node, summary)
+			storeNodeDiskIO(ctx, node.Name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// leakMinSamples is the number of samples below which a fit says
+	// nothing about a pod.
+	leakMinSamples = 10
+	// leakMonotonicShare is the share of consecutive samples in which
+	// memory must not have dropped for growth to count as a leak rather
+	// than a sawtooth of allocations and garbage collections.
+	leakMonotonicShare = 0.9
+)
+
+// PodGrowth is the memory trend of a pod fitted with least squares.
+type PodGrowth struct {
+	Namespace string `json:"namespace"`
+	PodName   string `json:"pod_name"`
+	Samples   int    `json:"samples"`
+	MinMemory int64  `json:"min_memory"`
+	MaxMemory int64  `json:"max_memory"`
+	// GrowthRate is the slope of the fit in bytes per hour.
+	GrowthRate float64 `json:"growth_bytes_per_hour"`
+	// Monotonic is the share of consecutive samples without a drop.
+	Monotonic float64 `json:"monotonic_share"`
+}
+
+type LeakReport struct {
+	From      time.Time   `json:"from"`
+	To        time.Time   `json:"to"`
+	Benchmark string      `json:"benchmark,omitempty"`
+	Threshold int64       `json:"threshold_bytes_per_hour"`
+	Suspects  []PodGrowth `json:"suspects"`
+}
+
+// suspectedLeaks fits the memory of every pod between from and to and
+// returns the pods growing faster than leak-threshold with hardly any
+// drops, fastest first.
+func suspectedLeaks(s Store, from, to time.Time) ([]PodGrowth, error) {
+	fits, err := s.PodMemoryGrowth(from, to, leakMinSamples)
+	if err != nil {
+		return nil, err
+	}
+	suspects := []PodGrowth{}
+	for _, g := range fits {
+		if g.GrowthRate >= float64(cfg.LeakThreshold) && g.Monotonic >= leakMonotonicShare {
+			suspects = append(suspects, g)
+		}
+	}
+	sort.Slice(suspects, func(i, j int) bool {
+		return suspects[i].GrowthRate > suspects[j].GrowthRate
+	})
+	return suspects, nil
+}
+
+// getLeaks lists the pods suspected of leaking memory over a benchmark run
+// given with ?benchmark=, which suits soak tests, or over from and to,
+// by default the last day. A run that is still going is fitted up to now.
+func getLeaks(c *gin.Context) {
+	report := LeakReport{Threshold: cfg.LeakThreshold}
+	if name := c.Query("benchmark"); name != "" {
+		run, err := loadBenchmarkRun(db, name)
+		if errors.Is(err, errRunNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		report.Benchmark = run.Name
+		report.From, report.To = run.Start, time.Now()
+		if run.End != nil {
+			report.To = *run.End
+		}
+	} else {
+		from, to, ok := parseTimeRange(c, 24*time.Hour)
+		if !ok {
+			return
+		}
+		report.From, report.To = from, to
+	}
+
+	suspects, err := suspectedLeaks(store, report.From, report.To)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	report.Suspects = []PodGrowth{}
+	for _, g := range suspects {
+		if tenantAllows(c, g.Namespace) {
+			report.Suspects = append(report.Suspects, g)
+		}
+	}
+
+	respond(c, http.StatusOK, report)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenNetworks maps the configured address family to the network passed
+// to net.Listen. "any" binds dual-stack where the host supports it.
+var listenNetworks = map[string]string{
+	"any":  "tcp",
+	"ipv4": "tcp4",
+	"ipv6": "tcp6",
+}
+
+// systemdListenFdsStart is the first file descriptor passed by systemd
+// socket activation (SD_LISTEN_FDS_START).
+const systemdListenFdsStart = 3
+
+// listen returns the listener for the HTTP API. A socket handed over by
+// systemd takes precedence, then addresses of the form unix:/path, and
+// finally a TCP address in the configured family.
+func listen(family, addr string) (net.Listener, error) {
+	if listener, err := systemdListener(); listener != nil || err != nil {
+		return listener, err
+	}
+
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// A socket file left behind by a previous run would make bind fail
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen(listenNetworks[family], addr)
+}
+
+// systemdListener returns the first socket passed via systemd socket
+// activation, or nil if the process wasn't socket activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+
+	// Don't leak the activation variables into child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(systemdListenFdsStart, "systemd-listener")
+	defer file.Close()
+	return net.FileListener(file)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// logLevel is parsed from log-level by loadConfig.
+var logLevel slog.Level
+
+// setupLogging makes the configured slog handler the default. The log
+// package writes through it as well, so fatal startup errors end up in
+// the same format.
+func setupLogging() {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if cfg.LogFormat == logJSON {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
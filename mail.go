@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	htmltemplate "html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mailPart is an attachment of an email. Parts with a content ID are
+// embedded in the HTML body, which refers to them as cid:<id>.
+type mailPart struct {
+	filename    string
+	contentType string
+	contentID   string
+	data        []byte
+}
+
+// sendMail sends an HTML email with attachments to the report-recipients.
+func sendMail(subject, html string, parts []mailPart) error {
+	var recipients []string
+	for _, recipient := range strings.Split(cfg.ReportRecipients, ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+
+	var body bytes.Buffer
+	mixed := multipart.NewWriter(&body)
+
+	// The HTML and the images it embeds form one multipart/related part
+	var related bytes.Buffer
+	relatedWriter := multipart.NewWriter(&related)
+	w, err := relatedWriter.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(html))
+	qp.Close()
+	for _, part := range parts {
+		if part.contentID == "" {
+			continue
+		}
+		err := writeBase64Part(relatedWriter, textproto.MIMEHeader{
+			"Content-Type":        {part.contentType},
+			"Content-ID":          {"<" + part.contentID + ">"},
+			"Content-Disposition": {`inline; filename="` + part.filename + `"`},
+		}, part.data)
+		if err != nil {
+			return err
+		}
+	}
+	relatedWriter.Close()
+
+	w, err = mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/related; boundary=" + relatedWriter.Boundary()},
+	})
+	if err != nil {
+		return err
+	}
+	w.Write(related.Bytes())
+	for _, part := range parts {
+		if part.contentID != "" {
+			continue
+		}
+		err := writeBase64Part(mixed, textproto.MIMEHeader{
+			"Content-Type":        {part.contentType},
+			"Content-Disposition": {`attachment; filename="` + part.filename + `"`},
+		}, part.data)
+		if err != nil {
+			return err
+		}
+	}
+	mixed.Close()
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", cfg.SMTPFrom)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed.Boundary())
+	message.Write(body.Bytes())
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return smtp.SendMail(cfg.SMTPAddr, auth, cfg.SMTPFrom, recipients, message.Bytes())
+}
+
+// writeBase64Part writes data base64 encoded in lines of 76 characters as
+// MIME requires.
+func writeBase64Part(w *multipart.Writer, header textproto.MIMEHeader, data []byte) error {
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := part.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = part.Write([]byte(encoded + "\r\n"))
+	return err
+}
+
+// mailReport emails a report as HTML with the node summaries attached as
+// CSV.
+func mailReport(report *Report) {
+	subject, html, err := renderMail(reportMailTemplate, report,
+		"Cluster utilization "+report.Period+" report "+report.From.In(reportLocation).Format(time.DateOnly))
+	if err != nil {
+		slog.Error("Error rendering report", "report", report.ID, "error", err)
+		return
+	}
+	var nodes bytes.Buffer
+	encoder := newCSVEncoder(&nodes, reflect.TypeOf(NodeSummary{}))
+	for _, n := range report.Nodes {
+		encoder.encode(reflect.ValueOf(n))
+	}
+	encoder.flush()
+
+	err = sendMail(subject, html, []mailPart{
+		{filename: "nodes.csv", contentType: mimeCSV, data: nodes.Bytes()},
+	})
+	if err != nil {
+		slog.Error("Error emailing report", "report", report.ID, "error", err)
+	}
+}
+
+type benchmarkMailNode struct {
+	NodeName string
+	*RunStats
+}
+
+var benchmarkHTML = htmltemplate.Must(htmltemplate.New("benchmark").Funcs(reportFuncs).Parse(
+	`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Benchmark {{.Run.Name}}</title></head>
+<body>
+<h1>Benchmark {{.Run.Name}}</h1>
+{{with .Run.Description}}<p>{{.}}</p>{{end}}
+<p>{{datetime .Run.Start}} to {{datetime .Run.End}}, {{.Run.Samples}} samples.{{range $k, $v := .Run.Labels}} {{$k}}={{$v}}{{end}}</p>
+{{with .Cluster}}<table>
+<tr><th></th><th>Average</th><th>Peak</th></tr>
+<tr><td>Cluster CPU</td><td>{{percent .AvgCpu}}</td><td>{{percent .MaxCpu}}</td></tr>
+<tr><td>Cluster memory</td><td>{{mib .AvgMemory}}</td><td>{{mib .MaxMemory}}</td></tr>
+</table>{{end}}
+{{range .Outliers}}<p><strong>Possible outlier:</strong> the average cluster {{if eq .Metric "avg_cpu"}}CPU of {{percent .Value}} is {{decimal .ZScore}} standard deviations from the {{percent .Mean}}{{else}}memory of {{mib .Value}} is {{decimal .ZScore}} standard deviations from the {{mib .Mean}}{{end}} of the {{.History}} prior runs with the same labels. This is more likely infrastructure noise than a regression.</p>
+{{end}}<table width="600">
+<tr><td colspan="2"><img src="cid:cluster-cpu" alt="Cluster CPU over the run"></td></tr>
+<tr><td align="left">{{datetime .Run.Start}}</td><td align="right">{{datetime .Run.End}}</td></tr>
+</table>
+<h2>Nodes</h2>
+<table>
+<tr><th>Node</th><th>Average CPU</th><th>Peak CPU</th><th>Average memory</th><th>Peak memory</th></tr>
+{{range .Nodes}}<tr><td>{{.NodeName}}</td><td>{{percent .AvgCpu}}</td><td>{{percent .MaxCpu}}</td><td>{{mib .AvgMemory}}</td><td>{{mib .MaxMemory}}</td></tr>
+{{end}}</table>
+<p>The samples of the run are attached as CSV.</p>
+</body>
+</html>
+`))
+
+// mailBenchmark emails the summary of a finished run with a chart of the
+// cluster CPU usage and its samples attached as CSV. The samples and the
+// prior runs are read from one snapshot.
+func mailBenchmark(run BenchmarkRun) {
+	view, release, err := snapshotView(context.Background())
+	if err != nil {
+		slog.Error("Error emailing benchmark", "benchmark", run.Name, "error", err)
+		return
+	}
+	defer release()
+
+	samples, err := view.store.QuerySamples(SampleQuery{
+		From:      run.Start,
+		To:        *run.End,
+		Basis:     "allocatable",
+		RunID:     run.ID,
+		Ascending: true,
+	})
+	if err != nil {
+		slog.Error("Error emailing benchmark", "benchmark", run.Name, "error", err)
+		return
+	}
+
+	nodes, cluster := runStats(samples)
+	data := struct {
+		Run      BenchmarkRun
+		Cluster  *RunStats
+		Nodes    []benchmarkMailNode
+		Outliers []RunOutlier
+	}{Run: run, Cluster: cluster.stats()}
+	outliers, err := checkPriorRuns(view, run, samples)
+	if err != nil {
+		// The email goes out without the outlier check
+		slog.Error("Error comparing benchmark with prior runs", "benchmark", run.Name, "error", err)
+	}
+	data.Outliers = outliers
+	for nodeName, stats := range nodes {
+		data.Nodes = append(data.Nodes, benchmarkMailNode{nodeName, stats.stats()})
+	}
+	sort.Slice(data.Nodes, func(i, j int) bool {
+		return data.Nodes[i].NodeName < data.Nodes[j].NodeName
+	})
+
+	subject, html, err := renderMail(benchmarkMailTemplate, data, "Benchmark "+run.Name+" finished")
+	if err != nil {
+		slog.Error("Error rendering benchmark email", "benchmark", run.Name, "error", err)
+		return
+	}
+
+	var clusterCPU []float64
+	var csv bytes.Buffer
+	encoder := newCSVEncoder(&csv, reflect.TypeOf(MetricsData{}))
+	for i, m := range samples {
+		if i == 0 || !m.Timestamp.Equal(samples[i-1].Timestamp) {
+			clusterCPU = append(clusterCPU, m.ClusterCpuUsage)
+		}
+		encoder.encode(reflect.ValueOf(m))
+	}
+	encoder.flush()
+	chart, err := lineChart(clusterCPU)
+	if err != nil {
+		slog.Error("Error rendering benchmark chart", "benchmark", run.Name, "error", err)
+		return
+	}
+
+	err = sendMail(subject, html, []mailPart{
+		{filename: "cluster-cpu.png", contentType: "image/png", contentID: "cluster-cpu", data: chart},
+		{filename: run.Name + ".csv", contentType: mimeCSV, data: csv.Bytes()},
+	})
+	if err != nil {
+		slog.Error("Error emailing benchmark", "benchmark", run.Name, "error", err)
+	}
+}
+
+const (
+	chartWidth  = 600
+	chartHeight = 200
+)
+
+// lineChart draws percentages from 0 to 100 as a line over a grid at every
+// 25%, as a PNG that mail clients show without running scripts.
+func lineChart(values []float64) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	background := color.RGBA{255, 255, 255, 255}
+	grid := color.RGBA{220, 220, 220, 255}
+	line := color.RGBA{31, 119, 180, 255}
+	for x := 0; x < chartWidth; x++ {
+		for y := 0; y < chartHeight; y++ {
+			img.Set(x, y, background)
+		}
+	}
+	for percent := 0; percent <= 100; percent += 25 {
+		y := chartY(float64(percent))
+		for x := 0; x < chartWidth; x++ {
+			img.Set(x, y, grid)
+		}
+	}
+
+	for i := 1; i < len(values); i++ {
+		x0 := (i - 1) * (chartWidth - 1) / (len(values) - 1)
+		x1 := i * (chartWidth - 1) / (len(values) - 1)
+		drawLine(img, x0, chartY(values[i-1]), x1, chartY(values[i]), line)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func chartY(percent float64) int {
+	percent = min(max(percent, 0), 100)
+	return chartHeight - 1 - int(percent*float64(chartHeight-1)/100)
+}
+
+// drawLine draws with Bresenham's algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.Set(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		if 2*e >= dy {
+			e += dy
+			x0 += sx
+		}
+		if 2*e <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -2,38 +2,103 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	metrics "k8s.io/metrics/pkg/client/clientset/versioned"
 )
 
 type MetricsData struct {
+	// Timestamp is when the collector scraped the sample, SampleTime when
+	// metrics-server measured it, averaged over Window seconds. Rows from
+	// before SampleTime was stored have it equal to Timestamp.
 	Timestamp       time.Time `json:"timestamp"`
+	SampleTime      time.Time `json:"sample_time"`
+	Window          float64   `json:"window_seconds"`
 	NodeName        string    `json:"node_name"`
+	NodeGroup       string    `json:"node_group,omitempty"`
 	CpuUsage        float64   `json:"cpu_usage"`
 	MemoryUsage     int64     `json:"memory_usage"`
 	IsBenchmark     bool      `json:"is_benchmark"`
+	Source          string    `json:"source"`
 	ClusterCpuUsage float64   `json:"cluster_cpu_usage"`
 	ClusterTotalCpu int64     `json:"cluster_total_cpu"`
+
+	CpuUsed               int64 `json:"cpu_used"`
+	NodeTotalCpu          int64 `json:"node_total_cpu"`
+	NodeAllocatableCpu    int64 `json:"node_allocatable_cpu"`
+	ClusterUsedCpu        int64 `json:"cluster_used_cpu"`
+	ClusterAllocatableCpu int64 `json:"cluster_allocatable_cpu"`
+	// Requested CPU is the sum of the requests of the pods scheduled on
+	// the node or cluster.
+	NodeRequestedCpu    int64 `json:"node_requested_cpu"`
+	ClusterRequestedCpu int64 `json:"cluster_requested_cpu"`
+	NodeRequestedMemory int64 `json:"node_requested_memory"`
+
+	// Memory percentages are relative to allocatable memory like CPU.
+	MemoryUsagePercent        float64 `json:"memory_usage_percent"`
+	ClusterMemoryUsagePercent float64 `json:"cluster_memory_usage_percent"`
+	NodeTotalMemory           int64   `json:"node_total_memory"`
+	NodeAllocatableMemory     int64   `json:"node_allocatable_memory"`
+	ClusterMemoryUsage        int64   `json:"cluster_memory_usage"`
+	ClusterTotalMemory        int64   `json:"cluster_total_memory"`
+	ClusterAllocatableMemory  int64   `json:"cluster_allocatable_memory"`
+	// Headroom is how many more standard pods fit into what the cluster
+	// leaves unused.
+	Headroom int64 `json:"headroom"`
+
+	// Seq increases with every stored sample and is never reused, though
+	// it may skip numbers.
+	Seq int64 `json:"seq"`
+
+	BenchmarkRunID int64 `json:"benchmark_run_id,omitempty"`
 }
 
-var db *sql.DB
+var db *database
 var metricsClient *metrics.Clientset
+var clientset *kubernetes.Clientset
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "burn" {
+		runBurner(os.Args[2:])
+		return
+	}
+
+	loadConfig()
+	setupLogging()
+	applyMemoryLimit()
+
+	// An aggregator only reads from the collectors of the fleet, it has no
+	// cluster or database of its own
+	if len(fleetCollectors) > 0 {
+		runAggregator()
+		return
+	}
+	if cfg.CardinalityLimit > 0 {
+		cardinality = newCardinalityGuard(cfg.CardinalityLimit, cfg.CardinalityAction, cfg.CardinalityWindow)
+	}
+
 	// Initialize database
 	initDB()
+	store = sqlStore{db: db}
 
 	// Initialize Kubernetes metrics client
-	config, err := rest.InClusterConfig()
+	config, err := loadKubeConfig(cfg.Kubeconfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -43,24 +108,268 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Start metrics collection
-	go collectMetrics(config)
+	clientset, err = kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGINT and SIGTERM cancel ctx, which stops every collection loop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	externalURL = resolveExternalURL(ctx, config)
+
+	// Nodes and pods are watched once instead of fetched on every tick
+	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+	nodeLister := informerFactory.Core().V1().Nodes().Lister()
+	podLister := informerFactory.Core().V1().Pods().Lister()
+	informerFactory.Start(ctx.Done())
+
+	// Start metrics collection once the cluster is ready
+	var workers sync.WaitGroup
+	startWorker := func(run func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run()
+		}()
+	}
+	startCollection := func(ctx context.Context) {
+		minNodes := prepareDistribution(ctx, config, cfg.MinNodes)
+		if !waitForCluster(ctx, minNodes, cfg.StartupTimeout) {
+			return
+		}
+		if cfg.KubeletStatsInterval > 0 {
+			startWorker(func() { collectKubeletStats(ctx, cfg.KubeletStatsInterval) })
+		}
+		if cfg.QuotaInterval > 0 {
+			startWorker(func() { collectQuotas(ctx, cfg.QuotaInterval) })
+		}
+		if !cache.WaitForCacheSync(ctx.Done(),
+			informerFactory.Core().V1().Nodes().Informer().HasSynced,
+			informerFactory.Core().V1().Pods().Informer().HasSynced,
+		) {
+			return
+		}
+		// Disruptions resolve workloads from the pod cache
+		if cfg.EventPollInterval > 0 {
+			startWorker(func() { pollEvents(ctx, cfg.EventPollInterval, podLister) })
+		}
+		collectMetrics(ctx, metricsClient, nodeLister, podLister)
+	}
+	// The gap is the time since the last tick, so it must be found before
+	// collection stores a new one. A standby replicates its gap instead.
+	if cfg.BackfillPrometheusURL != "" && cfg.ReplicateFrom == "" {
+		if gap, ok := findBackfillGap(time.Now()); ok {
+			startWorker(func() { backfill(ctx, gap) })
+		}
+	}
+	if cfg.ReplicateFrom != "" {
+		// A standby only collects once it took over from the primary, and
+		// only until the primary is back
+		startWorker(func() {
+			for replicate(ctx) {
+				collecting, demote := context.WithCancel(ctx)
+				startWorker(func() { watchPrimary(collecting, demote) })
+				startCollection(collecting)
+				demote()
+				// The standby's liveness must not fail on the collection it
+				// stopped
+				lastCollection.Store(0)
+			}
+		})
+	} else {
+		startWorker(func() { startCollection(ctx) })
+	}
+
+	if paths := pluginPaths(cfg.CollectorPlugins); len(paths) > 0 {
+		startWorker(func() { runCollectorPlugins(ctx, paths, cfg.PluginInterval) })
+	}
+	for _, path := range pluginPaths(cfg.ExporterPlugins) {
+		startWorker(func() { runExporterPlugin(ctx, path) })
+	}
+	if paths := pluginPaths(cfg.DerivedMetrics); len(paths) > 0 {
+		startWorker(func() { runDerivedMetrics(ctx, paths) })
+	}
+	if cfg.SheetsSpreadsheet != "" {
+		startWorker(func() { exportToSheets(ctx) })
+	}
+	if fleetCache != nil {
+		startWorker(func() { publishFleetState(ctx) })
+	}
+	if sinks := warehouseSinks(); len(sinks) > 0 {
+		startWorker(func() { exportToWarehouses(ctx, sinks, cfg.WarehouseInterval) })
+	}
+	if len(alertRules.Alerts) > 0 {
+		startWorker(func() { evaluateAlerts(ctx, cfg.AlertInterval) })
+	}
+	if len(recordingRules) > 0 {
+		startWorker(func() { evaluateRecordingRules(ctx, cfg.RecordingInterval) })
+	}
+
+	if cfg.RollupInterval > 0 {
+		startWorker(func() { rollUpMetrics(ctx, cfg.RollupInterval) })
+	}
+
+	if cfg.ReportSchedule != "" {
+		startWorker(func() { generateReports(ctx, cfg.ReportSchedule) })
+	}
+
+	if cfg.Retention > 0 {
+		startWorker(func() { pruneOldRows(ctx, cfg.Retention, cfg.RetentionInterval) })
+	}
+
+	if cfg.HeartbeatURL != "" {
+		startWorker(func() { sendHeartbeats(ctx, cfg.HeartbeatURL, cfg.HeartbeatInterval) })
+	}
+
+	if cfg.AdminAddr != "" {
+		go serveAdmin(ctx, cfg.AdminAddr, cfg.AdminToken)
+	}
 
 	// Setup HTTP server
 	router := gin.Default()
+	router.Use(observeRequests())
+	router.Use(limitRequestBody(cfg.MaxBodyBytes))
+	// Probes are registered before the query limiter so a busy collector
+	// isn't restarted for answering them with 429, and before the token
+	// check since the kubelet has no token
+	router.GET("/healthz", getHealthz)
+	router.GET("/readyz", getReadyz)
+	if cfg.ShareSecret != "" {
+		router.Use(acceptShareLinks())
+	}
+	if cfg.APIToken != "" || cfg.KubernetesAuth {
+		router.Use(requireAuth(cfg.APIToken, cfg.KubernetesAuth, cfg.APITokenReads))
+	}
+	// Streams stay open, they would hold a query slot for good
+	router.GET("/metrics/stream", getMetricsStream)
+	router.GET("/cluster/events", getClusterEvents)
+	if cfg.DBDriver == driverSQLite && cfg.MaxConcurrentQueries > 0 {
+		router.Use(limitConcurrentQueries(cfg.MaxConcurrentQueries))
+	}
 	router.GET("/metrics", getMetrics)
-	router.POST("/metrics/benchmark", startBenchmark)
+	router.GET("/metrics/latest", getLatestMetrics)
 	router.POST("/metrics/reset", resetDB)
+	router.POST("/reprocess", postReprocess)
+	router.POST("/simulate", postSimulate)
+	router.POST("/calibrate", postCalibrate)
+	router.GET("/calibrate/:id", getCalibration)
+	router.GET("/metrics/export", getMetricsExport)
+	router.GET("/export/destinations", getExportMarks)
+	router.POST("/export/destinations/:destination/ack", ackExport)
+	router.DELETE("/export/destinations/:destination", deleteExportMark)
+	router.GET("/metrics/aggregate", getAggregate)
+	router.GET("/metrics/recorded", getRecordedSeries)
+	router.GET("/metrics/tiles", getTiles)
+	router.GET("/metrics/fragmentation", getFragmentation)
+	router.GET("/metrics/prometheus", getPrometheus)
+	router.GET("/metrics/pods", getPodMetrics)
+	router.GET("/metrics/pods/:namespace/:name/containers", getContainerMetrics)
+	router.GET("/metrics/pods/:namespace/:name/network", getPodNetwork)
+	router.GET("/metrics/pods/:namespace/:name/filesystem", getPodFilesystem)
+	router.GET("/metrics/nodes/:node/io", getNodeDiskIO)
+	router.GET("/metrics/nodes/:node/images", getNodeImages)
+	router.GET("/metrics/node-events", getNodeEvents)
+	router.GET("/metrics/image-pulls", getImagePulls)
+	router.GET("/metrics/disruptions", getDisruptions)
+	router.GET("/metrics/quotas", getQuotas)
+	router.GET("/metrics/plugins", getPluginMetrics)
+	router.GET("/metrics/accuracy", getAccuracyChecks)
+	router.POST("/benchmarks/start", startBenchmark)
+	router.POST("/benchmarks/stop", stopBenchmark)
+	router.GET("/benchmarks", getBenchmarkRuns)
+	router.GET("/benchmarks/compare", getBenchmarkComparison)
+	router.GET("/benchmarks/:name", getBenchmarkRun)
+	router.GET("/benchmarks/:name/metrics", getBenchmarkMetrics)
+	router.GET("/benchmarks/:name/bundle", getBenchmarkBundle)
+	router.POST("/experiments", createExperiment)
+	router.GET("/experiments", getExperiments)
+	router.GET("/experiments/:name", getExperiment)
+	router.GET("/experiments/:name/report", getExperimentReport)
+	router.DELETE("/experiments/:name", deleteExperiment)
+	router.GET("/export/signing-key", getSigningKey)
+	router.POST("/subscriptions", createSubscription)
+	router.POST("/share", createShareLink)
+	router.GET("/alerts", getAlerts)
+	router.GET("/reports", getReports)
+	router.GET("/reports/summary", getReportSummary)
+	router.GET("/reports/:id", getReport)
+	router.GET("/subscriptions/:id", getSubscription)
+	router.DELETE("/subscriptions/:id", deleteSubscription)
+	router.GET("/status", getStatus)
+	router.GET("/schema", getSchema)
+	router.GET("/capabilities", getCapabilities)
+	// The configuration names hosts and users even with the secrets
+	// redacted, so it needs a token for reads too. Without api-token or
+	// kubernetes-auth nobody can read it.
+	router.GET("/config", requireAuth(cfg.APIToken, cfg.KubernetesAuth, true), getConfig)
+	router.GET("/version", getVersion)
+	router.GET("/ingest/stats", getIngestStats)
+	router.GET("/analysis/drain-impact", getDrainImpact)
+	router.GET("/analysis/startup", getStartupLatency)
+	router.GET("/analysis/governance", getGovernance)
+	router.GET("/analysis/leaks", getLeaks)
+	router.GET("/analysis/targets", getTargetCompliance)
+
+	listener, err := listen(cfg.AddressFamily, cfg.ListenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Listening", "addr", listener.Addr().String())
+
+	// No write timeout: responses for large exports are allowed to take long
+	server := &http.Server{
+		Handler:           router,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("Shutting down")
 
-	log.Fatal(http.ListenAndServe(":8089", router))
+	// Let requests in flight finish, then wait for the collection loops to
+	// finish their current tick so no write is cut off halfway
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error shutting down HTTP server", "error", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		slog.Warn("Collection loops did not stop in time")
+	}
+
+	if err := db.Close(); err != nil {
+		slog.Error("Error closing database", "error", err)
+	}
 }
 
 func initDB() {
 	var err error
-	db, err = sql.Open("sqlite3", "./metrics.db")
+	db, err = openDatabase(cfg.DBDriver, cfg.DBDSN, cfg.DBBusyTimeout)
 	if err != nil {
 		log.Fatal(err)
 	}
+	db.setPoolLimits(cfg.DBMaxOpenConns, cfg.DBMaxIdleConns, cfg.DBConnMaxLifetime)
+	version := checkSchemaVersion()
+	if cfg.Retention > 0 {
+		enableIncrementalVacuum()
+	}
 
 	_, err = db.Exec(`
         CREATE TABLE IF NOT EXISTS metrics (
@@ -71,193 +380,706 @@ func initDB() {
             memory_usage INTEGER,
             is_benchmark BOOLEAN,
             cluster_cpu_usage REAL,
-            cluster_total_cpu INTEGER
+            cluster_total_cpu INTEGER,
+            source TEXT NOT NULL DEFAULT 'metrics-server',
+            cpu_used INTEGER,
+            node_total_cpu INTEGER,
+            node_allocatable_cpu INTEGER,
+            cluster_used_cpu INTEGER,
+            cluster_allocatable_cpu INTEGER,
+            benchmark_run_id INTEGER,
+            cluster_memory_usage INTEGER,
+            cluster_total_memory INTEGER,
+            headroom INTEGER,
+            node_requested_cpu INTEGER,
+            cluster_requested_cpu INTEGER,
+            memory_usage_percent REAL,
+            cluster_memory_usage_percent REAL,
+            node_total_memory INTEGER,
+            node_allocatable_memory INTEGER,
+            cluster_allocatable_memory INTEGER,
+            sample_time DATETIME,
+            window_seconds REAL
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Databases created before the source column existed need it added, with
+	// benchmark copies moved to their own source so they don't collide with
+	// the sample they were copied from
+	added, err := ensureColumn("metrics", "source", "TEXT NOT NULL DEFAULT 'metrics-server'")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if added {
+		_, err = db.Exec("UPDATE metrics SET source = 'benchmark' WHERE is_benchmark")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Raw CPU values let queries pick capacity or allocatable as the
+	// denominator. Older rows only have the percentage of capacity.
+	for _, column := range []string{
+		"cpu_used",
+		"node_total_cpu",
+		"node_allocatable_cpu",
+		"cluster_used_cpu",
+		"cluster_allocatable_cpu",
+		"benchmark_run_id",
+		"cluster_memory_usage",
+		"cluster_total_memory",
+		"headroom",
+		"node_requested_cpu",
+		"cluster_requested_cpu",
+		"node_total_memory",
+		"node_allocatable_memory",
+		"cluster_allocatable_memory",
+		"node_requested_memory",
+	} {
+		if _, err := ensureColumn("metrics", column, "INTEGER"); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := ensureColumn("metrics", "sample_time", "DATETIME"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := ensureColumn("metrics", "node_group", "TEXT"); err != nil {
+		log.Fatal(err)
+	}
+	for _, column := range []string{
+		"memory_usage_percent",
+		"cluster_memory_usage_percent",
+		"window_seconds",
+	} {
+		if _, err := ensureColumn("metrics", column, "REAL"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	runMigrations(version)
+
+	// metrics-server keeps serving the same sample until its next scrape,
+	// collecting it again on a retry or after a restart must not store it
+	// twice
+	_, err = db.Exec(`
+        CREATE UNIQUE INDEX IF NOT EXISTS metrics_sample_time
+        ON metrics (sample_time, node_name, source)
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS pod_network (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            namespace TEXT,
+            pod_name TEXT,
+            node_name TEXT,
+            rx_bytes INTEGER,
+            tx_bytes INTEGER,
+            UNIQUE (timestamp, namespace, pod_name)
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS node_disk_io (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            node_name TEXT,
+            read_bytes INTEGER,
+            write_bytes INTEGER,
+            reads INTEGER,
+            writes INTEGER
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS container_filesystem (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            namespace TEXT,
+            pod_name TEXT,
+            container_name TEXT,
+            node_name TEXT,
+            rootfs_bytes INTEGER,
+            logs_bytes INTEGER
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS node_images (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            node_name TEXT,
+            image_count INTEGER,
+            images_bytes INTEGER,
+            image_fs_used INTEGER,
+            image_fs_capacity INTEGER
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS pod_metrics (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            namespace TEXT,
+            pod_name TEXT,
+            node_name TEXT,
+            cpu_usage INTEGER,
+            memory_usage INTEGER,
+            UNIQUE (timestamp, namespace, pod_name)
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS container_metrics (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            namespace TEXT,
+            pod_name TEXT,
+            container_name TEXT,
+            cpu_usage INTEGER,
+            memory_usage INTEGER,
+            UNIQUE (timestamp, namespace, pod_name, container_name)
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS image_pulls (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            event_uid TEXT UNIQUE,
+            timestamp DATETIME,
+            namespace TEXT,
+            pod_name TEXT,
+            node_name TEXT,
+            image TEXT,
+            duration REAL,
+            wait_duration REAL,
+            size_bytes INTEGER
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS pod_disruptions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            event_uid TEXT UNIQUE,
+            timestamp DATETIME,
+            namespace TEXT,
+            pod_name TEXT,
+            node_name TEXT,
+            workload TEXT,
+            reason TEXT,
+            message TEXT
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS quota_usage (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            namespace TEXT,
+            quota_name TEXT,
+            resource TEXT,
+            hard INTEGER,
+            used INTEGER
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS node_state (
+            node_name TEXT PRIMARY KEY,
+            boot_id TEXT,
+            kubelet_start DATETIME
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS node_events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            node_name TEXT,
+            event TEXT,
+            detail TEXT
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS accuracy_checks (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            node_name TEXT,
+            kubelet_cpu INTEGER,
+            metrics_server_cpu INTEGER,
+            cpu_discrepancy REAL,
+            kubelet_memory INTEGER,
+            metrics_server_memory INTEGER,
+            memory_discrepancy REAL,
+            sample_age_seconds REAL
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS benchmark_runs (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT UNIQUE,
+            description TEXT,
+            labels TEXT,
+            start_time DATETIME,
+            end_time DATETIME,
+            collector_version TEXT
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := ensureColumn("benchmark_runs", "collector_version", "TEXT"); err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS subscriptions (
+            id TEXT PRIMARY KEY,
+            nodes TEXT,
+            namespaces TEXT,
+            min_delta REAL,
+            max_frequency REAL,
+            created_at DATETIME
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := ensureColumn("subscriptions", "namespaces", "TEXT"); err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS reports (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            period TEXT,
+            from_time DATETIME,
+            to_time DATETIME,
+            created_at DATETIME,
+            summary TEXT,
+            UNIQUE (period, from_time)
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS plugin_metrics (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            plugin TEXT,
+            name TEXT,
+            labels TEXT,
+            value REAL
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS replication_state (
+            primary_url TEXT PRIMARY KEY,
+            last_seq INTEGER,
+            updated_at DATETIME
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS export_marks (
+            destination TEXT PRIMARY KEY,
+            last_seq INTEGER,
+            updated_at DATETIME
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS experiments (
+            name TEXT PRIMARY KEY,
+            description TEXT,
+            a_namespace TEXT,
+            a_deployment TEXT,
+            b_namespace TEXT,
+            b_deployment TEXT,
+            start_time DATETIME,
+            end_time DATETIME,
+            created_at DATETIME
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// alerts holds the firing alert rules so a restart doesn't notify
+	// about them again
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS alerts (
+            rule TEXT PRIMARY KEY,
+            value REAL,
+            since DATETIME,
+            issue TEXT
         )
     `)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// recorded_series holds the values of the recording rules, node_name
+	// is empty for aggregates
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS recorded_series (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            name TEXT,
+            node_name TEXT,
+            value REAL
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec(`
+        CREATE INDEX IF NOT EXISTS recorded_series_name_time
+        ON recorded_series (name, timestamp)
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	createRollupTables()
+
+	storeSchemaVersion()
 }
 
-func collectMetrics(config *rest.Config) {
-	ticker := time.NewTicker(1 * time.Second)
-	for range ticker.C {
+// ensureColumn adds a column to an existing table if it is missing and
+// reports whether it did.
+func ensureColumn(table, column, definition string) (bool, error) {
+	rows, err := db.Query(db.columnsQuery(), table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err == nil, err
+}
+
+// collectMetrics records node usage on every tick with the clients built
+// once at startup. Node capacity comes from the informer cache, so a tick
+// costs one metrics API request regardless of the number of nodes.
+func collectMetrics(ctx context.Context, metricsClient *metrics.Clientset, nodeLister corelisters.NodeLister, podLister corelisters.PodLister) {
+	ticker := time.NewTicker(cfg.CollectInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Every row of a tick shares one timestamp so node and pod rows line up
+		now := time.Now()
+
 		// Get node metrics
-		nodes, err := metricsClient.MetricsV1beta1().NodeMetricses().List(context.TODO(), metav1.ListOptions{})
+		nodes, err := metricsClient.MetricsV1beta1().NodeMetricses().List(ctx, metav1.ListOptions{})
 		if err != nil {
-			log.Printf("Error collecting metrics: %v", err)
+			slog.Error("Error collecting metrics", "error", err)
+			apiErrors.add("node_metrics", 1)
 			continue
 		}
+		lastCollection.Store(time.Now().UnixNano())
+		samplesCollected.add("node", float64(len(nodes.Items)))
 
-		clientset, err := kubernetes.NewForConfig(config)
+		requestedCPU, requestedMemory, err := requestsByNode(podLister)
 		if err != nil {
-			log.Printf("Error creating clientset: %v", err)
-			continue
+			slog.Error("Error listing pod requests", "error", err)
 		}
 
 		// Calculate cluster-wide totals
 		var clusterTotalCPU int64 = 0
+		var clusterAllocatableCPU int64 = 0
 		var clusterUsedCPU int64 = 0
+		var clusterTotalMemory int64 = 0
+		var clusterAllocatableMemory int64 = 0
+		var clusterUsedMemory int64 = 0
+		var clusterRequestedCPU int64 = 0
 
 		// First pass: gather cluster totals
 		for _, nodeMetric := range nodes.Items {
-			node, err := clientset.CoreV1().Nodes().Get(context.TODO(), nodeMetric.Name, metav1.GetOptions{})
+			node, err := nodeLister.Get(nodeMetric.Name)
 			if err != nil {
-				log.Printf("Error getting node info: %v", err)
+				slog.Error("Error getting node info", "node", nodeMetric.Name, "error", err)
 				continue
 			}
 
 			// Add to cluster totals
 			clusterTotalCPU += node.Status.Capacity.Cpu().MilliValue()
+			clusterAllocatableCPU += node.Status.Allocatable.Cpu().MilliValue()
 			clusterUsedCPU += nodeMetric.Usage.Cpu().MilliValue()
+			clusterRequestedCPU += requestedCPU[nodeMetric.Name]
+			clusterTotalMemory += node.Status.Capacity.Memory().Value()
+			clusterAllocatableMemory += node.Status.Allocatable.Memory().Value()
+			clusterUsedMemory += nodeMetric.Usage.Memory().Value()
 		}
 
-		// Calculate cluster-wide CPU percentage
-		clusterCpuPercentage := float64(clusterUsedCPU) / float64(clusterTotalCPU) * 100
+		// Calculate cluster-wide CPU percentage. Allocatable excludes what is
+		// reserved for the system, which workloads can never use.
+		clusterCpuPercentage := percentOf(clusterUsedCPU, clusterAllocatableCPU)
+		clusterMemoryPercentage := percentOf(clusterUsedMemory, clusterAllocatableMemory)
+		clusterHeadroom := headroom(clusterAllocatableCPU-clusterUsedCPU, clusterAllocatableMemory-clusterUsedMemory)
 
 		// Second pass: store metrics with cluster-wide information
+		var samples []MetricsData
 		for _, nodeMetric := range nodes.Items {
-			node, err := clientset.CoreV1().Nodes().Get(context.TODO(), nodeMetric.Name, metav1.GetOptions{})
+			node, err := nodeLister.Get(nodeMetric.Name)
 			if err != nil {
 				continue
 			}
 
 			nodeTotalCPU := node.Status.Capacity.Cpu().MilliValue()
+			nodeAllocatableCPU := node.Status.Allocatable.Cpu().MilliValue()
 			nodeUsedCPU := nodeMetric.Usage.Cpu().MilliValue()
+			nodeAllocatableMemory := node.Status.Allocatable.Memory().Value()
+			nodeUsedMemory := nodeMetric.Usage.Memory().Value()
 
-			// Calculate individual node percentage
-			nodePercentage := float64(nodeUsedCPU) / float64(nodeTotalCPU) * 100
-
-			_, err = db.Exec(
-				`INSERT INTO metrics (
-                    timestamp,
-                    node_name,
-                    cpu_usage,
-                    memory_usage,
-                    is_benchmark,
-                    cluster_cpu_usage,
-                    cluster_total_cpu
-                ) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-				time.Now(),
-				nodeMetric.Name,
-				nodePercentage, // Individual node CPU percentage
-				nodeMetric.Usage.Memory().Value(),
-				false,
-				clusterCpuPercentage, // Cluster-wide CPU percentage
-				clusterTotalCPU,
-			)
-			if err != nil {
-				log.Printf("Error inserting metrics: %v", err)
-			}
+			samples = append(samples, MetricsData{
+				Timestamp:                 now,
+				SampleTime:                nodeMetric.Timestamp.Time,
+				Window:                    nodeMetric.Window.Duration.Seconds(),
+				NodeName:                  nodeMetric.Name,
+				NodeGroup:                 nodeGroup(node),
+				CpuUsage:                  percentOf(nodeUsedCPU, nodeAllocatableCPU), // Individual node CPU percentage of allocatable
+				MemoryUsage:               nodeUsedMemory,
+				Source:                    sourceMetricsServer,
+				ClusterCpuUsage:           clusterCpuPercentage, // Cluster-wide CPU percentage of allocatable
+				ClusterTotalCpu:           clusterTotalCPU,
+				CpuUsed:                   nodeUsedCPU,
+				NodeTotalCpu:              nodeTotalCPU,
+				NodeAllocatableCpu:        nodeAllocatableCPU,
+				ClusterUsedCpu:            clusterUsedCPU,
+				ClusterAllocatableCpu:     clusterAllocatableCPU,
+				NodeRequestedCpu:          requestedCPU[nodeMetric.Name],
+				NodeRequestedMemory:       requestedMemory[nodeMetric.Name],
+				ClusterRequestedCpu:       clusterRequestedCPU,
+				MemoryUsagePercent:        percentOf(nodeUsedMemory, nodeAllocatableMemory),
+				ClusterMemoryUsagePercent: clusterMemoryPercentage,
+				NodeTotalMemory:           node.Status.Capacity.Memory().Value(),
+				NodeAllocatableMemory:     nodeAllocatableMemory,
+				ClusterMemoryUsage:        clusterUsedMemory,
+				ClusterTotalMemory:        clusterTotalMemory,
+				ClusterAllocatableMemory:  clusterAllocatableMemory,
+				Headroom:                  clusterHeadroom,
+			})
+		}
+		if err := store.InsertSamples(samples); err != nil {
+			slog.Error("Error inserting metrics", "error", err)
 		}
+		updates.publish(samples)
+
+		if cfg.CollectPods {
+			collectPodMetrics(ctx, podLister, now)
+		}
+		collectionDuration.observe(time.Since(now).Seconds())
+		ingest.record(now, len(samples))
+		slog.Debug("Collected metrics", "nodes", len(samples), "duration", time.Since(now))
 	}
 }
 
-func getMetrics(c *gin.Context) {
-	rows, err := db.Query(`
-        SELECT
-            timestamp,
-            node_name,
-            cpu_usage,
-            memory_usage,
-            is_benchmark,
-            cluster_cpu_usage,
-            cluster_total_cpu
-        FROM metrics
-        ORDER BY timestamp DESC
-    `)
+// headroom returns how many standard pods, as sized by headroom-pod-cpu
+// and headroom-pod-memory, fit into the free CPU and memory. It is based
+// on usage, not requests, so it is an upper bound for scheduling.
+func headroom(freeCPU, freeMemory int64) int64 {
+	pods := min(freeCPU/cfg.HeadroomPodCPU, freeMemory/cfg.HeadroomPodMemory)
+	return max(pods, 0)
+}
+
+// requestsByNode sums the CPU and memory requests of the pods scheduled
+// on each node. Pods that finished no longer hold their requests.
+func requestsByNode(podLister corelisters.PodLister) (map[string]int64, map[string]int64, error) {
+	pods, err := podLister.List(labels.Everything())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, err
+	}
+	requestedCPU := make(map[string]int64)
+	requestedMemory := make(map[string]int64)
+	for _, pod := range pods {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		cpu, memory := podRequests(pod)
+		requestedCPU[pod.Spec.NodeName] += cpu
+		requestedMemory[pod.Spec.NodeName] += memory
+	}
+	return requestedCPU, requestedMemory, nil
+}
+
+// getMetrics returns the samples between the optional from and to query
+// parameters (RFC3339 or unix seconds), optionally for a single node, one
+// page at a time. ?step=1m, 5m or 1h returns the per-node rollups of that
+// resolution instead of the raw samples. CPU percentages are relative to the
+// allocatable CPU by default; ?basis=capacity recomputes them against the
+// full node capacity and ?basis=requests against the sum of the requests
+// of the pods on the node, which is what bin-packing decisions go by.
+// Memory percentages follow the basis too, except for requests where they
+// stay relative to allocatable memory. Rows recorded before these values
+// were stored keep the percentage they were recorded with.
+func getMetrics(c *gin.Context) {
+	basis := c.DefaultQuery("basis", "allocatable")
+	if basis != "allocatable" && basis != "capacity" && basis != "requests" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "basis must be allocatable, capacity or requests"})
 		return
 	}
-	defer rows.Close()
 
-	var metrics []MetricsData
-	for rows.Next() {
-		var m MetricsData
-		err := rows.Scan(
-			&m.Timestamp,
-			&m.NodeName,
-			&m.CpuUsage,
-			&m.MemoryUsage,
-			&m.IsBenchmark,
-			&m.ClusterCpuUsage,
-			&m.ClusterTotalCpu,
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if step := c.Query("step"); step != "" {
+		r, ok := findRollup(step)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "step must be 1m, 5m or 1h"})
 			return
 		}
-		metrics = append(metrics, m)
+		if c.Query("after_seq") != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after_seq is not supported with step"})
+			return
+		}
+		getRollups(c, r, basis)
+		return
 	}
-	c.JSON(http.StatusOK, metrics)
-}
 
-func startBenchmark(c *gin.Context) {
-	_, err := db.Exec(`
-        INSERT INTO metrics (
-            timestamp,
-            node_name,
-            cpu_usage,
-            memory_usage,
-            is_benchmark,
-            cluster_cpu_usage,
-            cluster_total_cpu
-        )
-        SELECT
-            timestamp,
-            node_name,
-            cpu_usage,
-            memory_usage,
-            1,
-            cluster_cpu_usage,
-            cluster_total_cpu
-        FROM metrics
-        WHERE id IN (
-            SELECT id
-            FROM metrics
-            WHERE is_benchmark = 0
-            ORDER BY timestamp DESC
-            LIMIT 1
-        )
-    `)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
 		return
 	}
-	c.Status(http.StatusCreated)
-}
 
-func resetDB(c *gin.Context) {
-	// Begin a transaction
-	tx, err := db.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction: " + err.Error()})
+	limit, offset, ok := parsePage(c)
+	if !ok {
 		return
 	}
 
-	// Delete all records
-	_, err = tx.Exec("DELETE FROM metrics")
-	if err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete records: " + err.Error()})
-		return
+	q := SampleQuery{
+		From:   from,
+		To:     to,
+		Node:   c.Query("node"),
+		Basis:  basis,
+		Limit:  limit,
+		Offset: offset,
+	}
+	// after_seq pages by sequence number, which unlike timestamps and
+	// offsets doesn't shift when samples arrive late or are pruned
+	if v := c.Query("after_seq"); v != "" {
+		seq, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || seq < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after_seq must be a non-negative integer"})
+			return
+		}
+		if offset != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after_seq and offset can't be combined"})
+			return
+		}
+		q.BySeq = true
+		q.AfterSeq = seq
 	}
 
-	// Reset the auto-increment counter
-	_, err = tx.Exec("DELETE FROM sqlite_sequence WHERE name='metrics'")
+	metrics, err := store.QuerySamples(q)
 	if err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset sequence: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Commit the transaction
-	err = tx.Commit()
+	if q.BySeq {
+		next := q.AfterSeq
+		if len(metrics) > 0 {
+			next = metrics[len(metrics)-1].Seq
+		}
+		c.Header("X-Next-Seq", strconv.FormatInt(next, 10))
+	} else if limit > 0 && len(metrics) == limit {
+		// A full page means there may be more rows
+		c.Header("X-Next-Offset", strconv.Itoa(offset+limit))
+	}
+	respond(c, http.StatusOK, metrics)
+}
+
+// getLatestMetrics returns the samples of the most recent collection tick,
+// which is what a fleet aggregator adds the clusters up from.
+func getLatestMetrics(c *gin.Context) {
+	metrics, err := store.LatestSamples()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if metrics == nil {
+		metrics = []MetricsData{}
+	}
+	respond(c, http.StatusOK, metrics)
+}
 
+func resetDB(c *gin.Context) {
+	if err := store.Reset(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset metrics: " + err.Error()})
+		return
+	}
 	c.Status(http.StatusOK)
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limitRequestBody rejects requests whose body exceeds limit bytes. Bodies
+// without a Content-Length are cut off while being read.
+func limitRequestBody(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// requireAuth rejects requests that neither carry the API token nor, with
+// kubernetesAuth, a Kubernetes token whose owner RBAC allows the request.
+// Only requests that change data need it unless reads is set, so
+// dashboards keep working while /metrics/reset is protected. Reads let
+// through by acceptShareLinks need neither. The tokens of tenant-tokens
+// only read the namespaces of their tenant.
+func requireAuth(token string, kubernetesAuth, reads bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetBool(sharedKey) {
+			c.Next()
+			return
+		}
+		if !reads && (c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead) {
+			c.Next()
+			return
+		}
+		if token != "" && hasBearerToken(c.Request, token) {
+			c.Next()
+			return
+		}
+		if namespaces, ok := tenantNamespaces(c.Request); ok {
+			authorizeTenant(c, namespaces)
+			return
+		}
+
+		bearer, ok := strings.CutPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if kubernetesAuth && ok && bearer != "" {
+			authenticated, allowed, err := reviewAccess(c.Request.Context(), bearer, c.Request.URL.Path, rbacVerb(c.Request.Method))
+			if err != nil {
+				slog.Error("Error reviewing access", "path", c.Request.URL.Path, "error", err)
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "cannot verify the token"})
+				return
+			}
+			if allowed {
+				c.Next()
+				return
+			}
+			if authenticated {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+				return
+			}
+		}
+
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+// limitConcurrentQueries admits at most limit GET requests at a time and
+// turns the rest away with 429. SQLite has a single writer, so a burst of
+// dashboard queries would otherwise hold up the collector's inserts.
+func limitConcurrentQueries(limit int) gin.HandlerFunc {
+	slots := make(chan struct{}, limit)
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			c.Next()
+		default:
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many concurrent queries"})
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// schemaVersion is the layout of the database this build writes. Bump it
+// whenever initDB changes the schema of existing tables, so an older
+// collector refuses the database instead of failing on unknown columns.
+// Databases written before the version was recorded count as 0.
+//
+//	1: schema_version table
+//	2: benchmark_runs.collector_version
+//	3: memory capacity and percentages in metrics
+//	4: metrics.sample_time and metrics.window_seconds
+//	5: metrics.node_group
+//	6: metrics unique on sample_time instead of timestamp
+//	7: metrics.node_requested_memory
+//	8: subscriptions.namespaces
+const schemaVersion = 8
+
+// migrations rewrite the data of existing databases, keyed by the schema
+// version that needs them. initDB runs the ones newer than the database
+// once the columns they use exist.
+var migrations = []struct {
+	version int
+	migrate func() error
+}{
+	{6, keySamplesOnSampleTime},
+}
+
+func runMigrations(from int) {
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		if err := m.migrate(); err != nil {
+			log.Fatalf("Error upgrading the database to schema version %d: %v", m.version, err)
+		}
+	}
+}
+
+// keySamplesOnSampleTime replaces the unique index on the collector's
+// timestamp with one on the metrics-server sample time, which is the same
+// when a window is collected twice. Rows from before sample_time was
+// stored get their timestamp, then the duplicates are dropped.
+func keySamplesOnSampleTime() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range []string{
+		"UPDATE metrics SET sample_time = timestamp WHERE sample_time IS NULL",
+		`DELETE FROM metrics
+        WHERE id NOT IN (
+            SELECT MIN(id)
+            FROM metrics
+            GROUP BY sample_time, node_name, source
+        )`,
+		"DROP INDEX IF EXISTS metrics_sample",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// checkSchemaVersion compares the version of the database with this build
+// and returns the version of the database. A database from a newer
+// collector is refused, an older one is backed up before initDB upgrades
+// it in place. A new database has the current version.
+func checkSchemaVersion() int {
+	_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_version (
+            version INTEGER NOT NULL
+        )
+    `)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var version int
+	err = db.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// A database without a metrics table is new and has nothing to upgrade
+		var tables int
+		if err := db.QueryRow("SELECT COUNT(*) FROM ("+db.columnsQuery()+") AS columns", "metrics").Scan(&tables); err != nil {
+			log.Fatal(err)
+		}
+		if tables == 0 {
+			return schemaVersion
+		}
+		version = 0
+	case err != nil:
+		log.Fatal(err)
+	}
+
+	if version > schemaVersion {
+		log.Fatalf("The database has schema version %d, but this collector only supports up to %d. "+
+			"It was written by a newer collector: run that version again, or point db-dsn at a new database to start over.",
+			version, schemaVersion)
+	}
+	if version == schemaVersion {
+		return version
+	}
+
+	backup, err := backupDatabase(version)
+	if err != nil {
+		log.Fatalf("Error backing up the database before upgrading it from schema version %d: %v", version, err)
+	}
+	if backup != "" {
+		slog.Info("Upgrading the database, if the upgrade fails restore the backup and run the previous collector version",
+			"from_version", version, "to_version", schemaVersion, "backup", backup)
+	} else {
+		slog.Info("Upgrading the database", "from_version", version, "to_version", schemaVersion)
+	}
+	return version
+}
+
+// storeSchemaVersion records that the schema is up to date once initDB is
+// done with it.
+func storeSchemaVersion() {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", schemaVersion); err != nil {
+		log.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// backupDatabase copies a SQLite database next to itself. PostgreSQL
+// databases are left to the backups of the server and return no path.
+func backupDatabase(version int) (string, error) {
+	if db.driver != driverSQLite {
+		return "", nil
+	}
+	path := sqlitePath(cfg.DBDSN)
+	if path == "" {
+		return "", nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", path, version)
+	if _, err := os.Stat(backup); err == nil {
+		return "", fmt.Errorf("%s already exists, move it away first", backup)
+	}
+	// VACUUM INTO writes a consistent copy even with WAL journaling
+	_, err := db.Exec("VACUUM INTO ?", backup)
+	return backup, err
+}
+
+// sqlitePath returns the file of a SQLite DSN, or "" for an in-memory
+// database.
+func sqlitePath(dsn string) string {
+	if dsn == "" {
+		dsn = "./metrics.db"
+	}
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if path == ":memory:" || path == "" {
+		return ""
+	}
+	return path
+}
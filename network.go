@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PodNetworkSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	NodeName  string    `json:"node_name"`
+	RxBytes   int64     `json:"rx_bytes"`
+	TxBytes   int64     `json:"tx_bytes"`
+	RxRate    float64   `json:"rx_rate"`
+	TxRate    float64   `json:"tx_rate"`
+}
+
+// storePodNetwork records the cumulative network counters of every pod in
+// a kubelet summary. Rates are derived at query time.
+func storePodNetwork(nodeName string, summary *kubeletSummary) {
+	for _, pod := range summary.Pods {
+		if pod.Network == nil || pod.Network.RxBytes == nil || pod.Network.TxBytes == nil {
+			continue
+		}
+		namespace, podName, ok := cardinality.admitPod(pod.PodRef.Namespace, pod.PodRef.Name)
+		if !ok {
+			continue
+		}
+
+		_, err := db.Exec(
+			`INSERT INTO pod_network (
+                timestamp,
+                namespace,
+                pod_name,
+                node_name,
+                rx_bytes,
+                tx_bytes
+            ) VALUES (?, ?, ?, ?, ?, ?)
+            ON CONFLICT (timestamp, namespace, pod_name) DO NOTHING`,
+			pod.Network.Time.Local(),
+			namespace,
+			podName,
+			nodeName,
+			int64(*pod.Network.RxBytes),
+			int64(*pod.Network.TxBytes),
+		)
+		if err != nil {
+			slog.Error("Error inserting pod network stats", "node", nodeName, "error", err)
+		}
+	}
+}
+
+// getPodNetwork returns the network counters of a pod together with the
+// receive and transmit rates in bytes per second since the previous sample.
+func getPodNetwork(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT
+            timestamp,
+            node_name,
+            rx_bytes,
+            tx_bytes
+        FROM pod_network
+        WHERE namespace = ?
+          AND pod_name = ?
+          AND timestamp BETWEEN ? AND ?
+        ORDER BY timestamp
+    `, c.Param("namespace"), c.Param("name"), from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	samples := []PodNetworkSample{}
+	for rows.Next() {
+		var s PodNetworkSample
+		if err := rows.Scan(&s.Timestamp, &s.NodeName, &s.RxBytes, &s.TxBytes); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(samples) > 0 {
+			prev := samples[len(samples)-1]
+			seconds := s.Timestamp.Sub(prev.Timestamp).Seconds()
+			if seconds > 0 {
+				s.RxRate = counterRate(prev.RxBytes, s.RxBytes, seconds)
+				s.TxRate = counterRate(prev.TxBytes, s.TxBytes, seconds)
+			}
+		}
+		samples = append(samples, s)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, samples)
+}
+
+// counterRate computes the per-second increase of a counter. A counter that
+// went down was reset (pod sandbox restart), so it restarted from zero and
+// the current value is the whole increase.
+func counterRate(prev, current int64, seconds float64) float64 {
+	delta := current - prev
+	if delta < 0 {
+		delta = current
+	}
+	return float64(delta) / seconds
+}
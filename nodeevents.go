@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	nodeEventReboot         = "reboot"
+	nodeEventKubeletRestart = "kubelet_restart"
+)
+
+type NodeEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	NodeName  string    `json:"node_name"`
+	Event     string    `json:"event"`
+	Detail    string    `json:"detail"`
+}
+
+// detectNodeRestarts compares a node's boot ID and kubelet start time with
+// the values seen last and records a timeline event when either changed.
+// The last seen values are kept in node_state so restarts that happen
+// while the collector is down are still noticed.
+func detectNodeRestarts(node *corev1.Node, summary *kubeletSummary) {
+	bootID := node.Status.NodeInfo.BootID
+	var kubeletStart time.Time
+	for _, container := range summary.Node.SystemContainers {
+		if container.Name == "kubelet" {
+			kubeletStart = container.StartTime.Time
+		}
+	}
+
+	var lastBootID string
+	var lastKubeletStart time.Time
+	err := db.QueryRow(
+		"SELECT boot_id, kubelet_start FROM node_state WHERE node_name = ?",
+		node.Name,
+	).Scan(&lastBootID, &lastKubeletStart)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("Error reading node state", "node", node.Name, "error", err)
+		return
+	}
+	known := err == nil
+
+	switch {
+	case !known:
+	case bootID != "" && bootID != lastBootID:
+		// A reboot restarts the kubelet too, only record the reboot
+		recordNodeEvent(node.Name, nodeEventReboot, "boot id "+lastBootID+" -> "+bootID)
+	case !kubeletStart.IsZero() && !kubeletStart.Equal(lastKubeletStart):
+		recordNodeEvent(node.Name, nodeEventKubeletRestart, "kubelet started at "+kubeletStart.Format(time.RFC3339))
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO node_state (node_name, boot_id, kubelet_start) VALUES (?, ?, ?)
+        ON CONFLICT (node_name) DO UPDATE SET
+            boot_id = excluded.boot_id,
+            kubelet_start = excluded.kubelet_start`,
+		node.Name,
+		bootID,
+		kubeletStart,
+	)
+	if err != nil {
+		slog.Error("Error updating node state", "node", node.Name, "error", err)
+	}
+}
+
+func recordNodeEvent(nodeName, event, detail string) {
+	slog.Info("Node event", "node", nodeName, "event", event, "detail", detail)
+
+	_, err := db.Exec(
+		"INSERT INTO node_events (timestamp, node_name, event, detail) VALUES (?, ?, ?, ?)",
+		time.Now(),
+		nodeName,
+		event,
+		detail,
+	)
+	if err != nil {
+		slog.Error("Error inserting node event", "node", nodeName, "error", err)
+	}
+}
+
+func getNodeEvents(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            node_name,
+            event,
+            detail
+        FROM node_events
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	if node := c.Query("node"); node != "" {
+		query += " AND node_name = ?"
+		args = append(args, node)
+	}
+	query += " ORDER BY timestamp"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	events := []NodeEvent{}
+	for rows.Next() {
+		var e NodeEvent
+		if err := rows.Scan(&e.Timestamp, &e.NodeName, &e.Event, &e.Detail); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, events)
+}
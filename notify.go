@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	htmltemplate "html/template"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// The templates notifications are rendered with, the built-in ones unless
+// report-webhook-template, report-mail-template, benchmark-mail-template,
+// issue-template or page-template name a file. Mail templates may define a
+// "subject" template, the issue template must define a "title".
+var (
+	webhookTemplate       = reportMarkdown
+	reportMailTemplate    = reportHTML
+	benchmarkMailTemplate = benchmarkHTML
+	issueTemplate         = issueMarkdown
+	pageTemplate          = pageSummary
+)
+
+// loadNotificationTemplates parses the configured template files so that
+// mistakes in them show at startup rather than when a report is due.
+func loadNotificationTemplates() error {
+	if path := cfg.ReportWebhookTemplate; path != "" {
+		t, err := template.New(filepath.Base(path)).Funcs(reportFuncs).ParseFiles(path)
+		if err != nil {
+			return err
+		}
+		webhookTemplate = t
+	}
+	if path := cfg.ReportMailTemplate; path != "" {
+		t, err := htmltemplate.New(filepath.Base(path)).Funcs(reportFuncs).ParseFiles(path)
+		if err != nil {
+			return err
+		}
+		reportMailTemplate = t
+	}
+	if path := cfg.BenchmarkMailTemplate; path != "" {
+		t, err := htmltemplate.New(filepath.Base(path)).Funcs(reportFuncs).ParseFiles(path)
+		if err != nil {
+			return err
+		}
+		benchmarkMailTemplate = t
+	}
+	if path := cfg.IssueTemplate; path != "" {
+		t, err := template.New(filepath.Base(path)).Funcs(reportFuncs).ParseFiles(path)
+		if err != nil {
+			return err
+		}
+		if t.Lookup("title") == nil {
+			return errors.New(path + " defines no \"title\" template")
+		}
+		issueTemplate = t
+	}
+	if path := cfg.PageTemplate; path != "" {
+		t, err := template.New(filepath.Base(path)).Funcs(reportFuncs).ParseFiles(path)
+		if err != nil {
+			return err
+		}
+		pageTemplate = t
+	}
+	return nil
+}
+
+// renderMail renders the body of an email and its subject, which is
+// fallback if the template defines no "subject".
+func renderMail(t *htmltemplate.Template, data any, fallback string) (subject, body string, err error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	body = buf.String()
+	subject = fallback
+	if t.Lookup("subject") != nil {
+		buf.Reset()
+		if err := t.ExecuteTemplate(&buf, "subject", data); err != nil {
+			return "", "", err
+		}
+		// The subject is a header, not HTML, and a single line
+		subject = strings.Join(strings.Fields(html.UnescapeString(buf.String())), " ")
+	}
+	return subject, body, nil
+}
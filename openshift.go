@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// externalURL is resolved once at startup.
+var externalURL string
+
+var routeResource = schema.GroupVersionResource{Group: "route.openshift.io", Version: "v1", Resource: "routes"}
+
+// resolveExternalURL returns the URL the collector is reachable at from
+// outside the cluster, for links in reports. An explicit external-url
+// wins; on OpenShift it is taken from the Route named by route-name.
+func resolveExternalURL(ctx context.Context, config *rest.Config) string {
+	if cfg.ExternalURL != "" || cfg.RouteName == "" {
+		return cfg.ExternalURL
+	}
+
+	namespace, err := ownNamespace()
+	if err != nil {
+		slog.Error("Error finding the namespace of the route", "route", cfg.RouteName, "error", err)
+		return ""
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		slog.Error("Error creating client for routes", "error", err)
+		return ""
+	}
+	route, err := client.Resource(routeResource).Namespace(namespace).Get(ctx, cfg.RouteName, metav1.GetOptions{})
+	if err != nil {
+		slog.Error("Error getting route", "namespace", namespace, "route", cfg.RouteName, "error", err)
+		return ""
+	}
+	return routeURL(route)
+}
+
+// ownNamespace returns the namespace the collector runs in, from
+// POD_NAMESPACE or the mounted service account.
+func ownNamespace() (string, error) {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace, nil
+	}
+	b, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// routeURL builds the URL of a Route from its host, path and whether it
+// terminates TLS.
+func routeURL(route *unstructured.Unstructured) string {
+	host, _, _ := unstructured.NestedString(route.Object, "spec", "host")
+	if host == "" {
+		return ""
+	}
+	path, _, _ := unstructured.NestedString(route.Object, "spec", "path")
+	scheme := "http"
+	if _, found, _ := unstructured.NestedMap(route.Object, "spec", "tls"); found {
+		scheme = "https"
+	}
+	return scheme + "://" + host + path
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"maps"
+	"math"
+)
+
+const (
+	// outlierThreshold is how many standard deviations a run's cluster
+	// average may be away from the runs it's compared with before it is
+	// flagged.
+	outlierThreshold = 3.0
+	// minOutlierHistory is how many other runs it takes to tell noise
+	// from an outlier.
+	minOutlierHistory = 3
+	// outlierHistoryRuns is how many prior runs a finished run is checked
+	// against.
+	outlierHistoryRuns = 10
+)
+
+// RunOutlier flags a run whose cluster average CPU or memory is far
+// outside the spread of comparable runs, which is more likely
+// infrastructure noise, a busy neighbour or a degraded node, than a
+// regression worth chasing.
+type RunOutlier struct {
+	Run    string  `json:"run"`
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+	// Mean and StdDev are those of the History runs it's compared with.
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"stddev"`
+	ZScore  float64 `json:"z_score"`
+	History int     `json:"history"`
+}
+
+// runSummary is the cluster average CPU and memory of one run.
+type runSummary struct {
+	name    string
+	cluster *RunStats
+}
+
+func summarizeRun(name string, samples []MetricsData) runSummary {
+	_, cluster := runStats(samples)
+	return runSummary{name: name, cluster: cluster.stats()}
+}
+
+// runMetrics are the per-run values outliers and deltas are judged by.
+var runMetrics = []struct {
+	name  string
+	value func(*RunStats) float64
+}{
+	{"avg_cpu", func(s *RunStats) float64 { return s.AvgCpu }},
+	{"avg_memory", func(s *RunStats) float64 { return s.AvgMemory }},
+}
+
+// meanStdDev returns the mean and the sample standard deviation.
+func meanStdDev(values []float64) (float64, float64) {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	if len(values) < 2 {
+		return mean, 0
+	}
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(squares / float64(len(values)-1))
+}
+
+// checkOutlier compares a run with history, which must not include it.
+// Runs without samples are ignored, and so is a history of identical runs
+// since it gives no measure of the noise.
+func checkOutlier(run runSummary, history []runSummary) []RunOutlier {
+	if run.cluster == nil {
+		return nil
+	}
+	var outliers []RunOutlier
+	for _, metric := range runMetrics {
+		value := metric.value
+		var values []float64
+		for _, h := range history {
+			if h.cluster != nil {
+				values = append(values, value(h.cluster))
+			}
+		}
+		if len(values) < minOutlierHistory {
+			return nil
+		}
+		mean, stddev := meanStdDev(values)
+		if stddev == 0 {
+			continue
+		}
+		z := (value(run.cluster) - mean) / stddev
+		if math.Abs(z) > outlierThreshold {
+			outliers = append(outliers, RunOutlier{
+				Run:     run.name,
+				Metric:  metric.name,
+				Value:   value(run.cluster),
+				Mean:    mean,
+				StdDev:  stddev,
+				ZScore:  z,
+				History: len(values),
+			})
+		}
+	}
+	return outliers
+}
+
+// detectOutliers flags the runs of a comparison side that are far off the
+// other runs of the side. Candidate runs are checked against their prior
+// runs with checkPriorRuns instead, which also covers a single run.
+func detectOutliers(runs []runSummary) []RunOutlier {
+	outliers := []RunOutlier{}
+	for _, run := range runs {
+		outliers = append(outliers, checkOutlier(run, otherRuns(runs, run.name))...)
+	}
+	return outliers
+}
+
+func otherRuns(runs []runSummary, name string) []runSummary {
+	var others []runSummary
+	for _, run := range runs {
+		if run.name != name {
+			others = append(others, run)
+		}
+	}
+	return others
+}
+
+// priorRuns returns the last outlierHistoryRuns finished runs with the
+// same labels that ended before run started.
+func priorRuns(view readView, run BenchmarkRun) ([]BenchmarkRun, error) {
+	runs, err := listBenchmarkRuns(view.q, func(r *BenchmarkRun) bool {
+		return r.ID != run.ID && r.End != nil && !r.End.After(run.Start) && maps.Equal(r.Labels, run.Labels)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) > outlierHistoryRuns {
+		runs = runs[len(runs)-outlierHistoryRuns:]
+	}
+	return runs, nil
+}
+
+// checkPriorRuns checks a finished run with its samples against its prior
+// runs.
+func checkPriorRuns(view readView, run BenchmarkRun, samples []MetricsData) ([]RunOutlier, error) {
+	prior, err := priorRuns(view, run)
+	if err != nil {
+		return nil, err
+	}
+	var history []runSummary
+	for _, p := range prior {
+		priorSamples, err := benchmarkSamples(view, p)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, summarizeRun(p.Name, priorSamples))
+	}
+	return checkOutlier(summarizeRun(run.Name, samples), history), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Critical alert rules, such as cluster saturation or collection down,
+// page through PagerDuty or Opsgenie. The rule name is part of the
+// deduplication key, or the Opsgenie alias, so a rule that fires again
+// before its incident was resolved doesn't open another one, and the
+// incident is resolved or closed when the rule stops firing.
+
+const (
+	severityCritical = "critical"
+
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	opsgenieAlertsURL  = "https://api.opsgenie.com/v2/alerts"
+)
+
+// pageSummary is the built-in one line summary of a page.
+var pageSummary = template.Must(template.New("page").Funcs(reportFuncs).Parse(
+	`{{.Rule}}: {{.Metric}} is {{decimal .Value}}, above {{decimal .Above}}{{with .Issue}} ({{.}}){{end}}`))
+
+// pageDedupKey identifies the incident of a rule. The source keeps the
+// collectors of several clusters from folding into one incident.
+func pageDedupKey(rule string) string {
+	return pageSource() + "/" + rule
+}
+
+// routeAlert pages about a critical alert that started firing or resolves
+// the page of one that stopped.
+func routeAlert(ctx context.Context, alert Alert) {
+	if alert.Severity != severityCritical {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if cfg.PagerDutyRoutingKey != "" {
+		if err := sendPagerDutyEvent(ctx, alert); err != nil {
+			slog.Error("Error sending PagerDuty event", "rule", alert.Rule, "state", alert.State, "error", err)
+		}
+	}
+	if cfg.OpsgenieAPIKey != "" {
+		if err := sendOpsgenieAlert(ctx, alert); err != nil {
+			slog.Error("Error sending Opsgenie alert", "rule", alert.Rule, "state", alert.State, "error", err)
+		}
+	}
+}
+
+// sendPagerDutyEvent triggers or resolves an incident with the Events API
+// v2.
+func sendPagerDutyEvent(ctx context.Context, alert Alert) error {
+	event := map[string]any{
+		"routing_key":  cfg.PagerDutyRoutingKey,
+		"dedup_key":    pageDedupKey(alert.Rule),
+		"event_action": "resolve",
+	}
+	if alert.State == alertFiring {
+		var summary bytes.Buffer
+		if err := pageTemplate.Execute(&summary, alert); err != nil {
+			return err
+		}
+		event["event_action"] = "trigger"
+		event["payload"] = map[string]any{
+			"summary":   summary.String(),
+			"source":    pageSource(),
+			"severity":  severityCritical,
+			"timestamp": alert.Since.Format(time.RFC3339),
+			"custom_details": map[string]any{
+				"metric": alert.Metric,
+				"value":  alert.Value,
+				"above":  alert.Above,
+				"issue":  alert.Issue,
+			},
+		}
+		if externalURL != "" {
+			event["links"] = []map[string]string{{"href": strings.TrimSuffix(externalURL, "/") + "/alerts", "text": "Alerts"}}
+		}
+	}
+	return postPage(ctx, pagerDutyEventsURL, "", event)
+}
+
+// sendOpsgenieAlert creates or closes the Opsgenie alert of a rule.
+func sendOpsgenieAlert(ctx context.Context, alert Alert) error {
+	alias := pageDedupKey(alert.Rule)
+	if alert.State != alertFiring {
+		endpoint := opsgenieAlertsURL + "/" + url.PathEscape(alias) + "/close?identifierType=alias"
+		return postPage(ctx, endpoint, cfg.OpsgenieAPIKey, map[string]string{"source": pageSource()})
+	}
+	var summary bytes.Buffer
+	if err := pageTemplate.Execute(&summary, alert); err != nil {
+		return err
+	}
+	message := summary.String()
+	if len(message) > 130 {
+		// Opsgenie rejects longer messages, the details keep the rest
+		message = message[:130]
+	}
+	return postPage(ctx, opsgenieAlertsURL, cfg.OpsgenieAPIKey, map[string]any{
+		"message":     message,
+		"alias":       alias,
+		"description": summary.String(),
+		"source":      pageSource(),
+		"priority":    "P1",
+		"details": map[string]string{
+			"metric": alert.Metric,
+			"value":  fmt.Sprint(alert.Value),
+			"above":  fmt.Sprint(alert.Above),
+			"issue":  alert.Issue,
+		},
+	})
+}
+
+// pageSource names the collector in pages.
+func pageSource() string {
+	if externalURL != "" {
+		return externalURL
+	}
+	return "k8s-metrics-collector"
+}
+
+// postPage posts an event to PagerDuty or, with an API key, to Opsgenie.
+func postPage(ctx context.Context, endpoint, apiKey string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "GenieKey "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("rejected: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Plugins are executables that speak newline-delimited JSON over stdin
+// and stdout, so proprietary collectors and exporters can be written in
+// any language and added to the image without forking the collector.
+//
+// A collector plugin is run every plugin-interval and prints one
+// PluginSample per line before it exits. An exporter plugin is started
+// once and reads every node sample collected from then on as one
+// MetricsData per line, the format of /metrics/export. Anything either
+// writes to stderr goes to the collector's log.
+
+// pluginRestartDelay is how long an exporter plugin that exited waits
+// before it is started again.
+const pluginRestartDelay = 10 * time.Second
+
+// pluginStopTimeout is how long a plugin may take to exit after SIGTERM.
+const pluginStopTimeout = 5 * time.Second
+
+// maxPluginOutput is how much a collector plugin may print in one run.
+const maxPluginOutput = 16 << 20
+
+var errPluginOutput = errors.New("collector plugin printed more than 16 MiB")
+
+// PluginSample is a value printed by a collector plugin. Timestamp
+// defaults to when the plugin was started.
+type PluginSample struct {
+	Timestamp *time.Time        `json:"timestamp,omitempty"`
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type PluginMetric struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Plugin    string            `json:"plugin"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+}
+
+// pluginPaths splits a comma separated list of plugin executables.
+func pluginPaths(list string) []string {
+	var paths []string
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// pluginCommand runs a plugin with SIGTERM instead of SIGKILL when ctx is
+// done, so it can flush what it holds.
+func pluginCommand(ctx context.Context, path string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = pluginStopTimeout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// runCollectorPlugins runs every collector plugin on each interval. A run
+// that is still going when the next one is due is stopped, so a hanging
+// plugin can't pile up processes.
+func runCollectorPlugins(ctx context.Context, paths []string, interval time.Duration) {
+	// The runs are waited for so none writes after the database is closed
+	var runs sync.WaitGroup
+	defer runs.Wait()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, path := range paths {
+			runs.Add(1)
+			go func() {
+				defer runs.Done()
+				runCtx, cancel := context.WithTimeout(ctx, interval)
+				defer cancel()
+				if err := collectFromPlugin(runCtx, path, nil, time.Now()); err != nil {
+					slog.Error("Error running collector plugin", "plugin", filepath.Base(path), "error", err)
+				}
+			}()
+		}
+	}
+}
+
+// collectFromPlugin runs a collector plugin once with stdin, which may be
+// nil, and stores what it prints. Samples without a timestamp get now.
+// Lines that are not a sample are skipped with a warning.
+func collectFromPlugin(ctx context.Context, path string, stdin io.Reader, now time.Time) error {
+	plugin := filepath.Base(path)
+	// Output is collected while the plugin runs rather than read from its
+	// stdout pipe afterwards, so a plugin whose children keep stdout open
+	// can't hold the run past its timeout. Closing the reader at the limit
+	// fails the plugin's writes, which ends the run.
+	var output bytes.Buffer
+	reader, writer := io.Pipe()
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		output.ReadFrom(io.LimitReader(reader, maxPluginOutput+1))
+		reader.CloseWithError(errPluginOutput)
+	}()
+	cmd := pluginCommand(ctx, path)
+	cmd.Stdin = stdin
+	cmd.Stdout = writer
+	err := cmd.Run()
+	writer.Close()
+	<-read
+	if output.Len() > maxPluginOutput {
+		return errPluginOutput
+	}
+	if err != nil {
+		return err
+	}
+
+	var samples []PluginSample
+	scanner := bufio.NewScanner(&output)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var s PluginSample
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil || s.Name == "" {
+			slog.Warn("Skipping invalid plugin output", "plugin", plugin, "line", scanner.Text())
+			continue
+		}
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+        INSERT INTO plugin_metrics (
+            timestamp,
+            plugin,
+            name,
+            labels,
+            value
+        ) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, s := range samples {
+		timestamp := now
+		if s.Timestamp != nil {
+			// Stored in the zone of the collector's own timestamps, which
+			// SQLite compares as text
+			timestamp = s.Timestamp.Local()
+		}
+		if s.Labels == nil {
+			s.Labels = map[string]string{}
+		}
+		labels, err := json.Marshal(s.Labels)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(timestamp, plugin, s.Name, string(labels), s.Value); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	rowsInserted.add("plugin_metrics", float64(len(samples)))
+	return nil
+}
+
+var errExporterBehind = errors.New("exporter plugin fell behind, samples were dropped")
+
+// runExporterPlugin keeps an exporter plugin running until ctx is done,
+// starting it again whenever it exits.
+func runExporterPlugin(ctx context.Context, path string) {
+	for {
+		err := exportToPlugin(ctx, path)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("Exporter plugin stopped", "plugin", filepath.Base(path), "error", err, "restart_in", pluginRestartDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pluginRestartDelay):
+		}
+	}
+}
+
+// exportToPlugin starts an exporter plugin and writes the samples of every
+// collection tick to its stdin until it exits. Like a stream client, a
+// plugin that doesn't keep up is dropped by the hub, it is then restarted.
+func exportToPlugin(ctx context.Context, path string) error {
+	cmd := pluginCommand(ctx, path)
+	cmd.Stdout = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	sub := updates.subscribe(nil)
+	if err := cmd.Start(); err != nil {
+		updates.unsubscribe(sub)
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	failed := make(chan error, 1)
+	// Unsubscribing ends the writer, and once the plugin exited its stdin
+	// is closed, so waiting for the writer can't hang
+	var writer sync.WaitGroup
+	defer func() {
+		updates.unsubscribe(sub)
+		writer.Wait()
+	}()
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		w := bufio.NewWriter(stdin)
+		encoder := json.NewEncoder(w)
+		for {
+			samples, ok := updates.receive(sub)
+			if !ok {
+				if updates.wasEvicted(sub) {
+					failed <- errExporterBehind
+				}
+				return
+			}
+			for _, m := range samples {
+				if err := encoder.Encode(m); err != nil {
+					failed <- err
+					return
+				}
+			}
+			if err := w.Flush(); err != nil {
+				failed <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-exited:
+		return err
+	case err := <-failed:
+		cmd.Process.Kill()
+		<-exited
+		return err
+	}
+}
+
+// getPluginMetrics returns what the collector plugins recorded, filtered
+// by ?plugin= and ?name=.
+func getPluginMetrics(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, time.Hour)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            plugin,
+            name,
+            labels,
+            value
+        FROM plugin_metrics
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	for _, param := range []string{"plugin", "name"} {
+		if v := c.Query(param); v != "" {
+			query += " AND " + param + " = ?"
+			args = append(args, v)
+		}
+	}
+	query += " ORDER BY timestamp, plugin, name"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	metrics := []PluginMetric{}
+	for rows.Next() {
+		var m PluginMetric
+		var labels string
+		if err := rows.Scan(&m.Timestamp, &m.Plugin, &m.Name, &labels, &m.Value); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := json.Unmarshal([]byte(labels), &m.Labels); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		metrics = append(metrics, m)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, metrics)
+}
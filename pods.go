@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+type ContainerMetricsData struct {
+	Timestamp     time.Time `json:"timestamp"`
+	ContainerName string    `json:"container_name"`
+	CpuUsage      int64     `json:"cpu_usage"`
+	MemoryUsage   int64     `json:"memory_usage"`
+}
+
+type PodMetricsData struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Namespace   string    `json:"namespace"`
+	PodName     string    `json:"pod_name"`
+	NodeName    string    `json:"node_name"`
+	CpuUsage    int64     `json:"cpu_usage"`
+	MemoryUsage int64     `json:"memory_usage"`
+}
+
+// collectPodMetrics stores the usage of every container and of every pod,
+// summed over its containers. The node each pod runs on comes from the
+// informer cache so pod rows can be joined with the node rows of the same
+// tick.
+func collectPodMetrics(ctx context.Context, podLister corelisters.PodLister, timestamp time.Time) {
+	podMetrics, err := metricsClient.MetricsV1beta1().PodMetricses("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		slog.Error("Error collecting pod metrics", "error", err)
+		apiErrors.add("pod_metrics", 1)
+		return
+	}
+	samplesCollected.add("pod", float64(len(podMetrics.Items)))
+
+	// All rows of a tick go into one transaction like the node samples
+	start := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		slog.Error("Error inserting pod metrics", "error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	containerStmt, err := tx.Prepare(
+		`INSERT INTO container_metrics (
+            timestamp,
+            namespace,
+            pod_name,
+            container_name,
+            cpu_usage,
+            memory_usage
+        ) VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT (timestamp, namespace, pod_name, container_name) DO UPDATE SET
+            cpu_usage = container_metrics.cpu_usage + excluded.cpu_usage,
+            memory_usage = container_metrics.memory_usage + excluded.memory_usage`,
+	)
+	if err != nil {
+		slog.Error("Error inserting container metrics", "error", err)
+		return
+	}
+	defer containerStmt.Close()
+
+	podStmt, err := tx.Prepare(
+		`INSERT INTO pod_metrics (
+            timestamp,
+            namespace,
+            pod_name,
+            node_name,
+            cpu_usage,
+            memory_usage
+        ) VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT (timestamp, namespace, pod_name) DO UPDATE SET
+            cpu_usage = pod_metrics.cpu_usage + excluded.cpu_usage,
+            memory_usage = pod_metrics.memory_usage + excluded.memory_usage`,
+	)
+	if err != nil {
+		slog.Error("Error inserting pod metrics", "error", err)
+		return
+	}
+	defer podStmt.Close()
+
+	// Pods hashed by the cardinality guard share a row, which sums their
+	// usage through the upserts above and in the published samples
+	var podRows, containerRows int
+	var published []PodMetricsData
+	publishedIndex := make(map[string]int)
+	for _, podMetric := range podMetrics.Items {
+		namespace, podName, ok := cardinality.admitPod(podMetric.Namespace, podMetric.Name)
+		if !ok {
+			continue
+		}
+
+		var cpu, memory int64
+		for _, container := range podMetric.Containers {
+			containerCPU := container.Usage.Cpu().MilliValue()
+			containerMemory := container.Usage.Memory().Value()
+			cpu += containerCPU
+			memory += containerMemory
+
+			_, err = containerStmt.Exec(
+				timestamp,
+				namespace,
+				podName,
+				container.Name,
+				containerCPU,
+				containerMemory,
+			)
+			if err != nil {
+				slog.Error("Error inserting container metrics", "error", err)
+				return
+			}
+			containerRows++
+		}
+
+		nodeName := podNode(podLister, podMetric.Namespace, podMetric.Name)
+		_, err = podStmt.Exec(
+			timestamp,
+			namespace,
+			podName,
+			nodeName,
+			cpu,
+			memory,
+		)
+		if err != nil {
+			slog.Error("Error inserting pod metrics", "error", err)
+			return
+		}
+		podRows++
+
+		if i, ok := publishedIndex[namespace+"/"+podName]; ok {
+			published[i].CpuUsage += cpu
+			published[i].MemoryUsage += memory
+			continue
+		}
+		publishedIndex[namespace+"/"+podName] = len(published)
+		published = append(published, PodMetricsData{
+			Timestamp:   timestamp,
+			Namespace:   namespace,
+			PodName:     podName,
+			NodeName:    nodeName,
+			CpuUsage:    cpu,
+			MemoryUsage: memory,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("Error inserting pod metrics", "error", err)
+		return
+	}
+	dbWriteDuration.observe(time.Since(start).Seconds(), "pod_metrics")
+	rowsInserted.add("pod_metrics", float64(podRows))
+	rowsInserted.add("container_metrics", float64(containerRows))
+	ingest.pods.Store(int64(podRows))
+	updates.publishPods(published)
+}
+
+// podNode returns the node a pod is scheduled on, "" if the informer
+// hasn't seen the pod yet.
+func podNode(podLister corelisters.PodLister, namespace, name string) string {
+	pod, err := podLister.Pods(namespace).Get(name)
+	if err != nil {
+		return ""
+	}
+	return pod.Spec.NodeName
+}
+
+func getPodMetrics(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            namespace,
+            pod_name,
+            node_name,
+            cpu_usage,
+            memory_usage
+        FROM pod_metrics
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	for param, column := range map[string]string{"namespace": "namespace", "pod": "pod_name", "node": "node_name"} {
+		if v := c.Query(param); v != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	query, args = scopeNamespaces(c, query, args)
+	query += " ORDER BY timestamp DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	metrics := []PodMetricsData{}
+	for rows.Next() {
+		var m PodMetricsData
+		err := rows.Scan(
+			&m.Timestamp,
+			&m.Namespace,
+			&m.PodName,
+			&m.NodeName,
+			&m.CpuUsage,
+			&m.MemoryUsage,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		metrics = append(metrics, m)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, metrics)
+}
+
+func getContainerMetrics(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            container_name,
+            cpu_usage,
+            memory_usage
+        FROM container_metrics
+        WHERE namespace = ?
+          AND pod_name = ?
+          AND timestamp BETWEEN ? AND ?`
+	args := []any{c.Param("namespace"), c.Param("name"), from, to}
+	if v := c.Query("container"); v != "" {
+		query += " AND container_name = ?"
+		args = append(args, v)
+	}
+	query += " ORDER BY timestamp DESC, container_name"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	metrics := []ContainerMetricsData{}
+	for rows.Next() {
+		var m ContainerMetricsData
+		err := rows.Scan(
+			&m.Timestamp,
+			&m.ContainerName,
+			&m.CpuUsage,
+			&m.MemoryUsage,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		metrics = append(metrics, m)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, metrics)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// promWriter writes the Prometheus text exposition format. Every metric
+// family has to be written in one go, HELP and TYPE first.
+type promWriter struct {
+	w io.Writer
+}
+
+func (p promWriter) family(name, kind, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample. labels alternate between name and value.
+func (p promWriter) sample(name string, value float64, labels ...string) {
+	io.WriteString(p.w, name)
+	if len(labels) > 0 {
+		io.WriteString(p.w, "{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				io.WriteString(p.w, ",")
+			}
+			fmt.Fprintf(p.w, "%s=\"%s\"", labels[i], promEscaper.Replace(labels[i+1]))
+		}
+		io.WriteString(p.w, "}")
+	}
+	fmt.Fprintf(p.w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// getPrometheus exposes the most recent collection tick in the Prometheus
+// text format so Prometheus can scrape the collector directly.
+func getPrometheus(c *gin.Context) {
+	nodes, err := store.LatestSamples()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Header("Content-Type", prometheusContentType)
+	c.Status(http.StatusOK)
+	p := promWriter{c.Writer}
+	writeBudgetMetrics(p)
+	writeDatabaseMetrics(p)
+	writeSelfMetrics(p)
+	writeAccuracyMetrics(p)
+
+	p.family("k8s_node_cpu_usage_percent", "gauge", "CPU usage of the node as a percentage of its allocatable CPU.")
+	for _, n := range nodes {
+		p.sample("k8s_node_cpu_usage_percent", n.CpuUsage, "node", n.NodeName)
+	}
+	p.family("k8s_node_cpu_usage_millicores", "gauge", "CPU usage of the node.")
+	for _, n := range nodes {
+		p.sample("k8s_node_cpu_usage_millicores", float64(n.CpuUsed), "node", n.NodeName)
+	}
+	p.family("k8s_node_cpu_allocatable_millicores", "gauge", "CPU of the node available to pods.")
+	for _, n := range nodes {
+		p.sample("k8s_node_cpu_allocatable_millicores", float64(n.NodeAllocatableCpu), "node", n.NodeName)
+	}
+	p.family("k8s_node_cpu_requested_millicores", "gauge", "Sum of the CPU requests of the pods scheduled on the node.")
+	for _, n := range nodes {
+		p.sample("k8s_node_cpu_requested_millicores", float64(n.NodeRequestedCpu), "node", n.NodeName)
+	}
+	p.family("k8s_node_cpu_usage_percent_of_requests", "gauge", "CPU usage of the node as a percentage of the CPU requests of its pods.")
+	for _, n := range nodes {
+		p.sample("k8s_node_cpu_usage_percent_of_requests", percentOf(n.CpuUsed, n.NodeRequestedCpu), "node", n.NodeName)
+	}
+	p.family("k8s_node_memory_usage_bytes", "gauge", "Memory working set of the node.")
+	for _, n := range nodes {
+		p.sample("k8s_node_memory_usage_bytes", float64(n.MemoryUsage), "node", n.NodeName)
+	}
+	p.family("k8s_node_memory_usage_percent", "gauge", "Memory usage of the node as a percentage of its allocatable memory.")
+	for _, n := range nodes {
+		p.sample("k8s_node_memory_usage_percent", n.MemoryUsagePercent, "node", n.NodeName)
+	}
+	p.family("k8s_node_memory_capacity_bytes", "gauge", "Memory capacity of the node.")
+	for _, n := range nodes {
+		p.sample("k8s_node_memory_capacity_bytes", float64(n.NodeTotalMemory), "node", n.NodeName)
+	}
+	p.family("k8s_node_memory_allocatable_bytes", "gauge", "Memory of the node available to pods.")
+	for _, n := range nodes {
+		p.sample("k8s_node_memory_allocatable_bytes", float64(n.NodeAllocatableMemory), "node", n.NodeName)
+	}
+
+	// Cluster values are repeated on every node row, so they are only
+	// known when there is at least one
+	if len(nodes) == 0 {
+		return
+	}
+	cluster := nodes[0]
+	p.family("k8s_cluster_cpu_usage_percent", "gauge", "CPU usage of all nodes as a percentage of the allocatable CPU of the cluster.")
+	p.sample("k8s_cluster_cpu_usage_percent", cluster.ClusterCpuUsage)
+	p.family("k8s_cluster_cpu_usage_millicores", "gauge", "CPU usage of all nodes.")
+	p.sample("k8s_cluster_cpu_usage_millicores", float64(cluster.ClusterUsedCpu))
+	p.family("k8s_cluster_cpu_capacity_millicores", "gauge", "Sum of the CPU capacity of all nodes.")
+	p.sample("k8s_cluster_cpu_capacity_millicores", float64(cluster.ClusterTotalCpu))
+	p.family("k8s_cluster_cpu_allocatable_millicores", "gauge", "Sum of the allocatable CPU of all nodes.")
+	p.sample("k8s_cluster_cpu_allocatable_millicores", float64(cluster.ClusterAllocatableCpu))
+	p.family("k8s_cluster_cpu_requested_millicores", "gauge", "Sum of the CPU requests of all scheduled pods.")
+	p.sample("k8s_cluster_cpu_requested_millicores", float64(cluster.ClusterRequestedCpu))
+	p.family("k8s_cluster_cpu_usage_percent_of_requests", "gauge", "CPU usage of all nodes as a percentage of the CPU requests of all pods.")
+	p.sample("k8s_cluster_cpu_usage_percent_of_requests", percentOf(cluster.ClusterUsedCpu, cluster.ClusterRequestedCpu))
+	p.family("k8s_cluster_memory_usage_bytes", "gauge", "Memory working set of all nodes.")
+	p.sample("k8s_cluster_memory_usage_bytes", float64(cluster.ClusterMemoryUsage))
+	p.family("k8s_cluster_memory_capacity_bytes", "gauge", "Sum of the memory capacity of all nodes.")
+	p.sample("k8s_cluster_memory_capacity_bytes", float64(cluster.ClusterTotalMemory))
+	p.family("k8s_cluster_memory_allocatable_bytes", "gauge", "Sum of the allocatable memory of all nodes.")
+	p.sample("k8s_cluster_memory_allocatable_bytes", float64(cluster.ClusterAllocatableMemory))
+	p.family("k8s_cluster_memory_usage_percent", "gauge", "Memory usage of all nodes as a percentage of the allocatable memory of the cluster.")
+	p.sample("k8s_cluster_memory_usage_percent", cluster.ClusterMemoryUsagePercent)
+	p.family("k8s_cluster_headroom_pods", "gauge", "Standard pods that still fit into the unused allocatable CPU and memory of the cluster.")
+	p.sample("k8s_cluster_headroom_pods", float64(cluster.Headroom))
+}
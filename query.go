@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxPageLimit = 10000
+
+// parsePage reads the limit and offset query parameters. Paging is opt-in:
+// without limit the limit is 0, which means every row. On invalid input
+// it responds with 400 and returns false.
+func parsePage(c *gin.Context) (int, int, bool) {
+	limit := 0
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPageLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxPageLimit)})
+			return 0, 0, false
+		}
+		limit = n
+	}
+
+	offset := 0
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return 0, 0, false
+		}
+		offset = n
+	}
+	if offset > 0 && limit == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset requires limit"})
+		return 0, 0, false
+	}
+
+	return limit, offset, true
+}
+
+// parseTimeRange reads the from and to query parameters. to defaults to
+// now and from to window before to, or to the beginning of time if window
+// is zero. On invalid input it responds with 400 and returns false.
+func parseTimeRange(c *gin.Context, window time.Duration) (time.Time, time.Time, bool) {
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+			return time.Time{}, time.Time{}, false
+		}
+		to = t
+	}
+
+	from := time.Unix(0, 0)
+	if window > 0 {
+		from = to.Add(-window)
+	}
+	if v := c.Query("from"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+			return time.Time{}, time.Time{}, false
+		}
+		from = t
+	}
+
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// parseTime accepts either an RFC3339 timestamp or unix seconds. The result
+// is converted to the local zone so it compares correctly against the
+// timestamps stored by the collector.
+func parseTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.In(time.Local), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultQuotaThreshold = 0.9
+
+type QuotaUsage struct {
+	Timestamp time.Time `json:"timestamp"`
+	Namespace string    `json:"namespace"`
+	QuotaName string    `json:"quota_name"`
+	Resource  string    `json:"resource"`
+	Hard      int64     `json:"hard"`
+	Used      int64     `json:"used"`
+	Ratio     float64   `json:"ratio"`
+	NearLimit bool      `json:"near_limit"`
+}
+
+// collectQuotas records the hard limit and usage of every ResourceQuota.
+// Quota usage changes slowly, so it is polled on its own interval.
+func collectQuotas(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		quotas, err := clientset.CoreV1().ResourceQuotas("").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			slog.Error("Error listing resource quotas", "error", err)
+			apiErrors.add("resource_quotas", 1)
+			continue
+		}
+
+		now := time.Now()
+		for _, quota := range quotas.Items {
+			for name, hard := range quota.Status.Hard {
+				used := quota.Status.Used[name]
+
+				_, err = db.Exec(
+					`INSERT INTO quota_usage (
+                        timestamp,
+                        namespace,
+                        quota_name,
+                        resource,
+                        hard,
+                        used
+                    ) VALUES (?, ?, ?, ?, ?, ?)`,
+					now,
+					quota.Namespace,
+					quota.Name,
+					string(name),
+					quotaValue(name, hard),
+					quotaValue(name, used),
+				)
+				if err != nil {
+					slog.Error("Error inserting quota usage", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// quotaValue stores CPU quantities in millicores and everything else
+// (memory, storage, object counts) in whole units.
+func quotaValue(name corev1.ResourceName, q resource.Quantity) int64 {
+	if strings.HasSuffix(string(name), "cpu") {
+		return q.MilliValue()
+	}
+	return q.Value()
+}
+
+// getQuotas returns quota usage over time. Rows whose usage is at or above
+// threshold (a fraction of the hard limit, default 0.9) are flagged as near
+// the limit, since a namespace at its quota silently stops scaling.
+func getQuotas(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	threshold := defaultQuotaThreshold
+	if v := c.Query("threshold"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "threshold must be a positive number"})
+			return
+		}
+		threshold = t
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            namespace,
+            quota_name,
+            resource,
+            hard,
+            used
+        FROM quota_usage
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	for param, column := range map[string]string{"namespace": "namespace", "resource": "resource"} {
+		if v := c.Query(param); v != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	query, args = scopeNamespaces(c, query, args)
+	query += " ORDER BY timestamp, namespace, quota_name, resource"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	usage := []QuotaUsage{}
+	nearOnly := c.Query("near_limit") == "true"
+	for rows.Next() {
+		var u QuotaUsage
+		if err := rows.Scan(&u.Timestamp, &u.Namespace, &u.QuotaName, &u.Resource, &u.Hard, &u.Used); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if u.Hard > 0 {
+			u.Ratio = float64(u.Used) / float64(u.Hard)
+		}
+		u.NearLimit = u.Hard > 0 && u.Ratio >= threshold
+		if nearOnly && !u.NearLimit {
+			continue
+		}
+		usage = append(usage, u)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, usage)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const readinessPollInterval = 5 * time.Second
+
+type CollectorStatus struct {
+	State        string    `json:"state"`
+	Message      string    `json:"message,omitempty"`
+	Nodes        int       `json:"nodes"`
+	Since        time.Time `json:"since"`
+	Distribution string    `json:"distribution,omitempty"`
+}
+
+var (
+	statusMu sync.Mutex
+	status   = CollectorStatus{State: "starting", Since: time.Now()}
+)
+
+func setStatus(state, message string, nodes int) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	if status.State != state {
+		status.Since = time.Now()
+	}
+	status.State = state
+	status.Message = message
+	status.Nodes = nodes
+}
+
+// waitForCluster blocks until metrics-server answers and at least minNodes
+// nodes report metrics, so collection doesn't start with a burst of errors
+// and partial rows while the cluster is still coming up. After the timeout
+// collection starts anyway.
+func waitForCluster(ctx context.Context, minNodes int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		nodes, err := metricsClient.MetricsV1beta1().NodeMetricses().List(ctx, metav1.ListOptions{})
+		switch {
+		case err != nil:
+			setStatus("waiting", "metrics-server unavailable: "+err.Error(), 0)
+		case len(nodes.Items) < minNodes:
+			setStatus("waiting", fmt.Sprintf("%d of %d nodes reporting metrics", len(nodes.Items), minNodes), len(nodes.Items))
+		default:
+			setStatus("collecting", "", len(nodes.Items))
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			statusMu.Lock()
+			message, nodes := status.Message, status.Nodes
+			statusMu.Unlock()
+
+			slog.Warn("Cluster not ready, starting collection anyway", "timeout", timeout, "reason", message)
+			setStatus("collecting", "started before cluster was ready: "+message, nodes)
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(readinessPollInterval):
+		}
+	}
+}
+
+func getStatus(c *gin.Context) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	respond(c, http.StatusOK, status)
+}
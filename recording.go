@@ -0,0 +1,576 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Recording rules compute series from the stored ones on every
+// recording-interval and store the result under the rule's name, so an
+// expensive expression is evaluated once rather than by every dashboard.
+// The rules are read from the JSON file named by recording-rules, e.g.
+//
+//	{
+//	  "rules": [
+//	    {"record": "node_free_cpu", "expr": "node_allocatable_cpu - cpu_used"},
+//	    {"record": "cluster_cpu_usage_5m", "expr": "max(avg_over_time(cluster_cpu_usage[5m]))"},
+//	    {"record": "cluster_free_cpu", "expr": "sum(node_free_cpu) / 1000"}
+//	  ]
+//	}
+//
+// Expressions are a subset of PromQL over the per-node series:
+//
+//   - a series is a column of the metrics table listed in the schema, such
+//     as cpu_usage, or the record of an earlier rule, and evaluates to the
+//     latest value of every node within recordingLookback
+//   - avg_over_time, min_over_time and max_over_time take a range such as
+//     cpu_usage[5m] and evaluate to the average, least or greatest value of
+//     every node over it
+//   - sum, avg, min, max and count aggregate over the nodes
+//   - + - * / combine values node by node; a number or an aggregate applies
+//     to every node
+//
+// Results are stored in recorded_series with the node they belong to, or
+// none for aggregates, and read from /metrics/recorded.
+
+// recordingLookback is how far back a series looks for the latest value.
+const recordingLookback = 5 * time.Minute
+
+// RecordingRule stores the value of Expr as the series Record.
+type RecordingRule struct {
+	Record string `json:"record"`
+	Expr   string `json:"expr"`
+
+	expr recordingExpr
+}
+
+var recordingRules []RecordingRule
+
+// recordingValues are the values of an expression by node, "" for the one
+// value of a number or an aggregate.
+type recordingValues map[string]float64
+
+type recordingExpr interface {
+	eval(at time.Time) (recordingValues, error)
+}
+
+// loadRecordingRules reads and parses the recording-rules file and adds the
+// records to the schema.
+func loadRecordingRules(path string) ([]RecordingRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []RecordingRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	recorded := make(map[string]bool)
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if !isRecordName(rule.Record) || sampleColumn(rule.Record) || recorded[rule.Record] {
+			return nil, fmt.Errorf("record %q must be a unique name of letters, digits and _ that isn't a column", rule.Record)
+		}
+		p := &recordingParser{input: rule.Expr, recorded: recorded}
+		if rule.expr, err = p.parse(); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Record, err)
+		}
+		recorded[rule.Record] = true
+	}
+	for _, rule := range file.Rules {
+		metricRegistry = append(metricRegistry, MetricDescriptor{
+			Name:        rule.Record,
+			Table:       "recorded_series",
+			Type:        "gauge",
+			Collector:   "recording-rule",
+			Description: rule.Expr,
+		})
+	}
+	return file.Rules, nil
+}
+
+func isRecordName(name string) bool {
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && r != ':' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleColumn reports whether name is a column of the metrics table.
+func sampleColumn(name string) bool {
+	for _, m := range metricRegistry {
+		if m.Table == "metrics" && m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateRecordingRules evaluates the rules on every interval until ctx
+// is done.
+func evaluateRecordingRules(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := recordRules(time.Now()); err != nil {
+			slog.Error("Error evaluating recording rules", "error", err)
+		}
+	}
+}
+
+// recordRules evaluates every rule at one instant, in order so rules can
+// build on the records of earlier ones.
+func recordRules(at time.Time) error {
+	var stored int
+	for _, rule := range recordingRules {
+		values, err := rule.expr.eval(at)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Record, err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for node, value := range values {
+			_, err := tx.Exec("INSERT INTO recorded_series (timestamp, name, node_name, value) VALUES (?, ?, ?, ?)", at, rule.Record, node, value)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		stored += len(values)
+	}
+	rowsInserted.add("recorded_series", float64(stored))
+	return nil
+}
+
+// RecordedSample is a value stored by a recording rule.
+type RecordedSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Name      string    `json:"name"`
+	NodeName  string    `json:"node_name,omitempty"`
+	Value     float64   `json:"value"`
+}
+
+// getRecordedSeries returns what the recording rules stored, filtered by
+// ?name= and ?node=.
+func getRecordedSeries(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, time.Hour)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT timestamp, name, node_name, value
+        FROM recorded_series
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	for param, column := range map[string]string{"name": "name", "node": "node_name"} {
+		if v := c.Query(param); v != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, v)
+		}
+	}
+	query += " ORDER BY timestamp, name, node_name"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	series := []RecordedSample{}
+	for rows.Next() {
+		var s RecordedSample
+		if err := rows.Scan(&s.Timestamp, &s.Name, &s.NodeName, &s.Value); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		series = append(series, s)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, series)
+}
+
+// numberExpr is a number literal.
+type numberExpr float64
+
+func (n numberExpr) eval(time.Time) (recordingValues, error) {
+	return recordingValues{"": float64(n)}, nil
+}
+
+// seriesExpr is a series, latest value per node, or with a window the
+// avg, min or max per node over it.
+type seriesExpr struct {
+	name     string
+	recorded bool
+	window   time.Duration
+	fn       string
+}
+
+func (s seriesExpr) eval(at time.Time) (recordingValues, error) {
+	var query string
+	var args []any
+	switch {
+	case s.window > 0 && s.recorded:
+		query = "SELECT COALESCE(node_name, ''), " + s.fn + "(value) FROM recorded_series WHERE name = ? AND timestamp > ? AND timestamp <= ? GROUP BY node_name"
+		args = []any{s.name, at.Add(-s.window), at}
+	case s.window > 0:
+		query = "SELECT COALESCE(node_name, ''), " + s.fn + "(" + s.name + ") FROM metrics WHERE source = ? AND timestamp > ? AND timestamp <= ? GROUP BY node_name"
+		args = []any{sourceMetricsServer, at.Add(-s.window), at}
+	case s.recorded:
+		query = `
+            SELECT COALESCE(node_name, ''), value
+            FROM recorded_series
+            WHERE name = ?
+              AND timestamp = (
+                SELECT MAX(timestamp)
+                FROM recorded_series
+                WHERE name = ? AND timestamp > ? AND timestamp <= ?
+              )`
+		args = []any{s.name, s.name, at.Add(-recordingLookback), at}
+	default:
+		query = `
+            SELECT COALESCE(node_name, ''), ` + s.name + `
+            FROM metrics
+            WHERE source = ?
+              AND timestamp = (
+                SELECT MAX(timestamp)
+                FROM metrics
+                WHERE source = ? AND timestamp > ? AND timestamp <= ?
+              )`
+		args = []any{sourceMetricsServer, sourceMetricsServer, at.Add(-recordingLookback), at}
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(recordingValues)
+	for rows.Next() {
+		var node string
+		var value *float64
+		if err := rows.Scan(&node, &value); err != nil {
+			return nil, err
+		}
+		if value != nil {
+			values[node] = *value
+		}
+	}
+	return values, rows.Err()
+}
+
+// aggregateExpr aggregates over the nodes.
+type aggregateExpr struct {
+	fn  string
+	arg recordingExpr
+}
+
+func (a aggregateExpr) eval(at time.Time) (recordingValues, error) {
+	values, err := a.arg.eval(at)
+	if err != nil || len(values) == 0 {
+		return recordingValues{}, err
+	}
+	var result float64
+	first := true
+	for _, v := range values {
+		switch {
+		case a.fn == "min" && (first || v < result), a.fn == "max" && (first || v > result):
+			result = v
+		case a.fn == "sum", a.fn == "avg":
+			result += v
+		case a.fn == "count":
+			result++
+		}
+		first = false
+	}
+	if a.fn == "avg" {
+		result /= float64(len(values))
+	}
+	return recordingValues{"": result}, nil
+}
+
+// binaryExpr combines two values node by node. A single value without a
+// node applies to every node of the other side.
+type binaryExpr struct {
+	op          byte
+	left, right recordingExpr
+}
+
+func (b binaryExpr) eval(at time.Time) (recordingValues, error) {
+	left, err := b.left.eval(at)
+	if err != nil {
+		return nil, err
+	}
+	right, err := b.right.eval(at)
+	if err != nil {
+		return nil, err
+	}
+	_, leftOne := left[""]
+	_, rightOne := right[""]
+	values := make(recordingValues)
+	switch {
+	case leftOne && rightOne:
+		if v, ok := applyOp(b.op, left[""], right[""]); ok {
+			values[""] = v
+		}
+	case leftOne:
+		for node, r := range right {
+			if v, ok := applyOp(b.op, left[""], r); ok {
+				values[node] = v
+			}
+		}
+	default:
+		for node, l := range left {
+			r, ok := right[node]
+			if rightOne {
+				r, ok = right[""], true
+			}
+			if !ok {
+				continue
+			}
+			if v, ok := applyOp(b.op, l, r); ok {
+				values[node] = v
+			}
+		}
+	}
+	return values, nil
+}
+
+// applyOp leaves out divisions by zero rather than storing infinities.
+func applyOp(op byte, l, r float64) (float64, bool) {
+	switch op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	default:
+		return l / r, r != 0
+	}
+}
+
+var (
+	aggregateFuncs = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+	overTimeFuncs  = map[string]string{"avg_over_time": "AVG", "min_over_time": "MIN", "max_over_time": "MAX"}
+)
+
+// recordingParser is a recursive descent parser of rule expressions.
+type recordingParser struct {
+	input    string
+	pos      int
+	recorded map[string]bool
+}
+
+func (p *recordingParser) parse() (recordingExpr, error) {
+	expr, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at %d", p.input[p.pos], p.pos)
+	}
+	return expr, nil
+}
+
+func (p *recordingParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept consumes c if it is next.
+func (p *recordingParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *recordingParser) sum() (recordingExpr, error) {
+	left, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept('+'):
+			right, err := p.product()
+			if err != nil {
+				return nil, err
+			}
+			left = binaryExpr{'+', left, right}
+		case p.accept('-'):
+			right, err := p.product()
+			if err != nil {
+				return nil, err
+			}
+			left = binaryExpr{'-', left, right}
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *recordingParser) product() (recordingExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept('*'):
+			right, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			left = binaryExpr{'*', left, right}
+		case p.accept('/'):
+			right, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			left = binaryExpr{'/', left, right}
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *recordingParser) unary() (recordingExpr, error) {
+	if p.accept('-') {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{'*', numberExpr(-1), operand}, nil
+	}
+	if p.accept('(') {
+		inner, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("expected ) at %d", p.pos)
+		}
+		return inner, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.input) && (p.input[p.pos] == '.' || unicode.IsDigit(rune(p.input[p.pos]))) {
+		for p.pos < len(p.input) && (p.input[p.pos] == '.' || unicode.IsDigit(rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at %d", start)
+		}
+		return numberExpr(n), nil
+	}
+	for p.pos < len(p.input) && isRecordName(p.input[start:p.pos+1]) {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if name == "" {
+		if p.pos == len(p.input) {
+			return nil, errors.New("unexpected end of expression")
+		}
+		return nil, fmt.Errorf("unexpected %q at %d", p.input[p.pos], p.pos)
+	}
+
+	if aggregateFuncs[name] || overTimeFuncs[name] != "" {
+		if !p.accept('(') {
+			return nil, fmt.Errorf("expected ( after %s at %d", name, p.pos)
+		}
+		var arg recordingExpr
+		var err error
+		if fn := overTimeFuncs[name]; fn != "" {
+			arg, err = p.rangeSeries(fn)
+		} else {
+			arg, err = p.sum()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, fmt.Errorf("expected ) at %d", p.pos)
+		}
+		if aggregateFuncs[name] {
+			return aggregateExpr{name, arg}, nil
+		}
+		return arg, nil
+	}
+	return p.series(name, start)
+}
+
+func (p *recordingParser) series(name string, pos int) (seriesExpr, error) {
+	switch {
+	case sampleColumn(name):
+		return seriesExpr{name: name}, nil
+	case p.recorded[name]:
+		return seriesExpr{name: name, recorded: true}, nil
+	}
+	return seriesExpr{}, fmt.Errorf("unknown series %s at %d, expected a metrics column or the record of an earlier rule", name, pos)
+}
+
+// rangeSeries parses the series[window] argument of an _over_time function.
+func (p *recordingParser) rangeSeries(fn string) (recordingExpr, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && isRecordName(p.input[start:p.pos+1]) {
+		p.pos++
+	}
+	s, err := p.series(p.input[start:p.pos], start)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept('[') {
+		return nil, fmt.Errorf("expected a range such as [5m] at %d", p.pos)
+	}
+	end := strings.IndexByte(p.input[p.pos:], ']')
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated range at %d", p.pos)
+	}
+	window, err := time.ParseDuration(strings.TrimSpace(p.input[p.pos : p.pos+end]))
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid range at %d", p.pos)
+	}
+	p.pos += end + 1
+	s.window, s.fn = window, fn
+	return s, nil
+}
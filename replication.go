@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// replicationPage is how many samples a standby fetches per request.
+const replicationPage = 1000
+
+// replicate runs this instance as a standby of replicate-from: on every
+// replication-interval it pulls the samples the primary stored since the
+// last pull, paging with the after_seq cursor of /metrics, and checks the
+// primary's /healthz. It returns true once the primary has failed its
+// health check for takeover-after, so the caller starts collecting in its
+// place until watchPrimary hands collection back, and false when ctx is
+// done. Only node samples are replicated.
+func replicate(ctx context.Context) bool {
+	setStatus("standby", "replicating from the primary", 0)
+	client := &http.Client{Timeout: 30 * time.Second}
+	lastHeard := time.Now()
+
+	ticker := time.NewTicker(cfg.ReplicationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+
+		if err := pullSamples(ctx, client); err != nil && ctx.Err() == nil {
+			slog.Error("Error replicating samples", "error", err)
+		}
+
+		err := checkPrimary(ctx, client)
+		if err == nil {
+			lastHeard = time.Now()
+			continue
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		down := time.Since(lastHeard)
+		slog.Warn("Primary failed its health check", "error", err, "since", lastHeard)
+		if cfg.TakeoverAfter > 0 && down >= cfg.TakeoverAfter {
+			slog.Warn("Taking over collection from the primary", "down_for", down.Truncate(time.Second))
+			setStatus("starting", "took over from the primary", 0)
+			return true
+		}
+	}
+}
+
+// watchPrimary keeps checking the primary's /healthz while this standby
+// collects in its place and calls demote once the primary has passed it
+// for takeover-after, so the two don't both collect for longer than the
+// standby took to take over. The caller stops collecting and replicates
+// again.
+func watchPrimary(ctx context.Context, demote context.CancelFunc) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var upSince time.Time
+
+	ticker := time.NewTicker(cfg.ReplicationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := checkPrimary(ctx, client); err != nil {
+			upSince = time.Time{}
+			continue
+		}
+		if upSince.IsZero() {
+			upSince = time.Now()
+			slog.Info("Primary passes its health check again")
+		}
+		if up := time.Since(upSince); up >= cfg.TakeoverAfter {
+			slog.Warn("Handing collection back to the primary", "up_for", up.Truncate(time.Second))
+			demote()
+			return
+		}
+	}
+}
+
+// pullSamples stores the samples the primary has after the last replicated
+// sequence number, page by page until it has none left. The cursor is
+// saved after every page, a page stored twice after a crash replaces the
+// samples it stored the first time.
+func pullSamples(ctx context.Context, client *http.Client) error {
+	after, err := replicationCursor()
+	if err != nil {
+		return err
+	}
+	for {
+		var samples []MetricsData
+		query := url.Values{
+			"after_seq": {strconv.FormatInt(after, 10)},
+			"limit":     {strconv.Itoa(replicationPage)},
+		}
+		if err := getPrimary(ctx, client, "/metrics?"+query.Encode(), &samples); err != nil {
+			return err
+		}
+		if len(samples) == 0 {
+			return nil
+		}
+		// Stored times are compared as text by SQLite, so they must be in
+		// the zone of the rows collected locally
+		for i := range samples {
+			samples[i].Timestamp = samples[i].Timestamp.Local()
+			samples[i].SampleTime = samples[i].SampleTime.Local()
+		}
+		if err := store.InsertSamples(samples); err != nil {
+			return err
+		}
+		after = samples[len(samples)-1].Seq
+		if err := saveReplicationCursor(after); err != nil {
+			return err
+		}
+		if len(samples) < replicationPage {
+			return nil
+		}
+	}
+}
+
+// checkPrimary returns an error unless the primary's liveness probe
+// passes, which it stops doing when its collection stalls.
+func checkPrimary(ctx context.Context, client *http.Client) error {
+	return getPrimary(ctx, client, "/healthz", nil)
+}
+
+// getPrimary requests path from the primary with the replication-token
+// and decodes the JSON response into v unless it is nil.
+func getPrimary(ctx context.Context, client *http.Client, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(cfg.ReplicateFrom, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", gin.MIMEJSON)
+	if cfg.ReplicationToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.ReplicationToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// replicationCursor returns the sequence number of the primary's last
+// replicated sample, 0 before the first pull. The cursor is kept per
+// primary URL so pointing the standby at another primary starts over.
+func replicationCursor() (int64, error) {
+	var seq int64
+	err := db.QueryRow(
+		"SELECT last_seq FROM replication_state WHERE primary_url = ?",
+		cfg.ReplicateFrom,
+	).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return seq, err
+}
+
+func saveReplicationCursor(seq int64) error {
+	_, err := db.Exec(`
+        INSERT INTO replication_state (primary_url, last_seq, updated_at)
+        VALUES (?, ?, ?)
+        ON CONFLICT (primary_url) DO UPDATE
+        SET last_seq = excluded.last_seq,
+            updated_at = excluded.updated_at
+    `, cfg.ReplicateFrom, seq, time.Now())
+	return err
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+const (
+	reportDaily  = "daily"
+	reportWeekly = "weekly"
+)
+
+// Report summarizes the utilization of the cluster over one day or week.
+type Report struct {
+	ID        int64          `json:"id"`
+	Period    string         `json:"period"`
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	CreatedAt time.Time      `json:"created_at"`
+	Cluster   ClusterSummary `json:"cluster"`
+	Nodes     []NodeSummary  `json:"nodes"`
+	// Leaks lists the pods suspected of leaking memory in the period.
+	Leaks []PodGrowth `json:"leaks,omitempty"`
+	Link  string      `json:"link,omitempty"`
+}
+
+type ClusterSummary struct {
+	Samples        int64   `json:"samples"`
+	AvgCpu         float64 `json:"avg_cpu"`
+	MaxCpu         float64 `json:"max_cpu"`
+	AvgMemory      float64 `json:"avg_memory"`
+	MaxMemory      float64 `json:"max_memory"`
+	MinHeadroom    int64   `json:"min_headroom"`
+	AvgCpuRequests float64 `json:"avg_cpu_of_requests"`
+}
+
+type NodeSummary struct {
+	NodeName  string  `json:"node_name"`
+	Samples   int64   `json:"samples"`
+	AvgCpu    float64 `json:"avg_cpu"`
+	MaxCpu    float64 `json:"max_cpu"`
+	AvgMemory float64 `json:"avg_memory"`
+	MaxMemory float64 `json:"max_memory"`
+}
+
+var errReportNotFound = errors.New("report not found")
+
+// reportPeriod returns the period that ends at the last boundary before
+// now: the previous day at midnight or the previous Monday to Monday week,
+// in the zone of now.
+func reportPeriod(schedule string, now time.Time) (time.Time, time.Time) {
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if schedule == reportWeekly {
+		end = end.AddDate(0, 0, -(int(end.Weekday())+6)%7)
+		return end.AddDate(0, 0, -7), end
+	}
+	return end.AddDate(0, 0, -1), end
+}
+
+// generateReports creates a report whenever a period completes. A report
+// for the last completed period is created at startup if it is missing,
+// so a restart around midnight doesn't skip one.
+func generateReports(ctx context.Context, schedule string) {
+	for {
+		// Periods follow the report-timezone, the bounds are bound in the
+		// zone of the stored timestamps
+		from, to := reportPeriod(schedule, time.Now().In(reportLocation))
+		from, to = from.Local(), to.Local()
+		exists, err := reportExists(schedule, from)
+		if err != nil {
+			slog.Error("Error looking up report", "period", schedule, "error", err)
+		}
+		if err == nil && !exists {
+			report, err := buildReport(schedule, from, to)
+			if err != nil {
+				slog.Error("Error creating report", "period", schedule, "error", err)
+			} else {
+				slog.Info("Created report", "period", schedule, "report", report.ID, "from", from.Format(time.DateOnly))
+				if cfg.ReportWebhookURL != "" {
+					deliverReport(ctx, report)
+				}
+				if cfg.SMTPAddr != "" {
+					mailReport(report)
+				}
+			}
+		}
+
+		next := to.AddDate(0, 0, 1)
+		if schedule == reportWeekly {
+			next = to.AddDate(0, 0, 7)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+func reportExists(period string, from time.Time) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM reports WHERE period = ? AND from_time = ?", period, from).Scan(&n)
+	return n > 0, err
+}
+
+// buildReport aggregates the period in the database and stores the
+// report.
+func buildReport(period string, from, to time.Time) (*Report, error) {
+	report := &Report{Period: period, From: from, To: to, CreatedAt: time.Now()}
+	summary, err := summarizeReport(report)
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow(
+		`INSERT INTO reports (
+            period,
+            from_time,
+            to_time,
+            created_at,
+            summary
+        ) VALUES (?, ?, ?, ?, ?)
+        RETURNING id`,
+		report.Period,
+		report.From,
+		report.To,
+		report.CreatedAt,
+		summary,
+	).Scan(&report.ID)
+	if err != nil {
+		return nil, err
+	}
+	report.Link = reportLink(report)
+	return report, nil
+}
+
+// summarizeReport fills in the cluster and node summaries of the report
+// period and returns them as stored in the summary column.
+func summarizeReport(report *Report) (string, error) {
+	// The summaries and leaks read the same snapshot, so samples written
+	// in between can't make them disagree
+	view, release, err := snapshotView(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if report.Cluster, report.Nodes, err = view.store.SummarizeSamples(report.From, report.To); err != nil {
+		return "", err
+	}
+	if report.Leaks, err = suspectedLeaks(view.store, report.From, report.To); err != nil {
+		return "", err
+	}
+
+	summary, err := json.Marshal(struct {
+		Cluster ClusterSummary `json:"cluster"`
+		Nodes   []NodeSummary  `json:"nodes"`
+		Leaks   []PodGrowth    `json:"leaks,omitempty"`
+	}{report.Cluster, report.Nodes, report.Leaks})
+	return string(summary), err
+}
+
+// reportLink points at the raw data of the period, if the collector knows
+// where it is reachable.
+func reportLink(report *Report) string {
+	if externalURL == "" {
+		return ""
+	}
+	query := url.Values{}
+	query.Set("from", report.From.Format(time.RFC3339))
+	query.Set("to", report.To.Format(time.RFC3339))
+	query.Set("step", "1h")
+	return strings.TrimSuffix(externalURL, "/") + "/metrics?" + query.Encode()
+}
+
+const reportColumns = `
+            id,
+            period,
+            from_time,
+            to_time,
+            created_at,
+            summary`
+
+func scanReport(row interface{ Scan(...any) error }) (*Report, error) {
+	var report Report
+	var summary string
+	err := row.Scan(&report.ID, &report.Period, &report.From, &report.To, &report.CreatedAt, &summary)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errReportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(summary), &report); err != nil {
+		return nil, err
+	}
+	report.Link = reportLink(&report)
+	return &report, nil
+}
+
+// reportLocation and reportPrinter render reports and emails in the
+// report-timezone and report-locale.
+var (
+	reportLocation = time.Local
+	reportPrinter  = message.NewPrinter(language.English)
+)
+
+// loadReportLocale resolves report-timezone and report-locale.
+func loadReportLocale() error {
+	if cfg.ReportTimezone != "" {
+		location, err := time.LoadLocation(cfg.ReportTimezone)
+		if err != nil {
+			return err
+		}
+		reportLocation = location
+	}
+	tag, err := language.Parse(cfg.ReportLocale)
+	if err != nil {
+		return err
+	}
+	reportPrinter = message.NewPrinter(tag)
+	return nil
+}
+
+var reportFuncs = map[string]any{
+	"percent":    func(v float64) string { return reportPrinter.Sprintf("%.1f%%", v) },
+	"share":      func(v float64) string { return reportPrinter.Sprintf("%.0f%%", v*100) },
+	"mib":        mebibytes,
+	"millicores": millicores,
+	"decimal":    func(v float64) string { return reportPrinter.Sprintf("%.1f", v) },
+	"date":       func(t time.Time) string { return t.In(reportLocation).Format(time.DateOnly) },
+	"datetime":   func(t time.Time) string { return t.In(reportLocation).Format("2006-01-02 15:04 MST") },
+	"json":       jsonString,
+}
+
+// jsonString quotes a value for templates that render JSON, such as Slack
+// messages.
+func jsonString(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// mebibytes formats a byte count, which is a float64 for averages.
+func mebibytes(v any) string {
+	bytes, _ := v.(float64)
+	if n, ok := v.(int64); ok {
+		bytes = float64(n)
+	}
+	return reportPrinter.Sprintf("%.1f MiB", bytes/(1<<20))
+}
+
+// millicores formats a CPU usage in millicores, float64 or int64.
+func millicores(v any) string {
+	m, _ := v.(float64)
+	if n, ok := v.(int64); ok {
+		m = float64(n)
+	}
+	return reportPrinter.Sprintf("%.0fm", m)
+}
+
+var reportMarkdown = template.Must(template.New("report").Funcs(reportFuncs).Parse(
+	`# Cluster utilization {{.Period}} report
+
+{{date .From}} to {{date .To}}, {{.Cluster.Samples}} collections.
+
+| | Average | Peak |
+|---|---|---|
+| CPU | {{percent .Cluster.AvgCpu}} | {{percent .Cluster.MaxCpu}} |
+| Memory | {{percent .Cluster.AvgMemory}} | {{percent .Cluster.MaxMemory}} |
+
+CPU usage averaged {{percent .Cluster.AvgCpuRequests}} of the CPU requests. At the fullest, {{.Cluster.MinHeadroom}} more standard pods would have fit.
+
+## Nodes
+
+| Node | Average CPU | Peak CPU | Average memory | Peak memory |
+|---|---|---|---|---|
+{{range .Nodes}}| {{.NodeName}} | {{percent .AvgCpu}} | {{percent .MaxCpu}} | {{percent .AvgMemory}} | {{percent .MaxMemory}} |
+{{end}}{{with .Leaks}}
+## Suspected memory leaks
+
+| Pod | Growth per hour | Samples without a drop |
+|---|---|---|
+{{range .}}| {{.Namespace}}/{{.PodName}} | {{mib .GrowthRate}} | {{share .Monotonic}} |
+{{end}}{{end}}{{with .Link}}
+[Hourly data]({{.}})
+{{end}}`))
+
+var reportHTML = htmltemplate.Must(htmltemplate.New("report").Funcs(reportFuncs).Parse(
+	`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Cluster utilization {{.Period}} report {{date .From}}</title></head>
+<body>
+<h1>Cluster utilization {{.Period}} report</h1>
+<p>{{date .From}} to {{date .To}}, {{.Cluster.Samples}} collections.</p>
+<table>
+<tr><th></th><th>Average</th><th>Peak</th></tr>
+<tr><td>CPU</td><td>{{percent .Cluster.AvgCpu}}</td><td>{{percent .Cluster.MaxCpu}}</td></tr>
+<tr><td>Memory</td><td>{{percent .Cluster.AvgMemory}}</td><td>{{percent .Cluster.MaxMemory}}</td></tr>
+</table>
+<p>CPU usage averaged {{percent .Cluster.AvgCpuRequests}} of the CPU requests. At the fullest, {{.Cluster.MinHeadroom}} more standard pods would have fit.</p>
+<h2>Nodes</h2>
+<table>
+<tr><th>Node</th><th>Average CPU</th><th>Peak CPU</th><th>Average memory</th><th>Peak memory</th></tr>
+{{range .Nodes}}<tr><td>{{.NodeName}}</td><td>{{percent .AvgCpu}}</td><td>{{percent .MaxCpu}}</td><td>{{percent .AvgMemory}}</td><td>{{percent .MaxMemory}}</td></tr>
+{{end}}</table>
+{{with .Leaks}}<h2>Suspected memory leaks</h2>
+<table>
+<tr><th>Pod</th><th>Growth per hour</th><th>Samples without a drop</th></tr>
+{{range .}}<tr><td>{{.Namespace}}/{{.PodName}}</td><td>{{mib .GrowthRate}}</td><td>{{share .Monotonic}}</td></tr>
+{{end}}</table>
+{{end}}{{with .Link}}<p><a href="{{.}}">Hourly data</a></p>{{end}}
+</body>
+</html>
+`))
+
+// deliverReport posts a report to the webhook, rendered as Markdown or with
+// the report-webhook-template.
+func deliverReport(ctx context.Context, report *Report) {
+	var body bytes.Buffer
+	if err := webhookTemplate.Execute(&body, report); err != nil {
+		slog.Error("Error rendering report", "report", report.ID, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.ReportWebhookURL, &body)
+	if err != nil {
+		slog.Error("Error delivering report", "report", report.ID, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", cfg.ReportWebhookType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Error delivering report", "report", report.ID, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Error("Report rejected", "report", report.ID, "status", resp.Status)
+	}
+}
+
+func getReports(c *gin.Context) {
+	query := `
+        SELECT` + reportColumns + `
+        FROM reports`
+	var args []any
+	if period := c.Query("period"); period != "" {
+		query += " WHERE period = ?"
+		args = append(args, period)
+	}
+	query += " ORDER BY from_time DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		reports = append(reports, *report)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, reports)
+}
+
+// getReportSummary summarizes the period between from and to, the last
+// day by default, like a report that isn't stored.
+func getReportSummary(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 24*time.Hour)
+	if !ok {
+		return
+	}
+	report := &Report{Period: "custom", From: from, To: to, CreatedAt: time.Now()}
+	if _, err := summarizeReport(report); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, report)
+}
+
+// getReport returns one report, rendered as Markdown or HTML with
+// ?format=markdown or ?format=html.
+func getReport(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id must be an integer"})
+		return
+	}
+	report, err := scanReport(db.QueryRow(`
+        SELECT`+reportColumns+`
+        FROM reports
+        WHERE id = ?
+    `, id))
+	if errors.Is(err, errReportNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var body bytes.Buffer
+	switch c.Query("format") {
+	case "":
+		respond(c, http.StatusOK, report)
+		return
+	case "markdown":
+		err = reportMarkdown.Execute(&body, report)
+		c.Header("Content-Type", "text/markdown; charset=utf-8")
+	case "html":
+		err = reportHTML.Execute(&body, report)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be markdown or html"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Writer.Write(body.Bytes())
+}
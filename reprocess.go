@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReprocessResult struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Samples had their headroom recomputed.
+	Samples       int64          `json:"samples"`
+	RollupBuckets map[string]int `json:"rollup_buckets"`
+	Reports       []int64        `json:"reports"`
+}
+
+// reprocess recomputes what is derived from the raw node samples between
+// from and to with the current configuration: the headroom of every
+// sample, the rollup buckets and the reports of the period. Rollup buckets
+// that started before the oldest raw sample are kept, since retention
+// may already have pruned part of their data.
+func reprocess(from, to time.Time) (*ReprocessResult, error) {
+	result := &ReprocessResult{From: from, To: to, RollupBuckets: make(map[string]int), Reports: []int64{}}
+	var err error
+
+	if result.Samples, err = recomputeHeadroom(from, to); err != nil {
+		return nil, err
+	}
+
+	var oldest time.Time
+	err = db.QueryRow("SELECT timestamp FROM metrics WHERE source = ? ORDER BY timestamp LIMIT 1", sourceMetricsServer).Scan(&oldest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Only complete buckets, like the rollup worker
+	until := to
+	if now := time.Now(); now.Before(until) {
+		until = now
+	}
+	for _, r := range rollups {
+		start := from.Truncate(r.size).Local()
+		if start.Before(oldest) {
+			start = oldest.Truncate(r.size).Local()
+			if start.Before(oldest) {
+				start = start.Add(r.size)
+			}
+		}
+		end := until.Truncate(r.size).Local()
+		for batchStart := start; batchStart.Before(end); batchStart = batchStart.Add(rollupBatch) {
+			batchEnd := batchStart.Add(rollupBatch)
+			if end.Before(batchEnd) {
+				batchEnd = end
+			}
+			n, err := r.aggregate(batchStart, batchEnd)
+			if err != nil {
+				return nil, err
+			}
+			result.RollupBuckets[r.step] += n
+		}
+	}
+
+	rows, err := db.Query("SELECT "+reportColumns+" FROM reports WHERE from_time >= ? AND to_time <= ? ORDER BY id", from, to)
+	if err != nil {
+		return nil, err
+	}
+	var reports []*Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, report := range reports {
+		summary, err := summarizeReport(report)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec("UPDATE reports SET summary = ? WHERE id = ?", summary, report.ID); err != nil {
+			return nil, err
+		}
+		result.Reports = append(result.Reports, report.ID)
+	}
+	return result, nil
+}
+
+// recomputeHeadroom applies headroom to the cluster values of every tick
+// between from and to and returns the number of updated samples. The
+// cluster values repeat on every node row of a tick, so each tick is
+// computed once.
+func recomputeHeadroom(from, to time.Time) (int64, error) {
+	type tick struct {
+		timestamp time.Time
+		headroom  int64
+	}
+
+	rows, err := db.Query(`
+        SELECT DISTINCT
+            timestamp,
+            cluster_allocatable_cpu,
+            cluster_used_cpu,
+            cluster_allocatable_memory,
+            cluster_memory_usage
+        FROM metrics
+        WHERE source = ?
+          AND timestamp BETWEEN ? AND ?
+          AND cluster_used_cpu IS NOT NULL
+          AND cluster_memory_usage IS NOT NULL
+    `, sourceMetricsServer, from, to)
+	if err != nil {
+		return 0, err
+	}
+	var ticks []tick
+	for rows.Next() {
+		var t tick
+		var allocatableCPU, usedCPU, allocatableMemory, usedMemory int64
+		if err := rows.Scan(&t.timestamp, &allocatableCPU, &usedCPU, &allocatableMemory, &usedMemory); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		t.headroom = headroom(allocatableCPU-usedCPU, allocatableMemory-usedMemory)
+		ticks = append(ticks, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("UPDATE metrics SET headroom = ? WHERE source = ? AND timestamp = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var updated int64
+	for _, t := range ticks {
+		result, err := stmt.Exec(t.headroom, sourceMetricsServer, t.timestamp.Local())
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		updated += n
+	}
+	return updated, tx.Commit()
+}
+
+// postReprocess answers POST /reprocess?from=&to=, so a changed
+// configuration applies to past data too. Both bounds are required, since
+// the work grows with the range.
+func postReprocess(c *gin.Context) {
+	if c.Query("from") == "" || c.Query("to") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to are required"})
+		return
+	}
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	result, err := reprocess(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	slog.Info("Reprocessed samples", "from", from, "to", to, "samples", result.Samples, "reports", len(result.Reports), "duration", time.Since(start))
+
+	respond(c, http.StatusOK, result)
+}
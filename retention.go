@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"time"
+)
+
+// retentionTables are the tables with a timestamp column that grow with
+// every collection.
+var retentionTables = []string{
+	"metrics",
+	"pod_metrics",
+	"container_metrics",
+	"pod_network",
+	"node_disk_io",
+	"container_filesystem",
+	"node_images",
+	"image_pulls",
+	"pod_disruptions",
+	"quota_usage",
+	"node_events",
+	"accuracy_checks",
+	"plugin_metrics",
+	"recorded_series",
+}
+
+// enableIncrementalVacuum lets the janitor give the pages of deleted rows
+// back to the file system. SQLite only switches an existing database to
+// incremental auto-vacuum on a full VACUUM, which is done once.
+func enableIncrementalVacuum() {
+	if db.driver != driverSQLite {
+		return
+	}
+	var mode int
+	if err := db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		log.Fatal(err)
+	}
+	const incremental = 2
+	if mode == incremental {
+		return
+	}
+
+	slog.Info("Switching the database to incremental auto-vacuum, this rewrites the file once")
+	if _, err := db.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := db.Exec("VACUUM"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// pruneOldRows deletes what is older than the retention period on every
+// interval. Samples assigned to a benchmark run are kept as long as the
+// run exists so comparisons keep working. Samples are only assigned when a
+// run stops, so those since the start of a running one are kept as well.
+func pruneOldRows(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cutoff := time.Now().Add(-retention)
+		var deleted int64
+		for _, table := range retentionTables {
+			query := "DELETE FROM " + table + " WHERE timestamp < ?"
+			if table == "metrics" {
+				query += `
+                  AND benchmark_run_id IS NULL
+                  AND NOT EXISTS (
+                      SELECT 1
+                      FROM benchmark_runs
+                      WHERE benchmark_runs.end_time IS NULL
+                        AND COALESCE(metrics.sample_time, metrics.timestamp) >= benchmark_runs.start_time
+                  )`
+			}
+			result, err := db.Exec(query, cutoff)
+			if err != nil {
+				slog.Error("Error pruning", "table", table, "error", err)
+				continue
+			}
+			n, _ := result.RowsAffected()
+			deleted += n
+		}
+
+		if deleted > 0 {
+			slog.Info("Pruned old rows", "rows", deleted, "cutoff", cutoff)
+			if db.driver == driverSQLite {
+				if _, err := db.Exec("PRAGMA incremental_vacuum"); err != nil {
+					slog.Error("Error vacuuming", "error", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rollup is a table of per-node averages and maxima over fixed buckets of
+// the raw node samples. Rollups are not pruned by the retention janitor,
+// so long runs stay queryable after the raw samples are gone.
+type rollup struct {
+	step  string
+	table string
+	size  time.Duration
+}
+
+var rollups = []rollup{
+	{"1m", "metrics_1m", time.Minute},
+	{"5m", "metrics_5m", 5 * time.Minute},
+	{"1h", "metrics_1h", time.Hour},
+}
+
+// rollupBatch bounds how much raw data one pass reads, so catching up on
+// a large database happens over several passes.
+const rollupBatch = 24 * time.Hour
+
+type RollupSample struct {
+	// Timestamp is the start of the bucket.
+	Timestamp      time.Time `json:"timestamp"`
+	NodeName       string    `json:"node_name"`
+	Step           string    `json:"step"`
+	Samples        int64     `json:"samples"`
+	CpuUsage       float64   `json:"cpu_usage"`
+	CpuUsageMax    float64   `json:"cpu_usage_max"`
+	MemoryUsage    float64   `json:"memory_usage"`
+	MemoryUsageMax int64     `json:"memory_usage_max"`
+}
+
+func init() {
+	for _, r := range rollups {
+		metricRegistry = append(metricRegistry,
+			MetricDescriptor{
+				Name:        "cpu_usage",
+				Table:       r.table,
+				Type:        "gauge",
+				Unit:        "percent",
+				Collector:   "rollup",
+				Description: "Average CPU usage of the node over " + r.step + " as a percentage of its allocatable CPU",
+			},
+			MetricDescriptor{
+				Name:        "cpu_usage_max",
+				Table:       r.table,
+				Type:        "gauge",
+				Unit:        "percent",
+				Collector:   "rollup",
+				Description: "Highest CPU usage of the node in " + r.step + " as a percentage of its allocatable CPU",
+			},
+			MetricDescriptor{
+				Name:        "memory_usage",
+				Table:       r.table,
+				Type:        "gauge",
+				Unit:        "bytes",
+				Collector:   "rollup",
+				Description: "Average memory working set of the node over " + r.step,
+			},
+			MetricDescriptor{
+				Name:        "memory_usage_max",
+				Table:       r.table,
+				Type:        "gauge",
+				Unit:        "bytes",
+				Collector:   "rollup",
+				Description: "Highest memory working set of the node in " + r.step,
+			},
+		)
+	}
+}
+
+func createRollupTables() {
+	for _, r := range rollups {
+		_, err := db.Exec(`
+        CREATE TABLE IF NOT EXISTS ` + r.table + ` (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp DATETIME,
+            node_name TEXT,
+            samples INTEGER,
+            cpu_usage REAL,
+            cpu_usage_max REAL,
+            memory_usage REAL,
+            memory_usage_max INTEGER,
+            UNIQUE (timestamp, node_name)
+        )
+    `)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func findRollup(step string) (rollup, bool) {
+	for _, r := range rollups {
+		if r.step == step {
+			return r, true
+		}
+	}
+	return rollup{}, false
+}
+
+// rollUpMetrics aggregates the buckets that completed since the last pass
+// on every interval.
+func rollUpMetrics(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, r := range rollups {
+			if err := r.update(time.Now()); err != nil {
+				slog.Error("Error rolling up", "table", r.table, "error", err)
+			}
+		}
+	}
+}
+
+// update aggregates the complete buckets after the last one stored, up
+// to rollupBatch of raw data at a time.
+func (r rollup) update(now time.Time) error {
+	// Start at the first raw sample after the last stored bucket, so
+	// gaps in collection are skipped instead of read again on every pass
+	after := time.Unix(0, 0)
+	var last time.Time
+	err := db.QueryRow("SELECT timestamp FROM " + r.table + " ORDER BY timestamp DESC LIMIT 1").Scan(&last)
+	switch {
+	case err == nil:
+		after = last.Add(r.size)
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	var first time.Time
+	err = db.QueryRow(
+		"SELECT timestamp FROM metrics WHERE source = ? AND timestamp >= ? ORDER BY timestamp LIMIT 1",
+		sourceMetricsServer,
+		after.Local(),
+	).Scan(&first)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	start := first.Truncate(r.size).Local()
+
+	end := now.Truncate(r.size).Local()
+	if batchEnd := start.Add(rollupBatch); batchEnd.Before(end) {
+		end = batchEnd
+	}
+	if !end.After(start) {
+		return nil
+	}
+	_, err = r.aggregate(start, end)
+	return err
+}
+
+// aggregate stores the buckets between start and end, which must be
+// bucket boundaries, from the raw samples and returns how many there were.
+// Existing buckets are replaced.
+func (r rollup) aggregate(start, end time.Time) (int, error) {
+	// The WHERE clause also keeps SQLite from reading ON CONFLICT as part
+	// of a join
+	result, err := db.Exec(`
+        INSERT INTO `+r.table+` (
+            timestamp,
+            node_name,
+            samples,
+            cpu_usage,
+            cpu_usage_max,
+            memory_usage,
+            memory_usage_max
+        )
+        SELECT
+            `+db.bucketStart("timestamp", r.size)+`,
+            node_name,
+            COUNT(*),
+            AVG(cpu_usage),
+            MAX(cpu_usage),
+            AVG(memory_usage),
+            MAX(memory_usage)
+        FROM metrics
+        WHERE source = ?
+          AND timestamp >= ? AND timestamp < ?
+        GROUP BY 1, node_name
+        ON CONFLICT (timestamp, node_name) DO UPDATE SET
+            samples = excluded.samples,
+            cpu_usage = excluded.cpu_usage,
+            cpu_usage_max = excluded.cpu_usage_max,
+            memory_usage = excluded.memory_usage,
+            memory_usage_max = excluded.memory_usage_max
+    `, sourceMetricsServer, start, end)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// getRollups answers GET /metrics?step=. It is a separate handler because
+// rollups only have the allocatable basis.
+func getRollups(c *gin.Context, r rollup, basis string) {
+	if basis != "allocatable" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rollups only support basis=allocatable"})
+		return
+	}
+
+	from, to, ok := parseTimeRange(c, 0)
+	if !ok {
+		return
+	}
+
+	limit, offset, ok := parsePage(c)
+	if !ok {
+		return
+	}
+
+	query := `
+        SELECT timestamp, node_name, samples, cpu_usage, cpu_usage_max, memory_usage, memory_usage_max
+        FROM ` + r.table + `
+        WHERE timestamp BETWEEN ? AND ?`
+	args := []any{from, to}
+	if node := c.Query("node"); node != "" {
+		query += " AND node_name = ?"
+		args = append(args, node)
+	}
+	query += " ORDER BY timestamp DESC, node_name"
+	if limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	samples := []RollupSample{}
+	for rows.Next() {
+		s := RollupSample{Step: r.step}
+		err := rows.Scan(&s.Timestamp, &s.NodeName, &s.Samples, &s.CpuUsage, &s.CpuUsageMax, &s.MemoryUsage, &s.MemoryUsageMax)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		samples = append(samples, s)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if limit > 0 && len(samples) == limit {
+		c.Header("X-Next-Offset", strconv.Itoa(offset+limit))
+	}
+	respond(c, http.StatusOK, samples)
+}
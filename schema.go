@@ -0,0 +1,460 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MetricDescriptor struct {
+	Name        string `json:"name"`
+	Table       string `json:"table"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit"`
+	Collector   string `json:"collector"`
+	Description string `json:"description"`
+	// Since is the schema version that added the value, 0 for values that
+	// predate versioning.
+	Since int `json:"since_schema_version"`
+}
+
+// metricRegistry describes every value the collectors store. Add an entry
+// here whenever a collector starts recording a new column, with Since set
+// to the schemaVersion that adds it.
+var metricRegistry = []MetricDescriptor{
+	{
+		Name:        "cpu_usage",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "percent",
+		Collector:   "node",
+		Description: "CPU usage of the node as a percentage of its allocatable CPU",
+	},
+	{
+		Name:        "memory_usage",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "node",
+		Description: "Memory working set of the node",
+	},
+	{
+		Name:        "cluster_cpu_usage",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "percent",
+		Collector:   "node",
+		Description: "CPU usage of all nodes as a percentage of the allocatable CPU of the cluster",
+	},
+	{
+		Name:        "cluster_total_cpu",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "node",
+		Description: "Sum of the CPU capacity of all nodes",
+	},
+	{
+		Name:        "cpu_used",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "node",
+		Description: "CPU usage of the node",
+	},
+	{
+		Name:        "node_total_cpu",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "node",
+		Description: "CPU capacity of the node",
+	},
+	{
+		Name:        "node_allocatable_cpu",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "node",
+		Description: "CPU of the node available to pods after system reservations",
+	},
+	{
+		Name:        "cluster_used_cpu",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "node",
+		Description: "CPU usage of all nodes",
+	},
+	{
+		Name:        "cluster_allocatable_cpu",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "node",
+		Description: "Sum of the allocatable CPU of all nodes",
+	},
+	{
+		Name:        "node_requested_cpu",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "node",
+		Description: "Sum of the CPU requests of the pods scheduled on the node",
+	},
+	{
+		Name:        "cluster_requested_cpu",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "node",
+		Description: "Sum of the CPU requests of all scheduled pods",
+	},
+	{
+		Name:        "node_requested_memory",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "node",
+		Description: "Sum of the memory requests of the pods scheduled on the node",
+		Since:       7,
+	},
+	{
+		Name:        "window_seconds",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "seconds",
+		Collector:   "node",
+		Description: "Window metrics-server averaged the CPU usage of the node over",
+		Since:       4,
+	},
+	{
+		Name:        "memory_usage_percent",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "percent",
+		Collector:   "node",
+		Description: "Memory usage of the node as a percentage of its allocatable memory",
+		Since:       3,
+	},
+	{
+		Name:        "cluster_memory_usage_percent",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "percent",
+		Collector:   "node",
+		Description: "Memory usage of all nodes as a percentage of the allocatable memory of the cluster",
+		Since:       3,
+	},
+	{
+		Name:        "node_total_memory",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "node",
+		Description: "Memory capacity of the node",
+		Since:       3,
+	},
+	{
+		Name:        "node_allocatable_memory",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "node",
+		Description: "Memory of the node available to pods after system reservations",
+		Since:       3,
+	},
+	{
+		Name:        "cluster_allocatable_memory",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "node",
+		Description: "Sum of the allocatable memory of all nodes",
+		Since:       3,
+	},
+	{
+		Name:        "cluster_memory_usage",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "node",
+		Description: "Memory working set of all nodes",
+	},
+	{
+		Name:        "cluster_total_memory",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "node",
+		Description: "Sum of the memory capacity of all nodes",
+	},
+	{
+		Name:        "headroom",
+		Table:       "metrics",
+		Type:        "gauge",
+		Unit:        "pods",
+		Collector:   "node",
+		Description: "Standard pods that still fit into the unused allocatable CPU and memory of the cluster",
+	},
+	{
+		Name:        "cpu_usage",
+		Table:       "pod_metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "pod",
+		Description: "CPU usage of the pod summed over its containers",
+	},
+	{
+		Name:        "memory_usage",
+		Table:       "pod_metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "pod",
+		Description: "Memory working set of the pod summed over its containers",
+	},
+	{
+		Name:        "cpu_usage",
+		Table:       "container_metrics",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "pod",
+		Description: "CPU usage of a single container",
+	},
+	{
+		Name:        "memory_usage",
+		Table:       "container_metrics",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "pod",
+		Description: "Memory working set of a single container",
+	},
+	{
+		Name:        "rx_bytes",
+		Table:       "pod_network",
+		Type:        "counter",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Bytes received by the pod since its network namespace was created",
+	},
+	{
+		Name:        "tx_bytes",
+		Table:       "pod_network",
+		Type:        "counter",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Bytes transmitted by the pod since its network namespace was created",
+	},
+	{
+		Name:        "read_bytes",
+		Table:       "node_disk_io",
+		Type:        "counter",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Bytes read from all block devices of the node",
+	},
+	{
+		Name:        "write_bytes",
+		Table:       "node_disk_io",
+		Type:        "counter",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Bytes written to all block devices of the node",
+	},
+	{
+		Name:        "reads",
+		Table:       "node_disk_io",
+		Type:        "counter",
+		Unit:        "operations",
+		Collector:   "kubelet",
+		Description: "Completed read operations on all block devices of the node",
+	},
+	{
+		Name:        "writes",
+		Table:       "node_disk_io",
+		Type:        "counter",
+		Unit:        "operations",
+		Collector:   "kubelet",
+		Description: "Completed write operations on all block devices of the node",
+	},
+	{
+		Name:        "kubelet_cpu",
+		Table:       "accuracy_checks",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "kubelet",
+		Description: "CPU usage of the node as reported by the kubelet",
+		Since:       5,
+	},
+	{
+		Name:        "metrics_server_cpu",
+		Table:       "accuracy_checks",
+		Type:        "gauge",
+		Unit:        "millicores",
+		Collector:   "kubelet",
+		Description: "CPU usage of the node in the last metrics-server sample",
+		Since:       5,
+	},
+	{
+		Name:        "cpu_discrepancy",
+		Table:       "accuracy_checks",
+		Type:        "gauge",
+		Unit:        "percent",
+		Collector:   "kubelet",
+		Description: "Deviation of the metrics-server CPU usage from the kubelet",
+		Since:       5,
+	},
+	{
+		Name:        "kubelet_memory",
+		Table:       "accuracy_checks",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Memory working set of the node as reported by the kubelet",
+		Since:       5,
+	},
+	{
+		Name:        "metrics_server_memory",
+		Table:       "accuracy_checks",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Memory working set of the node in the last metrics-server sample",
+		Since:       5,
+	},
+	{
+		Name:        "memory_discrepancy",
+		Table:       "accuracy_checks",
+		Type:        "gauge",
+		Unit:        "percent",
+		Collector:   "kubelet",
+		Description: "Deviation of the metrics-server memory usage from the kubelet",
+		Since:       5,
+	},
+	{
+		Name:        "sample_age_seconds",
+		Table:       "accuracy_checks",
+		Type:        "gauge",
+		Unit:        "seconds",
+		Collector:   "kubelet",
+		Description: "How much older the metrics-server sample is than the kubelet reading",
+		Since:       5,
+	},
+	{
+		Name:        "rootfs_bytes",
+		Table:       "container_filesystem",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Writable layer usage of the container",
+	},
+	{
+		Name:        "logs_bytes",
+		Table:       "container_filesystem",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Log file usage of the container",
+	},
+	{
+		Name:        "image_count",
+		Table:       "node_images",
+		Type:        "gauge",
+		Unit:        "images",
+		Collector:   "kubelet",
+		Description: "Container images present on the node",
+	},
+	{
+		Name:        "images_bytes",
+		Table:       "node_images",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Total size of the container images present on the node",
+	},
+	{
+		Name:        "image_fs_used",
+		Table:       "node_images",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Used bytes of the filesystem holding container images",
+	},
+	{
+		Name:        "image_fs_capacity",
+		Table:       "node_images",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "kubelet",
+		Description: "Capacity of the filesystem holding container images",
+	},
+	{
+		Name:        "duration",
+		Table:       "image_pulls",
+		Type:        "gauge",
+		Unit:        "seconds",
+		Collector:   "events",
+		Description: "Time the kubelet spent pulling the image",
+	},
+	{
+		Name:        "wait_duration",
+		Table:       "image_pulls",
+		Type:        "gauge",
+		Unit:        "seconds",
+		Collector:   "events",
+		Description: "Pull time including waiting for other pulls on the node",
+	},
+	{
+		Name:        "size_bytes",
+		Table:       "image_pulls",
+		Type:        "gauge",
+		Unit:        "bytes",
+		Collector:   "events",
+		Description: "Size of the pulled image",
+	},
+	{
+		Name:        "hard",
+		Table:       "quota_usage",
+		Type:        "gauge",
+		Unit:        "resource",
+		Collector:   "quota",
+		Description: "Hard limit of a resource in a ResourceQuota (CPU in millicores, memory and storage in bytes, objects as counts)",
+	},
+	{
+		Name:        "used",
+		Table:       "quota_usage",
+		Type:        "gauge",
+		Unit:        "resource",
+		Collector:   "quota",
+		Description: "Usage of a resource counted against a ResourceQuota, in the same unit as hard",
+	},
+	{
+		Name:        "value",
+		Table:       "plugin_metrics",
+		Type:        "gauge",
+		Unit:        "plugin-defined",
+		Collector:   "plugin",
+		Description: "Value printed by a collector plugin, identified by its plugin, name and labels columns",
+	},
+}
+
+// getSchema lists the values stored by the collectors that are enabled.
+func getSchema(c *gin.Context) {
+	caps := currentCapabilities()
+	enabled := map[string]bool{
+		"rollup":         slices.Contains(caps.Features, "rollups"),
+		"recording-rule": slices.Contains(caps.Features, "recording-rules"),
+	}
+	for _, collector := range caps.Collectors {
+		enabled[collector] = true
+	}
+
+	metrics := []MetricDescriptor{}
+	for _, m := range metricRegistry {
+		if enabled[m.Collector] {
+			metrics = append(metrics, m)
+		}
+	}
+	respond(c, http.StatusOK, metrics)
+}
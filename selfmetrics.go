@@ -0,0 +1,154 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations per label values into cumulative buckets
+// the way Prometheus expects them.
+type histogram struct {
+	mu     sync.Mutex
+	labels []string
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(labels ...string) *histogram {
+	return &histogram{labels: labels, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogram) observe(seconds float64, values ...string) {
+	key := strings.Join(values, "\x00")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(latencyBuckets))}
+		h.series[key] = s
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += seconds
+}
+
+func (h *histogram) write(p promWriter, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p.family(name, "histogram", help)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		labels := make([]string, 0, 2*len(h.labels)+2)
+		for i, label := range h.labels {
+			labels = append(labels, label, s.values[i])
+		}
+		for i, bound := range latencyBuckets {
+			p.sample(name+"_bucket", float64(s.counts[i]), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+		}
+		p.sample(name+"_bucket", float64(s.count), append(labels, "le", "+Inf")...)
+		p.sample(name+"_sum", s.sum, labels...)
+		p.sample(name+"_count", float64(s.count), labels...)
+	}
+}
+
+// counter counts per value of a single label.
+type counter struct {
+	mu     sync.Mutex
+	label  string
+	values map[string]float64
+}
+
+func newCounter(label string) *counter {
+	return &counter{label: label, values: make(map[string]float64)}
+}
+
+func (c *counter) add(value string, n float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value] += n
+}
+
+func (c *counter) write(p promWriter, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p.family(name, "counter", help)
+	for _, value := range sortedKeys(c.values) {
+		p.sample(name, c.values[value], c.label, value)
+	}
+}
+
+func (c *counter) total() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var total float64
+	for _, n := range c.values {
+		total += n
+	}
+	return total
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Metrics about the collector itself, so failures show up on a dashboard
+// instead of only in the logs.
+var (
+	collectionDuration = newHistogram()
+	apiErrors          = newCounter("api")
+	rowsInserted       = newCounter("table")
+	samplesCollected   = newCounter("kind")
+	dbWriteDuration    = newHistogram("table")
+	requestDuration    = newHistogram("method", "route", "code")
+)
+
+// observeRequests records the latency of every request by route. Paths
+// without a route share one series so scanners can't add series.
+func observeRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		requestDuration.observe(time.Since(start).Seconds(), c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+	}
+}
+
+func writeSelfMetrics(p promWriter) {
+	collectionDuration.write(p, "k8s_collector_collection_duration_seconds", "Duration of the collection ticks of node and pod metrics.")
+	apiErrors.write(p, "k8s_collector_api_errors_total", "Failed requests to the Kubernetes API.")
+	rowsInserted.write(p, "k8s_collector_rows_inserted_total", "Rows written to the database.")
+	samplesCollected.write(p, "k8s_collector_samples_collected_total", "Samples received from the metrics API.")
+	dbWriteDuration.write(p, "k8s_collector_db_write_duration_seconds", "Duration of the database transactions writing collected rows.")
+	requestDuration.write(p, "k8s_collector_http_request_duration_seconds", "Latency of the HTTP API.")
+	cardinality.write(p)
+}
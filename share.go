@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultShareLifetime = 24 * time.Hour
+	maxShareLifetime     = 30 * 24 * time.Hour
+)
+
+// sharedKey marks a request authorized by a share link in the gin context.
+const sharedKey = "shared"
+
+// benchmarkShareRoutes are the routes a share link for a benchmark opens
+// for the run named by :name.
+var benchmarkShareRoutes = []string{
+	"/benchmarks/:name",
+	"/benchmarks/:name/metrics",
+	"/benchmarks/:name/bundle",
+}
+
+// rangeSharePaths are the queries a share link for a time range opens.
+var rangeSharePaths = []string{
+	"/metrics",
+	"/metrics/tiles",
+	"/metrics/fragmentation",
+}
+
+// shareGrant is what a share link grants: one benchmark, one report or
+// the node samples between From and To, until Expires. Times are unix
+// seconds to keep links short.
+type shareGrant struct {
+	Benchmark string `json:"b,omitempty"`
+	Report    int64  `json:"r,omitempty"`
+	From      int64  `json:"f,omitempty"`
+	To        int64  `json:"t,omitempty"`
+	Expires   int64  `json:"e"`
+}
+
+type ShareRequest struct {
+	Benchmark string `json:"benchmark"`
+	Report    int64  `json:"report"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	// ExpiresIn is how long the link works, 24h by default and at most
+	// 30 days.
+	ExpiresIn string `json:"expires_in"`
+}
+
+type ShareLink struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	errShareInvalid = errors.New("invalid share link")
+	errShareExpired = errors.New("share link expired")
+)
+
+// signShare encodes a grant as its JSON and an HMAC of it with the
+// share-secret, so the collector needs no table of issued links. Links
+// can't be revoked one by one, changing the secret revokes all of them.
+func signShare(grant shareGrant) string {
+	payload, _ := json.Marshal(grant)
+	mac := hmac.New(sha256.New, []byte(cfg.ShareSecret))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyShare(token string) (shareGrant, error) {
+	var grant shareGrant
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || cfg.ShareSecret == "" {
+		return grant, errShareInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return grant, errShareInvalid
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return grant, errShareInvalid
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.ShareSecret))
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return grant, errShareInvalid
+	}
+	if err := json.Unmarshal(payload, &grant); err != nil {
+		return grant, errShareInvalid
+	}
+	if time.Now().Unix() >= grant.Expires {
+		return grant, errShareExpired
+	}
+	return grant, nil
+}
+
+// covers reports whether the grant allows a read of the matched route
+// with its params and query. Benchmarks and reports are matched by the
+// route param rather than the path, so a run named like another route,
+// such as "compare", doesn't open that route. A time range grant needs
+// from and to inside the range, which the links it hands out carry.
+func (g shareGrant) covers(route string, params gin.Params, query url.Values) bool {
+	switch {
+	case g.Benchmark != "":
+		return slices.Contains(benchmarkShareRoutes, route) && params.ByName("name") == g.Benchmark
+	case g.Report != 0:
+		return route == "/reports/:id" && params.ByName("id") == strconv.FormatInt(g.Report, 10)
+	}
+	if !slices.Contains(rangeSharePaths, route) {
+		return false
+	}
+	from, err := parseTime(query.Get("from"))
+	if err != nil {
+		return false
+	}
+	to, err := parseTime(query.Get("to"))
+	if err != nil {
+		return false
+	}
+	return from.Unix() >= g.From && to.Unix() <= g.To
+}
+
+// acceptShareLinks lets requests with a valid ?share= through requireAuth,
+// as long as they are reads the link covers. Requests without one are
+// left to requireAuth.
+func acceptShareLinks() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		token := query.Get("share")
+		if token == "" {
+			c.Next()
+			return
+		}
+		grant, err := verifyShare(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "share links are read-only"})
+			return
+		}
+		if !grant.covers(c.FullPath(), c.Params, query) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "share link does not cover this request"})
+			return
+		}
+		c.Set(sharedKey, true)
+		c.Next()
+	}
+}
+
+// createShareLink signs a link to a benchmark, a report or a time range
+// of node samples that works without an API token until it expires.
+func createShareLink(c *gin.Context) {
+	var req ShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	lifetime := defaultShareLifetime
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxShareLifetime {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive duration of at most 720h"})
+			return
+		}
+		lifetime = d
+	}
+	expires := time.Now().Add(lifetime).Truncate(time.Second)
+	grant := shareGrant{Expires: expires.Unix()}
+
+	var path string
+	query := url.Values{}
+	switch {
+	case req.Benchmark != "" && req.Report == 0 && req.From == "" && req.To == "":
+		run, err := loadBenchmarkRun(db, req.Benchmark)
+		if errors.Is(err, errRunNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		grant.Benchmark = run.Name
+		path = "/benchmarks/" + url.PathEscape(run.Name)
+	case req.Report != 0 && req.Benchmark == "" && req.From == "" && req.To == "":
+		var exists bool
+		err := db.QueryRow("SELECT COUNT(*) > 0 FROM reports WHERE id = ?", req.Report).Scan(&exists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": errReportNotFound.Error()})
+			return
+		}
+		grant.Report = req.Report
+		path = "/reports/" + strconv.FormatInt(req.Report, 10)
+		query.Set("format", "html")
+	case req.From != "" && req.To != "" && req.Benchmark == "" && req.Report == 0:
+		from, err := parseTime(req.From)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+			return
+		}
+		to, err := parseTime(req.To)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+			return
+		}
+		if from.After(to) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+			return
+		}
+		grant.From, grant.To = from.Unix(), to.Unix()
+		path = "/metrics"
+		query.Set("from", strconv.FormatInt(grant.From, 10))
+		query.Set("to", strconv.FormatInt(grant.To, 10))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "share either a benchmark, a report or a time range with from and to"})
+		return
+	}
+
+	query.Set("share", signShare(grant))
+	respond(c, http.StatusCreated, ShareLink{
+		URL:     strings.TrimSuffix(externalURL, "/") + path + "?" + query.Encode(),
+		Expires: expires,
+	})
+}
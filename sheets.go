@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Finished benchmark runs are appended to a Google Sheet as one row each,
+// so teams that track performance runs in a shared spreadsheet get them
+// without copying numbers by hand. The collector authenticates as a
+// service account, which needs edit access to the sheet.
+
+const (
+	sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+	sheetsAPI   = "https://sheets.googleapis.com/v4/spreadsheets/"
+	// sheetsQueue is how many finished runs may wait to be appended.
+	sheetsQueue = 64
+)
+
+// sheetsHeader names the columns of the rows appended, the fields of
+// BenchmarkSummary but its ID.
+var sheetsHeader = []any{"name", "description", "labels", "start", "end", "duration_seconds", "samples", "avg_cpu", "max_cpu", "avg_memory", "max_memory", "outliers", "collector_version"}
+
+// serviceAccount holds what the collector needs from a service account key
+// file as downloaded from the Google Cloud console.
+type serviceAccount struct {
+	ClientEmail   string `json:"client_email"`
+	PrivateKeyPEM string `json:"private_key"`
+	TokenURI      string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var (
+	sheetsAccount *serviceAccount
+	sheetRuns     = make(chan BenchmarkRun, sheetsQueue)
+)
+
+// loadServiceAccount reads a service account key file.
+func loadServiceAccount(path string) (*serviceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	if account.ClientEmail == "" || account.TokenURI == "" {
+		return nil, errors.New("client_email and token_uri are required")
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKeyPEM))
+	if block == nil {
+		return nil, errors.New("private_key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private_key is not an RSA key")
+	}
+	account.key = rsaKey
+	return &account, nil
+}
+
+// accessToken returns an OAuth access token for scope, exchanging a signed
+// JWT for a new one when the last is about to expire.
+func (a *serviceAccount) accessToken(ctx context.Context, client *http.Client, scope string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expires) > time.Minute {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":   a.ClientEmail,
+		"scope": scope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("token request rejected: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	a.token = token.AccessToken
+	a.expires = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return a.token, nil
+}
+
+// queueSheetRun hands a finished run to the Sheets exporter. If the queue
+// is full the run is left out rather than holding up the request that
+// stopped it.
+func queueSheetRun(run BenchmarkRun) {
+	select {
+	case sheetRuns <- run:
+	default:
+		slog.Error("Sheets export queue is full, skipping benchmark", "benchmark", run.Name)
+	}
+}
+
+// exportToSheets appends the runs queued until ctx is done.
+func exportToSheets(ctx context.Context) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case run := <-sheetRuns:
+			if err := appendSheetRow(ctx, client, run); err != nil {
+				slog.Error("Error appending benchmark to sheet", "benchmark", run.Name, "error", err)
+			}
+		}
+	}
+}
+
+// appendSheetRow appends the summary of a finished run after the last row
+// of the sheet-range table, starting the table with sheetsHeader if it is
+// empty.
+func appendSheetRow(ctx context.Context, client *http.Client, run BenchmarkRun) error {
+	view, release, err := snapshotView(ctx)
+	if err != nil {
+		return err
+	}
+	summary, err := summarizeBenchmark(view, run)
+	release()
+	if err != nil {
+		return err
+	}
+	row := []any{
+		summary.Name,
+		summary.Description,
+		summary.Labels,
+		summary.Start,
+		summary.End,
+		summary.DurationSeconds,
+		summary.Samples,
+		"", "", "", "",
+		summary.Outliers,
+		summary.CollectorVersion,
+	}
+	if summary.AvgCpu != nil {
+		row[7], row[8], row[9], row[10] = *summary.AvgCpu, *summary.MaxCpu, *summary.AvgMemory, *summary.MaxMemory
+	}
+
+	token, err := sheetsAccount.accessToken(ctx, client, sheetsScope)
+	if err != nil {
+		return err
+	}
+	values := [][]any{row}
+	empty, err := sheetEmpty(ctx, client, token)
+	if err != nil {
+		return err
+	}
+	if empty {
+		values = [][]any{sheetsHeader, row}
+	}
+	body, err := json.Marshal(map[string]any{"values": values})
+	if err != nil {
+		return err
+	}
+	endpoint := sheetsAPI + url.PathEscape(cfg.SheetsSpreadsheet) + "/values/" + url.PathEscape(cfg.SheetsRange) +
+		":append?valueInputOption=RAW&insertDataOption=INSERT_ROWS"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("append rejected: %s", resp.Status)
+	}
+	return nil
+}
+
+// sheetEmpty reports whether the sheet-range table has no rows yet.
+func sheetEmpty(ctx context.Context, client *http.Client, token string) (bool, error) {
+	endpoint := sheetsAPI + url.PathEscape(cfg.SheetsSpreadsheet) + "/values/" + url.PathEscape(cfg.SheetsRange)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return false, fmt.Errorf("reading the sheet failed: %s", resp.Status)
+	}
+	var result struct {
+		Values [][]any `json:"values"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	return len(result.Values) == 0, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/blake2b"
+)
+
+// checksumTrailer carries the SHA-256 of a streamed export. It is sent as
+// a trailer since the digest is only known once the last row is out, and
+// it is missing when the export was cut short.
+const checksumTrailer = "X-Checksum-Sha256"
+
+// exportSigningKey signs benchmark bundles if export-signing-key is set.
+var exportSigningKey ed25519.PrivateKey
+
+// loadSigningKey reads an Ed25519 private key in PKCS #8 PEM, as written
+// by openssl genpkey -algorithm ed25519.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 key, got %T", key)
+	}
+	return signingKey, nil
+}
+
+// minisignKeyID identifies the signing key in minisign public keys and
+// signatures. minisign picks a random one when it generates a key, the
+// collector derives it from the public key so it stays the same across
+// restarts.
+func minisignKeyID(key ed25519.PrivateKey) []byte {
+	digest := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	return digest[:8]
+}
+
+// minisignPublicKey encodes the public key of key in the minisign format.
+func minisignPublicKey(key ed25519.PrivateKey) string {
+	id := minisignKeyID(key)
+	blob := append(append([]byte("Ed"), id...), key.Public().(ed25519.PublicKey)...)
+	return fmt.Sprintf("untrusted comment: minisign public key %s\n%s\n",
+		minisignKeyIDString(id), base64.StdEncoding.EncodeToString(blob))
+}
+
+// minisignKeyIDString formats a key ID like minisign does, as the hex of
+// the little-endian number it is.
+func minisignKeyIDString(id []byte) string {
+	reversed := slices.Clone(id)
+	slices.Reverse(reversed)
+	return strings.ToUpper(hex.EncodeToString(reversed))
+}
+
+// minisignSign returns a minisign signature of data. The signature is
+// over the BLAKE2b-512 hash of data, and a second one covers it and the
+// trusted comment, so the comment can't be altered either.
+func minisignSign(key ed25519.PrivateKey, data []byte, trustedComment string) string {
+	digest := blake2b.Sum512(data)
+	signature := ed25519.Sign(key, digest[:])
+	blob := append(append([]byte("ED"), minisignKeyID(key)...), signature...)
+	global := ed25519.Sign(key, append(signature, trustedComment...))
+	return fmt.Sprintf("untrusted comment: signature from k8s-metrics-collector secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(blob), trustedComment, base64.StdEncoding.EncodeToString(global))
+}
+
+// getSigningKey returns the minisign public key bundles are verified with.
+func getSigningKey(c *gin.Context) {
+	if exportSigningKey == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "export-signing-key is not set"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="signing-key.pub"`)
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(minisignPublicKey(exportSigningKey)))
+}
+
+// getBenchmarkBundle returns a finished run as a zip of run.json and
+// samples.csv with a SHA256SUMS file listing their digests. With an
+// export-signing-key, SHA256SUMS.minisig holds its minisign signature, so
+// a bundle passed on to auditors or vendors can be checked with
+//
+//	minisign -Vm SHA256SUMS -p signing-key.pub
+//	sha256sum -c SHA256SUMS
+//
+// where signing-key.pub is served by /export/signing-key. The trusted
+// comment names the run and when the bundle was signed.
+func getBenchmarkBundle(c *gin.Context) {
+	// The run and its samples are read from one snapshot, the bundle can
+	// take long to download
+	view, release, err := snapshotView(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	run, err := loadBenchmarkRun(view.q, c.Param("name"))
+	if errors.Is(err, errRunNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if run.End == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "benchmark " + run.Name + " is still running"})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="`+run.Name+`.zip"`)
+	c.Status(http.StatusOK)
+	if err := writeBundle(view, c.Writer, run); err != nil {
+		// The status is already sent, the client sees a truncated zip
+		slog.Error("Error writing benchmark bundle", "benchmark", run.Name, "error", err)
+	}
+}
+
+func writeBundle(view readView, w io.Writer, run *BenchmarkRun) error {
+	archive := zip.NewWriter(w)
+	var sums strings.Builder
+
+	f, digest, err := createHashed(archive, "run.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(run); err != nil {
+		return err
+	}
+	fmt.Fprintf(&sums, "%x  run.json\n", digest.Sum(nil))
+
+	f, digest, err = createHashed(archive, "samples.csv")
+	if err != nil {
+		return err
+	}
+	csv := newCSVEncoder(f, reflect.TypeFor[MetricsData]())
+	err = view.store.EachSample(SampleQuery{
+		From:      run.Start,
+		To:        *run.End,
+		Basis:     "allocatable",
+		RunID:     run.ID,
+		Ascending: true,
+	}, func(m MetricsData) error {
+		return csv.encode(reflect.ValueOf(m))
+	})
+	if err != nil {
+		return err
+	}
+	if err := csv.flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(&sums, "%x  samples.csv\n", digest.Sum(nil))
+
+	f, err = archive.Create("SHA256SUMS")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, sums.String()); err != nil {
+		return err
+	}
+	if exportSigningKey != nil {
+		f, err = archive.Create("SHA256SUMS.minisig")
+		if err != nil {
+			return err
+		}
+		comment := fmt.Sprintf("timestamp:%d\tfile:SHA256SUMS\tbenchmark:%s", time.Now().Unix(), run.Name)
+		if _, err := io.WriteString(f, minisignSign(exportSigningKey, []byte(sums.String()), comment)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// createHashed adds a file to the archive that hashes what is written to
+// it.
+func createHashed(archive *zip.Writer, name string) (io.Writer, hash.Hash, error) {
+	f, err := archive.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := sha256.New()
+	return io.MultiWriter(f, digest), digest, nil
+}
+
+// checksumWriter hashes a streamed response for checksumTrailer.
+type checksumWriter struct {
+	io.Writer
+	digest hash.Hash
+}
+
+func newChecksumWriter(c *gin.Context) *checksumWriter {
+	c.Writer.Header().Add("Trailer", checksumTrailer)
+	digest := sha256.New()
+	return &checksumWriter{Writer: io.MultiWriter(c.Writer, digest), digest: digest}
+}
+
+// setTrailer sends the checksum once the body is complete.
+func (w *checksumWriter) setTrailer(c *gin.Context) {
+	c.Writer.Header().Set(checksumTrailer, hex.EncodeToString(w.digest.Sum(nil)))
+}
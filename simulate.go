@@ -0,0 +1,276 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReplicaChange adds replicas of a workload, named like the workloads of
+// /metrics/disruptions as the kind/name of the controller owning its pods.
+type ReplicaChange struct {
+	Namespace string `json:"namespace"`
+	Workload  string `json:"workload"`
+	Replicas  int    `json:"replicas"`
+
+	// Filled in from the history of the current pods of the workload
+	CpuPerReplica        float64 `json:"cpu_per_replica"`
+	PeakCpuPerReplica    float64 `json:"peak_cpu_per_replica"`
+	MemoryPerReplica     float64 `json:"memory_per_replica"`
+	PeakMemoryPerReplica float64 `json:"peak_memory_per_replica"`
+}
+
+type SimulationRequest struct {
+	// Window is how much history the simulation replays, 24h by default.
+	Window           string          `json:"window"`
+	AddReplicas      []ReplicaChange `json:"add_replicas"`
+	RemoveNodeGroups []string        `json:"remove_node_groups"`
+}
+
+// SimulatedUtilization is the cluster utilization in percent of the
+// allocatable CPU and memory over the replayed ticks.
+type SimulatedUtilization struct {
+	AvgCpu            float64 `json:"avg_cpu"`
+	PeakCpu           float64 `json:"peak_cpu"`
+	AvgMemory         float64 `json:"avg_memory"`
+	PeakMemory        float64 `json:"peak_memory"`
+	AllocatableCpu    int64   `json:"allocatable_cpu"`
+	AllocatableMemory int64   `json:"allocatable_memory"`
+}
+
+type SimulationResult struct {
+	From        time.Time            `json:"from"`
+	To          time.Time            `json:"to"`
+	Ticks       int64                `json:"ticks"`
+	AddReplicas []ReplicaChange      `json:"add_replicas"`
+	Removed     []string             `json:"remove_node_groups"`
+	Observed    SimulatedUtilization `json:"observed"`
+	Projected   SimulatedUtilization `json:"projected"`
+	// Fits is false if the projected peak exceeds the remaining capacity.
+	Fits bool `json:"fits"`
+}
+
+// postSimulate replays the recorded node samples of the window with the
+// requested changes applied: added replicas use what the current pods of
+// their workload used on average and at peak, removed node groups take
+// their allocatable capacity away while their load moves to the remaining
+// nodes. Scheduling constraints are ignored, so like /analysis/drain-impact
+// the result is an estimate for planning only.
+func postSimulate(c *gin.Context) {
+	var req SimulationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	window := 24 * time.Hour
+	if req.Window != "" {
+		w, err := time.ParseDuration(req.Window)
+		if err != nil || w <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "window must be a positive duration"})
+			return
+		}
+		window = w
+	}
+
+	result := SimulationResult{
+		To:          time.Now(),
+		AddReplicas: []ReplicaChange{},
+		Removed:     []string{},
+	}
+	result.From = result.To.Add(-window)
+	if req.RemoveNodeGroups != nil {
+		result.Removed = req.RemoveNodeGroups
+	}
+
+	var addCPU, addPeakCPU, addMemory, addPeakMemory float64
+	for _, change := range req.AddReplicas {
+		if change.Namespace == "" || change.Workload == "" || change.Replicas <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "add_replicas needs namespace, workload and a positive replicas"})
+			return
+		}
+		found, err := replicaUsage(c, &change, result.From, result.To)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no usage recorded for the pods of " + change.Namespace + "/" + change.Workload})
+			return
+		}
+		n := float64(change.Replicas)
+		addCPU += n * change.CpuPerReplica
+		addPeakCPU += n * change.PeakCpuPerReplica
+		addMemory += n * change.MemoryPerReplica
+		addPeakMemory += n * change.PeakMemoryPerReplica
+		result.AddReplicas = append(result.AddReplicas, change)
+	}
+
+	groups, err := store.GroupCapacity(result.From, result.To)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	replay(&result, groups, simulatedLoad{addCPU, addPeakCPU, addMemory, addPeakMemory})
+	if result.Ticks == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "no samples with allocatable capacity in the window"})
+		return
+	}
+	if result.Projected.AllocatableCpu <= 0 || result.Projected.AllocatableMemory <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "removing these node groups leaves no capacity"})
+		return
+	}
+	result.Fits = result.Projected.PeakCpu <= 100 && result.Projected.PeakMemory <= 100
+
+	respond(c, http.StatusOK, result)
+}
+
+// GroupCapacity is the used and allocatable capacity of the nodes of one
+// node group at one tick.
+type GroupCapacity struct {
+	Timestamp         time.Time
+	NodeGroup         string
+	UsedCpu           int64
+	UsedMemory        int64
+	AllocatableCpu    int64
+	AllocatableMemory int64
+}
+
+// simulatedLoad is the usage the added replicas add to every tick, on
+// average and at peak.
+type simulatedLoad struct {
+	cpu, peakCPU, memory, peakMemory float64
+}
+
+// utilizationStats averages and takes the peak of the utilization of
+// ticks.
+type utilizationStats struct {
+	sum, peak float64
+	n         int
+}
+
+func (u *utilizationStats) add(avg, peak float64) {
+	if u.n == 0 || peak > u.peak {
+		u.peak = peak
+	}
+	u.sum += avg
+	u.n++
+}
+
+func (u *utilizationStats) avg() float64 {
+	if u.n == 0 {
+		return 0
+	}
+	return u.sum / float64(u.n)
+}
+
+// replay fills in the ticks and the observed and projected utilization of
+// result from the capacity of the node groups at every tick. The removed
+// groups take their allocatable capacity away from each tick, a tick
+// without capacity left doesn't count towards the projected utilization.
+func replay(result *SimulationResult, groups []GroupCapacity, load simulatedLoad) {
+	removed := make(map[string]bool)
+	for _, group := range result.Removed {
+		removed[group] = true
+	}
+
+	var observedCPU, observedMemory, projectedCPU, projectedMemory utilizationStats
+	var allocatableCPU, allocatableMemory, remainingCPU, remainingMemory float64
+	for i := 0; i < len(groups); {
+		var usedCPU, usedMemory, tickCPU, tickMemory, leftCPU, leftMemory float64
+		for timestamp := groups[i].Timestamp; i < len(groups) && groups[i].Timestamp.Equal(timestamp); i++ {
+			g := groups[i]
+			usedCPU += float64(g.UsedCpu)
+			usedMemory += float64(g.UsedMemory)
+			tickCPU += float64(g.AllocatableCpu)
+			tickMemory += float64(g.AllocatableMemory)
+			if !removed[g.NodeGroup] {
+				leftCPU += float64(g.AllocatableCpu)
+				leftMemory += float64(g.AllocatableMemory)
+			}
+		}
+		result.Ticks++
+
+		cpu, memory := usedCPU*100/tickCPU, usedMemory*100/tickMemory
+		observedCPU.add(cpu, cpu)
+		observedMemory.add(memory, memory)
+		allocatableCPU += tickCPU
+		allocatableMemory += tickMemory
+		if leftCPU != 0 {
+			projectedCPU.add((usedCPU+load.cpu)*100/leftCPU, (usedCPU+load.peakCPU)*100/leftCPU)
+		}
+		if leftMemory != 0 {
+			projectedMemory.add((usedMemory+load.memory)*100/leftMemory, (usedMemory+load.peakMemory)*100/leftMemory)
+		}
+		remainingCPU += leftCPU
+		remainingMemory += leftMemory
+	}
+	if result.Ticks == 0 {
+		return
+	}
+
+	ticks := float64(result.Ticks)
+	result.Observed = SimulatedUtilization{
+		AvgCpu:            observedCPU.avg(),
+		PeakCpu:           observedCPU.peak,
+		AvgMemory:         observedMemory.avg(),
+		PeakMemory:        observedMemory.peak,
+		AllocatableCpu:    int64(allocatableCPU / ticks),
+		AllocatableMemory: int64(allocatableMemory / ticks),
+	}
+	result.Projected = SimulatedUtilization{
+		AvgCpu:            projectedCPU.avg(),
+		PeakCpu:           projectedCPU.peak,
+		AvgMemory:         projectedMemory.avg(),
+		PeakMemory:        projectedMemory.peak,
+		AllocatableCpu:    int64(remainingCPU / ticks),
+		AllocatableMemory: int64(remainingMemory / ticks),
+	}
+}
+
+// PodUsage is the average and peak usage of a pod.
+type PodUsage struct {
+	PodName   string
+	AvgCpu    float64
+	MaxCpu    float64
+	AvgMemory float64
+	MaxMemory float64
+}
+
+// replicaUsage fills in the average and peak usage of one replica of the
+// workload from the history of its current pods between from and to. It
+// returns false if none of them has recorded usage.
+func replicaUsage(c *gin.Context, change *ReplicaChange, from, to time.Time) (bool, error) {
+	pods, err := clientset.CoreV1().Pods(change.Namespace).List(c.Request.Context(), metav1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if owner := metav1.GetControllerOf(&pod); owner != nil && owner.Kind+"/"+owner.Name == change.Workload {
+			names = append(names, pod.Name)
+		}
+	}
+
+	usage, err := store.PodUsage(change.Namespace, names, from, to)
+	if err != nil || len(usage) == 0 {
+		return false, err
+	}
+	for _, u := range usage {
+		change.CpuPerReplica += u.AvgCpu
+		change.PeakCpuPerReplica += u.MaxCpu
+		change.MemoryPerReplica += u.AvgMemory
+		change.PeakMemoryPerReplica += u.MaxMemory
+	}
+	n := float64(len(usage))
+	change.CpuPerReplica /= n
+	change.PeakCpuPerReplica /= n
+	change.MemoryPerReplica /= n
+	change.PeakMemoryPerReplica /= n
+	return true, nil
+}
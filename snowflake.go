@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Snowflake sink inserts every batch with one statement of the SQL
+// API, binding the rows as arrays. It authenticates with key pair
+// authentication as snowflake-user, whose public key must be set with
+// ALTER USER ... SET RSA_PUBLIC_KEY. The tables must exist in
+// snowflake-schema with the columns of the rows. The batch ID becomes the
+// request ID, which Snowflake uses to skip a statement it already ran.
+
+var snowflakeKey *rsa.PrivateKey
+
+type snowflakeSink struct{}
+
+func (snowflakeSink) destination() string { return "snowflake" }
+
+// loadSnowflakeKey reads an unencrypted RSA private key in PKCS #8 PEM.
+func loadSnowflakeKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA key, got %T", key)
+	}
+	return rsaKey, nil
+}
+
+// snowflakeJWT signs the token of key pair authentication. The issuer
+// names the public key by its fingerprint.
+func snowflakeJWT() (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(&snowflakeKey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	fingerprint := sha256.Sum256(der)
+	account, _, _ := strings.Cut(strings.ToUpper(cfg.SnowflakeAccount), ".")
+	subject := account + "." + strings.ToUpper(cfg.SnowflakeUser)
+
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss": subject + ".SHA256:" + base64.StdEncoding.EncodeToString(fingerprint[:]),
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, snowflakeKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// snowflakeRequestID turns a batch ID into the UUID the SQL API wants.
+func snowflakeRequestID(id string) string {
+	digest := sha256.Sum256([]byte(id))
+	h := hex.EncodeToString(digest[:16])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// snowflakeStatement is the part of a statement result the sink reads.
+type snowflakeStatement struct {
+	Code               string `json:"code"`
+	Message            string `json:"message"`
+	StatementHandle    string `json:"statementHandle"`
+	StatementStatusURL string `json:"statementStatusUrl"`
+}
+
+// load inserts rows into table and waits for the statement to finish.
+func (snowflakeSink) load(ctx context.Context, table, id string, rows any) error {
+	columns, err := warehouseColumns(rows)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	bindings := make(map[string]any, len(columns))
+	for i, column := range columns {
+		names[i] = column.name
+		placeholders[i] = "?"
+		bindings[strconv.Itoa(i+1)] = map[string]any{"type": "TEXT", "value": column.values}
+	}
+	database, schema, _ := strings.Cut(cfg.SnowflakeSchema, ".")
+	body, err := json.Marshal(map[string]any{
+		"statement": "INSERT INTO " + table + " (" + strings.Join(names, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")",
+		"timeout":   300,
+		"database":  database,
+		"schema":    schema,
+		"warehouse": cfg.SnowflakeWarehouse,
+		"bindings":  bindings,
+	})
+	if err != nil {
+		return err
+	}
+
+	base := "https://" + cfg.SnowflakeAccount + ".snowflakecomputing.com"
+	client := &http.Client{Timeout: 5 * time.Minute}
+	query := url.Values{"requestId": {snowflakeRequestID(id)}, "retry": {"true"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/api/v2/statements?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	var statement snowflakeStatement
+	status, err := snowflakeRequest(client, req, &statement)
+	// 202 means the statement still runs
+	for err == nil && status == http.StatusAccepted {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(warehousePoll):
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, base+statement.StatementStatusURL, nil)
+		if err != nil {
+			return err
+		}
+		status, err = snowflakeRequest(client, req, &statement)
+	}
+	return err
+}
+
+// snowflakeRequest sends req with a new token and decodes the statement
+// result into v. It returns the status code along with any error.
+func snowflakeRequest(client *http.Client, req *http.Request, v *snowflakeStatement) (int, error) {
+	token, err := snowflakeJWT()
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Snowflake-Authorization-Token-Type", "KEYPAIR_JWT")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil && resp.StatusCode < 300 {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("Snowflake rejected the statement: %s %s", resp.Status, v.Message)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type PodStartup struct {
+	Namespace string  `json:"namespace"`
+	PodName   string  `json:"pod_name"`
+	Scheduled float64 `json:"scheduled"`
+	Pulled    float64 `json:"pulled"`
+	Started   float64 `json:"started"`
+	Ready     float64 `json:"ready"`
+}
+
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+type StartupReport struct {
+	Pods      []PodStartup                  `json:"pods"`
+	Latencies map[string]LatencyPercentiles `json:"latencies"`
+}
+
+// getStartupLatency measures how long pods created since a point in time
+// took to reach each startup phase. Every phase is reported in seconds
+// since the pod was created: scheduled (PodScheduled condition), pulled
+// (last Pulled event), started (last container started) and ready (Ready
+// condition). Pods that haven't reached a phase report 0 for it and are
+// left out of that phase's percentiles.
+func getStartupLatency(c *gin.Context) {
+	since := time.Now().Add(-time.Hour)
+	if v := c.Query("since"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since: " + err.Error()})
+			return
+		}
+		since = t
+	}
+
+	selector, err := labels.Parse(c.Query("selector"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid selector: " + err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	namespace := c.Query("namespace")
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Image pulls are only visible as events, which expire after about an
+	// hour, so old pods may miss the pulled phase
+	events, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.Set{"involvedObject.kind": "Pod", "reason": "Pulled"}.String(),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	pulledAt := make(map[string]time.Time)
+	for _, event := range events.Items {
+		key := event.InvolvedObject.Namespace + "/" + event.InvolvedObject.Name
+		t := eventTime(&event)
+		if t.After(pulledAt[key]) {
+			pulledAt[key] = t
+		}
+	}
+
+	report := StartupReport{
+		Pods:      []PodStartup{},
+		Latencies: make(map[string]LatencyPercentiles),
+	}
+	phases := make(map[string][]float64)
+	for _, pod := range pods.Items {
+		created := pod.CreationTimestamp.Time
+		if created.Before(since) {
+			continue
+		}
+
+		startup := PodStartup{
+			Namespace: pod.Namespace,
+			PodName:   pod.Name,
+			Scheduled: secondsSince(created, conditionTime(&pod, corev1.PodScheduled)),
+			Pulled:    secondsSince(created, pulledAt[pod.Namespace+"/"+pod.Name]),
+			Started:   secondsSince(created, containersStarted(&pod)),
+			Ready:     secondsSince(created, conditionTime(&pod, corev1.PodReady)),
+		}
+		report.Pods = append(report.Pods, startup)
+
+		for phase, seconds := range map[string]float64{
+			"scheduled": startup.Scheduled,
+			"pulled":    startup.Pulled,
+			"started":   startup.Started,
+			"ready":     startup.Ready,
+		} {
+			if seconds > 0 {
+				phases[phase] = append(phases[phase], seconds)
+			}
+		}
+	}
+
+	for phase, values := range phases {
+		report.Latencies[phase] = latencyPercentiles(values)
+	}
+
+	respond(c, http.StatusOK, report)
+}
+
+func conditionTime(pod *corev1.Pod, conditionType corev1.PodConditionType) time.Time {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == corev1.ConditionTrue {
+			return condition.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// containersStarted returns when the last container of the pod started
+// running, or zero if any container isn't running yet.
+func containersStarted(pod *corev1.Pod) time.Time {
+	var started time.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running == nil {
+			return time.Time{}
+		}
+		if status.State.Running.StartedAt.After(started) {
+			started = status.State.Running.StartedAt.Time
+		}
+	}
+	return started
+}
+
+func eventTime(event *corev1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+func secondsSince(start, end time.Time) float64 {
+	if end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start).Seconds()
+}
+
+// latencyPercentiles uses the nearest-rank method on the sorted values.
+func latencyPercentiles(values []float64) LatencyPercentiles {
+	sort.Float64s(values)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(values)))) - 1
+		return values[max(i, 0)]
+	}
+	return LatencyPercentiles{
+		P50: rank(50),
+		P90: rank(90),
+		P99: rank(99),
+		Max: values[len(values)-1],
+	}
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const sourceMetricsServer = "metrics-server"
+
+// Store keeps the node samples and answers the aggregations over them and
+// the pod samples that reports, simulations and the fragmentation and leak
+// analyses run, so another backend only has to implement these methods
+// for them.
+type Store interface {
+	// InsertSamples stores the samples of one collection tick. A sample
+	// that already exists for the same sample time, node and source is
+	// replaced by the new one, which keeps its sequence number.
+	InsertSamples(samples []MetricsData) error
+	QuerySamples(q SampleQuery) ([]MetricsData, error)
+	// EachSample calls fn for every sample QuerySamples would return
+	// without holding them in memory, stopping at the first error.
+	EachSample(q SampleQuery, fn func(MetricsData) error) error
+	// LatestSamples returns the samples of the most recent collection tick.
+	LatestSamples() ([]MetricsData, error)
+	// SummarizeSamples summarizes the metrics-server samples from from up
+	// to, but not including, to for the cluster and per node, ordered by
+	// node name.
+	SummarizeSamples(from, to time.Time) (ClusterSummary, []NodeSummary, error)
+	// GroupCapacity returns the used and allocatable capacity of every
+	// node group at every tick between from and to, oldest first. Samples
+	// without used CPU or allocatable capacity are left out.
+	GroupCapacity(from, to time.Time) ([]GroupCapacity, error)
+	// FreeCapacity returns the capacity left unrequested at every tick
+	// between from and to, oldest first, with Timestamp, Nodes, FreeCpu,
+	// FreeMemory and SchedulablePods filled in for standard pods of podCPU
+	// and podMemory. nodeGroup restricts it to one node group if set.
+	// Samples without requested memory are left out.
+	FreeCapacity(from, to time.Time, nodeGroup string, podCPU, podMemory int64) ([]FragmentationTick, error)
+	// PodMemoryGrowth fits the memory of every pod with at least
+	// minSamples samples between from and to, leaving out pods the fit
+	// says nothing about.
+	PodMemoryGrowth(from, to time.Time, minSamples int) ([]PodGrowth, error)
+	// PodUsage returns the usage of each of the pods of namespace that has
+	// samples between from and to.
+	PodUsage(namespace string, pods []string, from, to time.Time) ([]PodUsage, error)
+	// MarkBenchmark assigns the collected samples between from and to to a
+	// benchmark run and returns how many there were.
+	MarkBenchmark(runID int64, from, to time.Time) (int64, error)
+	Reset() error
+}
+
+type SampleQuery struct {
+	From time.Time
+	To   time.Time
+	// Node restricts the result to one node if set.
+	Node string
+	// Basis is the CPU percentage denominator, allocatable or capacity.
+	Basis string
+	// Source restricts the result to one source if set.
+	Source string
+	// RunID restricts the result to one benchmark run if set.
+	RunID int64
+	// Ascending orders by time oldest first, the default is newest first.
+	Ascending bool
+	// BySeq orders by sequence number instead of time and returns only
+	// the samples after AfterSeq.
+	BySeq    bool
+	AfterSeq int64
+	// Limit of 0 returns every matching sample.
+	Limit  int
+	Offset int
+}
+
+var store Store
+
+// sqlStore implements Store on the SQLite or PostgreSQL database, or on a
+// snapshot of it if tx is set.
+type sqlStore struct {
+	db *database
+	tx *transaction
+}
+
+var errSnapshotReadOnly = errors.New("a snapshot can't be written to")
+
+// reader is the snapshot if the store has one, the database otherwise.
+func (s sqlStore) reader() rowQuerier {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// readView is what a read that takes several queries, or one long one,
+// goes through: the samples through store and the other tables through q.
+type readView struct {
+	store Store
+	q     rowQuerier
+}
+
+// snapshotView takes a snapshot of the database for the reads of one
+// request or job, so runs, marks and samples read one after another agree
+// with each other. The caller must release it to end the transaction.
+func snapshotView(ctx context.Context) (readView, func(), error) {
+	tx, err := db.snapshot(ctx)
+	if err != nil {
+		return readView{}, nil, err
+	}
+	release := func() { tx.Rollback() }
+	return readView{store: sqlStore{db: db, tx: tx}, q: tx}, release, nil
+}
+
+func (s sqlStore) InsertSamples(samples []MetricsData) error {
+	if s.tx != nil {
+		return errSnapshotReadOnly
+	}
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// One transaction and statement per tick instead of one per node keeps
+	// SQLite from locking and syncing the file for every row. A sample
+	// metrics-server already served on an earlier tick, or one replicated,
+	// backfilled or retried again, is updated in place, so the one
+	// collected last wins. It keeps its benchmark run and sequence number,
+	// cursors that already passed it don't ship it again.
+	stmt, err := tx.Prepare(
+		`INSERT INTO metrics (
+            timestamp,
+            sample_time,
+            window_seconds,
+            node_name,
+            cpu_usage,
+            memory_usage,
+            is_benchmark,
+            source,
+            cluster_cpu_usage,
+            cluster_total_cpu,
+            cpu_used,
+            node_total_cpu,
+            node_allocatable_cpu,
+            cluster_used_cpu,
+            cluster_allocatable_cpu,
+            node_requested_cpu,
+            cluster_requested_cpu,
+            memory_usage_percent,
+            cluster_memory_usage_percent,
+            node_total_memory,
+            node_allocatable_memory,
+            cluster_allocatable_memory,
+            cluster_memory_usage,
+            cluster_total_memory,
+            headroom,
+            node_group,
+            node_requested_memory
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (sample_time, node_name, source) DO UPDATE
+        SET timestamp = excluded.timestamp,
+            window_seconds = excluded.window_seconds,
+            cpu_usage = excluded.cpu_usage,
+            memory_usage = excluded.memory_usage,
+            cluster_cpu_usage = excluded.cluster_cpu_usage,
+            cluster_total_cpu = excluded.cluster_total_cpu,
+            cpu_used = excluded.cpu_used,
+            node_total_cpu = excluded.node_total_cpu,
+            node_allocatable_cpu = excluded.node_allocatable_cpu,
+            cluster_used_cpu = excluded.cluster_used_cpu,
+            cluster_allocatable_cpu = excluded.cluster_allocatable_cpu,
+            node_requested_cpu = excluded.node_requested_cpu,
+            cluster_requested_cpu = excluded.cluster_requested_cpu,
+            memory_usage_percent = excluded.memory_usage_percent,
+            cluster_memory_usage_percent = excluded.cluster_memory_usage_percent,
+            node_total_memory = excluded.node_total_memory,
+            node_allocatable_memory = excluded.node_allocatable_memory,
+            cluster_allocatable_memory = excluded.cluster_allocatable_memory,
+            cluster_memory_usage = excluded.cluster_memory_usage,
+            cluster_total_memory = excluded.cluster_total_memory,
+            headroom = excluded.headroom,
+            node_group = excluded.node_group,
+            node_requested_memory = excluded.node_requested_memory`,
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var inserted int64
+	for _, m := range samples {
+		result, err := stmt.Exec(
+			m.Timestamp,
+			m.SampleTime,
+			m.Window,
+			m.NodeName,
+			m.CpuUsage,
+			m.MemoryUsage,
+			m.IsBenchmark,
+			m.Source,
+			m.ClusterCpuUsage,
+			m.ClusterTotalCpu,
+			m.CpuUsed,
+			m.NodeTotalCpu,
+			m.NodeAllocatableCpu,
+			m.ClusterUsedCpu,
+			m.ClusterAllocatableCpu,
+			m.NodeRequestedCpu,
+			m.ClusterRequestedCpu,
+			m.MemoryUsagePercent,
+			m.ClusterMemoryUsagePercent,
+			m.NodeTotalMemory,
+			m.NodeAllocatableMemory,
+			m.ClusterAllocatableMemory,
+			m.ClusterMemoryUsage,
+			m.ClusterTotalMemory,
+			m.Headroom,
+			m.NodeGroup,
+			m.NodeRequestedMemory,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		inserted += n
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	dbWriteDuration.observe(time.Since(start).Seconds(), "metrics")
+	rowsInserted.add("metrics", float64(inserted))
+	return nil
+}
+
+// sampleColumns selects every MetricsData field in scanSamples order. The
+// placeholders take the basis, see basisArgs; rows recorded before
+// the raw CPU values were stored keep the percentage they were recorded
+// with.
+const sampleColumns = `
+            timestamp,
+            node_name,
+            CASE
+                WHEN ? = 'capacity' AND node_total_cpu > 0
+                    THEN cpu_used * 100.0 / node_total_cpu
+                WHEN ? = 'requests' AND node_requested_cpu > 0
+                    THEN cpu_used * 100.0 / node_requested_cpu
+                ELSE cpu_usage
+            END,
+            memory_usage,
+            is_benchmark,
+            CASE
+                WHEN ? = 'capacity' AND cluster_total_cpu > 0 AND cluster_used_cpu IS NOT NULL
+                    THEN cluster_used_cpu * 100.0 / cluster_total_cpu
+                WHEN ? = 'requests' AND cluster_requested_cpu > 0
+                    THEN cluster_used_cpu * 100.0 / cluster_requested_cpu
+                ELSE cluster_cpu_usage
+            END,
+            cluster_total_cpu,
+            source,
+            COALESCE(cpu_used, 0),
+            COALESCE(node_total_cpu, 0),
+            COALESCE(node_allocatable_cpu, 0),
+            COALESCE(cluster_used_cpu, 0),
+            COALESCE(cluster_allocatable_cpu, 0),
+            COALESCE(benchmark_run_id, 0),
+            COALESCE(cluster_memory_usage, 0),
+            COALESCE(cluster_total_memory, 0),
+            COALESCE(headroom, 0),
+            COALESCE(node_requested_cpu, 0),
+            COALESCE(cluster_requested_cpu, 0),
+            CASE WHEN ? = 'capacity' AND node_total_memory > 0
+                THEN memory_usage * 100.0 / node_total_memory
+                ELSE COALESCE(memory_usage_percent, 0)
+            END,
+            CASE WHEN ? = 'capacity' AND cluster_total_memory > 0
+                THEN cluster_memory_usage * 100.0 / cluster_total_memory
+                ELSE COALESCE(cluster_memory_usage_percent, 0)
+            END,
+            COALESCE(node_total_memory, 0),
+            COALESCE(node_allocatable_memory, 0),
+            COALESCE(cluster_allocatable_memory, 0),
+            sample_time,
+            COALESCE(window_seconds, 0),
+            COALESCE(node_group, ''),
+            COALESCE(node_requested_memory, 0),
+            id`
+
+// basisArgs fills the placeholders of sampleColumns.
+func basisArgs(basis string) []any {
+	return []any{basis, basis, basis, basis, basis, basis}
+}
+
+func (s sqlStore) QuerySamples(q SampleQuery) ([]MetricsData, error) {
+	query, args := sampleQuery(q)
+	rows, err := s.reader().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanSamples(rows)
+}
+
+func (s sqlStore) EachSample(q SampleQuery, fn func(MetricsData) error) error {
+	query, args := sampleQuery(q)
+	rows, err := s.reader().Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m, err := scanSample(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func sampleQuery(q SampleQuery) (string, []any) {
+	query := `
+        SELECT` + sampleColumns + `
+        FROM metrics
+        WHERE timestamp BETWEEN ? AND ?`
+	args := append(basisArgs(q.Basis), q.From, q.To)
+	if q.Node != "" {
+		query += " AND node_name = ?"
+		args = append(args, q.Node)
+	}
+	if q.Source != "" {
+		query += " AND source = ?"
+		args = append(args, q.Source)
+	}
+	if q.RunID != 0 {
+		query += " AND benchmark_run_id = ?"
+		args = append(args, q.RunID)
+	}
+	if q.BySeq {
+		query += " AND id > ? ORDER BY id"
+		args = append(args, q.AfterSeq)
+	} else if q.Ascending {
+		query += " ORDER BY timestamp, node_name"
+	} else {
+		query += " ORDER BY timestamp DESC, node_name"
+	}
+	if q.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, q.Limit, q.Offset)
+	}
+	return query, args
+}
+
+func (s sqlStore) LatestSamples() ([]MetricsData, error) {
+	rows, err := s.reader().Query(`
+        SELECT`+sampleColumns+`
+        FROM metrics
+        WHERE source = ?
+          AND timestamp = (
+            SELECT MAX(timestamp)
+            FROM metrics
+            WHERE source = ?
+          )
+        ORDER BY node_name
+    `, append(basisArgs("allocatable"), sourceMetricsServer, sourceMetricsServer)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanSamples(rows)
+}
+
+func scanSamples(rows *sql.Rows) ([]MetricsData, error) {
+	defer rows.Close()
+
+	var samples []MetricsData
+	for rows.Next() {
+		m, err := scanSample(rows)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, m)
+	}
+	return samples, rows.Err()
+}
+
+func scanSample(rows *sql.Rows) (MetricsData, error) {
+	var m MetricsData
+	var sampleTime sql.NullTime
+	err := rows.Scan(
+		&m.Timestamp,
+		&m.NodeName,
+		&m.CpuUsage,
+		&m.MemoryUsage,
+		&m.IsBenchmark,
+		&m.ClusterCpuUsage,
+		&m.ClusterTotalCpu,
+		&m.Source,
+		&m.CpuUsed,
+		&m.NodeTotalCpu,
+		&m.NodeAllocatableCpu,
+		&m.ClusterUsedCpu,
+		&m.ClusterAllocatableCpu,
+		&m.BenchmarkRunID,
+		&m.ClusterMemoryUsage,
+		&m.ClusterTotalMemory,
+		&m.Headroom,
+		&m.NodeRequestedCpu,
+		&m.ClusterRequestedCpu,
+		&m.MemoryUsagePercent,
+		&m.ClusterMemoryUsagePercent,
+		&m.NodeTotalMemory,
+		&m.NodeAllocatableMemory,
+		&m.ClusterAllocatableMemory,
+		&sampleTime,
+		&m.Window,
+		&m.NodeGroup,
+		&m.NodeRequestedMemory,
+		&m.Seq,
+	)
+	if err != nil {
+		return m, err
+	}
+	m.SampleTime = m.Timestamp
+	if sampleTime.Valid {
+		m.SampleTime = sampleTime.Time
+	}
+	return m, nil
+}
+
+// SummarizeSamples reads the cluster and node summaries with two queries,
+// which agree on a snapshot.
+func (s sqlStore) SummarizeSamples(from, to time.Time) (ClusterSummary, []NodeSummary, error) {
+	// Cluster values repeat on every node row of a tick, which doesn't
+	// change their averages
+	var cluster ClusterSummary
+	err := s.reader().QueryRow(`
+        SELECT
+            COUNT(DISTINCT timestamp),
+            COALESCE(AVG(cluster_cpu_usage), 0),
+            COALESCE(MAX(cluster_cpu_usage), 0),
+            COALESCE(AVG(cluster_memory_usage_percent), 0),
+            COALESCE(MAX(cluster_memory_usage_percent), 0),
+            COALESCE(MIN(headroom), 0),
+            COALESCE(AVG(CASE WHEN cluster_requested_cpu > 0 THEN cluster_used_cpu * 100.0 / cluster_requested_cpu END), 0)
+        FROM metrics
+        WHERE source = ?
+          AND timestamp >= ? AND timestamp < ?
+    `, sourceMetricsServer, from, to).Scan(
+		&cluster.Samples,
+		&cluster.AvgCpu,
+		&cluster.MaxCpu,
+		&cluster.AvgMemory,
+		&cluster.MaxMemory,
+		&cluster.MinHeadroom,
+		&cluster.AvgCpuRequests,
+	)
+	if err != nil {
+		return cluster, nil, err
+	}
+
+	rows, err := s.reader().Query(`
+        SELECT
+            node_name,
+            COUNT(*),
+            AVG(cpu_usage),
+            MAX(cpu_usage),
+            COALESCE(AVG(memory_usage_percent), 0),
+            COALESCE(MAX(memory_usage_percent), 0)
+        FROM metrics
+        WHERE source = ?
+          AND timestamp >= ? AND timestamp < ?
+        GROUP BY node_name
+        ORDER BY node_name
+    `, sourceMetricsServer, from, to)
+	if err != nil {
+		return cluster, nil, err
+	}
+	defer rows.Close()
+	nodes := []NodeSummary{}
+	for rows.Next() {
+		var n NodeSummary
+		if err := rows.Scan(&n.NodeName, &n.Samples, &n.AvgCpu, &n.MaxCpu, &n.AvgMemory, &n.MaxMemory); err != nil {
+			return cluster, nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return cluster, nodes, rows.Err()
+}
+
+func (s sqlStore) GroupCapacity(from, to time.Time) ([]GroupCapacity, error) {
+	rows, err := s.reader().Query(`
+        SELECT
+            timestamp,
+            COALESCE(node_group, ''),
+            SUM(cpu_used),
+            SUM(memory_usage),
+            SUM(node_allocatable_cpu),
+            SUM(node_allocatable_memory)
+        FROM metrics
+        WHERE source = ?
+          AND timestamp BETWEEN ? AND ?
+          AND cpu_used IS NOT NULL
+          AND node_allocatable_cpu > 0
+          AND node_allocatable_memory > 0
+        GROUP BY timestamp, COALESCE(node_group, '')
+        ORDER BY timestamp, COALESCE(node_group, '')
+    `, sourceMetricsServer, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []GroupCapacity
+	for rows.Next() {
+		var g GroupCapacity
+		if err := rows.Scan(&g.Timestamp, &g.NodeGroup, &g.UsedCpu, &g.UsedMemory, &g.AllocatableCpu, &g.AllocatableMemory); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (s sqlStore) FreeCapacity(from, to time.Time, nodeGroup string, podCPU, podMemory int64) ([]FragmentationTick, error) {
+	// Per node, capacity requested beyond allocatable leaves nothing free
+	// rather than making up for other nodes
+	freeCPU := "CASE WHEN node_allocatable_cpu > node_requested_cpu THEN node_allocatable_cpu - node_requested_cpu ELSE 0 END"
+	freeMemory := "CASE WHEN node_allocatable_memory > node_requested_memory THEN node_allocatable_memory - node_requested_memory ELSE 0 END"
+	cpuPods := fmt.Sprintf("free_cpu / %d", podCPU)
+	memoryPods := fmt.Sprintf("free_memory / %d", podMemory)
+
+	query := `
+        SELECT
+            timestamp,
+            COUNT(*),
+            SUM(free_cpu),
+            SUM(free_memory),
+            SUM(CASE WHEN ` + cpuPods + ` < ` + memoryPods + ` THEN ` + cpuPods + ` ELSE ` + memoryPods + ` END)
+        FROM (
+            SELECT
+                timestamp,
+                ` + freeCPU + ` AS free_cpu,
+                ` + freeMemory + ` AS free_memory
+            FROM metrics
+            WHERE source = ?
+              AND timestamp BETWEEN ? AND ?
+              AND node_allocatable_cpu IS NOT NULL
+              AND node_requested_cpu IS NOT NULL
+              AND node_requested_memory IS NOT NULL`
+	args := []any{sourceMetricsServer, from, to}
+	if nodeGroup != "" {
+		query += " AND node_group = ?"
+		args = append(args, nodeGroup)
+	}
+	query += `
+        ) AS nodes
+        GROUP BY timestamp
+        ORDER BY timestamp`
+
+	rows, err := s.reader().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ticks []FragmentationTick
+	for rows.Next() {
+		var t FragmentationTick
+		if err := rows.Scan(&t.Timestamp, &t.Nodes, &t.FreeCpu, &t.FreeMemory, &t.SchedulablePods); err != nil {
+			return nil, err
+		}
+		ticks = append(ticks, t)
+	}
+	return ticks, rows.Err()
+}
+
+// PodMemoryGrowth has the database compute the sums of the least squares
+// fit, with time in hours since from to keep them small.
+func (s sqlStore) PodMemoryGrowth(from, to time.Time, minSamples int) ([]PodGrowth, error) {
+	rows, err := s.reader().Query(`
+        WITH series AS (
+            SELECT
+                namespace,
+                pod_name,
+                (`+s.db.epochSeconds("timestamp")+` - ?) / 3600.0 AS x,
+                memory_usage * 1.0 AS y,
+                memory_usage - LAG(memory_usage) OVER (PARTITION BY namespace, pod_name ORDER BY timestamp) AS step
+            FROM pod_metrics
+            WHERE timestamp BETWEEN ? AND ?
+        )
+        SELECT
+            namespace,
+            pod_name,
+            COUNT(*),
+            MIN(y),
+            MAX(y),
+            SUM(x),
+            SUM(y),
+            SUM(x * y),
+            SUM(x * x),
+            SUM(CASE WHEN step >= 0 THEN 1 ELSE 0 END),
+            COUNT(step)
+        FROM series
+        GROUP BY namespace, pod_name
+        HAVING COUNT(*) >= ?
+    `, from.Unix(), from, to, minSamples)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fits []PodGrowth
+	for rows.Next() {
+		var g PodGrowth
+		var minMemory, maxMemory, sumX, sumY, sumXY, sumXX float64
+		var rising, steps int
+		err := rows.Scan(&g.Namespace, &g.PodName, &g.Samples, &minMemory, &maxMemory, &sumX, &sumY, &sumXY, &sumXX, &rising, &steps)
+		if err != nil {
+			return nil, err
+		}
+		n := float64(g.Samples)
+		denominator := n*sumXX - sumX*sumX
+		if denominator == 0 || steps == 0 {
+			continue
+		}
+		g.GrowthRate = (n*sumXY - sumX*sumY) / denominator
+		g.Monotonic = float64(rising) / float64(steps)
+		g.MinMemory, g.MaxMemory = int64(minMemory), int64(maxMemory)
+		fits = append(fits, g)
+	}
+	return fits, rows.Err()
+}
+
+func (s sqlStore) PodUsage(namespace string, pods []string, from, to time.Time) ([]PodUsage, error) {
+	if len(pods) == 0 {
+		return nil, nil
+	}
+	args := []any{namespace}
+	for _, pod := range pods {
+		args = append(args, pod)
+	}
+	rows, err := s.reader().Query(`
+        SELECT
+            pod_name,
+            AVG(cpu_usage),
+            MAX(cpu_usage),
+            AVG(memory_usage),
+            MAX(memory_usage)
+        FROM pod_metrics
+        WHERE namespace = ?
+          AND pod_name IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(pods)), ", ")+`)
+          AND timestamp BETWEEN ? AND ?
+        GROUP BY pod_name
+        ORDER BY pod_name
+    `, append(args, from, to)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []PodUsage
+	for rows.Next() {
+		var u PodUsage
+		if err := rows.Scan(&u.PodName, &u.AvgCpu, &u.MaxCpu, &u.AvgMemory, &u.MaxMemory); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// MarkBenchmark also sets is_benchmark for clients that only know the flag.
+// Samples are matched by when metrics-server measured them, so a slow
+// scrape doesn't pull a sample from before the run into it. Backfilled
+// samples belong to the run too, so its timeline has no hole where the
+// collector was down.
+func (s sqlStore) MarkBenchmark(runID int64, from, to time.Time) (int64, error) {
+	if s.tx != nil {
+		return 0, errSnapshotReadOnly
+	}
+	result, err := s.db.Exec(`
+        UPDATE metrics
+        SET is_benchmark = TRUE,
+            benchmark_run_id = ?
+        WHERE source IN (?, ?)
+          AND COALESCE(sample_time, timestamp) BETWEEN ? AND ?
+    `, runID, sourceMetricsServer, sourceBackfill, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Reset deletes every sample. The sequence numbers continue where they
+// were, so a scraper resuming with after_seq doesn't skip new samples.
+func (s sqlStore) Reset() error {
+	if s.tx != nil {
+		return errSnapshotReadOnly
+	}
+	_, err := s.db.Exec("DELETE FROM metrics")
+	return err
+}
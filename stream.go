@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	streamWriteTimeout = 10 * time.Second
+	streamPingInterval = 30 * time.Second
+)
+
+var streamUpgrader = websocket.Upgrader{
+	CheckOrigin: streamOriginAllowed,
+}
+
+// streamOriginAllowed accepts browsers on a page of the collector itself
+// or of one of the stream-origins. Clients that aren't browsers send no
+// Origin header and are accepted.
+func streamOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(cfg.StreamOrigins, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// getMetricsStream upgrades to a WebSocket and sends the node samples of
+// every collection tick as one JSON array message. With ?subscription=
+// the filters and throttling of that subscription apply, and one with
+// namespaces also gets the pod samples of the tick as another array
+// message, whose elements have a namespace and pod_name. A client that
+// falls behind is disconnected with close code 1008 instead of slowing
+// down collection.
+func getMetricsStream(c *gin.Context) {
+	var sub *Subscription
+	if id := c.Query("subscription"); id != "" {
+		s, err := loadSubscription(id)
+		if errors.Is(err, errSubscriptionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		sub = s
+	}
+
+	conn, err := streamUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader already answered with an error status
+		return
+	}
+	defer conn.Close()
+
+	s := updates.subscribe(sub)
+	defer updates.unsubscribe(s)
+
+	// The client only sends control frames, reading them notices when it
+	// goes away, which ends the subscription and with it the loop below
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				updates.unsubscribe(s)
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(streamPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		update, ok := updates.receiveUpdate(s)
+		if !ok {
+			if updates.wasEvicted(s) {
+				message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "fell behind")
+				conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(streamWriteTimeout))
+			}
+			return
+		}
+		var message any = update.nodes
+		if update.pods != nil {
+			message = update.pods
+		}
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err := conn.WriteJSON(message); err != nil {
+			return
+		}
+	}
+}
+
+// ClusterTick summarizes the cluster at one collection tick. The cluster
+// fields are the same on every sample of a tick, so they are taken from
+// the first one. Samples are only assigned to a benchmark run when it
+// stops, so the benchmark fields come from the run open at the tick.
+type ClusterTick struct {
+	Timestamp          time.Time `json:"timestamp"`
+	Nodes              int       `json:"nodes"`
+	CpuUsage           float64   `json:"cpu_usage"`
+	CpuUsed            int64     `json:"cpu_used"`
+	CpuAllocatable     int64     `json:"cpu_allocatable"`
+	CpuRequested       int64     `json:"cpu_requested"`
+	MaxNodeCpuUsage    float64   `json:"max_node_cpu_usage"`
+	MemoryUsagePercent float64   `json:"memory_usage_percent"`
+	MemoryUsage        int64     `json:"memory_usage"`
+	MemoryAllocatable  int64     `json:"memory_allocatable"`
+	Headroom           int64     `json:"headroom"`
+	IsBenchmark        bool      `json:"is_benchmark"`
+	BenchmarkRunID     int64     `json:"benchmark_run_id,omitempty"`
+}
+
+func clusterTick(samples []MetricsData, run *BenchmarkRun) ClusterTick {
+	first := samples[0]
+	tick := ClusterTick{
+		Timestamp:          first.Timestamp,
+		Nodes:              len(samples),
+		CpuUsage:           first.ClusterCpuUsage,
+		CpuUsed:            first.ClusterUsedCpu,
+		CpuAllocatable:     first.ClusterAllocatableCpu,
+		CpuRequested:       first.ClusterRequestedCpu,
+		MemoryUsagePercent: first.ClusterMemoryUsagePercent,
+		MemoryUsage:        first.ClusterMemoryUsage,
+		MemoryAllocatable:  first.ClusterAllocatableMemory,
+		Headroom:           first.Headroom,
+	}
+	if run != nil {
+		tick.IsBenchmark = true
+		tick.BenchmarkRunID = run.ID
+	}
+	for _, sample := range samples {
+		tick.MaxNodeCpuUsage = max(tick.MaxNodeCpuUsage, sample.CpuUsage)
+	}
+	return tick
+}
+
+// getClusterEvents sends a "tick" Server-Sent Event with the ClusterTick
+// of every collection tick, for curl and EventSource clients. A client
+// that falls behind gets an "evicted" event before the stream ends.
+func getClusterEvents(c *gin.Context) {
+	s := updates.subscribe(nil)
+	defer updates.unsubscribe(s)
+
+	// receive blocks until the next tick, unsubscribing wakes it up when
+	// the client goes away in between
+	go func() {
+		<-c.Request.Context().Done()
+		updates.unsubscribe(s)
+	}()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// Send the headers right away, clients wait for them until the first
+	// tick otherwise
+	c.Writer.Flush()
+	c.Stream(func(io.Writer) bool {
+		samples, ok := updates.receive(s)
+		if !ok {
+			if updates.wasEvicted(s) {
+				c.SSEvent("evicted", gin.H{"error": "fell behind"})
+			}
+			return false
+		}
+		if len(samples) > 0 {
+			run, err := runningBenchmark()
+			if err != nil {
+				slog.Error("Error loading the running benchmark", "error", err)
+			}
+			c.SSEvent("tick", clusterTick(samples, run))
+		}
+		return true
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Subscription is a filter registered by a streaming client. It is stored
+// so a client can reconnect with the same id instead of sending its
+// filters again, and so the server only pushes updates the client wants.
+type Subscription struct {
+	ID    string   `json:"id"`
+	Nodes []string `json:"nodes,omitempty"`
+	// Namespaces subscribes to the pod samples of these namespaces on top
+	// of the node samples. Nodes filters the pods by the node they run on.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// MinDelta is the change in CPU percentage points below which an update
+	// for the same node or pod is not sent again, of the node's CPU for a
+	// node and of one core for a pod.
+	MinDelta float64 `json:"min_delta,omitempty"`
+	// MaxFrequency caps the updates per second per node or pod.
+	MaxFrequency float64   `json:"max_frequency,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// matches reports whether an update for the node passes the node filter.
+// An empty list matches every node.
+func (s *Subscription) matches(node string) bool {
+	return len(s.Nodes) == 0 || slices.Contains(s.Nodes, node)
+}
+
+// matchesPod reports whether an update for the pod passes the namespace
+// and node filters.
+func (s *Subscription) matchesPod(p PodMetricsData) bool {
+	return slices.Contains(s.Namespaces, p.Namespace) && s.matches(p.NodeName)
+}
+
+// podCPUPercent is the CPU of a pod in percent of one core, the unit of
+// MinDelta for pods.
+func podCPUPercent(p PodMetricsData) float64 {
+	return float64(p.CpuUsage) / 10
+}
+
+// subscriptionThrottle applies the delta and frequency limits of one
+// subscription for one connected client.
+type subscriptionThrottle struct {
+	sub  *Subscription
+	last map[string]throttleEntry
+}
+
+type throttleEntry struct {
+	sent time.Time
+	cpu  float64
+}
+
+func newSubscriptionThrottle(sub *Subscription) *subscriptionThrottle {
+	return &subscriptionThrottle{sub: sub, last: make(map[string]throttleEntry)}
+}
+
+// admit reports whether an update for key (a node or namespace/pod) with
+// the given CPU value should be sent, and records it if so.
+func (t *subscriptionThrottle) admit(key string, cpu float64, now time.Time) bool {
+	last, seen := t.last[key]
+	if seen {
+		if t.sub.MaxFrequency > 0 && now.Sub(last.sent).Seconds() < 1/t.sub.MaxFrequency {
+			return false
+		}
+		if t.sub.MinDelta > 0 && math.Abs(cpu-last.cpu) < t.sub.MinDelta {
+			return false
+		}
+	}
+	t.last[key] = throttleEntry{sent: now, cpu: cpu}
+	return true
+}
+
+var errSubscriptionNotFound = errors.New("subscription not found")
+
+func loadSubscription(id string) (*Subscription, error) {
+	var s Subscription
+	var nodes string
+	var namespaces sql.NullString
+	err := db.QueryRow(`
+        SELECT id, nodes, namespaces, min_delta, max_frequency, created_at
+        FROM subscriptions
+        WHERE id = ?
+    `, id).Scan(&s.ID, &nodes, &namespaces, &s.MinDelta, &s.MaxFrequency, &s.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSubscriptionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(nodes), &s.Nodes); err != nil {
+		return nil, err
+	}
+	// Subscriptions stored before namespace filters have none
+	if namespaces.Valid {
+		if err := json.Unmarshal([]byte(namespaces.String), &s.Namespaces); err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+func createSubscription(c *gin.Context) {
+	var s Subscription
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Without pod collection there are no pod samples to filter
+	if len(s.Namespaces) > 0 && !cfg.CollectPods {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "namespaces needs collect-pods"})
+		return
+	}
+	if s.MinDelta < 0 || s.MaxFrequency < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_delta and max_frequency must not be negative"})
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.ID = hex.EncodeToString(id)
+	s.CreatedAt = time.Now()
+
+	nodes, _ := json.Marshal(s.Nodes)
+	namespaces, _ := json.Marshal(s.Namespaces)
+	_, err := db.Exec(
+		`INSERT INTO subscriptions (
+            id,
+            nodes,
+            namespaces,
+            min_delta,
+            max_frequency,
+            created_at
+        ) VALUES (?, ?, ?, ?, ?, ?)`,
+		s.ID,
+		string(nodes),
+		string(namespaces),
+		s.MinDelta,
+		s.MaxFrequency,
+		s.CreatedAt,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusCreated, s)
+}
+
+func getSubscription(c *gin.Context) {
+	s, err := loadSubscription(c.Param("id"))
+	if errors.Is(err, errSubscriptionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respond(c, http.StatusOK, s)
+}
+
+func deleteSubscription(c *gin.Context) {
+	result, err := db.Exec("DELETE FROM subscriptions WHERE id = ?", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": errSubscriptionNotFound.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const defaultNodeGroup = "default"
+
+// nodeGroupLabels are checked in order when node-group-label is not set.
+var nodeGroupLabels = []string{
+	"eks.amazonaws.com/nodegroup",
+	"cloud.google.com/gke-nodepool",
+	"kubernetes.azure.com/agentpool",
+	"karpenter.sh/nodepool",
+}
+
+// nodeGroup returns the node group a node belongs to, "default" if it
+// has no group label.
+func nodeGroup(node *corev1.Node) string {
+	labels := nodeGroupLabels
+	if cfg.NodeGroupLabel != "" {
+		labels = []string{cfg.NodeGroupLabel}
+	}
+	for _, label := range labels {
+		if v := node.Labels[label]; v != "" {
+			return v
+		}
+	}
+	return defaultNodeGroup
+}
+
+const (
+	resourceCPU    = "cpu"
+	resourceMemory = "memory"
+)
+
+// TargetBand is the utilization in percent of allocatable a node group
+// should stay within.
+type TargetBand struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// score is 100 inside the band and drops by one for every percentage
+// point outside it.
+func (b TargetBand) score(utilization float64) float64 {
+	switch {
+	case utilization < b.Min:
+		return max(0, 100-(b.Min-utilization))
+	case utilization > b.Max:
+		return max(0, 100-(utilization-b.Max))
+	}
+	return 100
+}
+
+// utilizationTargets holds the bands by node group and resource, parsed
+// from utilization-targets. The group "*" applies to every group without
+// a band of its own.
+var utilizationTargets map[string]map[string]TargetBand
+
+func parseUtilizationTargets(value string) (map[string]map[string]TargetBand, error) {
+	targets := make(map[string]map[string]TargetBand)
+	if value == "" {
+		return targets, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		key, band, ok := strings.Cut(entry, "=")
+		group, resource, hasResource := strings.Cut(key, ":")
+		if !ok || !hasResource || group == "" {
+			return nil, fmt.Errorf("%q is not group:resource=min-max", entry)
+		}
+		if resource != resourceCPU && resource != resourceMemory {
+			return nil, fmt.Errorf("unknown resource %q, expected cpu or memory", resource)
+		}
+		low, high, ok := strings.Cut(band, "-")
+		minimum, minErr := strconv.ParseFloat(low, 64)
+		maximum, maxErr := strconv.ParseFloat(high, 64)
+		if !ok || minErr != nil || maxErr != nil || minimum < 0 || minimum > maximum {
+			return nil, fmt.Errorf("invalid band %q, expected min-max in percent", band)
+		}
+		if targets[group] == nil {
+			targets[group] = make(map[string]TargetBand)
+		}
+		targets[group][resource] = TargetBand{Min: minimum, Max: maximum}
+	}
+	return targets, nil
+}
+
+func targetFor(group, resource string) (TargetBand, bool) {
+	if band, ok := utilizationTargets[group][resource]; ok {
+		return band, true
+	}
+	band, ok := utilizationTargets["*"][resource]
+	return band, ok
+}
+
+type TargetWindow struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Utilization float64   `json:"utilization"`
+	Score       float64   `json:"score"`
+	InTarget    bool      `json:"in_target"`
+}
+
+type TargetCompliance struct {
+	NodeGroup string     `json:"node_group"`
+	Resource  string     `json:"resource"`
+	Target    TargetBand `json:"target"`
+	// Compliance is the percentage of windows inside the band, Score the
+	// mean score of the windows.
+	Compliance float64        `json:"compliance"`
+	Score      float64        `json:"score"`
+	Below      int            `json:"windows_below"`
+	Above      int            `json:"windows_above"`
+	Windows    []TargetWindow `json:"windows"`
+
+	allocatable float64
+}
+
+type TargetReport struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Step float64   `json:"step_seconds"`
+	// Score is the mean of the group scores of each resource weighted by
+	// the allocatable capacity of the groups, so a large group missing
+	// its band counts for more than a small one.
+	Score  float64            `json:"score"`
+	Groups []TargetCompliance `json:"groups"`
+}
+
+// getTargetCompliance scores the utilization of each node group against
+// its target band in windows of ?step (default 5m). The utilization of a
+// window is the usage of all nodes in the group over their allocatable,
+// so larger nodes weigh more. Groups without a band are left out.
+func getTargetCompliance(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, 24*time.Hour)
+	if !ok {
+		return
+	}
+	step := 5 * time.Minute
+	if v := c.Query("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < cfg.CollectInterval {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("step must be a duration of at least %v", cfg.CollectInterval)})
+			return
+		}
+		step = d
+	}
+
+	query := `
+        SELECT
+            timestamp,
+            node_group,
+            SUM(cpu_used),
+            SUM(node_allocatable_cpu),
+            SUM(memory_usage),
+            SUM(node_allocatable_memory)
+        FROM metrics
+        WHERE source = ?
+          AND timestamp BETWEEN ? AND ?
+          AND node_group IS NOT NULL
+          AND node_allocatable_cpu > 0`
+	args := []any{sourceMetricsServer, from, to}
+	if v := c.Query("group"); v != "" {
+		query += " AND node_group = ?"
+		args = append(args, v)
+	}
+	query += " GROUP BY timestamp, node_group ORDER BY timestamp"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	type key struct {
+		group, resource string
+		window          time.Time
+	}
+	type usage struct{ used, allocatable float64 }
+	windows := make(map[key]*usage)
+	groups := make(map[[2]string]*TargetCompliance)
+	for rows.Next() {
+		var timestamp time.Time
+		var group string
+		var cpuUsed, cpuAllocatable, memoryUsed, memoryAllocatable float64
+		if err := rows.Scan(&timestamp, &group, &cpuUsed, &cpuAllocatable, &memoryUsed, &memoryAllocatable); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		window := timestamp.Truncate(step)
+		for _, r := range []struct {
+			resource          string
+			used, allocatable float64
+		}{
+			{resourceCPU, cpuUsed, cpuAllocatable},
+			{resourceMemory, memoryUsed, memoryAllocatable},
+		} {
+			band, ok := targetFor(group, r.resource)
+			if !ok || r.allocatable <= 0 {
+				continue
+			}
+			g, ok := groups[[2]string{group, r.resource}]
+			if !ok {
+				g = &TargetCompliance{NodeGroup: group, Resource: r.resource, Target: band, Windows: []TargetWindow{}}
+				groups[[2]string{group, r.resource}] = g
+			}
+			g.allocatable += r.allocatable
+
+			k := key{group, r.resource, window}
+			u, ok := windows[k]
+			if !ok {
+				u = &usage{}
+				windows[k] = u
+				g.Windows = append(g.Windows, TargetWindow{Timestamp: window})
+			}
+			u.used += r.used
+			u.allocatable += r.allocatable
+		}
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	report := TargetReport{From: from, To: to, Step: step.Seconds(), Groups: []TargetCompliance{}}
+	totals := make(map[string]struct{ score, allocatable float64 })
+	for _, g := range groups {
+		inTarget := 0
+		for i := range g.Windows {
+			w := &g.Windows[i]
+			u := windows[key{g.NodeGroup, g.Resource, w.Timestamp}]
+			w.Utilization = u.used * 100 / u.allocatable
+			w.Score = g.Target.score(w.Utilization)
+			switch {
+			case w.Utilization < g.Target.Min:
+				g.Below++
+			case w.Utilization > g.Target.Max:
+				g.Above++
+			default:
+				w.InTarget = true
+				inTarget++
+			}
+			g.Score += w.Score
+		}
+		g.Compliance = float64(inTarget) * 100 / float64(len(g.Windows))
+		g.Score /= float64(len(g.Windows))
+
+		t := totals[g.Resource]
+		t.score += g.Score * g.allocatable
+		t.allocatable += g.allocatable
+		totals[g.Resource] = t
+		report.Groups = append(report.Groups, *g)
+	}
+	for _, t := range totals {
+		report.Score += t.score / t.allocatable / float64(len(totals))
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].NodeGroup != report.Groups[j].NodeGroup {
+			return report.Groups[i].NodeGroup < report.Groups[j].NodeGroup
+		}
+		return report.Groups[i].Resource < report.Groups[j].Resource
+	})
+
+	respond(c, http.StatusOK, report)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tenantKey holds the namespaces of a tenant request in the gin context.
+const tenantKey = "tenant"
+
+// tenants maps the tokens of tenant-tokens to the namespaces their team
+// may see.
+var tenants map[string][]string
+
+// tenantRoutes are the reads open to tenants, the pod and namespace level
+// data. The ones set to true ask the Kubernetes API rather than the
+// database and need ?namespace=. Everything else, including node and
+// cluster data, is admin-only.
+var tenantRoutes = map[string]bool{
+	"/metrics/pods":      false,
+	"/metrics/aggregate": false,
+	"/metrics/pods/:namespace/:name/containers": false,
+	"/metrics/pods/:namespace/:name/network":    false,
+	"/metrics/pods/:namespace/:name/filesystem": false,
+	"/metrics/image-pulls":                      false,
+	"/metrics/disruptions":                      false,
+	"/metrics/quotas":                           false,
+	"/analysis/leaks":                           false,
+	"/analysis/startup":                         true,
+	"/analysis/governance":                      true,
+}
+
+// loadTenants reads a JSON object of tokens and the namespaces each may
+// see, e.g. {"<token of team a>": ["team-a", "team-a-staging"]}.
+func loadTenants(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens map[string][]string
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	for token, namespaces := range tokens {
+		if token == "" || len(namespaces) == 0 {
+			return nil, errors.New("every token needs at least one namespace")
+		}
+	}
+	return tokens, nil
+}
+
+// tenantNamespaces returns the namespaces of the tenant whose token r
+// carries. Every token is compared so the time taken doesn't tell which
+// one came close.
+func tenantNamespaces(r *http.Request) ([]string, bool) {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || got == "" {
+		return nil, false
+	}
+	var match []string
+	for token, namespaces := range tenants {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			match = namespaces
+		}
+	}
+	return match, match != nil
+}
+
+// authorizeTenant lets a tenant request through if it reads a tenant
+// route and names none but its own namespaces.
+func authorizeTenant(c *gin.Context, namespaces []string) {
+	needsNamespace, ok := tenantRoutes[c.FullPath()]
+	if !ok || (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "only pod and namespace data is open to tenants"})
+		return
+	}
+	for _, namespace := range []string{c.Param("namespace"), c.Query("namespace")} {
+		if namespace != "" && !slices.Contains(namespaces, namespace) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "namespace " + namespace + " belongs to another tenant"})
+			return
+		}
+	}
+	if needsNamespace && c.Query("namespace") == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "namespace is required for tenants"})
+		return
+	}
+	c.Set(tenantKey, namespaces)
+	c.Next()
+}
+
+// scopeNamespaces limits a query on a table with a namespace column to
+// the namespaces of a tenant request. Other requests see every namespace.
+func scopeNamespaces(c *gin.Context, query string, args []any) (string, []any) {
+	namespaces := c.GetStringSlice(tenantKey)
+	if namespaces == nil {
+		return query, args
+	}
+	query += " AND namespace IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(namespaces)), ", ") + ")"
+	for _, namespace := range namespaces {
+		args = append(args, namespace)
+	}
+	return query, args
+}
+
+// tenantAllows reports whether the request may see namespace.
+func tenantAllows(c *gin.Context, namespace string) bool {
+	namespaces := c.GetStringSlice(tenantKey)
+	return namespaces == nil || slices.Contains(namespaces, namespace)
+}
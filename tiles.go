@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTileWidth = 800
+	maxTileWidth     = 4000
+)
+
+type Tile struct {
+	Start     time.Time `json:"start"`
+	Count     int       `json:"count"`
+	CpuMin    float64   `json:"cpu_min"`
+	CpuMax    float64   `json:"cpu_max"`
+	CpuAvg    float64   `json:"cpu_avg"`
+	MemoryMax int64     `json:"memory_max"`
+	MemoryAvg int64     `json:"memory_avg"`
+}
+
+type TileSeries struct {
+	NodeName string `json:"node_name"`
+	Tiles    []Tile `json:"tiles"`
+}
+
+type TilesResponse struct {
+	From          time.Time    `json:"from"`
+	To            time.Time    `json:"to"`
+	BucketSeconds float64      `json:"bucket_seconds"`
+	Cluster       []Tile       `json:"cluster"`
+	Nodes         []TileSeries `json:"nodes"`
+}
+
+// getTiles returns the samples between from and to pre-binned into width
+// equally sized buckets, so a chart with width pixels gets exactly one
+// min/max/avg value per pixel column regardless of how many samples exist.
+// The buckets are aggregated by the database and are at least a second
+// wide. The node and cluster tiles are read from one snapshot, so they
+// cover the same ticks.
+func getTiles(c *gin.Context) {
+	from, to, ok := parseTimeRange(c, time.Hour)
+	if !ok {
+		return
+	}
+
+	width := defaultTileWidth
+	if v := c.Query("width"); v != "" {
+		w, err := strconv.Atoi(v)
+		if err != nil || w <= 0 || w > maxTileWidth {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "width must be between 1 and " + strconv.Itoa(maxTileWidth)})
+			return
+		}
+		width = w
+	}
+
+	seconds := max(int64(math.Ceil(to.Sub(from).Seconds()/float64(width))), 1)
+	bucket := time.Duration(seconds) * time.Second
+	// to is inclusive and may fall on the end of the last bucket
+	index := fmt.Sprintf(
+		"CASE WHEN (%[1]s - %[2]d) / %[3]d > %[4]d THEN %[4]d ELSE (%[1]s - %[2]d) / %[3]d END",
+		db.epochSeconds("timestamp"), from.Unix(), seconds, width-1,
+	)
+
+	response := TilesResponse{
+		From:          from,
+		To:            to,
+		BucketSeconds: bucket.Seconds(),
+		Nodes:         []TileSeries{},
+	}
+
+	view, release, err := snapshotView(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer release()
+
+	rows, err := view.q.Query(`
+        SELECT
+            node_name,
+            `+index+` AS bucket,
+            COUNT(*),
+            MIN(cpu_usage),
+            MAX(cpu_usage),
+            AVG(cpu_usage),
+            MAX(memory_usage),
+            AVG(memory_usage)
+        FROM metrics
+        WHERE source = ?
+          AND timestamp BETWEEN ? AND ?
+        GROUP BY node_name, bucket
+        ORDER BY node_name, bucket
+    `, sourceMetricsServer, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nodeName string
+		var i int64
+		var tile Tile
+		var memoryAvg float64
+		err := rows.Scan(&nodeName, &i, &tile.Count, &tile.CpuMin, &tile.CpuMax, &tile.CpuAvg, &tile.MemoryMax, &memoryAvg)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tile.Start = from.Add(time.Duration(i) * bucket)
+		tile.MemoryAvg = int64(memoryAvg)
+		if n := len(response.Nodes); n == 0 || response.Nodes[n-1].NodeName != nodeName {
+			response.Nodes = append(response.Nodes, TileSeries{NodeName: nodeName})
+		}
+		series := &response.Nodes[len(response.Nodes)-1]
+		series.Tiles = append(series.Tiles, tile)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Every node row of a tick carries the same cluster value, so each
+	// tick counts once
+	rows, err = view.q.Query(`
+        SELECT
+            `+strings.ReplaceAll(index, "timestamp", "ticks.timestamp")+` AS bucket,
+            COUNT(*),
+            MIN(cluster_cpu_usage),
+            MAX(cluster_cpu_usage),
+            AVG(cluster_cpu_usage)
+        FROM (
+            SELECT DISTINCT timestamp, cluster_cpu_usage
+            FROM metrics
+            WHERE source = ?
+              AND timestamp BETWEEN ? AND ?
+        ) AS ticks
+        GROUP BY bucket
+        ORDER BY bucket
+    `, sourceMetricsServer, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+	response.Cluster = []Tile{}
+	for rows.Next() {
+		var i int64
+		var tile Tile
+		if err := rows.Scan(&i, &tile.Count, &tile.CpuMin, &tile.CpuMax, &tile.CpuAvg); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tile.Start = from.Add(time.Duration(i) * bucket)
+		response.Cluster = append(response.Cluster, tile)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	respond(c, http.StatusOK, response)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildDate = ""
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// buildInfo falls back to the VCS information the go tool embeds when the
+// binary was built from a checkout without ldflags.
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.GitCommit == "":
+				info.GitCommit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// versionString identifies the build in one string, e.g. v1.2.3+4f2c1e9.
+func versionString() string {
+	info := buildInfo()
+	if len(info.GitCommit) > 7 {
+		return info.Version + "+" + info.GitCommit[:7]
+	}
+	if info.GitCommit != "" {
+		return info.Version + "+" + info.GitCommit
+	}
+	return info.Version
+}
+
+func getVersion(c *gin.Context) {
+	respond(c, http.StatusOK, buildInfo())
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Warehouse sinks load the node samples and the summaries of finished
+// benchmark runs into BigQuery or Snowflake every warehouse-interval, for
+// organizations that centralize performance data there. They ship what
+// was stored after their export mark, like an incremental /metrics/export
+// does, and move the mark once a batch is loaded, so a failed load is
+// retried on the next interval. Samples go to the table "samples" and runs
+// to "benchmark_runs", with the columns named after the JSON fields.
+//
+// Every batch carries an ID derived from the collector and the sequence
+// numbers it covers, which BigQuery and Snowflake use to drop a load they
+// already ran. Only a crash between a load and saving the mark, after more
+// samples were stored, can load samples twice; seq tells them apart.
+
+const (
+	// warehouseBatch is how many samples one load carries at most.
+	warehouseBatch = 10000
+
+	// warehousePoll is how often a load that is still running is checked.
+	warehousePoll = 2 * time.Second
+
+	warehouseSamplesTable = "samples"
+	warehouseRunsTable    = "benchmark_runs"
+)
+
+// warehouseSink loads rows into a data warehouse.
+type warehouseSink interface {
+	// destination names the sink's export marks.
+	destination() string
+	// load appends rows, a slice of structs, to table. A load with the ID
+	// of one that already succeeded must succeed without loading again.
+	load(ctx context.Context, table, id string, rows any) error
+}
+
+// BenchmarkSummary is the row of a finished run in a warehouse or sheet.
+// The statistics are missing for a run without samples.
+type BenchmarkSummary struct {
+	ID               int64    `json:"id"`
+	Name             string   `json:"name"`
+	Description      string   `json:"description"`
+	Labels           string   `json:"labels"`
+	Start            string   `json:"start"`
+	End              string   `json:"end"`
+	DurationSeconds  float64  `json:"duration_seconds"`
+	Samples          int      `json:"samples"`
+	AvgCpu           *float64 `json:"avg_cpu"`
+	MaxCpu           *float64 `json:"max_cpu"`
+	AvgMemory        *float64 `json:"avg_memory"`
+	MaxMemory        *int64   `json:"max_memory"`
+	Outliers         string   `json:"outliers"`
+	CollectorVersion string   `json:"collector_version"`
+}
+
+// summarizeBenchmark summarizes a finished run with the outliers among its
+// prior runs.
+func summarizeBenchmark(view readView, run BenchmarkRun) (BenchmarkSummary, error) {
+	samples, err := benchmarkSamples(view, run)
+	if err != nil {
+		return BenchmarkSummary{}, err
+	}
+	outliers, err := checkPriorRuns(view, run, samples)
+	if err != nil {
+		// The summary goes out without the outlier check
+		slog.Error("Error comparing benchmark with prior runs", "benchmark", run.Name, "error", err)
+	}
+	var flagged []string
+	for _, o := range outliers {
+		flagged = append(flagged, fmt.Sprintf("%s z=%.1f", o.Metric, o.ZScore))
+	}
+	var labels []string
+	for _, key := range slices.Sorted(maps.Keys(run.Labels)) {
+		labels = append(labels, key+"="+run.Labels[key])
+	}
+
+	summary := BenchmarkSummary{
+		ID:               run.ID,
+		Name:             run.Name,
+		Description:      run.Description,
+		Labels:           strings.Join(labels, ", "),
+		Start:            run.Start.Format(time.RFC3339),
+		End:              run.End.Format(time.RFC3339),
+		DurationSeconds:  run.End.Sub(run.Start).Seconds(),
+		Samples:          len(samples),
+		Outliers:         strings.Join(flagged, ", "),
+		CollectorVersion: run.CollectorVersion,
+	}
+	if s := summarizeRun(run.Name, samples).cluster; s != nil {
+		summary.AvgCpu, summary.MaxCpu, summary.AvgMemory, summary.MaxMemory = &s.AvgCpu, &s.MaxCpu, &s.AvgMemory, &s.MaxMemory
+	}
+	return summary, nil
+}
+
+// warehouseSinks returns the configured sinks.
+func warehouseSinks() []warehouseSink {
+	var sinks []warehouseSink
+	if bigQueryAccount != nil {
+		sinks = append(sinks, bigQuerySink{})
+	}
+	if snowflakeKey != nil {
+		sinks = append(sinks, snowflakeSink{})
+	}
+	return sinks
+}
+
+// exportToWarehouses syncs the sinks every interval until ctx is done.
+func exportToWarehouses(ctx context.Context, sinks []warehouseSink, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, sink := range sinks {
+			if err := syncWarehouse(ctx, sink); err != nil && ctx.Err() == nil {
+				slog.Error("Error loading into the warehouse", "warehouse", sink.destination(), "error", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncWarehouse loads the samples and the finished runs after the marks of
+// the sink, batch by batch.
+func syncWarehouse(ctx context.Context, sink warehouseSink) error {
+	batchPrefix := warehouseBatchPrefix()
+	for ctx.Err() == nil {
+		mark, err := exportMark(sink.destination())
+		if err != nil {
+			return err
+		}
+		samples, err := store.QuerySamples(SampleQuery{
+			From:     time.Unix(0, 0),
+			To:       time.Now(),
+			Basis:    "allocatable",
+			BySeq:    true,
+			AfterSeq: mark,
+			Limit:    warehouseBatch,
+		})
+		if err != nil {
+			return err
+		}
+		if len(samples) == 0 {
+			break
+		}
+		last := samples[len(samples)-1].Seq
+		id := fmt.Sprintf("%s_samples_%d_%d", batchPrefix, mark, last)
+		if err := sink.load(ctx, warehouseSamplesTable, id, samples); err != nil {
+			return err
+		}
+		if err := saveExportMark(sink.destination(), last); err != nil {
+			return err
+		}
+		if len(samples) < warehouseBatch {
+			break
+		}
+	}
+
+	destination := sink.destination() + "-benchmarks"
+	mark, err := exportMark(destination)
+	if err != nil {
+		return err
+	}
+	summaries, err := finishedRunSummaries(ctx, mark)
+	if err != nil || len(summaries) == 0 {
+		return err
+	}
+	last := summaries[len(summaries)-1].ID
+	id := fmt.Sprintf("%s_runs_%d_%d", batchPrefix, mark, last)
+	if err := sink.load(ctx, warehouseRunsTable, id, summaries); err != nil {
+		return err
+	}
+	return saveExportMark(destination, last)
+}
+
+// finishedRunSummaries summarizes the finished runs after the run ID mark.
+// Only one run is open at a time, so runs finish in the order of their IDs
+// and the mark can't pass one that is still running. The runs and their
+// samples are read from one snapshot, which is released before the load.
+func finishedRunSummaries(ctx context.Context, mark int64) ([]BenchmarkSummary, error) {
+	view, release, err := snapshotView(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := view.q.Query(`
+        SELECT`+benchmarkRunColumns+`
+        FROM benchmark_runs
+        WHERE id > ? AND end_time IS NOT NULL
+        ORDER BY id
+    `, mark)
+	if err != nil {
+		return nil, err
+	}
+	var runs []BenchmarkRun
+	for rows.Next() {
+		run, err := scanBenchmarkRun(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		runs = append(runs, *run)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	summaries := make([]BenchmarkSummary, len(runs))
+	for i, run := range runs {
+		if summaries[i], err = summarizeBenchmark(view, run); err != nil {
+			return nil, err
+		}
+	}
+	return summaries, nil
+}
+
+// warehouseBatchPrefix keeps the batch IDs of collectors loading into the
+// same warehouse apart.
+func warehouseBatchPrefix() string {
+	digest := sha256.Sum256([]byte(pageSource() + "|" + cfg.DBDSN))
+	return "k8s_metrics_" + hex.EncodeToString(digest[:6])
+}
+
+// warehouseColumn is a column of the rows of a load with the values of
+// the rows as text, nil for a missing value.
+type warehouseColumn struct {
+	name   string
+	values []any
+}
+
+// warehouseColumns splits rows, a slice of structs, into columns named
+// after the JSON fields like a CSV export.
+func warehouseColumns(rows any) ([]warehouseColumn, error) {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct {
+		return nil, errors.New("rows must be a slice of structs")
+	}
+	var columns []warehouseColumn
+	for _, c := range csvColumns(v.Type().Elem()) {
+		column := warehouseColumn{name: c.name, values: make([]any, v.Len())}
+		for i := range v.Len() {
+			field := v.Index(i).Field(c.index)
+			if field.Kind() == reflect.Pointer {
+				if field.IsNil() {
+					continue
+				}
+				field = field.Elem()
+			}
+			column.values[i] = csvValue(field)
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}